@@ -8,17 +8,24 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
 	"syscall"
 
 	"github.com/chainguard-dev/clog"
 	"github.com/chainguard-dev/clog/slag"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"gopkg.in/yaml.v3"
 
 	"github.com/chainguard-dev/dfc/pkg/dfc"
@@ -27,6 +34,10 @@ import (
 func main() {
 	ctx := context.Background()
 	if err := mainE(ctx); err != nil {
+		if errors.Is(err, errCheckFailed) {
+			// The files needing conversion have already been listed, like gofmt -l
+			os.Exit(1)
+		}
 		clog.FromContext(ctx).Fatal(err.Error())
 	}
 }
@@ -42,11 +53,38 @@ func cli() *cobra.Command {
 	var inPlace bool
 	var org string
 	var registry string
-	var mappingsFile string
+	var registryMap map[string]string
+	var mappingsFiles []string
+	var catalog string
 	var updateFlag bool
+	var offlineFlag bool
 	var noBuiltInFlag bool
 	var strictFlag bool
 	var warnMissingPackagesFlag bool
+	var apkNoProgressFlag bool
+	var noDevSuffixFlag bool
+	var fromOnlyFlag bool
+	var packagesOnlyFlag bool
+	var resolveTagDefaultsFlag bool
+	var apkStyle string
+	var mappingsPriority string
+	var apkRepositories []string
+	var convertCopyFromFlag bool
+	var annotatePackagesFlag bool
+	var annotateOriginalFlag bool
+	var provenanceLabelFlag bool
+	var statsFlag bool
+	var lintFlag bool
+	var noWildcardImagesFlag bool
+	var documentSeparator string
+	var outputPath string
+	var outReport string
+	var splitStagesDir string
+	var checkFlag bool
+	var failOnUnknownDirectiveFlag bool
+	var emitMakeFlag bool
+	var printDigestFlag bool
+	var cacheFlag bool
 
 	// Default log level is info
 	var level = slag.Level(slog.LevelInfo)
@@ -54,7 +92,7 @@ func cli() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:     "dfc",
 		Example: "dfc <path_to_dockerfile>",
-		Args:    cobra.MaximumNArgs(1),
+		Args:    cobra.ArbitraryArgs,
 		Version: dfc.Version(),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			// Setup logging
@@ -62,6 +100,22 @@ func cli() *cobra.Command {
 			log := clog.New(slog.Default().Handler())
 			ctx := clog.WithLogger(cmd.Context(), log)
 
+			if updateFlag && offlineFlag {
+				return fmt.Errorf("unable to use --update and --offline flags at same time")
+			}
+
+			switch dfc.ApkStyle(apkStyle) {
+			case dfc.ApkStyleNoCache, dfc.ApkStyleUpdateIndex:
+			default:
+				return fmt.Errorf("invalid --apk-style %q, must be one of: %s, %s", apkStyle, dfc.ApkStyleNoCache, dfc.ApkStyleUpdateIndex)
+			}
+
+			switch dfc.ExtraMappingsPriority(mappingsPriority) {
+			case dfc.ExtraMappingsOverride, dfc.ExtraMappingsFallback:
+			default:
+				return fmt.Errorf("invalid --mappings-priority %q, must be one of: %s, %s", mappingsPriority, dfc.ExtraMappingsOverride, dfc.ExtraMappingsFallback)
+			}
+
 			// If update flag is set but no args, just update and exit
 			if updateFlag && len(args) == 0 {
 				// Set up update options
@@ -69,6 +123,7 @@ func cli() *cobra.Command {
 
 				// Set UserAgent
 				updateOpts.UserAgent = fmt.Sprintf("dfc/%s", dfc.Version())
+				updateOpts.Retries = dfc.DefaultUpdateRetries
 
 				if err := dfc.Update(ctx, updateOpts); err != nil {
 					return fmt.Errorf("failed to update: %w", err)
@@ -81,6 +136,80 @@ func cli() *cobra.Command {
 				return fmt.Errorf("requires at least 1 arg(s), only received 0")
 			}
 
+			// Only --check can process several files at once
+			if len(args) > 1 && !checkFlag {
+				return fmt.Errorf("accepts at most 1 arg(s) unless --check is set, received %d", len(args))
+			}
+
+			// Print a Makefile target that runs this same command, instead of converting
+			if emitMakeFlag {
+				fmt.Fprint(cmd.OutOrStdout(), makeTarget(cmd.Flags(), args))
+				return nil
+			}
+
+			// Setup conversion options
+			opts := dfc.Options{
+				Organization:        org,
+				Registry:            registry,
+				RegistryMap:         registryMap,
+				Update:              updateFlag,
+				Offline:             offlineFlag,
+				NoBuiltIn:           noBuiltInFlag,
+				Strict:              strictFlag,
+				WarnMissingPackages: warnMissingPackagesFlag,
+				ApkNoProgress:       apkNoProgressFlag,
+				ApkStyle:            dfc.ApkStyle(apkStyle),
+				ApkRepositories:     apkRepositories,
+				ConvertCopyFrom:     convertCopyFromFlag,
+				AnnotatePackages:    annotatePackagesFlag,
+				AnnotateOriginal:    annotateOriginalFlag,
+				AddProvenanceLabel:  provenanceLabelFlag,
+				NoDevSuffix:         noDevSuffixFlag,
+				FromOnly:            fromOnlyFlag,
+				PackagesOnly:        packagesOnlyFlag,
+				ResolveTagDefaults:  resolveTagDefaultsFlag,
+				Catalog:             catalog,
+
+				DisableWildcardImageMatch: noWildcardImagesFlag,
+				ExtraMappingsPriority:     dfc.ExtraMappingsPriority(mappingsPriority),
+				FailOnUnknownDirective:    failOnUnknownDirectiveFlag,
+			}
+
+			// If custom mappings files are provided, load them as ExtraMappings
+			if len(mappingsFiles) > 0 {
+				extraMappings, err := loadMappingsFiles(ctx, mappingsFiles)
+				if err != nil {
+					return err
+				}
+				opts.ExtraMappings = extraMappings
+			}
+
+			// If --no-builtin flag is used without --mappings, warn the user
+			if noBuiltInFlag && len(mappingsFiles) == 0 {
+				log.Warn("Using --no-builtin without --mappings will use default conversion logic without any package/image mappings")
+			}
+
+			if fromOnlyFlag && packagesOnlyFlag {
+				return fmt.Errorf("unable to use --from-only with --packages-only")
+			}
+
+			// Reuse earlier conversions of unchanged input, only the converted Dockerfile is cached
+			var conversionCache *dfc.ConversionCache
+			if cacheFlag {
+				if j || outReport != "" || statsFlag || lintFlag {
+					return fmt.Errorf("unable to use --cache with --json, --out-report, --stats or --lint flags")
+				}
+				conversionCache = &dfc.ConversionCache{Dir: dfc.DefaultConversionCacheDir()}
+			}
+
+			// Report the files that would be modified, without writing anything
+			if checkFlag {
+				if inPlace || j || outputPath != "" || outReport != "" || splitStagesDir != "" {
+					return fmt.Errorf("unable to use --check with --in-place, --json, --output, --out-report or --split-stages flags")
+				}
+				return checkFiles(ctx, cmd, args, documentSeparator, opts, conversionCache)
+			}
+
 			// Allow for piping into the CLI if first arg is "-"
 			input := cmd.InOrStdin()
 			isFile := args[0] != "-"
@@ -100,47 +229,88 @@ func cli() *cobra.Command {
 			}
 			raw := buf.Bytes()
 
-			// Use dfc2 to parse the Dockerfile
-			dockerfile, err := dfc.ParseDockerfile(ctx, raw)
-			if err != nil {
-				return fmt.Errorf("unable to parse dockerfile: %w", err)
+			if j && documentSeparator != "" {
+				return fmt.Errorf("unable to use --json and --document-separator flags at same time")
+			}
+			if outReport != "" && documentSeparator != "" {
+				return fmt.Errorf("unable to use --out-report and --document-separator flags at same time")
+			}
+			if inPlace && outputPath != "" {
+				return fmt.Errorf("unable to use --in-place and --output flags at same time, --in-place overwrites the input")
+			}
+			if inPlace && outReport != "" {
+				return fmt.Errorf("unable to use --in-place and --out-report flags at same time")
+			}
+			if splitStagesDir != "" && (inPlace || j || outputPath != "" || documentSeparator != "" || cacheFlag) {
+				return fmt.Errorf("unable to use --split-stages with --in-place, --json, --output, --document-separator or --cache flags")
 			}
 
-			// Setup conversion options
-			opts := dfc.Options{
-				Organization:        org,
-				Registry:            registry,
-				Update:              updateFlag,
-				NoBuiltIn:           noBuiltInFlag,
-				Strict:              strictFlag,
-				WarnMissingPackages: warnMissingPackagesFlag,
+			// Convert the Dockerfile (or each of the documents in the input)
+			convertedDockerfiles, result, err := convertDocuments(ctx, raw, documentSeparator, opts, conversionCache)
+			if err != nil {
+				return err
 			}
 
-			// If custom mappings file is provided, load it as ExtraMappings
-			if mappingsFile != "" {
-				log.Info("Loading custom mappings file", "file", mappingsFile)
-				mappingsBytes, err := os.ReadFile(mappingsFile)
-				if err != nil {
-					return fmt.Errorf("reading mappings file %s: %w", mappingsFile, err)
+			// Record the digest of the converted output, in the JSON output or on stderr so stdout stays clean
+			if printDigestFlag {
+				if documentSeparator == "" && (j || outReport != "") {
+					convertedDockerfiles[0].Digest = convertedDockerfiles[0].ContentDigest()
+				}
+				if !j {
+					fmt.Fprintf(cmd.ErrOrStderr(), "sha256:%x\n", sha256.Sum256([]byte(result)))
 				}
+			}
 
-				var extraMappings dfc.MappingsConfig
-				if err := yaml.Unmarshal(mappingsBytes, &extraMappings); err != nil {
-					return fmt.Errorf("unmarshalling package mappings: %w", err)
+			// Summarize the changes on stderr, so it doesn't mix with the output
+			if statsFlag {
+				for _, convertedDockerfile := range convertedDockerfiles {
+					fmt.Fprint(cmd.ErrOrStderr(), convertedDockerfile.Stats().String())
 				}
+			}
 
-				opts.ExtraMappings = extraMappings
+			// Report likely issues left after conversion on stderr
+			if lintFlag {
+				for _, convertedDockerfile := range convertedDockerfiles {
+					for _, finding := range convertedDockerfile.Lint() {
+						fmt.Fprintln(cmd.ErrOrStderr(), finding.String())
+					}
+				}
 			}
 
-			// If --no-builtin flag is used without --mappings, warn the user
-			if noBuiltInFlag && mappingsFile == "" {
-				log.Warn("Using --no-builtin without --mappings will use default conversion logic without any package/image mappings")
+			// Write the JSON report and/or the converted Dockerfile to files, from the same conversion
+			if outReport != "" {
+				b, err := json.Marshal(convertedDockerfiles[0])
+				if err != nil {
+					return fmt.Errorf("marshalling dockerfile to json: %w", err)
+				}
+				log.Info("Writing JSON report", "path", outReport)
+				if err := os.WriteFile(outReport, append(b, '\n'), 0600); err != nil {
+					return fmt.Errorf("writing report to %s: %w", outReport, err)
+				}
+			}
+			if outputPath != "" {
+				if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+					return fmt.Errorf("creating directory for %s: %w", outputPath, err)
+				}
+				log.Info("Writing converted dockerfile", "path", outputPath)
+				if err := os.WriteFile(outputPath, []byte(result), 0600); err != nil {
+					return fmt.Errorf("writing dockerfile to %s: %w", outputPath, err)
+				}
 			}
 
-			// Convert the Dockerfile
-			convertedDockerfile, err := dockerfile.Convert(ctx, opts)
-			if err != nil {
-				return fmt.Errorf("converting dockerfile: %w", err)
+			// Write each stage of the converted Dockerfile to its own file
+			if splitStagesDir != "" {
+				if err := os.MkdirAll(splitStagesDir, 0755); err != nil {
+					return fmt.Errorf("creating directory %s: %w", splitStagesDir, err)
+				}
+				for _, stage := range convertedDockerfiles[0].Stages() {
+					stagePath := filepath.Join(splitStagesDir, stage.FileName())
+					log.Info("Writing stage", "path", stagePath)
+					if err := os.WriteFile(stagePath, []byte(stage.Dockerfile.String()), 0600); err != nil {
+						return fmt.Errorf("writing stage to %s: %w", stagePath, err)
+					}
+				}
+				return nil
 			}
 
 			// Output the Dockerfile as JSON
@@ -150,7 +320,7 @@ func cli() *cobra.Command {
 				}
 
 				// Output the Dockerfile as JSON
-				b, err := json.Marshal(convertedDockerfile)
+				b, err := json.Marshal(convertedDockerfiles[0])
 				if err != nil {
 					return fmt.Errorf("marshalling dockerfile to json: %w", err)
 				}
@@ -158,8 +328,10 @@ func cli() *cobra.Command {
 				return nil
 			}
 
-			// Get the string representation
-			result := convertedDockerfile.String()
+			// The converted Dockerfile has already been written
+			if outputPath != "" {
+				return nil
+			}
 
 			// modify file in place
 			if inPlace {
@@ -195,14 +367,288 @@ func cli() *cobra.Command {
 
 	cmd.Flags().StringVar(&org, "org", dfc.DefaultOrg, "the organization for cgr.dev/<org>/<image> (defaults to ORG)")
 	cmd.Flags().StringVar(&registry, "registry", "", "an alternate registry and root namepace (e.g. r.example.com/cg-mirror)")
+	cmd.Flags().StringToStringVar(&registryMap, "registry-map", nil, "per-image registry override as <image>=<registry> (e.g. node=r.example.com/cg), can be repeated")
 	cmd.Flags().BoolVarP(&inPlace, "in-place", "i", false, "modified the Dockerfile in place (vs. stdout), saving original in a .bak file")
 	cmd.Flags().BoolVarP(&j, "json", "j", false, "print dockerfile as json (before conversion)")
-	cmd.Flags().StringVarP(&mappingsFile, "mappings", "m", "", "path to a custom package mappings YAML file (instead of the default)")
+	cmd.Flags().StringArrayVarP(&mappingsFiles, "mappings", "m", nil, "path to a custom package mappings YAML file, can be repeated (later files override earlier ones, and all of them override the built-in mappings unless --no-builtin is set)")
+	cmd.Flags().StringVar(&mappingsPriority, "mappings-priority", string(dfc.ExtraMappingsOverride), "whether --mappings files override the built-in mappings (override) or only add the mappings they lack (fallback)")
+	cmd.Flags().StringVar(&catalog, "catalog", "", "the target catalog whose mappings (under catalogs.<name> in a mappings file) override the others")
 	cmd.Flags().BoolVar(&updateFlag, "update", false, "check for and apply available updates")
+	cmd.Flags().BoolVar(&offlineFlag, "offline", false, "never fetch mappings updates and only use the mappings embedded in dfc")
 	cmd.Flags().BoolVar(&noBuiltInFlag, "no-builtin", false, "skip built-in package/image mappings, still apply default conversion logic")
 	cmd.Flags().Var(&level, "log-level", "log level (e.g. debug, info, warn, error)")
 	cmd.Flags().BoolVar(&strictFlag, "strict", false, "when true, fail if any package is unknown")
+	cmd.Flags().BoolVar(&failOnUnknownDirectiveFlag, "fail-on-unknown-directive", false, "fail if a line looks like a directive but isn't a known one (e.g. FORM instead of FROM)")
 	cmd.Flags().BoolVar(&warnMissingPackagesFlag, "warn-missing-packages", false, "when true, warn about missing package mappings")
+	cmd.Flags().BoolVar(&apkNoProgressFlag, "apk-no-progress", false, "add --no-progress to generated apk add commands")
+	cmd.Flags().StringVar(&apkStyle, "apk-style", string(dfc.ApkStyleNoCache), "index handling for generated apk add commands: no-cache (--no-cache) or update-index (-U)")
+	cmd.Flags().StringArrayVar(&apkRepositories, "apk-repository", nil, "extra apk repository URL passed to generated apk add commands with --repository, can be repeated")
+	cmd.Flags().BoolVar(&noDevSuffixFlag, "no-dev-suffix", false, "never add the -dev suffix to converted tags, even for stages with RUN commands")
+	cmd.Flags().BoolVar(&fromOnlyFlag, "from-only", false, "only convert base images (FROM, ARG and COPY --from), keep RUN lines as they are")
+	cmd.Flags().BoolVar(&packagesOnlyFlag, "packages-only", false, "only convert RUN lines, keep base images (FROM, ARG and COPY --from) as they are")
+	cmd.Flags().BoolVar(&resolveTagDefaultsFlag, "resolve-tag-defaults", false, "convert FROM tags such as ${TAG:-18} like their default value when no ARG sets the variable")
+	cmd.Flags().BoolVar(&convertCopyFromFlag, "convert-copy-from", false, "also convert external images referenced by COPY --from")
+	cmd.Flags().BoolVar(&noWildcardImagesFlag, "no-wildcard-images", false, "ignore wildcard image mappings (e.g. nodejs*), only use exact matches")
+	cmd.Flags().BoolVar(&emitMakeFlag, "emit-make", false, "print a Makefile target that runs dfc with the same flags and arguments, instead of converting")
+	cmd.Flags().BoolVar(&checkFlag, "check", false, "don't write anything, list the files that would be modified and exit non-zero if there are any (accepts multiple files, and directories, which are scanned for Dockerfile and *.Dockerfile files)")
+	cmd.Flags().StringVarP(&outputPath, "output", "o", "", "write the converted Dockerfile to this path (instead of stdout), creating its parent directories if needed")
+	cmd.Flags().StringVar(&outReport, "out-report", "", "also write the converted Dockerfile as JSON (see --json) to this path")
+	cmd.Flags().StringVar(&splitStagesDir, "split-stages", "", "experimental: write each stage of the converted Dockerfile to its own file in this directory (instead of stdout)")
+	cmd.Flags().StringVar(&documentSeparator, "document-separator", "", "split the input into documents on lines matching this separator (e.g. \"# ---\") and convert each independently")
+	cmd.Flags().BoolVar(&cacheFlag, "cache", false, "reuse the converted output of unchanged Dockerfiles with the same options and mappings, cached in the XDG cache directory")
+	cmd.Flags().BoolVar(&printDigestFlag, "print-digest", false, "print the sha256 digest of the converted Dockerfile to stderr (or add it as the digest field with --json)")
+	cmd.Flags().BoolVar(&statsFlag, "stats", false, "print a summary of the changes made to stderr")
+	cmd.Flags().BoolVar(&lintFlag, "lint", false, "print likely issues left after conversion (e.g. DFC001) to stderr")
+	cmd.Flags().BoolVar(&annotatePackagesFlag, "annotate-packages", false, "add a comment above converted RUN lines listing the package mappings applied")
+	cmd.Flags().BoolVar(&annotateOriginalFlag, "annotate", false, "add a comment with the original line above converted FROM, RUN and ARG lines")
+	cmd.Flags().BoolVar(&provenanceLabelFlag, "provenance-label", false, "add a LABEL to the final stage recording that the Dockerfile was converted by dfc")
+
+	// --out-dockerfile is the earlier name of --output
+	cmd.Flags().SetNormalizeFunc(func(_ *pflag.FlagSet, name string) pflag.NormalizedName {
+		if name == "out-dockerfile" {
+			name = "output"
+		}
+		return pflag.NormalizedName(name)
+	})
 
 	return cmd
 }
+
+// makeTargetName is the name of the target printed by --emit-make
+const makeTargetName = "dfc-migrate"
+
+// makeTarget returns a Makefile target that runs dfc with the flags that were set on the command line
+// (except --emit-make) and the same arguments
+func makeTarget(flags *pflag.FlagSet, args []string) string {
+	command := []string{"dfc"}
+	flags.Visit(func(f *pflag.Flag) {
+		if f.Name == "emit-make" {
+			return
+		}
+		switch f.Value.Type() {
+		case "bool":
+			if f.Value.String() == "true" {
+				command = append(command, "--"+f.Name)
+			} else {
+				command = append(command, "--"+f.Name+"=false")
+			}
+		case "stringArray":
+			values, _ := flags.GetStringArray(f.Name)
+			for _, value := range values {
+				command = append(command, "--"+f.Name+"="+shellQuote(value))
+			}
+		case "stringToString":
+			values, _ := flags.GetStringToString(f.Name)
+			keys := make([]string, 0, len(values))
+			for key := range values {
+				keys = append(keys, key)
+			}
+			slices.Sort(keys)
+			for _, key := range keys {
+				command = append(command, "--"+f.Name+"="+shellQuote(key+"="+values[key]))
+			}
+		default:
+			command = append(command, "--"+f.Name+"="+shellQuote(f.Value.String()))
+		}
+	})
+	for _, arg := range args {
+		command = append(command, shellQuote(arg))
+	}
+
+	// Make expands $, so it has to be escaped in the recipe
+	recipe := strings.ReplaceAll(strings.Join(command, " "), "$", "$$")
+	return fmt.Sprintf(".PHONY: %s\n%s:\n\t%s\n", makeTargetName, makeTargetName, recipe)
+}
+
+// shellQuote quotes a value for the shell if it contains anything other than safe characters
+func shellQuote(value string) string {
+	if value != "" && strings.Trim(value, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=@,+%") == "" {
+		return value
+	}
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// errCheckFailed is returned by --check when some files need conversion
+var errCheckFailed = errors.New("some files need conversion")
+
+// checkFiles converts each file in memory and prints the paths of the files that would be modified,
+// returning errCheckFailed if there are any
+func checkFiles(ctx context.Context, cmd *cobra.Command, paths []string, separator string, opts dfc.Options, cache *dfc.ConversionCache) error {
+	paths, err := dockerfilePaths(paths)
+	if err != nil {
+		return err
+	}
+
+	needsConversion := false
+	for _, path := range paths {
+		var raw []byte
+		var err error
+		if path == "-" {
+			path = "<stdin>"
+			raw, err = io.ReadAll(cmd.InOrStdin())
+		} else {
+			raw, err = os.ReadFile(filepath.Clean(path))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		_, result, err := convertDocuments(ctx, raw, separator, opts, cache)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if result != string(raw) {
+			fmt.Fprintln(cmd.OutOrStdout(), path)
+			needsConversion = true
+		}
+	}
+
+	if needsConversion {
+		// Not a usage error, the exit code is all that's needed
+		cmd.SilenceErrors = true
+		cmd.SilenceUsage = true
+		return errCheckFailed
+	}
+	return nil
+}
+
+// dockerfilePaths replaces the directories among paths with the Dockerfiles found in them, i.e. the files
+// named Dockerfile or *.Dockerfile, in lexical order. Hidden directories such as .git are skipped. A file
+// given more than once, e.g. both as Dockerfile and through the directory ".", is only returned once.
+func dockerfilePaths(paths []string) ([]string, error) {
+	var result []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if key := filepath.Clean(path); !seen[key] {
+			seen[key] = true
+			result = append(result, path)
+		}
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if path == "-" || err != nil || !info.IsDir() {
+			// Files, and errors, are handled when the path is read
+			add(path)
+			continue
+		}
+
+		var found []string
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if p != path && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.Name() == "Dockerfile" || strings.HasSuffix(d.Name(), ".Dockerfile") {
+				found = append(found, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %w", path, err)
+		}
+		for _, p := range found {
+			add(p)
+		}
+	}
+	return result, nil
+}
+
+// loadMappingsFiles loads the custom mappings files and merges them in order,
+// with mappings in later files taking precedence over earlier ones
+func loadMappingsFiles(ctx context.Context, files []string) (dfc.MappingsConfig, error) {
+	log := clog.FromContext(ctx)
+
+	var mappings dfc.MappingsConfig
+	for _, file := range files {
+		log.Info("Loading custom mappings file", "file", file)
+		mappingsBytes, err := os.ReadFile(file)
+		if err != nil {
+			return mappings, fmt.Errorf("reading mappings file %s: %w", file, err)
+		}
+
+		var fileMappings dfc.MappingsConfig
+		if err := yaml.Unmarshal(mappingsBytes, &fileMappings); err != nil {
+			return mappings, fmt.Errorf("unmarshalling package mappings from %s (images and packages must be maps, see pkg/dfc/builtin-mappings.yaml for the format): %w", file, err)
+		}
+		if err := dfc.ValidateMappingsConfig(fileMappings); err != nil {
+			// Keep all the problems on one line, so they are readable in the log output
+			return mappings, fmt.Errorf("invalid mappings file %s: %s", file, strings.ReplaceAll(err.Error(), "\n", "; "))
+		}
+
+		mappings = dfc.MergeMappings(mappings, fileMappings)
+	}
+
+	return mappings, nil
+}
+
+// convertDocuments converts the input, returning the converted Dockerfiles and the output.
+// If separator is set, the input is split into documents on lines matching the separator,
+// each document is converted independently and the results are rejoined with the original separator lines.
+// If cache is set, the documents are converted with it and only the output is returned.
+func convertDocuments(ctx context.Context, raw []byte, separator string, opts dfc.Options, cache *dfc.ConversionCache) ([]*dfc.Dockerfile, string, error) {
+	documents := [][]byte{raw}
+	var separatorLines []string
+	if separator != "" {
+		documents, separatorLines = splitDocuments(string(raw), separator)
+	}
+
+	var builder strings.Builder
+	convertedDockerfiles := make([]*dfc.Dockerfile, 0, len(documents))
+	for i, document := range documents {
+		if cache != nil {
+			converted, err := cache.ConvertBytes(ctx, document, opts)
+			if err != nil {
+				return nil, "", err
+			}
+			builder.Write(converted)
+		} else {
+			dockerfile, err := dfc.ParseDockerfile(ctx, document)
+			if err != nil {
+				return nil, "", fmt.Errorf("unable to parse dockerfile: %w", err)
+			}
+
+			convertedDockerfile, err := dockerfile.Convert(ctx, opts)
+			if err != nil {
+				return nil, "", fmt.Errorf("converting dockerfile: %w", err)
+			}
+			convertedDockerfiles = append(convertedDockerfiles, convertedDockerfile)
+
+			builder.WriteString(convertedDockerfile.String())
+		}
+		if i < len(separatorLines) {
+			// Make sure the separator stays on its own line
+			if builder.Len() > 0 && !strings.HasSuffix(builder.String(), "\n") {
+				builder.WriteString("\n")
+			}
+			builder.WriteString(separatorLines[i])
+		}
+	}
+
+	return convertedDockerfiles, builder.String(), nil
+}
+
+// splitDocuments splits the input on lines matching the separator (ignoring surrounding whitespace),
+// returning the documents and the separator lines between them (including their line endings)
+func splitDocuments(input string, separator string) ([][]byte, []string) {
+	var documents [][]byte
+	var separatorLines []string
+
+	var current strings.Builder
+	for _, line := range strings.SplitAfter(input, "\n") {
+		if strings.TrimSpace(line) == strings.TrimSpace(separator) {
+			documents = append(documents, []byte(current.String()))
+			separatorLines = append(separatorLines, line)
+			current.Reset()
+			continue
+		}
+		current.WriteString(line)
+	}
+	documents = append(documents, []byte(current.String()))
+
+	return documents, separatorLines
+}
@@ -0,0 +1,496 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/chainguard-dev/dfc/pkg/dfc"
+)
+
+func TestConvertDocuments(t *testing.T) {
+	opts := dfc.Options{
+		NoBuiltIn: true,
+		ExtraMappings: dfc.MappingsConfig{
+			Images: map[string]string{
+				"node":   "node",
+				"python": "python",
+			},
+			Packages: dfc.PackageMap{
+				dfc.DistroDebian: {"build-essential": {"build-base"}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		input         string
+		separator     string
+		wantDocuments int
+		want          string
+	}{
+		{
+			name:          "no separator converts the whole input",
+			input:         "FROM node:20\nRUN echo hello\n",
+			separator:     "",
+			wantDocuments: 1,
+			want:          "FROM cgr.dev/ORG/node:20-dev\nRUN echo hello\n",
+		},
+		{
+			name: "two documents are converted independently",
+			input: `FROM python:3.12 AS base
+RUN apt-get update && apt-get install -y build-essential
+# ---
+FROM node:20
+RUN echo hello
+`,
+			separator:     "# ---",
+			wantDocuments: 2,
+			want: `FROM cgr.dev/ORG/python:3.12-dev AS base
+USER root
+RUN apk add --no-cache build-base
+# ---
+FROM cgr.dev/ORG/node:20-dev
+RUN echo hello
+`,
+		},
+		{
+			name:          "separator not present",
+			input:         "FROM node:20\n",
+			separator:     "# ---",
+			wantDocuments: 1,
+			want:          "FROM cgr.dev/ORG/node:20\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfiles, got, err := convertDocuments(context.Background(), []byte(tt.input), tt.separator, opts, nil)
+			if err != nil {
+				t.Fatalf("convertDocuments() error: %v", err)
+			}
+			if len(dockerfiles) != tt.wantDocuments {
+				t.Errorf("convertDocuments() returned %d documents, want %d", len(dockerfiles), tt.wantDocuments)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("convertDocuments() mismatch (-want +got):\n%s", diff)
+			}
+
+			// The same output is returned with a cache, converting and then from the cache
+			cache := &dfc.ConversionCache{Dir: t.TempDir()}
+			for range 2 {
+				dockerfiles, got, err := convertDocuments(context.Background(), []byte(tt.input), tt.separator, opts, cache)
+				if err != nil {
+					t.Fatalf("convertDocuments() with cache error: %v", err)
+				}
+				if len(dockerfiles) != 0 {
+					t.Errorf("convertDocuments() with cache returned %d documents, want none", len(dockerfiles))
+				}
+				if diff := cmp.Diff(tt.want, got); diff != "" {
+					t.Errorf("convertDocuments() with cache mismatch (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadMappingsFiles(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.yaml")
+	second := filepath.Join(dir, "second.yaml")
+	if err := os.WriteFile(first, []byte(`images:
+  node: node-first
+  python: python
+packages:
+  debian:
+    build-essential: [build-base]
+    libssl-dev: [openssl-dev-first]
+`), 0o600); err != nil {
+		t.Fatalf("writing mappings: %v", err)
+	}
+	if err := os.WriteFile(second, []byte(`images:
+  node: node-second
+packages:
+  debian:
+    libssl-dev: [openssl-dev]
+  fedora:
+    gcc-c++: [gcc]
+`), 0o600); err != nil {
+		t.Fatalf("writing mappings: %v", err)
+	}
+
+	got, err := loadMappingsFiles(context.Background(), []string{first, second})
+	if err != nil {
+		t.Fatalf("loadMappingsFiles() error: %v", err)
+	}
+
+	// Later files override earlier ones
+	want := dfc.MappingsConfig{
+		Images: map[string]string{
+			"node":   "node-second",
+			"python": "python",
+		},
+		Packages: dfc.PackageMap{
+			dfc.DistroDebian: {
+				"build-essential": {"build-base"},
+				"libssl-dev":      {"openssl-dev"},
+			},
+			dfc.DistroFedora: {
+				"gcc-c++": {"gcc"},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("loadMappingsFiles() mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := loadMappingsFiles(context.Background(), []string{first, filepath.Join(dir, "missing.yaml")}); err == nil {
+		t.Errorf("loadMappingsFiles() expected error for missing file")
+	}
+
+	invalid := filepath.Join(dir, "invalid.yaml")
+	if err := os.WriteFile(invalid, []byte(`packages:
+  ubuntu:
+    curl: [curl]
+`), 0o600); err != nil {
+		t.Fatalf("writing mappings: %v", err)
+	}
+	_, err = loadMappingsFiles(context.Background(), []string{first, invalid})
+	if err == nil || !strings.Contains(err.Error(), `unknown distro "ubuntu"`) {
+		t.Errorf("loadMappingsFiles() expected unknown distro error, got %v", err)
+	}
+}
+
+func TestOutDockerfileAndReport(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "Dockerfile")
+	outDockerfile := filepath.Join(dir, "Dockerfile.converted")
+	outReport := filepath.Join(dir, "report.json")
+	if err := os.WriteFile(input, []byte("FROM node:20\nRUN apt-get update && apt-get install -y curl\n"), 0o600); err != nil {
+		t.Fatalf("writing dockerfile: %v", err)
+	}
+
+	cmd := cli()
+	cmd.SetArgs([]string{"--no-builtin", "--out-dockerfile", outDockerfile, "--out-report", outReport, input})
+	if err := cmd.ExecuteContext(context.Background()); err != nil {
+		t.Fatalf("dfc failed: %v", err)
+	}
+
+	wantDockerfile := "FROM cgr.dev/ORG/node:20-dev\nUSER root\nRUN apk add --no-cache curl\n"
+	gotDockerfile, err := os.ReadFile(outDockerfile)
+	if err != nil {
+		t.Fatalf("reading converted dockerfile: %v", err)
+	}
+	if diff := cmp.Diff(wantDockerfile, string(gotDockerfile)); diff != "" {
+		t.Errorf("converted dockerfile mismatch (-want +got):\n%s", diff)
+	}
+
+	reportBytes, err := os.ReadFile(outReport)
+	if err != nil {
+		t.Fatalf("reading report: %v", err)
+	}
+	var report struct {
+		SchemaVersion string `json:"schemaVersion"`
+		Lines         []struct {
+			Raw       string `json:"raw"`
+			Converted string `json:"converted"`
+		} `json:"lines"`
+	}
+	if err := json.Unmarshal(reportBytes, &report); err != nil {
+		t.Fatalf("unmarshalling report: %v", err)
+	}
+	if report.SchemaVersion != dfc.JSONSchemaVersion {
+		t.Errorf("report schemaVersion = %q, want %q", report.SchemaVersion, dfc.JSONSchemaVersion)
+	}
+	if len(report.Lines) < 2 {
+		t.Fatalf("report has %d lines, want at least 2", len(report.Lines))
+	}
+
+	// The report describes the same conversion as the written Dockerfile
+	var fromReport strings.Builder
+	for _, line := range report.Lines {
+		converted := line.Converted
+		if converted == "" {
+			converted = line.Raw
+		}
+		if converted != "" {
+			fromReport.WriteString(converted + "\n")
+		}
+	}
+	if diff := cmp.Diff(wantDockerfile, fromReport.String()); diff != "" {
+		t.Errorf("report conversion mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	converted := filepath.Join(dir, "converted.Dockerfile")
+	unconverted := filepath.Join(dir, "unconverted.Dockerfile")
+	if err := os.WriteFile(converted, []byte("FROM cgr.dev/ORG/node:20-dev\nUSER root\nRUN apk add --no-cache curl\n"), 0o600); err != nil {
+		t.Fatalf("writing dockerfile: %v", err)
+	}
+	unconvertedContent := []byte("FROM node:20\nRUN apt-get update && apt-get install -y curl\n")
+	if err := os.WriteFile(unconverted, unconvertedContent, 0o600); err != nil {
+		t.Fatalf("writing dockerfile: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		paths   []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "clean",
+			paths: []string{converted},
+		},
+		{
+			name:    "needs conversion",
+			paths:   []string{converted, unconverted},
+			want:    unconverted + "\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			cmd := cli()
+			cmd.SetOut(&out)
+			cmd.SetArgs(append([]string{"--no-builtin", "--check"}, tt.paths...))
+			err := cmd.ExecuteContext(context.Background())
+			if tt.wantErr != errors.Is(err, errCheckFailed) {
+				t.Errorf("dfc --check error = %v, want errCheckFailed: %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, out.String()); diff != "" {
+				t.Errorf("dfc --check output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("directory", func(t *testing.T) {
+		tree := t.TempDir()
+		files := map[string]string{
+			"Dockerfile":                    string(unconvertedContent),
+			"clean/Dockerfile":              "FROM cgr.dev/ORG/node:20-dev\nUSER root\nRUN apk add --no-cache curl\n",
+			"services/api/build.Dockerfile": string(unconvertedContent),
+			"services/api/README.md":        string(unconvertedContent),
+			".git/Dockerfile":               string(unconvertedContent),
+		}
+		for name, content := range files {
+			path := filepath.Join(tree, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				t.Fatalf("creating directory: %v", err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatalf("writing dockerfile: %v", err)
+			}
+		}
+
+		var out bytes.Buffer
+		cmd := cli()
+		cmd.SetOut(&out)
+		cmd.SetArgs([]string{"--no-builtin", "--check", tree})
+		if err := cmd.ExecuteContext(context.Background()); !errors.Is(err, errCheckFailed) {
+			t.Errorf("dfc --check error = %v, want errCheckFailed", err)
+		}
+		want := filepath.Join(tree, "Dockerfile") + "\n" + filepath.Join(tree, "services/api/build.Dockerfile") + "\n"
+		if diff := cmp.Diff(want, out.String()); diff != "" {
+			t.Errorf("dfc --check output mismatch (-want +got):\n%s", diff)
+		}
+
+		// A file given both directly and through its directory is checked once
+		out.Reset()
+		cmd = cli()
+		cmd.SetOut(&out)
+		cmd.SetArgs([]string{"--no-builtin", "--check", filepath.Join(tree, "Dockerfile"), tree + string(filepath.Separator) + "."})
+		if err := cmd.ExecuteContext(context.Background()); !errors.Is(err, errCheckFailed) {
+			t.Errorf("dfc --check error = %v, want errCheckFailed", err)
+		}
+		if diff := cmp.Diff(want, out.String()); diff != "" {
+			t.Errorf("dfc --check output mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	// Nothing is written
+	got, err := os.ReadFile(unconverted)
+	if err != nil {
+		t.Fatalf("reading dockerfile: %v", err)
+	}
+	if diff := cmp.Diff(string(unconvertedContent), string(got)); diff != "" {
+		t.Errorf("dfc --check modified the file (-want +got):\n%s", diff)
+	}
+}
+
+func TestEmitMake(t *testing.T) {
+	var out bytes.Buffer
+	cmd := cli()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"--emit-make", "--org", "myorg", "--no-builtin", "-m", "team-a.yaml", "-m", "team b.yaml", "--registry-map", "node=r.example.com/cg", "./Dockerfile"})
+	if err := cmd.ExecuteContext(context.Background()); err != nil {
+		t.Fatalf("dfc --emit-make failed: %v", err)
+	}
+
+	want := ".PHONY: dfc-migrate\n" +
+		"dfc-migrate:\n" +
+		"\tdfc --mappings=team-a.yaml --mappings='team b.yaml' --no-builtin --org=myorg --registry-map=node=r.example.com/cg ./Dockerfile\n"
+	if diff := cmp.Diff(want, out.String()); diff != "" {
+		t.Errorf("dfc --emit-make output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestPrintDigest(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "Dockerfile")
+	outDockerfile := filepath.Join(dir, "Dockerfile.converted")
+	outReport := filepath.Join(dir, "report.json")
+	if err := os.WriteFile(input, []byte("FROM node:20\nRUN apt-get update && apt-get install -y curl\n"), 0o600); err != nil {
+		t.Fatalf("writing dockerfile: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	cmd := cli()
+	cmd.SetErr(&stderr)
+	cmd.SetArgs([]string{"--no-builtin", "--print-digest", "--out-dockerfile", outDockerfile, "--out-report", outReport, input})
+	if err := cmd.ExecuteContext(context.Background()); err != nil {
+		t.Fatalf("dfc failed: %v", err)
+	}
+
+	converted, err := os.ReadFile(outDockerfile)
+	if err != nil {
+		t.Fatalf("reading converted dockerfile: %v", err)
+	}
+	wantDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(converted))
+	if diff := cmp.Diff(wantDigest+"\n", stderr.String()); diff != "" {
+		t.Errorf("printed digest mismatch (-want +got):\n%s", diff)
+	}
+
+	reportBytes, err := os.ReadFile(outReport)
+	if err != nil {
+		t.Fatalf("reading report: %v", err)
+	}
+	var report struct {
+		Digest string `json:"digest"`
+	}
+	if err := json.Unmarshal(reportBytes, &report); err != nil {
+		t.Fatalf("unmarshalling report: %v", err)
+	}
+	if report.Digest != wantDigest {
+		t.Errorf("report digest = %q, want %q", report.Digest, wantDigest)
+	}
+
+	// Without the flag, nothing is printed and the report has no digest
+	stderr.Reset()
+	cmd = cli()
+	cmd.SetErr(&stderr)
+	cmd.SetArgs([]string{"--no-builtin", "--out-dockerfile", outDockerfile, "--out-report", outReport, input})
+	if err := cmd.ExecuteContext(context.Background()); err != nil {
+		t.Fatalf("dfc failed: %v", err)
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("expected nothing on stderr without --print-digest, got %q", stderr.String())
+	}
+	if reportBytes, err = os.ReadFile(outReport); err != nil {
+		t.Fatalf("reading report: %v", err)
+	}
+	if strings.Contains(string(reportBytes), `"digest"`) {
+		t.Errorf("expected no digest in the report without --print-digest")
+	}
+}
+
+func TestSplitStages(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "Dockerfile")
+	stagesDir := filepath.Join(dir, "stages")
+	raw := `FROM golang:1.22 AS build
+RUN go build -o /out ./...
+
+FROM debian:12 AS tools
+RUN apt-get install -y curl
+
+FROM debian:12
+COPY --from=build /out /out
+`
+	if err := os.WriteFile(input, []byte(raw), 0o600); err != nil {
+		t.Fatalf("writing dockerfile: %v", err)
+	}
+
+	cmd := cli()
+	cmd.SetArgs([]string{"--no-builtin", "--split-stages", stagesDir, input})
+	if err := cmd.ExecuteContext(context.Background()); err != nil {
+		t.Fatalf("dfc failed: %v", err)
+	}
+
+	want := map[string]string{
+		"stage-0-build.Dockerfile": "FROM cgr.dev/ORG/golang:1.22-dev AS build\nRUN go build -o /out ./...\n",
+		"stage-1-tools.Dockerfile": "\nFROM cgr.dev/ORG/debian:12-dev AS tools\nUSER root\nRUN apk add --no-cache curl\n",
+		"stage-2.Dockerfile":       "\n# dfc: stage 2 was split from a multi-stage Dockerfile and uses stage 0 (build),\n# build it as part of the combined Dockerfile\nFROM cgr.dev/ORG/debian:12\nCOPY --from=build /out /out\n",
+	}
+	entries, err := os.ReadDir(stagesDir)
+	if err != nil {
+		t.Fatalf("reading stages directory: %v", err)
+	}
+	got := map[string]string{}
+	for _, entry := range entries {
+		b, err := os.ReadFile(filepath.Join(stagesDir, entry.Name()))
+		if err != nil {
+			t.Fatalf("reading stage: %v", err)
+		}
+		got[entry.Name()] = string(b)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("stage files mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestOutput(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "Dockerfile")
+	raw := "FROM node:20\nRUN apt-get update && apt-get install -y curl\n"
+	if err := os.WriteFile(input, []byte(raw), 0o600); err != nil {
+		t.Fatalf("writing dockerfile: %v", err)
+	}
+
+	// Parent directories of the output are created, the input is left as is
+	output := filepath.Join(dir, "out", "chainguard", "Dockerfile")
+	cmd := cli()
+	cmd.SetArgs([]string{"--no-builtin", input, "-o", output})
+	if err := cmd.ExecuteContext(context.Background()); err != nil {
+		t.Fatalf("dfc failed: %v", err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("reading output: %v", err)
+	}
+	if diff := cmp.Diff("FROM cgr.dev/ORG/node:20-dev\nUSER root\nRUN apk add --no-cache curl\n", string(got)); diff != "" {
+		t.Errorf("output mismatch (-want +got):\n%s", diff)
+	}
+	original, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatalf("reading input: %v", err)
+	}
+	if string(original) != raw {
+		t.Errorf("input was modified:\n%s", original)
+	}
+
+	cmd = cli()
+	cmd.SetArgs([]string{"--no-builtin", "--in-place", "-o", output, input})
+	cmd.SilenceUsage = true
+	if err := cmd.ExecuteContext(context.Background()); err == nil || !strings.Contains(err.Error(), "--in-place and --output") {
+		t.Errorf("expected an error using --in-place with --output, got %v", err)
+	}
+}
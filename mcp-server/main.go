@@ -10,8 +10,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"maps"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -25,11 +28,27 @@ const (
 	Version = "dev"
 )
 
+// Input size limits
+const (
+	// DefaultMaxInputSize is the default maximum size of Dockerfile content accepted by the tools
+	DefaultMaxInputSize = 1024 * 1024
+
+	// MaxInputSizeEnv is the environment variable used to override the maximum input size (in bytes)
+	MaxInputSizeEnv = "DFC_MCP_MAX_INPUT_SIZE"
+)
+
 func main() {
 	// Set up logging to stderr for diagnostics
 	logger := log.New(os.Stderr, "[dfc-mcp] ", log.LstdFlags)
 	logger.Printf("Starting dfc MCP Server v%s", Version)
 
+	maxInputSize, err := maxInputSizeFromEnv()
+	if err != nil {
+		logger.Printf("Error: %v", err)
+		os.Exit(1)
+	}
+	logger.Printf("Maximum Dockerfile content size: %d bytes", maxInputSize)
+
 	// Create a context that listens for termination signals
 	_, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
@@ -73,6 +92,10 @@ func main() {
 			logger.Printf("Error: Empty dockerfile content in request")
 			return mcp.NewToolResultError("Dockerfile content cannot be empty"), nil
 		}
+		if err := checkInputSize(dockerfileContent, maxInputSize); err != nil {
+			logger.Printf("Error: %v", err)
+			return mcp.NewToolResultError(err.Error()), nil
+		}
 
 		// Log a sample of the Dockerfile content (first 50 chars)
 		contentPreview := dockerfileContent
@@ -152,6 +175,10 @@ func main() {
 			logger.Printf("Error: Empty dockerfile content in analyze request")
 			return mcp.NewToolResultError("Dockerfile content cannot be empty"), nil
 		}
+		if err := checkInputSize(dockerfileContent, maxInputSize); err != nil {
+			logger.Printf("Error: %v", err)
+			return mcp.NewToolResultError(err.Error()), nil
+		}
 
 		// Parse the Dockerfile
 		dockerfile, err := dfc.ParseDockerfile(ctx, []byte(dockerfileContent))
@@ -160,48 +187,13 @@ func main() {
 			return mcp.NewToolResultError(fmt.Sprintf("Failed to parse Dockerfile: %v", err)), nil
 		}
 
-		// Analyze the Dockerfile
-		stageCount := 0
-		baseImages := []string{}
-		packageManagers := map[string]bool{}
-
-		for _, line := range dockerfile.Lines {
-			if line.From != nil {
-				stageCount++
-				if line.From.Orig != "" {
-					baseImages = append(baseImages, line.From.Orig)
-				} else {
-					baseImg := line.From.Base
-					if line.From.Tag != "" {
-						baseImg += ":" + line.From.Tag
-					}
-					baseImages = append(baseImages, baseImg)
-				}
-			}
-			if line.Run != nil && line.Run.Manager != "" {
-				packageManagers[string(line.Run.Manager)] = true
-			}
-		}
-
-		// Build package manager list
-		// TODO: something seems to be off here, returning "No package managers detected"
-		packageManagerList := []string{}
-		for pm := range packageManagers {
-			packageManagerList = append(packageManagerList, pm)
-		}
-
-		// Build analysis text
-		analysis := "Dockerfile Analysis:\n\n"
-		analysis += fmt.Sprintf("- Total stages: %d\n", stageCount)
-		analysis += fmt.Sprintf("- Base images: %s\n", strings.Join(baseImages, ", "))
-		if len(packageManagerList) > 0 {
-			analysis += fmt.Sprintf("- Package managers: %s\n", strings.Join(packageManagerList, ", "))
-		} else {
-			analysis += "- No package managers detected\n"
+		analysis, stageCount, err := analyzeDockerfile(dockerfile)
+		if err != nil {
+			logger.Printf("Error analyzing Dockerfile: %v", err)
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to analyze Dockerfile: %v", err)), nil
 		}
 
-		logger.Printf("Successfully analyzed Dockerfile: %d stages, %d base images",
-			stageCount, len(baseImages))
+		logger.Printf("Successfully analyzed Dockerfile: %d stages", stageCount)
 
 		// Return the result
 		return mcp.NewToolResultText(analysis), nil
@@ -217,30 +209,150 @@ func main() {
 	}
 }
 
+// maxInputSizeFromEnv returns the maximum Dockerfile content size, which can be
+// overridden with the DFC_MCP_MAX_INPUT_SIZE environment variable
+func maxInputSizeFromEnv() (int, error) {
+	value := os.Getenv(MaxInputSizeEnv)
+	if value == "" {
+		return DefaultMaxInputSize, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid %s value %q: must be a positive number of bytes", MaxInputSizeEnv, value)
+	}
+	return size, nil
+}
+
+// checkInputSize returns an error if the Dockerfile content exceeds the maximum size
+func checkInputSize(dockerfileContent string, maxInputSize int) error {
+	if len(dockerfileContent) > maxInputSize {
+		return fmt.Errorf("Dockerfile content is too large: %d bytes exceeds the maximum of %d bytes", len(dockerfileContent), maxInputSize)
+	}
+	return nil
+}
+
 // convertDockerfile converts a Dockerfile to use Chainguard Images and APKs
 func convertDockerfile(ctx context.Context, dockerfileContent, organization, registry string) (string, error) {
-	// Parse the Dockerfile
-	dockerfile, err := dfc.ParseDockerfile(ctx, []byte(dockerfileContent))
+	converted, err := dfc.ConvertBytes(ctx, []byte(dockerfileContent), dfc.Options{
+		Organization: organization,
+		Registry:     registry,
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to parse Dockerfile: %w", err)
+		return "", fmt.Errorf("failed to convert Dockerfile: %w", err)
 	}
+	return string(converted), nil
+}
 
-	// Create options for conversion
-	opts := dfc.Options{
-		Organization: organization,
+// valueOrDefault returns the value, or the given default if the value is empty
+func valueOrDefault(value, def string) string {
+	if value == "" {
+		return def
 	}
+	return value
+}
 
-	// If registry is provided, set it in options
-	if registry != "" {
-		opts.Registry = registry
+// analyzeDockerfile returns a plain text summary of a parsed Dockerfile and its number of stages.
+// Stages are listed by zero-based index, which is how COPY --from refers to unnamed stages.
+func analyzeDockerfile(dockerfile *dfc.Dockerfile) (string, int, error) {
+	stageCount := 0
+	baseImages := []string{}
+	stageLines := []string{}
+	labelLines := []string{}
+	packageManagers := map[string]bool{}
+
+	// Runtime settings of the final stage
+	var finalUser, finalWorkdir, finalEntrypoint, finalCmd string
+
+	if err := dockerfile.Walk(func(line *dfc.DockerfileLine) error {
+		if line.From != nil {
+			stageCount++
+			finalUser, finalWorkdir, finalEntrypoint, finalCmd = "", "", "", ""
+			baseImg := line.From.Orig
+			if baseImg == "" {
+				baseImg = line.From.Base
+				if line.From.Tag != "" {
+					baseImg += ":" + line.From.Tag
+				}
+			}
+			baseImages = append(baseImages, baseImg)
+
+			stageLine := fmt.Sprintf("  - stage %d = %s", stageCount-1, baseImg)
+			if line.From.Parent > 0 {
+				stageLine += fmt.Sprintf(" (stage %d)", line.From.Parent-1)
+			}
+			if line.From.Alias != "" {
+				stageLine += fmt.Sprintf(" as %s", line.From.Alias)
+			}
+			if line.From.IsScratch {
+				stageLine += " [scratch: no shell or package manager]"
+			}
+			stageLines = append(stageLines, stageLine)
+		}
+		// The manager is only set on converted lines, so also look for supported package managers in the parsed command
+		if line.Run != nil && line.Run.Manager != "" {
+			packageManagers[string(line.Run.Manager)] = true
+		} else if line.Run != nil && line.Run.Shell != nil && line.Run.Shell.Before != nil {
+			for _, part := range line.Run.Shell.Before.Parts {
+				if _, ok := dfc.ManagerDistro(dfc.Manager(part.Command)); ok {
+					packageManagers[part.Command] = true
+				}
+			}
+		}
+		for _, key := range slices.Sorted(maps.Keys(line.Labels)) {
+			labelLines = append(labelLines, fmt.Sprintf("  - %s=%q (stage %d)", key, line.Labels[key], stageCount-1))
+		}
+		if line.User != nil {
+			finalUser = line.User.User
+			if line.User.Group != "" {
+				finalUser += ":" + line.User.Group
+			}
+		}
+		if line.Workdir != nil {
+			finalWorkdir = line.Workdir.Path
+		}
+		if line.Entrypoint != nil {
+			finalEntrypoint = line.Entrypoint.String()
+		}
+		if line.Cmd != nil {
+			finalCmd = line.Cmd.String()
+		}
+		return nil
+	}); err != nil {
+		return "", 0, fmt.Errorf("failed to walk Dockerfile: %w", err)
 	}
 
-	// Convert the Dockerfile
-	converted, err := dockerfile.Convert(ctx, opts)
-	if err != nil {
-		return "", fmt.Errorf("failed to convert Dockerfile: %w", err)
+	// Build package manager list
+	packageManagerList := []string{}
+	for _, pm := range slices.Sorted(maps.Keys(packageManagers)) {
+		if distro, ok := dfc.ManagerDistro(dfc.Manager(pm)); ok {
+			pm += fmt.Sprintf(" (%s)", distro)
+		}
+		packageManagerList = append(packageManagerList, pm)
+	}
+	supportedManagers := []string{}
+	for _, pm := range dfc.SupportedManagers() {
+		supportedManagers = append(supportedManagers, string(pm))
+	}
+
+	// Build analysis text
+	analysis := "Dockerfile Analysis:\n\n"
+	analysis += fmt.Sprintf("- Total stages: %d\n", stageCount)
+	analysis += fmt.Sprintf("- Base images: %s\n", strings.Join(baseImages, ", "))
+	if len(stageLines) > 0 {
+		analysis += "- Stages:\n" + strings.Join(stageLines, "\n") + "\n"
+	}
+	if len(labelLines) > 0 {
+		analysis += "- Labels:\n" + strings.Join(labelLines, "\n") + "\n"
+	}
+	if len(packageManagerList) > 0 {
+		analysis += fmt.Sprintf("- Package managers: %s\n", strings.Join(packageManagerList, ", "))
+	} else {
+		analysis += fmt.Sprintf("- No package managers detected (supported: %s)\n", strings.Join(supportedManagers, ", "))
 	}
+	analysis += fmt.Sprintf("- Final user: %s\n", valueOrDefault(finalUser, "not set (inherited from base image)"))
+	analysis += fmt.Sprintf("- Final working directory: %s\n", valueOrDefault(finalWorkdir, "not set (inherited from base image)"))
+	analysis += fmt.Sprintf("- Entrypoint: %s\n", valueOrDefault(finalEntrypoint, "not set (inherited from base image)"))
+	analysis += fmt.Sprintf("- Command: %s\n", valueOrDefault(finalCmd, "not set (inherited from base image)"))
 
-	// Return the converted Dockerfile as a string
-	return converted.String(), nil
+	return analysis, stageCount, nil
 }
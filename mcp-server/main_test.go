@@ -0,0 +1,134 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/dfc/pkg/dfc"
+)
+
+func TestCheckInputSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		max     int
+		wantErr bool
+	}{
+		{
+			name:    "normal input",
+			content: "FROM alpine\nRUN apk add --no-cache curl",
+			max:     DefaultMaxInputSize,
+		},
+		{
+			name:    "input at the limit",
+			content: strings.Repeat("a", 10),
+			max:     10,
+		},
+		{
+			name:    "oversized input",
+			content: "FROM alpine\n" + strings.Repeat("RUN echo hello\n", DefaultMaxInputSize/10),
+			max:     DefaultMaxInputSize,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkInputSize(tt.content, tt.max)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkInputSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaxInputSizeFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{name: "default", value: "", want: DefaultMaxInputSize},
+		{name: "override", value: "2048", want: 2048},
+		{name: "not a number", value: "1MB", wantErr: true},
+		{name: "zero", value: "0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(MaxInputSizeEnv, tt.value)
+			got, err := maxInputSizeFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("maxInputSizeFromEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("maxInputSizeFromEnv() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnalyzeDockerfile(t *testing.T) {
+	raw := `FROM golang:1.22
+RUN go build -o /app
+FROM debian:12 AS runtime
+LABEL version="1.0" description="my app"
+COPY --from=0 /app /app
+FROM runtime
+FROM scratch AS static
+COPY --from=0 /app /app
+`
+	dockerfile, err := dfc.ParseDockerfile(context.Background(), []byte(raw))
+	if err != nil {
+		t.Fatalf("ParseDockerfile() error: %v", err)
+	}
+
+	analysis, stageCount, err := analyzeDockerfile(dockerfile)
+	if err != nil {
+		t.Fatalf("analyzeDockerfile() error: %v", err)
+	}
+	if stageCount != 4 {
+		t.Errorf("analyzeDockerfile() stage count = %d, want 4", stageCount)
+	}
+	for _, want := range []string{
+		"- Total stages: 4\n",
+		"  - stage 0 = golang:1.22\n",
+		"  - stage 1 = debian:12 as runtime\n",
+		"  - stage 2 = runtime (stage 1)\n",
+		"  - stage 3 = scratch as static [scratch: no shell or package manager]\n",
+		"- Labels:\n  - description=\"my app\" (stage 1)\n  - version=\"1.0\" (stage 1)\n",
+		"- No package managers detected (supported: apk, apt, apt-get, dnf, microdnf, yum)\n",
+	} {
+		if !strings.Contains(analysis, want) {
+			t.Errorf("analyzeDockerfile() missing %q in:\n%s", want, analysis)
+		}
+	}
+}
+
+func TestAnalyzeDockerfilePackageManagers(t *testing.T) {
+	raw := `FROM debian:12 AS build
+RUN apt-get update && apt-get install -y gcc
+FROM fedora:40
+RUN dnf install -y nginx
+`
+	dockerfile, err := dfc.ParseDockerfile(context.Background(), []byte(raw))
+	if err != nil {
+		t.Fatalf("ParseDockerfile() error: %v", err)
+	}
+
+	analysis, _, err := analyzeDockerfile(dockerfile)
+	if err != nil {
+		t.Fatalf("analyzeDockerfile() error: %v", err)
+	}
+	want := "- Package managers: apt-get (debian), dnf (fedora)\n"
+	if !strings.Contains(analysis, want) {
+		t.Errorf("analyzeDockerfile() missing %q in:\n%s", want, analysis)
+	}
+}
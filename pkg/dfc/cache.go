@@ -0,0 +1,120 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/adrg/xdg"
+	"github.com/chainguard-dev/clog"
+	"gopkg.in/yaml.v3"
+)
+
+// ConversionCache stores converted Dockerfiles on disk, so that converting an unchanged Dockerfile
+// with unchanged options and mappings returns the earlier output without converting it again
+type ConversionCache struct {
+	Dir string // Directory holding the cached conversions, see DefaultConversionCacheDir
+}
+
+// DefaultConversionCacheDir returns the XDG cache directory for cached conversions
+func DefaultConversionCacheDir() string {
+	return filepath.Join(xdg.CacheHome, orgName, "conversions")
+}
+
+// ConvertBytes converts raw like the package-level ConvertBytes, but returns the cached output if the
+// same input was converted before with the same options, mappings and dfc version. Conversions with a
+// FromLineConverter or RunLineConverter are never cached. Diagnostics are only logged when the
+// Dockerfile is actually converted.
+func (c *ConversionCache) ConvertBytes(ctx context.Context, raw []byte, opts Options) ([]byte, error) {
+	if opts.FromLineConverter != nil || opts.RunLineConverter != nil {
+		return ConvertBytes(ctx, raw, opts)
+	}
+	log := clog.FromContext(ctx)
+
+	mappings, err := resolveMappings(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	key, err := conversionCacheKey(raw, opts, mappings)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(c.Dir, key)
+
+	cached, err := os.ReadFile(path)
+	if err == nil {
+		log.Debug("Using cached conversion", "path", path)
+		return cached, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading cached conversion: %w", err)
+	}
+
+	// The mappings were just updated if requested, don't update them again
+	opts.Update = false
+	converted, err := ConvertBytes(ctx, raw, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write to a temporary file first, so a concurrent run never reads a partial conversion
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating conversion cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(c.Dir, key+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating cached conversion: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(converted); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("writing cached conversion: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("writing cached conversion: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, fmt.Errorf("writing cached conversion: %w", err)
+	}
+
+	return converted, nil
+}
+
+// conversionCacheKey returns the cache key of a conversion: a digest of the dfc version, the input,
+// the options and the resolved mappings
+func conversionCacheKey(raw []byte, opts Options, mappings MappingsConfig) (string, error) {
+	mappingsYAML, err := yaml.Marshal(mappings)
+	if err != nil {
+		return "", fmt.Errorf("marshalling mappings for the conversion cache key: %w", err)
+	}
+
+	// The options that only select the mappings are covered by the mappings
+	opts.ExtraMappings = MappingsConfig{}
+	opts.Update = false
+	opts.Offline = false
+	opts.NoBuiltIn = false
+	opts.Catalog = ""
+
+	// Unset means override, both share a cache entry
+	priority := opts.ExtraMappingsPriority
+	if priority == "" {
+		priority = ExtraMappingsOverride
+	}
+	opts.ExtraMappingsPriority = ""
+
+	h := sha256.New()
+	fmt.Fprintf(h, "version: %s\n", Version())
+	fmt.Fprintf(h, "input: %x\n", sha256.Sum256(raw))
+	fmt.Fprintf(h, "options: %+v\n", opts)
+	fmt.Fprintf(h, "mappings priority: %s\n", priority)
+	fmt.Fprintf(h, "mappings: %x\n", sha256.Sum256(mappingsYAML))
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestConversionCache(t *testing.T) {
+	ctx := context.Background()
+	raw := []byte("FROM debian:12\nRUN apt-get update && apt-get install -y build-essential\n")
+	opts := Options{Offline: true}
+
+	cache := &ConversionCache{Dir: filepath.Join(t.TempDir(), "conversions")}
+
+	// convert converts raw with the cache and returns the output and the cache entries afterwards
+	convert := func(t *testing.T, raw []byte, opts Options) (string, []string) {
+		t.Helper()
+		converted, err := cache.ConvertBytes(ctx, raw, opts)
+		if err != nil {
+			t.Fatalf("ConvertBytes failed: %v", err)
+		}
+		entries, err := filepath.Glob(filepath.Join(cache.Dir, "*"))
+		if err != nil {
+			t.Fatalf("listing cache entries: %v", err)
+		}
+		return string(converted), entries
+	}
+
+	want, err := ConvertBytes(ctx, raw, opts)
+	if err != nil {
+		t.Fatalf("ConvertBytes failed: %v", err)
+	}
+
+	// Miss: the conversion is stored
+	got, entries := convert(t, raw, opts)
+	if diff := cmp.Diff(string(want), got); diff != "" {
+		t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 cache entry, got %v", entries)
+	}
+
+	// Hit: the stored conversion is returned as is
+	const cached = "FROM cached\n"
+	if err := os.WriteFile(entries[0], []byte(cached), 0600); err != nil {
+		t.Fatalf("writing cache entry: %v", err)
+	}
+	if got, _ := convert(t, raw, opts); got != cached {
+		t.Errorf("expected the cached conversion, got:\n%s", got)
+	}
+
+	tests := []struct {
+		name string
+		raw  []byte
+		opts Options
+		want string
+	}{
+		{
+			name: "changed input",
+			raw:  []byte("FROM debian:12\nRUN apt-get install -y curl\n"),
+			opts: opts,
+			want: "FROM cgr.dev/ORG/chainguard-base:latest\nUSER root\nRUN apk add --no-cache curl\n",
+		},
+		{
+			name: "changed options",
+			raw:  raw,
+			opts: Options{Offline: true, Organization: "example.com"},
+			want: "FROM cgr.dev/example.com/chainguard-base:latest\nUSER root\nRUN apk add --no-cache build-base\n",
+		},
+		{
+			name: "changed mappings",
+			raw:  raw,
+			opts: Options{Offline: true, ExtraMappings: MappingsConfig{
+				Packages: PackageMap{DistroDebian: {"build-essential": {"build-base", "git"}}},
+			}},
+			want: "FROM cgr.dev/ORG/chainguard-base:latest\nUSER root\nRUN apk add --no-cache build-base git\n",
+		},
+		{
+			name: "changed mappings priority",
+			raw:  raw,
+			opts: Options{Offline: true, ExtraMappingsPriority: ExtraMappingsFallback, ExtraMappings: MappingsConfig{
+				Packages: PackageMap{DistroDebian: {"build-essential": {"build-base", "git"}}},
+			}},
+			want: "FROM cgr.dev/ORG/chainguard-base:latest\nUSER root\nRUN apk add --no-cache build-base\n",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, entries := convert(t, tt.raw, tt.opts)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+			// Each conversion is stored under its own key
+			if want := i + 2; len(entries) != want {
+				t.Errorf("expected %d cache entries, got %d", want, len(entries))
+			}
+		})
+	}
+
+	t.Run("unset mappings priority is the same as override", func(t *testing.T) {
+		mappings := MappingsConfig{Images: map[string]string{"debian": "chainguard-base"}}
+		unset, err := conversionCacheKey(raw, Options{}, mappings)
+		if err != nil {
+			t.Fatalf("conversionCacheKey failed: %v", err)
+		}
+		override, err := conversionCacheKey(raw, Options{ExtraMappingsPriority: ExtraMappingsOverride}, mappings)
+		if err != nil {
+			t.Fatalf("conversionCacheKey failed: %v", err)
+		}
+		fallback, err := conversionCacheKey(raw, Options{ExtraMappingsPriority: ExtraMappingsFallback}, mappings)
+		if err != nil {
+			t.Fatalf("conversionCacheKey failed: %v", err)
+		}
+		if unset != override {
+			t.Errorf("expected the same key for an unset and the override mappings priority, got %s and %s", unset, override)
+		}
+		if override == fallback {
+			t.Errorf("expected different keys for the override and fallback mappings priorities, got %s", override)
+		}
+	})
+
+	t.Run("custom converters are not cached", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "conversions")
+		cache := &ConversionCache{Dir: dir}
+		opts := Options{Offline: true, RunLineConverter: func(_ *RunDetails, converted string, _ int) (string, error) {
+			return converted, nil
+		}}
+		if _, err := cache.ConvertBytes(ctx, raw, opts); err != nil {
+			t.Fatalf("ConvertBytes failed: %v", err)
+		}
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("expected no cache directory, got err %v", err)
+		}
+	})
+}
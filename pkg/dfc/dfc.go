@@ -6,12 +6,19 @@ SPDX-License-Identifier: Apache-2.0
 package dfc
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"maps"
 	"path/filepath"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/chainguard-dev/clog"
 )
@@ -22,6 +29,12 @@ type Distro string
 // Manager represents a package manager
 type Manager string
 
+// ApkStyle determines how the apk index is handled in generated apk add commands
+type ApkStyle string
+
+// ExtraMappingsPriority determines whether ExtraMappings take precedence over the built-in mappings
+type ExtraMappingsPriority string
+
 // Supported distributions
 const (
 	DistroDebian Distro = "debian"
@@ -39,12 +52,39 @@ const (
 	ManagerApt      Manager = "apt"
 )
 
+// Supported apk styles
+const (
+	ApkStyleNoCache     ApkStyle = "no-cache"     // apk add --no-cache (default)
+	ApkStyleUpdateIndex ApkStyle = "update-index" // apk add -U
+)
+
+// Supported extra mappings priorities
+const (
+	ExtraMappingsOverride ExtraMappingsPriority = "override" // ExtraMappings take precedence over the built-in mappings (default)
+	ExtraMappingsFallback ExtraMappingsPriority = "fallback" // The built-in mappings take precedence, ExtraMappings only add the mappings they lack
+)
+
 // Package manager Commands
 const (
 	CommandAddAptRepository = "add-apt-repository"
 	CommandAptAddRepository = "apt-add-repository"
 )
 
+// Shell builtins
+const (
+	CommandExport = "export"
+)
+
+// Locale and timezone setup commands and packages
+const (
+	CommandLocaleGen       = "locale-gen"
+	CommandUpdateLocale    = "update-locale"
+	CommandDpkgReconfigure = "dpkg-reconfigure"
+	PackageLocales         = "locales"
+	PackageTzdata          = "tzdata"
+	PackageGlibcLocales    = "glibc-locales"
+)
+
 // User management commands and packages
 const (
 	CommandUserAdd  = "useradd"
@@ -52,12 +92,19 @@ const (
 	CommandGroupAdd = "groupadd"
 	CommandAddGroup = "addgroup"
 	PackageShadow   = "shadow"
+	PackageBash     = "bash"
 )
 
 // Install subcommands
 const (
-	SubcommandInstall = "install"
-	SubcommandAdd     = "add"
+	SubcommandInstall      = "install"
+	SubcommandAdd          = "add"
+	SubcommandDel          = "del"
+	SubcommandUpdate       = "update"
+	SubcommandClean        = "clean"
+	SubcommandDownload     = "download"     // Downloads package files without installing them
+	SubcommandReinstall    = "reinstall"    // Installs packages again, like install for a fresh image
+	SubcommandLocalInstall = "localinstall" // Installs local rpm files
 )
 
 // Dockerfile directives
@@ -66,7 +113,37 @@ const (
 	DirectiveRun  = "RUN"
 	DirectiveUser = "USER"
 	DirectiveArg  = "ARG"
+	DirectiveCopy = "COPY"
 	KeywordAs     = "AS"
+
+	DirectiveWorkdir     = "WORKDIR"
+	DirectiveCmd         = "CMD"
+	DirectiveEntrypoint  = "ENTRYPOINT"
+	DirectiveLabel       = "LABEL"
+	DirectiveAdd         = "ADD"
+	DirectiveEnv         = "ENV"
+	DirectiveExpose      = "EXPOSE"
+	DirectiveHealthcheck = "HEALTHCHECK"
+	DirectiveMaintainer  = "MAINTAINER"
+	DirectiveOnbuild     = "ONBUILD"
+	DirectiveShell       = "SHELL"
+	DirectiveStopsignal  = "STOPSIGNAL"
+	DirectiveVolume      = "VOLUME"
+)
+
+// knownDirectives are all the instructions supported in a Dockerfile (https://docs.docker.com/reference/dockerfile/#overview)
+var knownDirectives = []string{
+	DirectiveAdd, DirectiveArg, DirectiveCmd, DirectiveCopy, DirectiveEntrypoint, DirectiveEnv, DirectiveExpose,
+	DirectiveFrom, DirectiveHealthcheck, DirectiveLabel, DirectiveMaintainer, DirectiveOnbuild, DirectiveRun,
+	DirectiveShell, DirectiveStopsignal, DirectiveUser, DirectiveVolume, DirectiveWorkdir,
+}
+
+// Parser directives (https://docs.docker.com/reference/dockerfile/#parser-directives)
+const (
+	ParserDirectiveSyntax = "syntax"
+	ParserDirectiveEscape = "escape"
+	ParserDirectiveCheck  = "check"
+	DefaultEscapeChar     = "\\"
 )
 
 // Default values
@@ -80,26 +157,70 @@ const (
 
 // Other
 const (
-	ApkNoCacheFlag = "--no-cache"
+	ApkNoCacheFlag     = "--no-cache"
+	ApkUpdateIndexFlag = "-U"
+	ApkNoProgressFlag  = "--no-progress"
+	ApkVirtualFlag     = "--virtual"
+	ApkRepositoryFlag  = "--repository"
 )
 
 // PackageManagerInfo holds metadata about a package manager
 type PackageManagerInfo struct {
-	Distro             Distro
-	InstallKeyword     string
-	AssociatedCommands []string
+	Distro              Distro
+	InstallKeyword      string
+	InstallAliases      []string // Other subcommands that install packages like InstallKeyword (e.g. reinstall)
+	AssociatedCommands  []string
+	FlagsWithValue      []string // Flags whose value is passed as a separate argument (e.g. "-t bookworm-backports")
+	RecoveryFlags       []string // Flags that work around dependency issues, these are dropped since apk resolves dependencies itself
+	UnsupportedCommands []string // Subcommands with no apk equivalent, RUN directives using them are left unchanged
+	SimulateFlags       []string // Flags that make an install a dry run, RUN directives using them are left unchanged
 }
 
+// Flags that take a separate value argument, per package manager family
+var (
+	aptFlagsWithValue = []string{"-t", "--target-release", "--default-release", "-o", "--option", "-c", "--config-file"}
+	aptRecoveryFlags  = []string{"-f", "--fix-broken", "-m", "--fix-missing", "--ignore-missing"}
+	aptUnsupported    = []string{"build-dep", "source", SubcommandDownload}
+	aptSimulateFlags  = []string{"-s", "--simulate", "--just-print", "--dry-run", "--recon", "--no-act", "--print-uris"}
+	dnfUnsupported    = []string{"builddep", SubcommandDownload, SubcommandLocalInstall}
+	dnfSimulateFlags  = []string{"--assumeno"}
+	dnfFlagsWithValue = []string{"-c", "--config", "--releasever", "--installroot", "--enablerepo", "--disablerepo", "--repo", "--repoid", "-x", "--exclude", "--setopt"}
+	apkFlagsWithValue = []string{"-t", "--virtual", "-X", "--repository", "-p", "--root", "--arch", "--cache-dir", "--keys-dir"}
+)
+
 // PackageManagerInfoMap maps package managers to their metadata
 var PackageManagerInfoMap = map[Manager]PackageManagerInfo{
-	ManagerAptGet: {Distro: DistroDebian, InstallKeyword: SubcommandInstall, AssociatedCommands: []string{CommandAddAptRepository, CommandAptAddRepository}},
-	ManagerApt:    {Distro: DistroDebian, InstallKeyword: SubcommandInstall, AssociatedCommands: []string{CommandAddAptRepository, CommandAptAddRepository}},
+	ManagerAptGet: {Distro: DistroDebian, InstallKeyword: SubcommandInstall, InstallAliases: []string{SubcommandReinstall}, AssociatedCommands: []string{CommandAddAptRepository, CommandAptAddRepository}, FlagsWithValue: aptFlagsWithValue, RecoveryFlags: aptRecoveryFlags, UnsupportedCommands: aptUnsupported, SimulateFlags: aptSimulateFlags},
+	ManagerApt:    {Distro: DistroDebian, InstallKeyword: SubcommandInstall, InstallAliases: []string{SubcommandReinstall}, AssociatedCommands: []string{CommandAddAptRepository, CommandAptAddRepository}, FlagsWithValue: aptFlagsWithValue, RecoveryFlags: aptRecoveryFlags, UnsupportedCommands: aptUnsupported, SimulateFlags: aptSimulateFlags},
 
-	ManagerYum:      {Distro: DistroFedora, InstallKeyword: SubcommandInstall},
-	ManagerDnf:      {Distro: DistroFedora, InstallKeyword: SubcommandInstall},
-	ManagerMicrodnf: {Distro: DistroFedora, InstallKeyword: SubcommandInstall},
+	ManagerYum:      {Distro: DistroFedora, InstallKeyword: SubcommandInstall, InstallAliases: []string{SubcommandReinstall}, FlagsWithValue: dnfFlagsWithValue, UnsupportedCommands: []string{SubcommandLocalInstall}, SimulateFlags: dnfSimulateFlags},
+	ManagerDnf:      {Distro: DistroFedora, InstallKeyword: SubcommandInstall, InstallAliases: []string{SubcommandReinstall}, FlagsWithValue: dnfFlagsWithValue, UnsupportedCommands: dnfUnsupported, SimulateFlags: dnfSimulateFlags},
+	ManagerMicrodnf: {Distro: DistroFedora, InstallKeyword: SubcommandInstall, InstallAliases: []string{SubcommandReinstall}, FlagsWithValue: dnfFlagsWithValue},
 
-	ManagerApk: {Distro: DistroAlpine, InstallKeyword: SubcommandAdd},
+	ManagerApk: {Distro: DistroAlpine, InstallKeyword: SubcommandAdd, FlagsWithValue: apkFlagsWithValue},
+}
+
+// SupportedManagers returns the package managers in PackageManagerInfoMap, sorted by name
+func SupportedManagers() []Manager {
+	return slices.Sorted(maps.Keys(PackageManagerInfoMap))
+}
+
+// SupportedDistros returns the distributions of the package managers in PackageManagerInfoMap, sorted by name
+func SupportedDistros() []Distro {
+	var distros []Distro
+	for _, info := range PackageManagerInfoMap {
+		if !slices.Contains(distros, info.Distro) {
+			distros = append(distros, info.Distro)
+		}
+	}
+	slices.Sort(distros)
+	return distros
+}
+
+// ManagerDistro returns the distribution of a package manager, or false if the package manager is not supported
+func ManagerDistro(manager Manager) (Distro, bool) {
+	info, ok := PackageManagerInfoMap[manager]
+	return info.Distro, ok
 }
 
 type PackageSpec struct {
@@ -110,6 +231,8 @@ type PackageSpec struct {
 	Version        string
 	Release        string
 	Epoch          string
+	Arch           string // Debian multiarch qualifier, e.g. amd64 for nginx:amd64
+	VersionFamily  bool   // Version is the prefix of a version family, e.g. 1.18 for nginx=1.18.*
 }
 
 // DockerfileLine represents a single line in a Dockerfile
@@ -121,6 +244,15 @@ type DockerfileLine struct {
 	From      *FromDetails `json:"from,omitempty"`
 	Run       *RunDetails  `json:"run,omitempty"`
 	Arg       *ArgDetails  `json:"arg,omitempty"`
+	Copy      *CopyDetails `json:"copy,omitempty"`
+
+	User       *UserDetails    `json:"user,omitempty"`
+	Workdir    *WorkdirDetails `json:"workdir,omitempty"`
+	Cmd        *CommandDetails `json:"cmd,omitempty"`
+	Entrypoint *CommandDetails `json:"entrypoint,omitempty"`
+	Labels     LabelDetails    `json:"labels,omitempty"`
+
+	Diagnostics []string `json:"diagnostics,omitempty"` // Advisories about this line that need manual review
 }
 
 // ArgDetails holds details about an ARG directive
@@ -139,8 +271,48 @@ type FromDetails struct {
 	Parent      int    `json:"parent,omitempty"`
 	BaseDynamic bool   `json:"baseDynamic,omitempty"`
 	TagDynamic  bool   `json:"tagDynamic,omitempty"`
-	Orig        string `json:"orig,omitempty"`     // Original full image reference
-	Platform    string `json:"platform,omitempty"` // Platform specification from --platform flag
+	Orig        string `json:"orig,omitempty"`      // Original full image reference
+	Platform    string `json:"platform,omitempty"`  // Platform specification from --platform flag
+	IsScratch   bool   `json:"isScratch,omitempty"` // Stage starts from the empty scratch image, directly or through its parent stages
+}
+
+// CopyDetails holds details about a COPY directive with a --from flag
+type CopyDetails struct {
+	From      string `json:"from,omitempty"`      // Original value of the --from flag
+	FromStage int    `json:"fromStage,omitempty"` // Build stage referenced by --from (by alias or index)
+	FromImage string `json:"fromImage,omitempty"` // External image referenced by --from
+}
+
+// UserDetails holds details about a USER directive
+type UserDetails struct {
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+// WorkdirDetails holds details about a WORKDIR directive
+type WorkdirDetails struct {
+	Path string `json:"path,omitempty"`
+}
+
+// LabelDetails holds the key/value pairs of a LABEL directive, without quotes
+type LabelDetails map[string]string
+
+// CommandDetails holds details about a CMD or ENTRYPOINT directive
+type CommandDetails struct {
+	Exec bool     `json:"exec,omitempty"` // True for the JSON array (exec) form, false for the shell form
+	Args []string `json:"args,omitempty"`
+}
+
+// String returns the command as it would be written in a Dockerfile
+func (c *CommandDetails) String() string {
+	if !c.Exec {
+		return strings.Join(c.Args, " ")
+	}
+	b, err := json.Marshal(c.Args)
+	if err != nil {
+		return strings.Join(c.Args, " ")
+	}
+	return string(b)
 }
 
 // RunDetails holds details about a RUN directive
@@ -148,7 +320,12 @@ type RunDetails struct {
 	Distro   Distro           `json:"distro,omitempty"`
 	Manager  Manager          `json:"manager,omitempty"`
 	Packages []string         `json:"packages,omitempty"`
+	Heredoc  *HeredocDetails  `json:"heredoc,omitempty"`
+	Flags    []string         `json:"flags,omitempty"` // BuildKit flags before the command, e.g. --mount=type=cache,target=/var/cache/apt
 	Shell    *RunDetailsShell `json:"-"`
+
+	// Packages installed by language package managers (e.g. npm install -g), detected but not converted
+	LanguageManagers []LanguageInstall `json:"languageManagers,omitempty"`
 }
 
 type RunDetailsShell struct {
@@ -158,7 +335,33 @@ type RunDetailsShell struct {
 
 // Dockerfile represents a parsed Dockerfile
 type Dockerfile struct {
-	Lines []*DockerfileLine `json:"lines"`
+	Lines  []*DockerfileLine `json:"lines"`
+	Escape string            `json:"escape,omitempty"` // Line continuation character set by the escape parser directive, empty for the default
+	CRLF   bool              `json:"crlf,omitempty"`   // Whether the lines of the original Dockerfile end with \r\n, String uses the same line endings
+	Digest string            `json:"digest,omitempty"` // Digest of the Dockerfile content (see ContentDigest), only set when requested
+}
+
+// ContentDigest returns the sha256 digest of the Dockerfile content, e.g. "sha256:3b1f..."
+func (d *Dockerfile) ContentDigest() string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(d.String())))
+}
+
+// JSONSchemaVersion is the version of the JSON representation of a Dockerfile.
+// The major version is only bumped for breaking changes (renamed or removed fields);
+// adding new optional fields bumps the minor version.
+const JSONSchemaVersion = "1.8"
+
+// MarshalJSON serializes the Dockerfile, always including the schemaVersion field
+// (a value receiver is used so that both Dockerfile and *Dockerfile include it)
+func (d Dockerfile) MarshalJSON() ([]byte, error) {
+	type dockerfileJSON Dockerfile // Avoid recursing into this method
+	return json.Marshal(struct {
+		SchemaVersion string `json:"schemaVersion"`
+		dockerfileJSON
+	}{
+		SchemaVersion:  JSONSchemaVersion,
+		dockerfileJSON: dockerfileJSON(d),
+	})
 }
 
 // String returns the Dockerfile content as a string
@@ -186,24 +389,74 @@ func (d *Dockerfile) String() string {
 		}
 	}
 
+	if d.CRLF {
+		return strings.ReplaceAll(builder.String(), "\n", "\r\n")
+	}
 	return builder.String()
 }
 
+// IsConvertedForm reports whether the Dockerfile is already in converted form, i.e.
+// converting it again with the given options would not change its output
+func (d *Dockerfile) IsConvertedForm(ctx context.Context, opts Options) (bool, error) {
+	content := d.String()
+
+	reparsed, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		return false, fmt.Errorf("parsing dockerfile: %w", err)
+	}
+	reconverted, err := reparsed.Convert(ctx, opts)
+	if err != nil {
+		return false, fmt.Errorf("converting dockerfile: %w", err)
+	}
+
+	return reconverted.String() == content, nil
+}
+
+// ConvertBytes parses and converts the content of a Dockerfile, returning the converted Dockerfile
+func ConvertBytes(ctx context.Context, raw []byte, opts Options) ([]byte, error) {
+	dockerfile, err := ParseDockerfile(ctx, raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing dockerfile: %w", err)
+	}
+	converted, err := dockerfile.Convert(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("converting dockerfile: %w", err)
+	}
+	return []byte(converted.String()), nil
+}
+
 // ParseDockerfile parses a Dockerfile into a structured representation
 func ParseDockerfile(_ context.Context, content []byte) (*Dockerfile, error) {
+	// Make sure we are working with UTF-8
+	content, err := normalizeEncoding(content)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create a new Dockerfile
 	dockerfile := &Dockerfile{
 		Lines: []*DockerfileLine{},
 	}
 
+	// Parse with \n line endings, keeping track of files that only use \r\n
+	if crlf := bytes.Count(content, []byte("\r\n")); crlf > 0 {
+		dockerfile.CRLF = crlf == bytes.Count(content, []byte("\n"))
+		content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	}
+
 	// Split into lines while preserving original structure
 	lines := strings.Split(string(content), "\n")
 
 	var extraContent strings.Builder
 	var currentInstruction strings.Builder
 	var inMultilineInstruction bool
+	escapeChar := DefaultEscapeChar
+	lookingForDirectives := true
+	var pendingHeredocs []heredocMarker
 	currentStage := 0
-	stageAliases := make(map[string]int) // Maps stage aliases to their index
+	stageAliases := make(map[string]int)  // Maps stage aliases to their index
+	scratchStages := make(map[int]bool)   // Stages that start from scratch, directly or through their parent stages
+	globalArgs := make(map[string]string) // Default values of the ARGs before the first FROM, which FROM lines can use
 
 	processCurrentInstruction := func() {
 		if currentInstruction.Len() == 0 {
@@ -211,8 +464,7 @@ func ParseDockerfile(_ context.Context, content []byte) (*Dockerfile, error) {
 		}
 
 		instruction := currentInstruction.String()
-		trimmedInstruction := strings.TrimSpace(instruction)
-		upperInstruction := strings.ToUpper(trimmedInstruction)
+		directive, args := splitDirective(instruction)
 
 		// Create a new Dockerfile line
 		dockerfileLine := &DockerfileLine{
@@ -222,85 +474,65 @@ func ParseDockerfile(_ context.Context, content []byte) (*Dockerfile, error) {
 		}
 
 		// Handle FROM instructions (case-insensitive)
-		if strings.HasPrefix(upperInstruction, DirectiveFrom+" ") {
+		if directive == DirectiveFrom {
 			currentStage++
 			dockerfileLine.Stage = currentStage
 
 			// Extract the FROM details
-			fromPartIdx := len(DirectiveFrom + " ")
-			fromPart := strings.TrimSpace(trimmedInstruction[fromPartIdx:])
+			fromPart := args
 
 			// Check for --platform flag first
 			var platform string
 			if strings.HasPrefix(fromPart, "--platform") {
-				// Handle --platform=value format
-				if strings.HasPrefix(fromPart, "--platform=") {
-					parts := strings.SplitN(fromPart, " ", 2)
-					if len(parts) >= 2 {
-						platformPart := parts[0]
-						platform = strings.TrimPrefix(platformPart, "--platform=")
-						fromPart = strings.TrimSpace(parts[1])
+				flag, rest, _ := cutWhitespace(fromPart)
+				if value, ok := strings.CutPrefix(flag, "--platform="); ok {
+					// Handle --platform=value format
+					if rest != "" {
+						platform = value
+						fromPart = rest
 					}
-				} else if strings.HasPrefix(fromPart, "--platform ") {
-					// Handle --platform value format (with space)
-					parts := strings.SplitN(fromPart, " ", 3)
-					if len(parts) >= 3 {
-						platform = parts[1]
-						fromPart = strings.TrimSpace(strings.Join(parts[2:], " "))
+				} else if flag == "--platform" {
+					// Handle --platform value format (with whitespace)
+					if value, rest, _ := cutWhitespace(rest); rest != "" {
+						platform = value
+						fromPart = rest
 					}
 				}
 			}
 
-			// Check for AS clause which defines an alias (case-insensitive)
+			// Check for AS clause which defines an alias (case-insensitive), the original
+			// image reference is saved before any parsing
 			var alias string
-			// Capture space + AS + space to get exact length
-			asKeywordWithSpaces := " " + KeywordAs + " "
-
-			// Save the original image reference before any parsing
-			var origImageRef string
-
-			// Split by case-insensitive " AS " pattern
-			asParts := strings.Split(strings.ToUpper(fromPart), asKeywordWithSpaces)
-			if len(asParts) > 1 {
-				// Find the position of the case-insensitive " AS " to preserve case in the base part
-				asIndex := strings.Index(strings.ToUpper(fromPart), asKeywordWithSpaces)
-				if asIndex != -1 {
-					// Use the original case for the base and alias
-					basePart := strings.TrimSpace(fromPart[:asIndex])
-					aliasPart := strings.TrimSpace(fromPart[asIndex+len(asKeywordWithSpaces):])
-					fromPart = basePart
-					origImageRef = basePart // Capture only the image reference part
-					alias = aliasPart
-
-					// Store this alias for parent references
-					stageAliases[strings.ToLower(alias)] = currentStage
-				}
-			} else {
-				origImageRef = fromPart
+			origImageRef := fromPart
+			if loc := fromAliasRegex.FindStringIndex(fromPart); loc != nil {
+				// Use the original case for the base and alias
+				alias = strings.TrimSpace(fromPart[loc[1]:])
+				fromPart = fromPart[:loc[0]]
+				origImageRef = fromPart // Capture only the image reference part
+
+				// Store this alias for parent references
+				stageAliases[strings.ToLower(alias)] = currentStage
 			}
 
 			// Parse the image reference
-			var base, tag, digest string
-
-			// Check for digest
-			if digestParts := strings.Split(fromPart, "@"); len(digestParts) > 1 {
-				fromPart = digestParts[0]
-				digest = digestParts[1]
-			}
+			base, tag, digest := splitImageReference(fromPart)
 
-			// Check for tag
-			if tagParts := strings.Split(fromPart, ":"); len(tagParts) > 1 {
-				base = tagParts[0]
-				tag = tagParts[1]
-			} else {
-				base = fromPart
-			}
-
-			// Check for parent reference (case-insensitive)
+			// Check for parent reference (case-insensitive), which may be given by an ARG (e.g. FROM ${BUILD_STAGE})
 			var parent int
-			if parentStage, exists := stageAliases[strings.ToLower(base)]; exists {
+			stageName := base
+			if argName, defaultValue, ok := argReference(base); ok && tag == "" && digest == "" {
+				stageName = defaultValue
+				if value, exists := globalArgs[argName]; exists {
+					stageName = strings.Trim(value, `"'`)
+				}
+			}
+			if parentStage, exists := stageAliases[strings.ToLower(stageName)]; exists {
 				parent = parentStage
 			}
+			isScratch := base == "scratch" || scratchStages[parent]
+			if isScratch {
+				scratchStages[currentStage] = true
+			}
 
 			// Create the FromDetails
 			dockerfileLine.From = &FromDetails{
@@ -313,14 +545,13 @@ func ParseDockerfile(_ context.Context, content []byte) (*Dockerfile, error) {
 				TagDynamic:  strings.Contains(tag, "$"),
 				Orig:        origImageRef,
 				Platform:    platform,
+				IsScratch:   isScratch,
 			}
 		}
 
 		// Handle ARG instructions (case-insensitive)
-		if strings.HasPrefix(upperInstruction, DirectiveArg+" ") {
-			// Extract the ARG part (everything after "ARG ")
-			argPartIdx := len(DirectiveArg + " ")
-			argPart := strings.TrimSpace(trimmedInstruction[argPartIdx:])
+		if directive == DirectiveArg {
+			argPart := args
 
 			// Parse the ARG name and default value if present
 			var name, defaultValue string
@@ -336,23 +567,70 @@ func ParseDockerfile(_ context.Context, content []byte) (*Dockerfile, error) {
 				Name:         name,
 				DefaultValue: defaultValue,
 			}
+			if currentStage == 0 {
+				globalArgs[name] = defaultValue
+			}
+		}
+
+		// Handle COPY instructions (case-insensitive)
+		if directive == DirectiveCopy {
+			dockerfileLine.Copy = parseCopyFrom(args, currentStage, stageAliases)
+		}
+
+		// Handle USER, WORKDIR, CMD and ENTRYPOINT instructions (case-insensitive)
+		if directive == DirectiveUser {
+			user, group, _ := strings.Cut(args, ":")
+			dockerfileLine.User = &UserDetails{User: user, Group: group}
+		}
+		if directive == DirectiveWorkdir {
+			dockerfileLine.Workdir = &WorkdirDetails{Path: args}
+		}
+		if directive == DirectiveCmd {
+			dockerfileLine.Cmd = parseCommandDetails(args, escapeChar)
+		}
+		if directive == DirectiveEntrypoint {
+			dockerfileLine.Entrypoint = parseCommandDetails(args, escapeChar)
+		}
+		if directive == DirectiveLabel {
+			dockerfileLine.Labels = parseLabelDetails(args, escapeChar)
 		}
 
 		// Handle RUN instructions (case-insensitive)
-		if strings.HasPrefix(upperInstruction, DirectiveRun+" ") {
-			// Extract the command part (everything after "RUN ")
-			cmdPartIdx := len(DirectiveRun + " ")
-			cmdPart := strings.TrimSpace(trimmedInstruction[cmdPartIdx:])
-
-			// Parse the shell command
-			shellCmd := ParseMultilineShell(cmdPart)
-
-			// Store the shell command in Run.Shell.Before
-			if shellCmd != nil {
-				dockerfileLine.Run = &RunDetails{
-					Shell: &RunDetailsShell{
-						Before: shellCmd,
-					},
+		if directive == DirectiveRun {
+			cmdPart := args
+
+			// The shell parser only understands backslash continuations
+			if escapeChar != DefaultEscapeChar {
+				cmdPart = replaceLineContinuations(cmdPart, escapeChar, DefaultEscapeChar)
+			}
+
+			if heredoc := parseRunHeredoc(instruction); heredoc != nil {
+				// The whole script is a heredoc, parse its body line by line
+				if shellCmd := ParseHeredocShell(heredoc.Body); shellCmd != nil {
+					dockerfileLine.Run = &RunDetails{
+						Heredoc: heredoc,
+						Shell: &RunDetailsShell{
+							Before: shellCmd,
+						},
+						LanguageManagers: detectLanguageInstalls(shellCmd),
+					}
+				}
+			} else if len(findHeredocMarkers(instruction)) == 0 {
+				// Flags such as --mount=... are not part of the shell command
+				flags, shellPart := splitRunFlags(cmdPart)
+
+				// Parse the shell command. Other heredoc forms are left untouched.
+				shellCmd := ParseMultilineShell(shellPart)
+
+				// Store the shell command in Run.Shell.Before
+				if shellCmd != nil {
+					dockerfileLine.Run = &RunDetails{
+						Flags: flags,
+						Shell: &RunDetailsShell{
+							Before: shellCmd,
+						},
+						LanguageManagers: detectLanguageInstalls(shellCmd),
+					}
 				}
 			}
 		}
@@ -365,9 +643,47 @@ func ParseDockerfile(_ context.Context, content []byte) (*Dockerfile, error) {
 		extraContent.Reset()
 	}
 
-	for _, line := range lines {
+	// endInstruction processes the current instruction unless it opened heredocs,
+	// in which case the following lines are consumed as heredoc bodies first
+	endInstruction := func() {
+		if pendingHeredocs = findHeredocMarkers(currentInstruction.String()); len(pendingHeredocs) > 0 {
+			currentInstruction.WriteString("\n")
+			return
+		}
+		processCurrentInstruction()
+	}
+
+	for i, line := range lines {
+		// Inside a heredoc every line belongs to the current instruction verbatim
+		if len(pendingHeredocs) > 0 {
+			currentInstruction.WriteString(line)
+			if isHeredocTerminator(line, pendingHeredocs[0]) {
+				pendingHeredocs = pendingHeredocs[1:]
+				if len(pendingHeredocs) == 0 {
+					processCurrentInstruction()
+					continue
+				}
+			}
+			currentInstruction.WriteString("\n")
+			continue
+		}
+
 		trimmedLine := strings.TrimSpace(line)
 
+		// Parser directives are only honored at the very top of the file, before
+		// any instruction, regular comment, or empty line has been processed
+		if lookingForDirectives {
+			if name, value, ok := parseParserDirective(trimmedLine); ok {
+				if name == ParserDirectiveEscape && (value == "`" || value == DefaultEscapeChar) {
+					escapeChar = value
+				}
+				extraContent.WriteString(line)
+				extraContent.WriteString("\n")
+				continue
+			}
+			lookingForDirectives = false
+		}
+
 		// Handle empty lines
 		if trimmedLine == "" {
 			if !inMultilineInstruction {
@@ -377,40 +693,46 @@ func ParseDockerfile(_ context.Context, content []byte) (*Dockerfile, error) {
 			continue
 		}
 
-		// Handle comments
+		// Handle comments. Comments within a multi-line instruction are kept in
+		// the instruction, they are ignored when the instruction is parsed.
 		if strings.HasPrefix(trimmedLine, "#") {
 			if !inMultilineInstruction {
 				extraContent.WriteString(line)
 				extraContent.WriteString("\n")
+			} else {
+				currentInstruction.WriteString(line)
+				currentInstruction.WriteString("\n")
 			}
 			continue
 		}
 
 		// Check if this is the start of a new instruction or continuation
 		if !inMultilineInstruction {
-			// Check for continuation character
-			if strings.HasSuffix(trimmedLine, "\\") {
+			// Check for continuation character. The check is done against the trimmed
+			// line so that stray whitespace after the escape character (technically
+			// invalid, but tolerated by BuildKit) still continues the instruction.
+			if continuesInstruction(trimmedLine, nextInstructionLine(lines[i+1:]), escapeChar) {
 				inMultilineInstruction = true
 				currentInstruction.WriteString(line)
 				currentInstruction.WriteString("\n")
 			} else {
 				// Single line instruction
 				currentInstruction.WriteString(line)
-				processCurrentInstruction()
+				endInstruction()
 			}
 		} else {
 			// Continuation of a multi-line instruction
 			currentInstruction.WriteString(line)
 
 			// Check if this is the end of the multi-line instruction
-			if !strings.HasSuffix(trimmedLine, "\\") {
+			if !continuesInstruction(trimmedLine, nextInstructionLine(lines[i+1:]), escapeChar) {
 				inMultilineInstruction = false
 
 				// We don't need to add a newline at the end of a completed multiline instruction
 				// This prevents the extra newline that appears at the end of RUN commands
 				// Only add newlines between individual lines, not at the end
 
-				processCurrentInstruction()
+				endInstruction()
 			} else {
 				// Not the end yet, add a newline
 				currentInstruction.WriteString("\n")
@@ -418,8 +740,13 @@ func ParseDockerfile(_ context.Context, content []byte) (*Dockerfile, error) {
 		}
 	}
 
-	// Process any remaining instruction
-	if inMultilineInstruction {
+	// Process any remaining instruction, including an unterminated heredoc
+	if len(pendingHeredocs) > 0 {
+		remaining := strings.TrimSuffix(currentInstruction.String(), "\n")
+		currentInstruction.Reset()
+		currentInstruction.WriteString(remaining)
+		processCurrentInstruction()
+	} else if inMultilineInstruction {
 		processCurrentInstruction()
 	}
 
@@ -433,9 +760,250 @@ func ParseDockerfile(_ context.Context, content []byte) (*Dockerfile, error) {
 		extraContent.Reset()
 	}
 
+	if escapeChar != DefaultEscapeChar {
+		dockerfile.Escape = escapeChar
+	}
+
 	return dockerfile, nil
 }
 
+// parserDirectiveRegex matches a parser directive comment such as "# escape=`"
+var parserDirectiveRegex = regexp.MustCompile(`^#\s*([a-zA-Z][a-zA-Z0-9]*)\s*=\s*(.+?)\s*$`)
+
+// parseParserDirective returns the lowercased name and value of a known parser directive
+func parseParserDirective(trimmedLine string) (name, value string, ok bool) {
+	matches := parserDirectiveRegex.FindStringSubmatch(trimmedLine)
+	if matches == nil {
+		return "", "", false
+	}
+	name = strings.ToLower(matches[1])
+	switch name {
+	case ParserDirectiveSyntax, ParserDirectiveEscape, ParserDirectiveCheck:
+		return name, matches[2], true
+	}
+	return "", "", false
+}
+
+// parseCopyFrom extracts the --from flag of a COPY instruction, determining whether
+// it references an earlier build stage or an external image. Returns nil if there is no --from flag.
+func parseCopyFrom(copyPart string, currentStage int, stageAliases map[string]int) *CopyDetails {
+	var from string
+	for _, field := range strings.Fields(copyPart) {
+		if !strings.HasPrefix(field, "--") {
+			break // Flags always come before the sources
+		}
+		if strings.HasPrefix(strings.ToLower(field), "--from=") {
+			from = field[len("--from="):]
+			break
+		}
+	}
+	if from == "" {
+		return nil
+	}
+
+	copyDetails := &CopyDetails{From: from}
+	if stage, exists := stageAliases[strings.ToLower(from)]; exists {
+		copyDetails.FromStage = stage
+	} else if index, err := strconv.Atoi(from); err == nil {
+		// Stage indexes are zero-based, while stages are numbered from 1. An index that is not
+		// an earlier stage is a mistake rather than an image, so it is never converted.
+		if index >= 0 && index < currentStage {
+			copyDetails.FromStage = index + 1
+		}
+	} else if !strings.Contains(from, "$") {
+		// Anything that is not a known stage is pulled as an image
+		copyDetails.FromImage = from
+	}
+	return copyDetails
+}
+
+// instructionComments returns the comment lines found within a multi-line instruction,
+// without their indentation, followed by the comments at the end of its continued lines
+func instructionComments(instruction string) string {
+	var builder strings.Builder
+	for _, line := range strings.Split(instruction, "\n")[1:] {
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "#") {
+			builder.WriteString(trimmed)
+			builder.WriteString("\n")
+		}
+	}
+	for _, comment := range continuedLineComments(instruction) {
+		builder.WriteString(comment)
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+// continuesInstruction reports whether a trimmed line is continued on the next line, i.e. it ends with
+// the escape character. A comment after the escape character (e.g. "apt-get install -y nginx \ # web server")
+// doesn't end the instruction either, unless the next line starts a directive: Docker would fail on
+// the next line otherwise, which is clearly meant to continue it.
+func continuesInstruction(trimmedLine, nextLine, escapeChar string) bool {
+	if strings.HasSuffix(trimmedLine, escapeChar) {
+		return true
+	}
+	i := commentIndex(trimmedLine)
+	if i <= 0 || !strings.HasSuffix(strings.TrimSpace(trimmedLine[:i]), escapeChar) {
+		return false
+	}
+	return !slices.Contains(knownDirectives, leadingDirective(nextLine))
+}
+
+// nextInstructionLine returns the first of the remaining lines that is neither empty nor a comment, trimmed
+func nextInstructionLine(lines []string) string {
+	for _, line := range lines {
+		if trimmed := strings.TrimSpace(line); trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			return trimmed
+		}
+	}
+	return ""
+}
+
+// continuedLineComments returns the comments at the end of the lines of an instruction that are continued
+// (e.g. "apt-get install -y nginx # web server \"). The shell treats the rest of the instruction as part
+// of such a comment, but dfc ignores just the comment.
+func continuedLineComments(instruction string) []string {
+	var comments []string
+	lines := strings.Split(instruction, "\n")
+	for _, line := range lines[:len(lines)-1] {
+		trimmed := strings.TrimSpace(line)
+		if i := commentIndex(trimmed); i > 0 {
+			comments = append(comments, strings.TrimSpace(strings.TrimRight(trimmed[i:], "\\`")))
+		}
+	}
+	return comments
+}
+
+// parseCommandDetails parses the arguments of a CMD or ENTRYPOINT instruction,
+// which may be in either exec form (["executable", "param"]) or shell form
+func parseCommandDetails(cmdPart string, escapeChar string) *CommandDetails {
+	cmdPart = removeComments(replaceLineContinuations(strings.TrimSpace(cmdPart), escapeChar, DefaultEscapeChar))
+
+	if strings.HasPrefix(cmdPart, "[") {
+		var args []string
+		if err := json.Unmarshal([]byte(cmdPart), &args); err == nil {
+			return &CommandDetails{Exec: true, Args: args}
+		}
+		// Not valid JSON, Docker treats this as shell form
+	}
+
+	return &CommandDetails{Args: tokenize(cmdPart)}
+}
+
+// parseLabelDetails parses the key/value pairs of a LABEL directive, e.g. version=1.0 "description"="my app",
+// which may span several lines. The legacy form with a single key and value (LABEL version 1.0) is supported too.
+func parseLabelDetails(args string, escapeChar string) LabelDetails {
+	args = removeComments(replaceLineContinuations(strings.TrimSpace(args), escapeChar, DefaultEscapeChar))
+
+	labels := LabelDetails{}
+	words := labelWords(args)
+	if len(words) == 0 {
+		return labels
+	}
+
+	// Legacy form, the value is the rest of the line
+	if _, _, ok := cutUnquoted(words[0], '='); !ok {
+		key := unquoteLabelWord(words[0])
+		labels[key] = strings.TrimSpace(strings.TrimPrefix(args, words[0]))
+		return labels
+	}
+
+	for _, word := range words {
+		if key, value, ok := cutUnquoted(word, '='); ok {
+			labels[unquoteLabelWord(key)] = unquoteLabelWord(value)
+		}
+	}
+	return labels
+}
+
+// labelWords splits the arguments of a LABEL directive on whitespace outside of quotes, keeping the quotes
+func labelWords(s string) []string {
+	var words []string
+	var word strings.Builder
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && quote != '\'' && i+1 < len(s):
+			word.WriteByte(c)
+			i++
+			c = s[i]
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ' ' || c == '\t':
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+			continue
+		}
+		word.WriteByte(c)
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// cutUnquoted slices s around the first instance of sep that is outside of quotes
+func cutUnquoted(s string, sep byte) (before, after string, found bool) {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && quote != '\'':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == sep:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+// unquoteLabelWord removes the quotes of a LABEL key or value, along with the backslashes
+// escaping a character outside of single quotes
+func unquoteLabelWord(s string) string {
+	var builder strings.Builder
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && quote != '\'' && i+1 < len(s):
+			i++
+			builder.WriteByte(s[i])
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		default:
+			builder.WriteByte(c)
+		}
+	}
+	return builder.String()
+}
+
+// replaceLineContinuations swaps the line continuation character at the end of each line
+func replaceLineContinuations(s, from, to string) string {
+	lines := strings.Split(s, "\n")
+	for i := 0; i < len(lines)-1; i++ {
+		trimmed := strings.TrimRight(lines[i], " \t")
+		if strings.HasSuffix(trimmed, from) {
+			lines[i] = strings.TrimSuffix(trimmed, from) + to + lines[i][len(trimmed):]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
 // PackageMap maps distros to package mappings
 type PackageMap map[Distro]map[string][]string
 
@@ -494,52 +1062,113 @@ type RunLineConverter func(run *RunDetails, converted string, stage int) (string
 type Options struct {
 	Organization        string
 	Registry            string
+	RegistryMap         map[string]string // Optional per-image registry overrides, keyed by target image name (e.g. "node": "r.example.com/cg")
 	ExtraMappings       MappingsConfig
 	Update              bool              // When true, update cached mappings before conversion
+	Offline             bool              // When true, never update and only use the embedded built-in mappings
 	NoBuiltIn           bool              // When true, don't use built-in mappings, only ExtraMappings
 	FromLineConverter   FromLineConverter // Optional custom converter for FROM lines
 	RunLineConverter    RunLineConverter  // Optional custom converter for RUN lines
 	Strict              bool              // When true, fail if any package is unknown
 	WarnMissingPackages bool              // When true, warn about missing package mappings instead of using the original package name
+	ApkNoProgress       bool              // When true, add --no-progress to generated apk add commands for cleaner CI logs
+	ApkStyle            ApkStyle          // How generated apk add commands handle the index, defaults to ApkStyleNoCache
+	ApkRepositories     []string          // Extra repositories passed to generated apk add commands with --repository, in order
+	ConvertCopyFrom     bool              // When true, convert external images referenced by COPY --from like FROM images
+	AnnotatePackages    bool              // When true, add a comment above converted RUN lines listing the package mappings applied
+	AnnotateOriginal    bool              // When true, add a comment above converted FROM, RUN and ARG lines with the original line
+	NoDevSuffix         bool              // When true, never add the -dev suffix to converted tags, even for stages with RUN commands
+	IndentStyle         string            // Indentation of the continuation lines of converted RUN commands (e.g. "\t" or "  "), defaults to four spaces
+	FromOnly            bool              // When true, only convert base images (FROM, ARG and COPY --from), RUN lines are kept as they are
+	PackagesOnly        bool              // When true, only convert RUN lines, base images (FROM, ARG and COPY --from) are kept as they are
+	AddProvenanceLabel  bool              // When true, add a LABEL to the final stage recording that the Dockerfile was converted by dfc
+	ResolveTagDefaults  bool              // When true, a FROM tag such as ${TAG:-18} is converted like the default value if no ARG sets TAG
+
+	DisableWildcardImageMatch bool                  // When true, image mappings ending in "*" are ignored and only exact matches are used
+	ExtraMappingsPriority     ExtraMappingsPriority // Whether ExtraMappings override the built-in mappings or only fill gaps, defaults to ExtraMappingsOverride
+	FailOnUnknownDirective    bool                  // When true, fail if a line looks like a directive (e.g. FORM) but isn't a known one
+
+	TagRules map[string]TagRule // Optional tag rules keyed by target image name, taking precedence over DefaultTagRules
+	Catalog  string             // Optional target catalog whose mappings (MappingsConfig.Catalogs) take precedence over the others
+}
+
+// TagRule describes how the tag of a converted image is derived from the original tag
+type TagRule struct {
+	Prefix           string // Prepended to the converted tag unless it is latest or latest-dev (e.g. "openjdk-")
+	ForceLatest      bool   // Always use the latest tag, without a -dev suffix
+	PreserveOriginal bool   // Keep the original tag instead of truncating it to major.minor
+}
+
+// DefaultTagRules are the tag rules for specific target images, keyed by target image name
+var DefaultTagRules = map[string]TagRule{
+	DefaultChainguardBase: {ForceLatest: true},
+	"jdk":                 {Prefix: "openjdk-"},
+	"jre":                 {Prefix: "openjdk-"},
+}
+
+// tagRule returns the tag rule for a target image, preferring the rules in opts over DefaultTagRules
+func tagRule(targetImage string, opts Options) TagRule {
+	if rule, ok := opts.TagRules[targetImage]; ok {
+		return rule
+	}
+	return DefaultTagRules[targetImage]
 }
 
 // MappingsConfig represents the structure of builtin-mappings.yaml
 type MappingsConfig struct {
-	Images   map[string]string `yaml:"images"`
-	Packages PackageMap        `yaml:"packages"`
+	Images   map[string]string          `yaml:"images"`
+	Packages PackageMap                 `yaml:"packages"`
+	Catalogs map[string]CatalogMappings `yaml:"catalogs,omitempty"` // Mappings that only apply to a specific target catalog, keyed by catalog name
+	Groups   PackageMap                 `yaml:"groups,omitempty"`   // Packages to install for a package group (e.g. dnf install @development-tools), keyed by distro and group name
 }
 
-// parseImageReference extracts base and tag from an image reference
-func parseImageReference(imageRef string) (base, tag string) {
-	// Check for tag
-	if tagParts := strings.Split(imageRef, ":"); len(tagParts) > 1 {
-		base = tagParts[0]
-		tag = tagParts[1]
-	} else {
-		base = imageRef
+// fromAliasRegex matches the AS keyword before the stage name in a FROM instruction
+var fromAliasRegex = regexp.MustCompile(`(?i)\s+` + KeywordAs + `\s+`)
+
+// cutWhitespace cuts s around its first run of whitespace, like strings.Cut
+func cutWhitespace(s string) (before, after string, found bool) {
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i == -1 {
+		return s, "", false
 	}
-	return base, tag
+	return s[:i], strings.TrimLeftFunc(s[i:], unicode.IsSpace), true
 }
 
-// Convert applies the conversion to the Dockerfile and returns a new converted Dockerfile
-func (d *Dockerfile) Convert(ctx context.Context, opts Options) (*Dockerfile, error) {
+// splitDirective splits an instruction into its directive, uppercased, and its arguments. Any whitespace may
+// follow the directive (e.g. "FROM\tnode:18" or "RUN   apt-get ..."), an instruction without arguments
+// has no directive.
+func splitDirective(instruction string) (directive, args string) {
+	directive, args, found := cutWhitespace(strings.TrimSpace(instruction))
+	if !found {
+		return "", ""
+	}
+	return strings.ToUpper(directive), args
+}
+
+// resolveMappings returns the mappings used to convert with opts: the built-in mappings (unless NoBuiltIn is set)
+// merged with ExtraMappings, with the mappings of the target catalog applied
+func resolveMappings(ctx context.Context, opts Options) (MappingsConfig, error) {
 	// Initialize mappings
 	var mappings MappingsConfig
 
 	// Handle mappings based on options
 	if !opts.NoBuiltIn {
 		// Load the default mappings (unless NoBuiltIn is true)
-		defaultMappings, err := defaultGetDefaultMappings(ctx, opts.Update)
+		defaultMappings, err := defaultGetDefaultMappings(ctx, opts.Update, opts.Offline)
 		if err != nil {
-			return nil, fmt.Errorf("loading default mappings: %w", err)
+			return MappingsConfig{}, fmt.Errorf("loading default mappings: %w", err)
 		}
 
 		// Use default mappings
 		mappings = defaultMappings
 
 		// Merge with the extra mappings if provided
-		if len(opts.ExtraMappings.Images) > 0 || len(opts.ExtraMappings.Packages) > 0 {
-			mappings = MergeMappings(defaultMappings, opts.ExtraMappings)
+		if len(opts.ExtraMappings.Images) > 0 || len(opts.ExtraMappings.Packages) > 0 || len(opts.ExtraMappings.Catalogs) > 0 || len(opts.ExtraMappings.Groups) > 0 {
+			if opts.ExtraMappingsPriority == ExtraMappingsFallback {
+				mappings = MergeMappings(opts.ExtraMappings, defaultMappings)
+			} else {
+				mappings = MergeMappings(defaultMappings, opts.ExtraMappings)
+			}
 		}
 	} else {
 		// NoBuiltIn is true, use only ExtraMappings if provided
@@ -554,18 +1183,47 @@ func (d *Dockerfile) Convert(ctx context.Context, opts Options) (*Dockerfile, er
 		}
 	}
 
+	// Apply the mappings of the target catalog, if any
+	return mappings.ForCatalog(opts.Catalog)
+}
+
+// Convert applies the conversion to the Dockerfile and returns a new converted Dockerfile
+func (d *Dockerfile) Convert(ctx context.Context, opts Options) (*Dockerfile, error) {
+	if opts.FromOnly && opts.PackagesOnly {
+		return nil, fmt.Errorf("FromOnly and PackagesOnly cannot be used together")
+	}
+	if opts.FailOnUnknownDirective {
+		if err := d.checkDirectives(); err != nil {
+			return nil, err
+		}
+	}
+
+	mappings, err := resolveMappings(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create a new Dockerfile for the converted content
 	converted := &Dockerfile{
-		Lines: make([]*DockerfileLine, len(d.Lines)),
+		Lines:  make([]*DockerfileLine, len(d.Lines)),
+		Escape: d.Escape,
+		CRLF:   d.CRLF,
 	}
 
 	// Track packages installed per stage
 	stagePackages := make(map[int][]string)
 
+	// Package mappings used for RUN conversion, including the package groups
+	packageMap := mappings.packageMapWithGroups()
+
 	// Track ARGs that are used as base images
 	argNameToDockerfileLine := make(map[string]*DockerfileLine)
 	argsUsedAsBase := make(map[string]bool)
 
+	// Options used for FROM and ARG conversion, with the merged mappings
+	optsWithMappings := opts
+	optsWithMappings.ExtraMappings = mappings
+
 	// Track stages with RUN commands for determining if we need -dev suffix
 	stagesWithRunCommands := detectStagesWithRunCommands(d.Lines)
 
@@ -585,40 +1243,92 @@ func (d *Dockerfile) Convert(ctx context.Context, opts Options) (*Dockerfile, er
 			newLine.From = copyFromDetails(line.From)
 
 			// Apply FROM line conversion only for non-dynamic bases
-			if shouldConvertFromLine(line.From) {
-				// Use the merged mappings for conversion
-				optsWithMappings := Options{
-					Organization:      opts.Organization,
-					Registry:          opts.Registry,
-					ExtraMappings:     mappings,
-					FromLineConverter: opts.FromLineConverter,
-					RunLineConverter:  opts.RunLineConverter,
+			if !opts.PackagesOnly && shouldConvertFromLine(line.From) {
+				from := line.From
+				if opts.ResolveTagDefaults && from.TagDynamic {
+					if tag, ok := resolveTagDefaults(from.Tag, argNameToDockerfileLine); ok {
+						from = copyFromDetails(from)
+						from.Tag = tag
+						from.TagDynamic = false
+					}
 				}
-				newLine.Converted = convertFromLine(line.From, line.Stage, stagesWithRunCommands, optsWithMappings)
+				newLine.Converted = convertFromLine(ctx, from, line.Stage, stagesWithRunCommands, optsWithMappings)
 			}
 		}
 
-		// Handle ARG lines that are used as base images
-		if line.Arg != nil && line.Arg.UsedAsBase && line.Arg.DefaultValue != "" {
-			// Use the merged mappings for conversion
-			optsWithMappings := Options{
-				Organization:      opts.Organization,
-				Registry:          opts.Registry,
-				ExtraMappings:     mappings,
-				FromLineConverter: opts.FromLineConverter,
-				RunLineConverter:  opts.RunLineConverter,
+		if line.User != nil {
+			userDetails := *line.User
+			newLine.User = &userDetails
+		}
+		if line.Workdir != nil {
+			workdirDetails := *line.Workdir
+			newLine.Workdir = &workdirDetails
+		}
+		if line.Cmd != nil {
+			newLine.Cmd = &CommandDetails{Exec: line.Cmd.Exec, Args: slices.Clone(line.Cmd.Args)}
+		}
+		if line.Entrypoint != nil {
+			newLine.Entrypoint = &CommandDetails{Exec: line.Entrypoint.Exec, Args: slices.Clone(line.Entrypoint.Args)}
+		}
+		if line.Labels != nil {
+			newLine.Labels = maps.Clone(line.Labels)
+		}
+
+		// Handle COPY lines that pull files from an external image
+		if line.Copy != nil {
+			copyDetails := *line.Copy
+			newLine.Copy = &copyDetails
+			if opts.ConvertCopyFrom && !opts.PackagesOnly && line.Copy.FromImage != "" {
+				newLine.Converted = convertCopyLine(ctx, line, optsWithMappings)
+			}
+			if _, err := strconv.Atoi(line.Copy.From); err == nil && line.Copy.FromStage == 0 {
+				newLine.Diagnostics = append(newLine.Diagnostics, fmt.Sprintf("COPY --from=%s refers to stage index %s, which is not an earlier stage of this Dockerfile", line.Copy.From, line.Copy.From))
 			}
+		}
+
+		// Handle ARG lines that are used as base images
+		if line.Arg != nil && line.Arg.UsedAsBase && line.Arg.DefaultValue != "" && !opts.PackagesOnly {
 			argLine, argDetails := convertArgLine(line.Arg, d.Lines, stagesWithRunCommands, optsWithMappings)
 			newLine.Converted = argLine
 			newLine.Arg = argDetails
 		}
 
-		// Process RUN commands
-		if line.Run != nil && line.Run.Shell != nil && line.Run.Shell.Before != nil {
-			err := processRunLineWithConverter(ctx, newLine, line, stagePackages, mappings.Packages, opts.RunLineConverter, opts.Strict, opts.WarnMissingPackages)
+		// Keep RUN commands as they are when only base images are converted. Package installs are
+		// marked as converted to themselves, so that they still run as root in the Chainguard Image.
+		if opts.FromOnly && line.Run != nil && line.Run.Shell != nil && line.Run.Shell.Before != nil {
+			newLine.Run = &RunDetails{
+				Heredoc:          line.Run.Heredoc,
+				Flags:            slices.Clone(line.Run.Flags),
+				Shell:            &RunDetailsShell{Before: line.Run.Shell.Before},
+				LanguageManagers: slices.Clone(line.Run.LanguageManagers),
+			}
+			newLine.Run.Distro, newLine.Run.Manager = installManager(line.Run.Shell.Before)
+			if newLine.Run.Manager != "" {
+				newLine.Converted = line.Raw
+			}
+		} else if line.Run != nil && line.Run.Shell != nil && line.Run.Shell.Before != nil {
+			err := processRunLineWithConverter(ctx, newLine, line, stagePackages, packageMap, apkAddFlags(opts), opts.RunLineConverter, opts.Strict, opts.WarnMissingPackages, opts.IndentStyle)
 			if err != nil {
 				return nil, err
 			}
+
+			// Converted shell commands are emitted with backslash continuations
+			if d.Escape != "" && newLine.Converted != "" {
+				newLine.Converted = replaceLineContinuations(newLine.Converted, DefaultEscapeChar, d.Escape)
+			}
+
+			// The converted command is rebuilt without the comments between its lines,
+			// so keep them right above it instead
+			if newLine.Converted != "" && line.Run.Heredoc == nil {
+				newLine.Converted = instructionComments(line.Raw) + newLine.Converted
+				if comments := continuedLineComments(line.Raw); len(comments) > 0 {
+					newLine.Diagnostics = append(newLine.Diagnostics, fmt.Sprintf("RUN has a comment on a continued line (%s), the shell ignores the rest of the command after it, the comment was moved above the converted RUN directive and the following lines were kept as part of the command", strings.Join(comments, ", ")))
+				}
+			}
+
+			if opts.AnnotatePackages && newLine.Converted != "" {
+				newLine.Converted = packageMappingComments(newLine.Run, packageMap) + newLine.Converted
+			}
 		}
 
 		// Add the converted line to the result
@@ -627,6 +1337,21 @@ func (d *Dockerfile) Convert(ctx context.Context, opts Options) (*Dockerfile, er
 
 	// Second pass: add USER root directives where needed
 	addUserRootDirectives(converted.Lines)
+	addNumericUserDiagnostics(converted.Lines)
+	addScriptDependencyDiagnostics(converted.Lines, opts.FromOnly)
+	addRemoteExecDiagnostics(converted.Lines)
+	if opts.AnnotateOriginal {
+		addOriginalLineComments(converted.Lines)
+	}
+	if opts.AddProvenanceLabel {
+		addProvenanceLabel(converted.Lines)
+	}
+
+	// Surface anything that could not be converted automatically
+	log := clog.FromContext(ctx)
+	for _, diagnostic := range converted.Diagnostics() {
+		log.Warn(diagnostic.Message, "line", diagnostic.Line)
+	}
 
 	return converted, nil
 }
@@ -636,7 +1361,7 @@ func detectStagesWithRunCommands(lines []*DockerfileLine) map[int]bool {
 	stagesWithRunCommands := make(map[int]bool)
 
 	for _, line := range lines {
-		if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(line.Raw)), DirectiveRun+" ") {
+		if directive, _ := splitDirective(line.Raw); directive == DirectiveRun {
 			stagesWithRunCommands[line.Stage] = true
 		}
 	}
@@ -651,15 +1376,10 @@ func identifyArgsUsedAsBaseImages(lines []*DockerfileLine, argNameToLine map[str
 			argNameToLine[line.Arg.Name] = line
 		}
 
-		if line.From != nil && line.From.BaseDynamic {
-			// Check if the base contains a reference to an ARG
-			baseName := line.From.Base
-			if strings.HasPrefix(baseName, "$") {
-				// Handle both ${VAR} and $VAR formats
-				argName := baseName[1:] // Remove the '$'
-				if strings.HasPrefix(argName, "{") && strings.HasSuffix(argName, "}") {
-					argName = argName[1 : len(argName)-1] // Remove the '{}' brackets
-				}
+		// An ARG that refers to a stage (e.g. FROM ${BUILD_STAGE}) is not a base image
+		if line.From != nil && line.From.BaseDynamic && line.From.Parent == 0 {
+			// Check if the base is a reference to an ARG
+			if argName, _, ok := argReference(line.From.Base); ok {
 				argsUsedAsBase[argName] = true
 			}
 		}
@@ -673,6 +1393,25 @@ func identifyArgsUsedAsBaseImages(lines []*DockerfileLine, argNameToLine map[str
 	}
 }
 
+// argReference returns the name of the ARG that s refers to if s is only a reference to an ARG,
+// i.e. $NAME, ${NAME} or ${NAME:-default}, along with the default value given in the reference
+func argReference(s string) (name, defaultValue string, ok bool) {
+	name, ok = strings.CutPrefix(s, "$")
+	if !ok {
+		return "", "", false
+	}
+	if inner, braced := strings.CutPrefix(name, "{"); braced {
+		if name, ok = strings.CutSuffix(inner, "}"); !ok {
+			return "", "", false
+		}
+		name, defaultValue, _ = strings.Cut(name, ":-")
+	}
+	if name == "" || strings.ContainsFunc(name, isNotVariableNameChar) {
+		return "", "", false
+	}
+	return name, defaultValue, true
+}
+
 // copyFromDetails creates a deep copy of FromDetails
 func copyFromDetails(from *FromDetails) *FromDetails {
 	return &FromDetails{
@@ -685,15 +1424,58 @@ func copyFromDetails(from *FromDetails) *FromDetails {
 		TagDynamic:  from.TagDynamic,
 		Orig:        from.Orig,
 		Platform:    from.Platform,
+		IsScratch:   from.IsScratch,
 	}
 }
 
 // convertFromLine handles converting a FROM line
-func convertFromLine(from *FromDetails, stage int, stagesWithRunCommands map[int]bool, opts Options) string {
-	// First, always do the default Chainguard conversion
-	// Determine if we need the -dev suffix
-	needsDevSuffix := stagesWithRunCommands[stage]
+func convertFromLine(ctx context.Context, from *FromDetails, stage int, stagesWithRunCommands map[int]bool, opts Options) string {
+	fromLine := DirectiveFrom
+	if from.Platform != "" {
+		fromLine += " --platform=" + from.Platform
+	}
+	fromLine += " " + convertImageReference(ctx, from, stagesWithRunCommands[stage], opts)
+	if from.Alias != "" {
+		fromLine += " " + KeywordAs + " " + from.Alias
+	}
+
+	return fromLine
+}
+
+// convertCopyLine handles converting a COPY line whose --from flag references an external image
+func convertCopyLine(ctx context.Context, line *DockerfileLine, opts Options) string {
+	base, tag, digest := splitImageReference(line.Copy.FromImage)
+	from := &FromDetails{
+		Base:   base,
+		Tag:    tag,
+		Digest: digest,
+		Orig:   line.Copy.FromImage,
+	}
 
+	// Files are only copied out of the image, so the -dev variant is never needed
+	imageRef := convertImageReference(ctx, from, false, opts)
+	return strings.Replace(line.Raw, "--from="+line.Copy.From, "--from="+imageRef, 1)
+}
+
+// convertImageReference returns the Chainguard image reference to use in place of the given image
+func convertImageReference(ctx context.Context, from *FromDetails, needsDevSuffix bool, opts Options) string {
+	if opts.NoDevSuffix {
+		needsDevSuffix = false
+	}
+
+	// An image that is already a Chainguard image is only moved to the configured registry and org
+	if rehomedRef, ok := rehomeChainguardReference(from.Base, from.Tag, from.Digest, needsDevSuffix, opts); ok {
+		if opts.FromLineConverter != nil {
+			customImageRef, err := opts.FromLineConverter(from, rehomedRef, needsDevSuffix)
+			if err != nil {
+				return from.Orig
+			}
+			return customImageRef
+		}
+		return rehomedRef
+	}
+
+	// First, always do the default Chainguard conversion
 	// Get the converted base without tag
 	base := from.Base
 	tag := from.Tag
@@ -705,87 +1487,20 @@ func convertFromLine(from *FromDetails, stage int, stagesWithRunCommands map[int
 	targetImage := baseFilename
 	var convertedTag string
 
-	// Check for exact match first, in specific order
-	// For example, if the mapping is just node, it should match all of the following:
-	// FROM registry-1.docker.io/library/node
-	// FROM docker.io/node
-	// FROM docker.io/library/node
-	// FROM index.docker.io/node
-	// FROM index.docker.io/library/node
-	//
-	// If the mapping is someorg/somerepo, it should match all of the following:
-	// FROM registry-1.docker.io/someorg/somerepo
-	// FROM docker.io/someorg/somerepo
-	// FROM index.docker.io/someorg/somerepo
-	var mappedImage string
-
-	// First check for exact match with full image reference including tag
-	fullImageRef := base
-	if tag != "" {
-		fullImageRef += ":" + tag
-	}
-	if img, ok := opts.ExtraMappings.Images[fullImageRef]; ok {
-		mappedImage = img
-	} else if img, ok := opts.ExtraMappings.Images[base]; ok {
-		mappedImage = img
-	} else if img, ok := opts.ExtraMappings.Images[baseFilename]; ok {
-		mappedImage = img
-	} else {
-		// Generate all possible variants for the base image
-		baseVariants := generateDockerHubVariants(base)
-
-		// Check if any variant matches a key in the mappings
-		for _, variant := range baseVariants {
-			if img, ok := opts.ExtraMappings.Images[variant]; ok {
-				mappedImage = img
-				break
-			}
-		}
-
-		// If still no match, try to normalize the base and check against simple keys
-		if mappedImage == "" {
-			normalizedBase := normalizeImageName(base)
-
-			// Check if the normalized base matches any key
-			if img, ok := opts.ExtraMappings.Images[normalizedBase]; ok {
-				mappedImage = img
-			} else if strings.HasPrefix(normalizedBase, "library/") {
-				// Try removing library/ prefix if it exists
-				simpleBase := strings.TrimPrefix(normalizedBase, "library/")
-				if img, ok := opts.ExtraMappings.Images[simpleBase]; ok {
-					mappedImage = img
-				}
-			}
-		}
-
-		// If still no match, check for glob patterns with asterisks
-		if mappedImage == "" {
-			for pattern, img := range opts.ExtraMappings.Images {
-				if strings.HasSuffix(pattern, "*") {
-					prefix := strings.TrimSuffix(pattern, "*")
-					if strings.HasPrefix(baseFilename, prefix) {
-						mappedImage = img
-						break
-					}
-				}
-			}
-		}
+	mappedImage, kind, key := lookupImageMapping(opts.ExtraMappings.Images, base, tag, !opts.DisableWildcardImageMatch)
+	if kind != MatchKindNone {
+		clog.FromContext(ctx).Debug("Image mapping matched", "image", from.Orig, "target", mappedImage, "match", kind, "key", key)
 	}
 
 	// Process the mapped image if found
 	if mappedImage != "" {
 		// Check if the mapped image includes a tag
-		if parts := strings.Split(mappedImage, ":"); len(parts) > 1 {
-			targetImage = parts[0]
-			convertedTag = parts[1]
-		} else {
-			targetImage = mappedImage
-		}
+		targetImage, convertedTag = splitImageTag(mappedImage)
 	}
 
 	// If targetTag is not specified in mapping, calculate it using the existing logic
 	if convertedTag == "" {
-		convertedTag = calculateConvertedTag(targetImage, tag, from.TagDynamic, needsDevSuffix)
+		convertedTag = calculateConvertedTag(tag, from.TagDynamic, needsDevSuffix, tagRule(targetImage, opts))
 	}
 
 	// Build the image reference
@@ -793,49 +1508,22 @@ func convertFromLine(from *FromDetails, stage int, stagesWithRunCommands map[int
 
 	// Now, if a custom converter is provided, let it process the result
 	if opts.FromLineConverter != nil {
-		customImageRef, err := opts.FromLineConverter(from, chainguardImageRef, stagesWithRunCommands[stage])
+		customImageRef, err := opts.FromLineConverter(from, chainguardImageRef, needsDevSuffix)
 		if err != nil {
-			// If an error occurs, still return a valid FROM line using the original image
-			fromLine := DirectiveFrom
-			if from.Platform != "" {
-				fromLine += " --platform=" + from.Platform
-			}
-			fromLine += " " + from.Orig
-			if from.Alias != "" {
-				fromLine += " " + KeywordAs + " " + from.Alias
-			}
-			return fromLine
-		}
-
-		// Create the converted FROM line with the custom image
-		fromLine := DirectiveFrom
-		if from.Platform != "" {
-			fromLine += " --platform=" + from.Platform
+			// If an error occurs, still return a valid reference using the original image
+			return from.Orig
 		}
-		fromLine += " " + customImageRef
-		if from.Alias != "" {
-			fromLine += " " + KeywordAs + " " + from.Alias
-		}
-		return fromLine
+		return customImageRef
 	}
 
 	// If no custom converter, use the Chainguard converted reference
-	fromLine := DirectiveFrom
-	if from.Platform != "" {
-		fromLine += " --platform=" + from.Platform
-	}
-	fromLine += " " + chainguardImageRef
-	if from.Alias != "" {
-		fromLine += " " + KeywordAs + " " + from.Alias
-	}
-
-	return fromLine
+	return chainguardImageRef
 }
 
 // convertArgLine handles converting an ARG line used as base image
 func convertArgLine(arg *ArgDetails, lines []*DockerfileLine, stagesWithRunCommands map[int]bool, opts Options) (string, *ArgDetails) {
 	// Create a FromDetails structure from the ARG default value
-	base, tag := parseImageReference(arg.DefaultValue)
+	base, tag := splitImageTag(arg.DefaultValue)
 
 	// Create a FromDetails to represent this ARG value as a FROM line
 	fromDetails := &FromDetails{
@@ -845,7 +1533,7 @@ func convertArgLine(arg *ArgDetails, lines []*DockerfileLine, stagesWithRunComma
 	}
 
 	// Determine if we need the -dev suffix
-	needsDevSuffix := determineIfArgNeedsDevSuffix(arg.Name, lines, stagesWithRunCommands)
+	needsDevSuffix := !opts.NoDevSuffix && determineIfArgNeedsDevSuffix(arg.Name, lines, stagesWithRunCommands)
 
 	// First perform the default Chainguard conversion
 	// Calculate default image reference using common approach
@@ -855,41 +1543,22 @@ func convertArgLine(arg *ArgDetails, lines []*DockerfileLine, stagesWithRunComma
 	targetImage := baseFilename
 	var convertedTag string
 
-	// Check for exact match first
-	if mappedImage, ok := opts.ExtraMappings.Images[baseFilename]; ok {
+	// Check for the full image reference first, e.g. a private registry image without a tag
+	if mappedImage, _, _ := lookupImageMapping(opts.ExtraMappings.Images, base, tag, !opts.DisableWildcardImageMatch); mappedImage != "" {
 		// Check if the mapped image includes a tag
-		if parts := strings.Split(mappedImage, ":"); len(parts) > 1 {
-			targetImage = parts[0]
-			convertedTag = parts[1]
-		} else {
-			targetImage = mappedImage
-		}
-	} else {
-		// No exact match, check for glob patterns with asterisks
-		for pattern, mappedImage := range opts.ExtraMappings.Images {
-			if strings.HasSuffix(pattern, "*") {
-				prefix := strings.TrimSuffix(pattern, "*")
-				if strings.HasPrefix(baseFilename, prefix) {
-					// Found a match with a glob pattern
-					if parts := strings.Split(mappedImage, ":"); len(parts) > 1 {
-						targetImage = parts[0]
-						convertedTag = parts[1]
-					} else {
-						targetImage = mappedImage
-					}
-					break
-				}
-			}
-		}
+		targetImage, convertedTag = splitImageTag(mappedImage)
 	}
 
 	// If targetTag is not specified in mapping, calculate it using the existing logic
 	if convertedTag == "" {
-		convertedTag = calculateConvertedTag(targetImage, tag, false, needsDevSuffix)
+		convertedTag = calculateConvertedTag(tag, false, needsDevSuffix, tagRule(targetImage, opts))
 	}
 
-	// Build the image reference
+	// Build the image reference, an image that is already a Chainguard image keeps its tag
 	chainguardImageRef := buildImageReference(targetImage, convertedTag, opts)
+	if rehomedRef, ok := rehomeChainguardReference(base, tag, "", needsDevSuffix, opts); ok {
+		chainguardImageRef = rehomedRef
+	}
 
 	// Get the converted image reference
 	var finalImageRef string
@@ -933,13 +1602,13 @@ func determineIfArgNeedsDevSuffix(argName string, lines []*DockerfileLine, stage
 	return false
 }
 
-// calculateConvertedTag calculates the appropriate tag based on the base image and whether -dev is needed
-func calculateConvertedTag(baseFilename string, tag string, isDynamicTag bool, needsDevSuffix bool) string {
+// calculateConvertedTag calculates the appropriate tag based on the tag rule of the target image and whether -dev is needed
+func calculateConvertedTag(tag string, isDynamicTag bool, needsDevSuffix bool, rule TagRule) string {
 	var convertedTag string
 
-	// Special case for chainguard-base - always use latest
-	if baseFilename == DefaultChainguardBase {
-		return "latest" // Always use latest tag for chainguard-base, no -dev suffix ever
+	// Some images (e.g. chainguard-base) always use latest
+	if rule.ForceLatest {
+		return "latest" // No -dev suffix ever
 	}
 
 	// First process the tag normally (including semantic version truncation)
@@ -947,37 +1616,142 @@ func calculateConvertedTag(baseFilename string, tag string, isDynamicTag bool, n
 	case tag == "":
 		convertedTag = "latest"
 	case strings.Contains(tag, "$"):
-		// For dynamic tags, preserve the original tag
+		// For dynamic tags, preserve the variables but drop a variant suffix (e.g. ${VERSION}-slim)
+		convertedTag = trimDynamicTagVariant(tag)
+	case rule.PreserveOriginal:
 		convertedTag = tag
 	default:
 		// Convert the tag normally for static tags
 		convertedTag = convertImageTag(tag, isDynamicTag)
 	}
 
-	// Special case for JDK/JRE - prepend "openjdk-" to the tag unless it's "latest" or "latest-dev"
-	if (baseFilename == "jdk" || baseFilename == "jre") && convertedTag != "latest" && convertedTag != "latest-dev" {
-		convertedTag = "openjdk-" + convertedTag
+	// Some images use a prefix on their version tags (e.g. openjdk- for JDK/JRE), but not on "latest" or "latest-dev"
+	if rule.Prefix != "" && convertedTag != "latest" && convertedTag != "latest-dev" && !strings.HasPrefix(convertedTag, rule.Prefix) {
+		convertedTag = rule.Prefix + convertedTag
+	}
+
+	// Add -dev suffix if needed
+	if needsDevSuffix && convertedTag != "latest" {
+		// Ensure we don't accidentally add -dev twice
+		if !strings.HasSuffix(convertedTag, "-dev") {
+			convertedTag += "-dev"
+		}
+	} else if needsDevSuffix && convertedTag == "latest" {
+		convertedTag = DefaultImageTag
+	}
+
+	return convertedTag
+}
+
+// trimDynamicTagVariant removes a literal variant suffix following the last variable of a
+// dynamic tag, e.g. "${VERSION}-slim" becomes "${VERSION}", since Chainguard Images have no such variants
+func trimDynamicTagVariant(tag string) string {
+	end := strings.LastIndex(tag, "}") + 1
+	if end == 0 {
+		// $VERSION form, the variable name ends at the first character that can't be part of it
+		start := strings.LastIndex(tag, "$") + 1
+		end = start + strings.IndexFunc(tag[start:], isNotVariableNameChar)
+		if end < start {
+			return tag
+		}
+	}
+	if strings.HasPrefix(tag[end:], "-") {
+		return tag[:end]
+	}
+	return tag
+}
+
+// rehomeChainguardReference returns the reference of an image that is already a Chainguard image
+// (e.g. cgr.dev/someorg/node:22) in the configured registry and org, keeping its tag and digest.
+// The -dev suffix is only added when needed, the digest is dropped then since it no longer matches the tag.
+// It returns false if the image is not a Chainguard image.
+func rehomeChainguardReference(base, tag, digest string, needsDevSuffix bool, opts Options) (string, bool) {
+	// The repository follows the org, e.g. "node" for cgr.dev/someorg/node
+	path, ok := strings.CutPrefix(base, DefaultRegistryDomain+"/")
+	if !ok {
+		return "", false
+	}
+	_, repository, ok := strings.Cut(path, "/")
+	if !ok || repository == "" || strings.Contains(base, "$") {
+		return "", false
+	}
+
+	if tag == "" {
+		tag = "latest"
+	}
+	// Some images (e.g. chainguard-base) have no -dev variant
+	if needsDevSuffix && !opts.NoDevSuffix && !strings.HasSuffix(tag, "-dev") && !tagRule(repository, opts).ForceLatest {
+		tag = calculateConvertedTag(tag, false, true, TagRule{PreserveOriginal: true})
+		digest = ""
 	}
 
-	// Add -dev suffix if needed
-	if needsDevSuffix && convertedTag != "latest" {
-		// Ensure we don't accidentally add -dev twice
-		if !strings.HasSuffix(convertedTag, "-dev") {
-			convertedTag += "-dev"
-		}
-	} else if needsDevSuffix && convertedTag == "latest" {
-		convertedTag = DefaultImageTag
+	ref := buildImageReference(repository, tag, opts)
+	if digest != "" {
+		ref += "@" + digest
 	}
+	return ref, true
+}
 
-	return convertedTag
+// resolveTagDefaults replaces the variables of a dynamic tag that have a default value, i.e. ${NAME:-default}
+// or ${NAME:=default}, with their default value, also when the default is itself such a variable
+// (e.g. ${TAG:-${BASE_TAG:-18}}). It returns false if the tag has any other variable, or a variable
+// that is declared by an ARG, since the default may then not be used (e.g. with --build-arg).
+func resolveTagDefaults(tag string, args map[string]*DockerfileLine) (string, bool) {
+	var builder strings.Builder
+	for {
+		start := strings.Index(tag, "$")
+		if start == -1 {
+			builder.WriteString(tag)
+			return builder.String(), true
+		}
+		builder.WriteString(tag[:start])
+
+		// Find the closing brace, the default value may contain other variables
+		if !strings.HasPrefix(tag[start:], "${") {
+			return "", false
+		}
+		end, depth := -1, 0
+		for i := start; i < len(tag) && end == -1; i++ {
+			switch {
+			case strings.HasPrefix(tag[i:], "${"):
+				depth++
+				i++
+			case tag[i] == '}':
+				if depth--; depth == 0 {
+					end = i
+				}
+			}
+		}
+		if end == -1 {
+			return "", false
+		}
+
+		expression := tag[start+2 : end]
+		i := strings.IndexFunc(expression, isNotVariableNameChar)
+		if i <= 0 || (!strings.HasPrefix(expression[i:], ":-") && !strings.HasPrefix(expression[i:], ":=")) {
+			return "", false
+		}
+		if _, ok := args[expression[:i]]; ok {
+			return "", false
+		}
+		defaultValue, ok := resolveTagDefaults(expression[i+2:], args)
+		if !ok {
+			return "", false
+		}
+		builder.WriteString(defaultValue)
+		tag = tag[end+1:]
+	}
 }
 
 // buildImageReference builds the full image reference with registry, org, and tag
 func buildImageReference(baseFilename string, tag string, opts Options) string {
 	var newBase string
 
-	// If registry is specified, use registry/basename
-	if opts.Registry != "" {
+	// A per-image registry takes precedence over the global registry and org
+	if registry, ok := opts.RegistryMap[baseFilename]; ok && registry != "" {
+		newBase = strings.TrimSuffix(registry, "/") + "/" + baseFilename
+	} else if opts.Registry != "" {
+		// If registry is specified, use registry/basename
 		newBase = opts.Registry + "/" + baseFilename
 	} else {
 		// Otherwise use DefaultRegistryDomain/org/basename
@@ -996,22 +1770,30 @@ func buildImageReference(baseFilename string, tag string, opts Options) string {
 }
 
 // processRunLineWithConverter handles the conversion of RUN lines but supports a RunLineConverter.
-func processRunLineWithConverter(ctx context.Context, newLine *DockerfileLine, line *DockerfileLine, stagePackages map[int][]string, packageMap PackageMap, runLineConverter RunLineConverter, strict bool, warnMissingPackages bool) error {
+func processRunLineWithConverter(ctx context.Context, newLine *DockerfileLine, line *DockerfileLine, stagePackages map[int][]string, packageMap PackageMap, apkFlags []string, runLineConverter RunLineConverter, strict bool, warnMissingPackages bool, indent string) error {
 	beforeShell := line.Run.Shell.Before
 
+	if indent == "" {
+		indent = defaultIndent
+	}
+
 	// Initialize RunDetails with Before shell
 	newLine.Run = &RunDetails{
+		Heredoc: line.Run.Heredoc,
+		Flags:   slices.Clone(line.Run.Flags),
 		Shell: &RunDetailsShell{
 			Before: beforeShell,
 		},
+		LanguageManagers: slices.Clone(line.Run.LanguageManagers),
 	}
 
 	// First check for package manager commands
-	modifiedPMCommands, distro, manager, packages, mappedPackages, afterShell, err :=
-		convertPackageManagerCommands(ctx, beforeShell, packageMap, strict, warnMissingPackages)
+	modifiedPMCommands, distro, manager, packages, mappedPackages, afterShell, diagnostics, err :=
+		convertPackageManagerCommands(ctx, beforeShell, packageMap, apkFlags, strict, warnMissingPackages)
 	if err != nil {
 		return err
 	}
+	newLine.Diagnostics = append(newLine.Diagnostics, diagnostics...)
 	newLine.Run.Distro = distro
 	newLine.Run.Manager = manager
 	newLine.Run.Packages = packages
@@ -1034,22 +1816,24 @@ func processRunLineWithConverter(ctx context.Context, newLine *DockerfileLine, l
 	if modifiedAnything {
 		newLine.Run.Shell.After = afterShell
 
-		// Extract the original RUN directive from the raw line to preserve case
-		rawLine := line.Raw
-		upperRawLine := strings.ToUpper(rawLine)
+		// Keep the case of the original RUN directive, the whitespace after it becomes a single space
+		runDirective := DirectiveRun
+		if rawLine := strings.TrimLeftFunc(line.Raw, unicode.IsSpace); len(rawLine) >= len(DirectiveRun) && strings.EqualFold(rawLine[:len(DirectiveRun)], DirectiveRun) {
+			runDirective = rawLine[:len(DirectiveRun)]
+		}
 
-		// Find the position of the case-insensitive "RUN " directive
-		runPrefix := DirectiveRun + " "
-		runIndex := strings.Index(upperRawLine, runPrefix)
+		// Re-emit any flags (e.g. --mount=...) before the command
+		var flagsPrefix string
+		if len(line.Run.Flags) > 0 {
+			flagsPrefix = strings.Join(line.Run.Flags, " ") + " "
+		}
 
 		var defaultConverted string
-		if runIndex != -1 {
-			// Get the original case of the RUN directive
-			originalRunDirective := rawLine[runIndex : runIndex+len(runPrefix)]
-			defaultConverted = originalRunDirective + afterShell.String()
+		if line.Run.Heredoc != nil {
+			// Preserve the heredoc form, only the script body is rewritten
+			defaultConverted = line.Run.Heredoc.String(afterShell)
 		} else {
-			// Fallback if we can't find the directive (shouldn't happen)
-			defaultConverted = DirectiveRun + " " + afterShell.String()
+			defaultConverted = runDirective + " " + flagsPrefix + afterShell.StringWithIndent(indent)
 		}
 
 		if runLineConverter != nil {
@@ -1065,38 +1849,171 @@ func processRunLineWithConverter(ctx context.Context, newLine *DockerfileLine, l
 	return nil
 }
 
+// splitRunFlags splits the flags at the start of a RUN command (e.g. --mount=..., --network=...
+// or --security=...) from the shell command that follows them
+func splitRunFlags(cmdPart string) ([]string, string) {
+	var flags []string
+	rest := cmdPart
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if after, ok := strings.CutPrefix(rest, "\\\n"); ok {
+			// Line continuation between flags
+			rest = after
+			continue
+		}
+		if !strings.HasPrefix(rest, "--") {
+			return flags, rest
+		}
+
+		// The flag ends at the first whitespace outside of quotes
+		end := len(rest)
+		var quote byte
+		for i := 0; i < len(rest); i++ {
+			c := rest[i]
+			if quote != 0 {
+				if c == quote {
+					quote = 0
+				}
+				continue
+			}
+			if c == '"' || c == '\'' {
+				quote = c
+				continue
+			}
+			if c == ' ' || c == '\t' || c == '\n' {
+				end = i
+				break
+			}
+		}
+		flags = append(flags, rest[:end])
+		rest = rest[end:]
+	}
+}
+
+// packageMappingComments returns a comment line for each package of a converted RUN line
+// that was mapped to a different package name, e.g. "# mapped package: build-essential -> build-base"
+func packageMappingComments(run *RunDetails, packageMap PackageMap) string {
+	if run == nil || run.Manager == "" {
+		return ""
+	}
+
+	var builder strings.Builder
+	for _, pkg := range run.Packages {
+		spec := parsePackageSpec(run.Manager, pkg)
+		targets := packageMap[run.Distro][spec.Name]
+		if targets == nil || slices.Equal(targets, []string{spec.Name}) {
+			continue // Passed through as-is
+		}
+		builder.WriteString(fmt.Sprintf("# mapped package: %s -> %s\n", spec.Name, strings.Join(targets, ", ")))
+	}
+	return builder.String()
+}
+
+// Keys of the LABEL added to the final stage with Options.AddProvenanceLabel
+const (
+	ProvenanceLabelConverted = "dev.chainguard.dfc.converted"
+	ProvenanceLabelVersion   = "dev.chainguard.dfc.version"
+)
+
+// addProvenanceLabel adds a LABEL after the FROM line of the final stage, recording that the Dockerfile
+// was converted and the dfc version. Nothing is added if the final stage already has the label
+// (from an earlier conversion).
+func addProvenanceLabel(lines []*DockerfileLine) {
+	var from *DockerfileLine
+	for _, line := range lines {
+		if line.From != nil {
+			from = line
+		}
+	}
+	if from == nil {
+		return
+	}
+	for _, line := range lines {
+		if line.Stage == from.Stage && line.Labels[ProvenanceLabelConverted] != "" {
+			return
+		}
+	}
+
+	label := fmt.Sprintf("%s %s=%q %s=%q", DirectiveLabel, ProvenanceLabelConverted, "true", ProvenanceLabelVersion, Version())
+	if from.Converted == "" {
+		from.Converted = from.Raw
+	}
+	from.Converted += "\n" + label
+}
+
+// OriginalLineCommentPrefix starts the comments added above converted lines with Options.AnnotateOriginal
+const OriginalLineCommentPrefix = "# dfc: was: "
+
+// addOriginalLineComments adds a comment with the original line above each converted FROM, RUN and ARG line.
+// Lines converted again replace the comments of an earlier conversion right above them, so comments don't
+// stack up, while lines that are already converted keep them.
+func addOriginalLineComments(lines []*DockerfileLine) {
+	for _, line := range lines {
+		if line.From == nil && line.Run == nil && line.Arg == nil {
+			continue
+		}
+		if line.Converted == "" || convertedDirective(line) == line.Raw {
+			continue
+		}
+		// RUN lines kept as they are (e.g. with FromOnly) may only have USER directives around them
+		if line.Run != nil && line.Run.Shell != nil && line.Run.Shell.After == nil {
+			continue
+		}
+		line.Extra = withoutOriginalLineComments(line.Extra)
+
+		var builder strings.Builder
+		for _, raw := range strings.Split(line.Raw, "\n") {
+			builder.WriteString(OriginalLineCommentPrefix + raw + "\n")
+		}
+		line.Converted = builder.String() + line.Converted
+	}
+}
+
+// withoutOriginalLineComments removes the comments added by addOriginalLineComments at the end of
+// the comments and whitespace before a line, i.e. right above it
+func withoutOriginalLineComments(extra string) string {
+	lines := strings.SplitAfter(strings.TrimSuffix(extra, "\n"), "\n")
+	end := len(lines)
+	for end > 0 && strings.HasPrefix(lines[end-1], OriginalLineCommentPrefix) {
+		end--
+	}
+	if end == len(lines) {
+		return extra
+	}
+	return strings.Join(lines[:end], "")
+}
+
+// convertedDirective returns the converted directive of a line, without the comments added above it
+// or the USER directive added after a FROM line
+func convertedDirective(line *DockerfileLine) string {
+	directive := line.Converted
+	for strings.HasPrefix(directive, "#") {
+		_, directive, _ = strings.Cut(directive, "\n")
+	}
+	if line.From != nil {
+		directive = strings.TrimSuffix(directive, "\n"+DirectiveUser+" "+DefaultUser)
+	}
+	return directive
+}
+
 // addUserRootDirectives adds USER root directives where needed
 func addUserRootDirectives(lines []*DockerfileLine) {
 	// First determine which stages have converted RUN lines
 	stagesWithConvertedRuns := make(map[int]bool)
-	// Also keep track of stages that already have USER root directives
-	stagesWithUserRoot := make(map[int]bool)
+	// Also keep track of stages that already set a USER before their first converted RUN line,
+	// those are handled below
+	stagesWithUser := make(map[int]bool)
 
-	// First pass - identify stages with converted RUN lines and existing USER root directives
+	// First pass - identify stages with converted RUN lines and existing USER directives
 	for _, line := range lines {
 		// Check if this is a converted RUN line with a package manager
-		if line.Run != nil && line.Converted != "" && line.Run.Manager != "" {
+		if isConvertedInstall(line) {
 			stagesWithConvertedRuns[line.Stage] = true
 		}
 
-		// Check if this line is a USER directive with root
-		raw := line.Raw
-		converted := line.Converted
-
-		if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(raw)), DirectiveUser+" ") {
-			// Extract the user name after "USER "
-			userPart := strings.TrimSpace(raw[len(DirectiveUser)+1:])
-			if strings.ToLower(userPart) == DefaultUser {
-				stagesWithUserRoot[line.Stage] = true
-			}
-		}
-
-		if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(converted)), DirectiveUser+" ") {
-			// Extract the user name after "USER "
-			userPart := strings.TrimSpace(converted[len(DirectiveUser)+1:])
-			if strings.ToLower(userPart) == DefaultUser {
-				stagesWithUserRoot[line.Stage] = true
-			}
+		// Check if this line is a USER directive in effect for the first converted RUN line
+		if line.User != nil && !stagesWithConvertedRuns[line.Stage] {
+			stagesWithUser[line.Stage] = true
 		}
 	}
 
@@ -1105,12 +2022,12 @@ func addUserRootDirectives(lines []*DockerfileLine) {
 		for _, line := range lines {
 			// Check if this is a FROM line in a stage that has converted RUN lines
 			if line.From != nil && stagesWithConvertedRuns[line.Stage] {
-				// Skip parent stages (FROM base AS dependencies)
-				if line.From.Parent > 0 {
+				// Skip parent stages (FROM base AS dependencies), and scratch stages which have no user to switch from
+				if line.From.Parent > 0 || line.From.IsScratch {
 					continue
 				}
-				// If there's no USER root directive in this stage already
-				if !stagesWithUserRoot[line.Stage] {
+				// If no USER directive is in effect for the first converted RUN line yet
+				if !stagesWithUser[line.Stage] {
 					// Add a USER root directive after this FROM line
 					if line.Converted != "" {
 						line.Converted += "\n" + DirectiveUser + " " + DefaultUser
@@ -1118,17 +2035,87 @@ func addUserRootDirectives(lines []*DockerfileLine) {
 						line.Converted = line.Raw + "\n" + DirectiveUser + " " + DefaultUser
 					}
 					// Mark this stage as having a USER root directive
-					stagesWithUserRoot[line.Stage] = true
+					stagesWithUser[line.Stage] = true
 				}
 			}
 		}
 	}
+
+	// An explicit non-root USER before a converted install would make it run as that user,
+	// so switch to root just for the install and then back, unless the Dockerfile
+	// switches user itself right after the install
+	currentUser := ""
+	for i, line := range lines {
+		if line.From != nil {
+			currentUser = ""
+			continue
+		}
+		if line.User != nil {
+			currentUser = line.User.User
+			if line.User.Group != "" {
+				currentUser += ":" + line.User.Group
+			}
+			continue
+		}
+		if currentUser == "" || isRootUser(currentUser) || !isConvertedInstall(line) {
+			continue
+		}
+
+		line.Converted = DirectiveUser + " " + DefaultUser + "\n" + line.Converted
+		if next := i + 1; next >= len(lines) || lines[next].User == nil || lines[next].Stage != line.Stage {
+			line.Converted += "\n" + DirectiveUser + " " + currentUser
+		}
+	}
+}
+
+// isConvertedInstall checks if a line is a RUN directive whose package installs were converted
+func isConvertedInstall(line *DockerfileLine) bool {
+	return line.Run != nil && line.Converted != "" && line.Run.Manager != ""
+}
+
+// installManager returns the distro and package manager of the first package install in a shell command,
+// or empty values if it installs no packages
+func installManager(shell *ShellCommand) (Distro, Manager) {
+	for _, part := range shell.Parts {
+		pmInfo, ok := PackageManagerInfoMap[Manager(part.Command)]
+		if ok && findInstallKeyword(part.Args, pmInfo) != -1 {
+			return pmInfo.Distro, Manager(part.Command)
+		}
+	}
+	return "", ""
+}
+
+// isRootUser checks if a USER value refers to the root user
+func isRootUser(user string) bool {
+	user, _, _ = strings.Cut(user, ":")
+	return strings.ToLower(user) == DefaultUser || user == "0"
+}
+
+// addNumericUserDiagnostics warns about USER directives with a numeric UID that follow
+// converted package installs, since the UID may not exist in the Chainguard Image
+func addNumericUserDiagnostics(lines []*DockerfileLine) {
+	stagesWithConvertedRuns := make(map[int]bool)
+	for _, line := range lines {
+		if line.Run != nil && line.Converted != "" && line.Run.Manager != "" {
+			stagesWithConvertedRuns[line.Stage] = true
+			continue
+		}
+
+		if line.User == nil || !stagesWithConvertedRuns[line.Stage] {
+			continue
+		}
+		uid, err := strconv.Atoi(line.User.User)
+		if err != nil || uid == 0 {
+			continue
+		}
+		line.Diagnostics = append(line.Diagnostics, fmt.Sprintf("USER %s uses a numeric UID, Chainguard Images run as the nonroot user (UID 65532) by default and UID %d may not exist in the converted image, consider creating it or using USER nonroot", line.User.User, uid))
+	}
 }
 
 // shouldConvertFromLine determines if a FROM line should be converted
 func shouldConvertFromLine(from *FromDetails) bool {
 	// Skip conversion for scratch, parent stages, or dynamic bases
-	if from.Base == "scratch" || from.Parent > 0 || from.BaseDynamic {
+	if from.Base == "scratch" || from.IsScratch || from.Parent > 0 || from.BaseDynamic {
 		return false
 	}
 	return true
@@ -1181,11 +2168,179 @@ func convertImageTag(tag string, _ bool) string {
 	return tag
 }
 
+// apkAddFlags returns the flags placed between "apk add" and the packages
+func apkAddFlags(opts Options) []string {
+	flags := []string{ApkNoCacheFlag}
+	if opts.ApkStyle == ApkStyleUpdateIndex {
+		flags = []string{ApkUpdateIndexFlag}
+	}
+	if opts.ApkNoProgress {
+		flags = append(flags, ApkNoProgressFlag)
+	}
+	for _, repository := range opts.ApkRepositories {
+		flags = append(flags, ApkRepositoryFlag, repository)
+	}
+	return flags
+}
+
+// apkAddArgs builds the arguments for an apk add command
+func apkAddArgs(apkFlags []string, packages []string) []string {
+	args := make([]string, 0, 1+len(apkFlags)+len(packages))
+	args = append(args, SubcommandAdd)
+	args = append(args, apkFlags...)
+	return append(args, packages...)
+}
+
+// findInstallKeyword returns the index of the install keyword in the arguments of a package manager
+// command, or -1 if the command is not an install. The keyword is the subcommand, i.e. the first
+// argument that is neither a flag nor the value of a flag (e.g. apt-get -t bookworm-backports -y install).
+func findInstallKeyword(args []string, pmInfo PackageManagerInfo) int {
+	return findSubcommand(args, pmInfo, append([]string{pmInfo.InstallKeyword}, pmInfo.InstallAliases...))
+}
+
+// simulateFlag returns the flag that makes an install a dry run (e.g. apt-get -s install), or an empty
+// string if the arguments are not such an install
+func simulateFlag(args []string, pmInfo PackageManagerInfo) string {
+	if findInstallKeyword(args, pmInfo) < 0 {
+		return ""
+	}
+	for _, arg := range args {
+		if arg == "|" {
+			break
+		}
+		if slices.Contains(pmInfo.SimulateFlags, arg) {
+			return arg
+		}
+	}
+	return ""
+}
+
+// findSubcommand returns the index of the subcommand in the arguments of a package manager command
+// if it is one of subcommands, or -1 otherwise
+func findSubcommand(args []string, pmInfo PackageManagerInfo, subcommands []string) int {
+	skipNext := false
+	for i, arg := range args {
+		if skipNext {
+			skipNext = false
+			continue
+		}
+		if strings.HasPrefix(arg, "-") {
+			skipNext = slices.Contains(pmInfo.FlagsWithValue, arg)
+			continue
+		}
+		if slices.Contains(subcommands, arg) {
+			return i
+		}
+		// Tolerate the value of a flag we don't know about (e.g. --foo value install)
+		if i > 0 && strings.HasPrefix(args[i-1], "-") && !strings.Contains(args[i-1], "=") && !slices.Contains(pmInfo.FlagsWithValue, args[i-1]) {
+			continue
+		}
+		return -1
+	}
+	return -1
+}
+
+// apkVirtualName returns the virtual package name given to apk add with -t/--virtual, if any
+func apkVirtualName(args []string) string {
+	for i, arg := range args {
+		if (arg == "-t" || arg == ApkVirtualFlag) && i+1 < len(args) {
+			return args[i+1]
+		}
+		if name, ok := strings.CutPrefix(arg, ApkVirtualFlag+"="); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// commonVirtualName returns the virtual package name if all the names are the same and non-empty
+func commonVirtualName(names []string) string {
+	if len(names) == 0 || names[0] == "" {
+		return ""
+	}
+	for _, name := range names[1:] {
+		if name != names[0] {
+			return ""
+		}
+	}
+	return names[0]
+}
+
+// isApkVirtualDelete checks if a shell part only removes the given apk virtual package
+func isApkVirtualDelete(part *ShellPart, virtualName string) bool {
+	if Manager(part.Command) != ManagerApk {
+		return false
+	}
+	var names []string
+	for _, arg := range part.Args {
+		if !strings.HasPrefix(arg, "-") && arg != SubcommandDel {
+			names = append(names, arg)
+		}
+	}
+	return slices.Contains(part.Args, SubcommandDel) && slices.Equal(names, []string{virtualName})
+}
+
+// manualReviewPrefix starts the diagnostics of commands that dfc leaves as they are, which must be
+// reviewed manually
+const manualReviewPrefix = "manual review needed: "
+
+// manualReview returns a diagnostic for a command that dfc leaves as it is
+func manualReview(format string, args ...any) string {
+	return manualReviewPrefix + fmt.Sprintf(format, args...)
+}
+
+// unconvertibleInstallMessages returns the reasons why the package manager commands of a shell command
+// can't be converted, in which case the RUN directive is left unchanged rather than converted in part
+func unconvertibleInstallMessages(shell *ShellCommand) []string {
+	// Converting only part of a subshell or command group would break it
+	if manager := groupedPackageManager(shell); manager != "" {
+		return []string{manualReview("RUN was left unchanged since %s runs inside a subshell or command group", manager)}
+	}
+
+	// Installs from different branches of a conditional can't be combined
+	if manager := branchedPackageManager(shell); manager != "" {
+		return []string{manualReview("RUN was left unchanged since %s installs packages in more than one branch of a shell conditional or loop", manager)}
+	}
+
+	// A subcommand that can't be converted would otherwise be dropped
+	var messages []string
+	add := func(message string) {
+		if !slices.Contains(messages, message) {
+			messages = append(messages, message)
+		}
+	}
+	for _, part := range shell.Parts {
+		pmInfo := PackageManagerInfoMap[Manager(part.Command)]
+		if i := findSubcommand(part.Args, pmInfo, pmInfo.UnsupportedCommands); i >= 0 {
+			switch part.Args[i] {
+			case SubcommandDownload:
+				// Not an install, converting it to apk add would install the packages instead of fetching them
+				add(manualReview("RUN was left unchanged since %s %s only downloads package files, which apk fetch does", part.Command, part.Args[i]))
+			case SubcommandLocalInstall:
+				// The rpm files can't be installed with apk, and their names are not package names
+				add(manualReview("RUN was left unchanged since %s %s installs local rpm files, which apk can't install", part.Command, part.Args[i]))
+			default:
+				add(manualReview("RUN was left unchanged since %s %s has no Chainguard equivalent", part.Command, part.Args[i]))
+			}
+			continue
+		}
+		if flag := simulateFlag(part.Args, pmInfo); flag != "" {
+			add(manualReview("RUN was left unchanged since %s %s %s only simulates the install", part.Command, part.Args[findInstallKeyword(part.Args, pmInfo)], flag))
+		}
+	}
+	return messages
+}
+
 // convertPackageManagerCommands converts package manager commands in a shell command
 // to the Alpine equivalent (apk add)
-func convertPackageManagerCommands(ctx context.Context, shell *ShellCommand, packageMap PackageMap, strict bool, warnMissingPackages bool) (bool, Distro, Manager, []string, []string, *ShellCommand, error) {
+func convertPackageManagerCommands(ctx context.Context, shell *ShellCommand, packageMap PackageMap, apkFlags []string, strict bool, warnMissingPackages bool) (bool, Distro, Manager, []string, []string, *ShellCommand, []string, error) {
 	if shell == nil {
-		return false, "", "", nil, nil, nil, nil
+		return false, "", "", nil, nil, nil, nil, nil
+	}
+
+	// Leave the command untouched rather than converting only part of it
+	if messages := unconvertibleInstallMessages(shell); len(messages) > 0 {
+		return false, "", "", nil, nil, shell, messages, nil
 	}
 
 	// Determine which distro/package manager we're going to focus on
@@ -1196,6 +2351,19 @@ func convertPackageManagerCommands(ctx context.Context, shell *ShellCommand, pac
 	packagesToInstall := []string{}
 	hasPackageManager := false
 	hasNonPackageManagerCommands := false
+	var diagnostics []string
+
+	// Virtual package names (apk add --virtual) used by each apk install, "" for none
+	var virtualNames []string
+
+	// Whether the first install is run in the background (e.g. "apt-get install -y nginx &")
+	backgroundInstall := false
+
+	// The redirections of the first install (e.g. "> /tmp/install.log 2>&1"), if any
+	var redirections []string
+
+	// The pipeline the first install is part of (e.g. "| tee install.log"), if any
+	var pipeline []string
 
 	// Identify package manager and collect packages
 	for i, part := range shell.Parts {
@@ -1212,33 +2380,108 @@ func convertPackageManagerCommands(ctx context.Context, shell *ShellCommand, pac
 
 			// Only process install commands from the first package manager we encounter
 			if Manager(part.Command) == firstPM {
-				// Check if this is an install command by finding the install keyword
-				installKeywordIndex := -1
-				// Find the index of the install keyword in arguments
-				for j, arg := range part.Args {
-					if arg == pmInfo.InstallKeyword {
-						installKeywordIndex = j
-						break
-					}
-				}
+				// Check if this is an install command, flags may come before or after the install keyword
+				installKeywordIndex := findInstallKeyword(part.Args, pmInfo)
 
 				// If we found the install keyword, process the command
 				if installKeywordIndex >= 0 {
+					// The subcommand used, e.g. install or reinstall
+					installKeyword := part.Args[installKeywordIndex]
 					if firstPMInstallIndex == -1 {
 						firstPMInstallIndex = i
+						backgroundInstall = part.Delimiter == "&"
+					}
+					if part.Delimiter == "&" {
+						diagnostics = append(diagnostics, fmt.Sprintf("%s %s runs in the background with &, the build step may finish before the packages are installed, consider removing the &", part.Command, installKeyword))
+					}
+
+					// Flags working around dependency issues are dropped, but worth a review
+					var recoveryFlags []string
+					for _, arg := range part.Args {
+						if slices.Contains(pmInfo.RecoveryFlags, arg) {
+							recoveryFlags = append(recoveryFlags, arg)
+						}
+					}
+					if len(recoveryFlags) > 0 {
+						diagnostics = append(diagnostics, fmt.Sprintf("%s %s uses %s, which was dropped since apk resolves dependencies itself, the original build may have had dependency issues", part.Command, installKeyword, strings.Join(recoveryFlags, " ")))
+					}
+
+					if firstPM == ManagerApk {
+						virtualNames = append(virtualNames, apkVirtualName(part.Args[installKeywordIndex+1:]))
 					}
 
 					// Collect packages, applying mapping if available
 					// Start from after the install keyword
-					for _, arg := range part.Args[installKeywordIndex+1:] {
+					skipNext := false
+					installArgs := part.Args[installKeywordIndex+1:]
+					// The arguments after a pipe are the other commands in the pipeline, not packages
+					var installPipeline []string
+					if j := slices.Index(installArgs, "|"); j >= 0 {
+						installArgs, installPipeline = installArgs[:j], installArgs[j:]
+					}
+					// Output redirections are not packages, but are kept on the apk add command
+					installArgs, installRedirections := splitRedirections(installArgs)
+					if i == firstPMInstallIndex {
+						redirections = installRedirections
+						pipeline = installPipeline
+					}
+					for _, arg := range installArgs {
+						if skipNext {
+							// This is the value of the previous flag, not a package
+							skipNext = false
+							continue
+						}
+						if slices.Contains(pmInfo.FlagsWithValue, arg) {
+							skipNext = true
+							continue
+						}
+						if isCommandSubstitution(arg) {
+							// Packages come from a command we can't evaluate, keep it as-is
+							packagesToInstall = append(packagesToInstall, arg)
+							if file := substitutedFile(arg); file != "" {
+								diagnostics = append(diagnostics, manualReview("%s %s packages were not mapped since they are read from the file %s with %s", part.Command, installKeyword, file, arg))
+							} else {
+								diagnostics = append(diagnostics, manualReview("%s %s packages were not mapped since they come from the command substitution %s", part.Command, installKeyword, arg))
+							}
+							continue
+						}
+						if strings.HasPrefix(arg, "@") && distro == DistroFedora && packageMap[distro][arg] == nil {
+							// A package group has no single apk equivalent, don't install it under its own name
+							packagesDetected = append(packagesDetected, arg)
+							diagnostics = append(diagnostics, fmt.Sprintf("%s %s %s installs a package group that has no mapping, it was dropped and the packages it provides must be added manually, or mapped under groups in a mappings file", part.Command, installKeyword, arg))
+							continue
+						}
 						if !strings.HasPrefix(arg, "-") {
+							// A quoted package (e.g. "nginx=1.18.*") is mapped by its name and stays quoted
+							quote := ""
+							if len(arg) > 1 && (arg[0] == '"' || arg[0] == '\'') && arg[len(arg)-1] == arg[0] {
+								quote = arg[:1]
+								arg = arg[1 : len(arg)-1]
+							}
 							packagesDetected = append(packagesDetected, arg)
 							packageSpec := parsePackageSpec(firstPM, arg)
+							if packageSpec.Arch != "" {
+								diagnostics = append(diagnostics, fmt.Sprintf("%s %s %s requests the %s architecture, the qualifier was dropped since apk installs packages for the architecture of the image", part.Command, installKeyword, arg, packageSpec.Arch))
+							}
+							if packageSpec.Tag != "" {
+								diagnostics = append(diagnostics, fmt.Sprintf("%s %s %s pins %s to the @%s repository, the pin was dropped since the Chainguard package repository has no tagged repositories", part.Command, installKeyword, arg, packageSpec.Name, packageSpec.Tag))
+								packageSpec.Tag = ""
+							}
+							if strings.ContainsAny(packageSpec.Version, "*?[") {
+								diagnostics = append(diagnostics, fmt.Sprintf("%s %s %s pins %s to the version pattern %s, which apk cannot express, the version was dropped and must be pinned manually if needed", part.Command, installKeyword, arg, packageSpec.Name, packageSpec.Version))
+								packageSpec.Version = ""
+								packageSpec.Release = ""
+							}
 							packages, err := convertPackage(ctx, packageSpec, distro, packageMap, strict, warnMissingPackages)
 							if err != nil {
-								return false, "", "", nil, nil, nil, err
+								return false, "", "", nil, nil, nil, nil, err
+							}
+							if packageSpec.VersionFamily && packageSpec.Version != "" {
+								diagnostics = append(diagnostics, fmt.Sprintf("%s %s %s pins %s to the version family %s.*, which was converted to %s and matches any %s release", part.Command, installKeyword, arg, packageSpec.Name, packageSpec.Version, strings.Join(packages, " "), packageSpec.Version))
+							}
+							for _, pkg := range packages {
+								packagesToInstall = append(packagesToInstall, quote+pkg+quote)
 							}
-							packagesToInstall = append(packagesToInstall, packages...)
 						}
 					}
 				}
@@ -1246,12 +2489,17 @@ func convertPackageManagerCommands(ctx context.Context, shell *ShellCommand, pac
 		} else {
 			// This is not a package manager command
 			hasNonPackageManagerCommands = true
+
+			if isIndirectInstall(part) {
+				// The package manager is in a variable, which can't be resolved
+				diagnostics = append(diagnostics, manualReview("%s was not converted since it appears to install packages with a package manager stored in a variable", part.Command))
+			}
 		}
 	}
 
 	// If we don't have any package manager commands, return the original shell
 	if !hasPackageManager {
-		return false, distro, firstPM, nil, nil, shell, nil
+		return false, distro, firstPM, nil, nil, shell, diagnostics, nil
 	}
 
 	// Sort and deduplicate packages
@@ -1268,24 +2516,35 @@ func convertPackageManagerCommands(ctx context.Context, shell *ShellCommand, pac
 	// Clear the package list
 	packagesToInstall = []string{}
 
-	// Add packages back to the list in sorted order
+	// Add packages back to the list in sorted order, quoted packages are sorted by their name
 	for pkg := range packagesMap {
 		packagesToInstall = append(packagesToInstall, pkg)
 	}
-	slices.Sort(packagesToInstall)
+	slices.SortFunc(packagesToInstall, func(a, b string) int {
+		return cmp.Or(strings.Compare(strings.Trim(a, `"'`), strings.Trim(b, `"'`)), strings.Compare(a, b))
+	})
+
+	// Keep the virtual package if all apk installs use the same one, so that a
+	// later "apk del <name>" still removes exactly the packages installed here
+	virtualName := commonVirtualName(virtualNames)
+	if virtualName != "" {
+		apkFlags = append(slices.Clone(apkFlags), ApkVirtualFlag, virtualName)
+	}
 
 	// If we only have package manager commands and no non-PM commands,
 	// and we found packages to install, convert it to just an apk add command
 	if !hasNonPackageManagerCommands && len(packagesToInstall) > 0 {
-		// Return a simple apk add command
+		// Return a simple apk add command, kept in the background if the original install was
+		apkPart := &ShellPart{
+			Command: string(ManagerApk),
+			Args:    slices.Concat(apkAddArgs(apkFlags, packagesToInstall), redirections, pipeline),
+		}
+		if backgroundInstall {
+			apkPart.Delimiter = "&"
+		}
 		return true, distro, firstPM, packagesDetected, packagesToInstall, &ShellCommand{
-			Parts: []*ShellPart{
-				{
-					Command: string(ManagerApk),
-					Args:    append([]string{SubcommandAdd, ApkNoCacheFlag}, packagesToInstall...),
-				},
-			},
-		}, nil
+			Parts: []*ShellPart{apkPart},
+		}, diagnostics, nil
 	}
 
 	// If we only have package manager commands but no packages to install,
@@ -1297,7 +2556,7 @@ func convertPackageManagerCommands(ctx context.Context, shell *ShellCommand, pac
 					Command: "true",
 				},
 			},
-		}, nil
+		}, diagnostics, nil
 	}
 
 	// Create a new shell command with parts
@@ -1309,11 +2568,33 @@ func convertPackageManagerCommands(ctx context.Context, shell *ShellCommand, pac
 	// Create the apk add part to be inserted at the right position
 	apkPart := &ShellPart{
 		Command: string(ManagerApk),
-		Args:    append([]string{SubcommandAdd, ApkNoCacheFlag}, packagesToInstall...),
+		Args:    slices.Concat(apkAddArgs(apkFlags, packagesToInstall), redirections, pipeline),
 	}
 
 	firstPMInfo := PackageManagerInfoMap[firstPM]
 
+	// The shell keywords of dropped parts (e.g. "then"), moved to the next part to keep conditionals intact
+	var keywords []string
+	keep := func(part *ShellPart) {
+		if len(keywords) > 0 {
+			if slices.Contains(closingKeywords, part.Command) {
+				// Nothing is left in the branch, but it still needs a command
+				newParts = append(newParts, &ShellPart{ExtraPre: strings.Join(keywords, " "), Command: "true", Delimiter: ";"})
+			} else {
+				part.ExtraPre = strings.TrimSpace(strings.Join(keywords, " ") + " " + part.ExtraPre)
+			}
+			keywords = nil
+		}
+		if last := len(newParts) - 1; last >= 0 && part.continuesCompound() && (newParts[last].Delimiter == "&&" || newParts[last].Delimiter == "||") {
+			newParts[last].Delimiter = ";"
+		}
+		newParts = append(newParts, part)
+	}
+	drop := func(part *ShellPart) {
+		keepHeredocLineBreak(newParts, part)
+		keywords = append(keywords, part.keywords()...)
+	}
+
 	// Process parts in the original order
 	for i, part := range shell.Parts {
 		if Manager(part.Command) == firstPM {
@@ -1326,14 +2607,28 @@ func convertPackageManagerCommands(ctx context.Context, shell *ShellCommand, pac
 				apkPart.ExtraPre = part.ExtraPre
 
 				// Add the apk add command at this position
-				newParts = append(newParts, apkPart)
+				keep(apkPart)
 				apkAdded = true
+			} else if virtualName != "" && isApkVirtualDelete(part, virtualName) || part.isCondition() {
+				// Removing the virtual package installed above, or the condition of a conditional, keep it
+				keep(cloneShellPart(part))
+			} else {
+				// Skip this package manager command (don't add it to newParts)
+				drop(part)
+			}
+		} else if part.Command == CommandExport {
+			// Keep the export, without the variables that only configure the original package manager
+			if newPart := dropPackageManagerExports(part); newPart != nil {
+				keep(newPart)
+			} else {
+				drop(part)
 			}
-			// Skip this package manager command (don't add it to newParts)
-		} else if !slices.Contains(firstPMInfo.AssociatedCommands, part.Command) && !isPackageManagerCleanupCommand(part) {
-			// This is not a package manager command or associated command, keep it
+		} else if !slices.Contains(firstPMInfo.AssociatedCommands, part.Command) && !isPackageManagerCleanupCommand(part) || part.isCondition() {
+			// This is not a package manager command or associated command, or it is the condition of a conditional, keep it
 			newPart := cloneShellPart(part)
-			newParts = append(newParts, newPart)
+			keep(newPart)
+		} else {
+			drop(part)
 		}
 	}
 
@@ -1348,9 +2643,11 @@ func convertPackageManagerCommands(ctx context.Context, shell *ShellCommand, pac
 		newParts = append(newParts, apkPart)
 	}
 
-	// Fix delimiters: ensure the last part has no delimiter
+	// Fix delimiters: ensure the last part has no delimiter, other than a trailing & running it in the background
 	if len(newParts) > 0 {
-		newParts[len(newParts)-1].Delimiter = ""
+		if newParts[len(newParts)-1].Delimiter != "&" {
+			newParts[len(newParts)-1].Delimiter = ""
+		}
 
 		// Also fix any consecutive delimiters
 		for i := 0; i < len(newParts)-1; i++ {
@@ -1365,7 +2662,36 @@ func convertPackageManagerCommands(ctx context.Context, shell *ShellCommand, pac
 		})
 	}
 
-	return true, distro, firstPM, packagesDetected, packagesToInstall, &ShellCommand{Parts: newParts}, nil
+	return true, distro, firstPM, packagesDetected, packagesToInstall, &ShellCommand{Parts: newParts}, diagnostics, nil
+}
+
+// branchedPackageManager returns the package manager that installs packages in more than one branch of a
+// shell conditional or loop (e.g. in both the then and the else branch), or "" if there is none. Branches
+// are separated by shell keywords such as "then", "else" and "fi".
+func branchedPackageManager(shell *ShellCommand) string {
+	branch := 0
+	installBranches := map[string]int{}
+	for _, part := range shell.Parts {
+		if len(part.keywords()) > 0 || slices.Contains(closingKeywords, part.Command) {
+			branch++
+		}
+		pmInfo, ok := PackageManagerInfoMap[Manager(part.Command)]
+		if !ok || findInstallKeyword(part.Args, pmInfo) == -1 {
+			continue
+		}
+		if installBranch, found := installBranches[part.Command]; found && installBranch != branch {
+			return part.Command
+		}
+		installBranches[part.Command] = branch
+	}
+	return ""
+}
+
+// keepHeredocLineBreak moves the line break of a dropped heredoc part onto the previous kept part
+func keepHeredocLineBreak(newParts []*ShellPart, dropped *ShellPart) {
+	if dropped.Delimiter == HeredocLineDelimiter && len(newParts) > 0 {
+		newParts[len(newParts)-1].Delimiter = HeredocLineDelimiter
+	}
 }
 
 // Helper function to clone a shell part
@@ -1525,6 +2851,23 @@ var packageManagerRemoveCacheArgs = [][]string{
 	{"-rf", "/var/cache/yum/*"},
 }
 
+// packageManagerEnvVars are environment variables that only configure Debian's package tools
+var packageManagerEnvVars = []string{"DEBIAN_FRONTEND", "DEBCONF_NONINTERACTIVE_SEEN", "DEBIAN_PRIORITY", "APT_LISTCHANGES_FRONTEND"}
+
+// dropPackageManagerExports returns a copy of an export command without the variables in packageManagerEnvVars,
+// or nil if no variables remain
+func dropPackageManagerExports(part *ShellPart) *ShellPart {
+	newPart := cloneShellPart(part)
+	newPart.Args = slices.DeleteFunc(newPart.Args, func(arg string) bool {
+		name, _, _ := strings.Cut(arg, "=")
+		return slices.Contains(packageManagerEnvVars, name)
+	})
+	if len(newPart.Args) == 0 && len(part.Args) > 0 {
+		return nil
+	}
+	return newPart
+}
+
 // isPackageManagerCleanupCommand checks if the shell command is a known package manager cleanup command.
 func isPackageManagerCleanupCommand(part *ShellPart) bool {
 	if part.Command == "rm" {
@@ -1565,8 +2908,9 @@ func parsePackageSpec(manager Manager, packageArg string) (spec PackageSpec) {
 		spec.Version, spec.Release, _ = strings.Cut(spec.Version, "-")
 	case ManagerApt, ManagerAptGet:
 		// https://www.debian.org/doc/debian-policy/ch-controlfields.html#version
-		// name=[epoch:]upstream_version[-debian_revision]
+		// name[:arch]=[epoch:]upstream_version[-debian_revision]
 		spec.Name, spec.Version, _ = strings.Cut(packageArg, "=")
+		spec.Name, spec.Arch, _ = strings.Cut(spec.Name, ":")
 		if spec.Version != "" {
 			spec.VersionMatcher = "="
 			if strings.Contains(spec.Version, ":") {
@@ -1578,6 +2922,13 @@ func parsePackageSpec(manager Manager, packageArg string) (spec PackageSpec) {
 				spec.Release = spec.Version[lastHyphenIndex+1:]
 				spec.Version = spec.Version[:lastHyphenIndex]
 			}
+
+			// A trailing wildcard selects a version family, e.g. 1.18.* for any 1.18 release.
+			// Other wildcards are kept in the version, they can't be expressed with apk.
+			if prefix, ok := strings.CutSuffix(spec.Version, "*"); ok && !strings.ContainsAny(prefix, "*?[") && spec.Release == "" {
+				spec.Version = strings.TrimSuffix(prefix, ".")
+				spec.VersionFamily = true
+			}
 		}
 	case ManagerDnf, ManagerMicrodnf, ManagerYum:
 		// Format is name-version-release
@@ -1613,7 +2964,7 @@ func convertPackage(ctx context.Context, spec PackageSpec, distro Distro, packag
 // createApkPackageSpec formats an apk package parameter. The following adjustments will be made to align with
 // chainguard best practices:
 // - Drop release specifier
-// - Force fuzzy matching (= -> =~)
+// - Force fuzzy matching (= -> =~), which also matches a version family (1.18.* -> =~1.18)
 func createApkPackageSpec(name string, spec PackageSpec) string {
 	pkg := name
 	if spec.Tag != "" {
@@ -7,10 +7,12 @@ package dfc
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"strings"
 	"testing"
 
@@ -2074,6 +2076,36 @@ func TestParsePackageSpec(t *testing.T) {
 			args:     args{manager: ManagerApt, packageArg: "foo-3=1:1.0.0-r0"},
 			wantSpec: PackageSpec{Manager: ManagerApt, Name: "foo-3", Epoch: "1", Version: "1.0.0", VersionMatcher: "=", Release: "r0"},
 		},
+		{
+			name:     "apt with architecture",
+			args:     args{manager: ManagerApt, packageArg: "foo-3:amd64"},
+			wantSpec: PackageSpec{Manager: ManagerApt, Name: "foo-3", Arch: "amd64"},
+		},
+		{
+			name:     "apt with architecture and version epoch",
+			args:     args{manager: ManagerAptGet, packageArg: "foo-3:i386=1:1.0.0-r0"},
+			wantSpec: PackageSpec{Manager: ManagerAptGet, Name: "foo-3", Arch: "i386", Epoch: "1", Version: "1.0.0", VersionMatcher: "=", Release: "r0"},
+		},
+		{
+			name:     "apt-get with version family",
+			args:     args{manager: ManagerAptGet, packageArg: "nginx=1.18.*"},
+			wantSpec: PackageSpec{Manager: ManagerAptGet, Name: "nginx", Version: "1.18", VersionMatcher: "=", VersionFamily: true},
+		},
+		{
+			name:     "apt-get with version family without dot",
+			args:     args{manager: ManagerAptGet, packageArg: "nginx=1.18*"},
+			wantSpec: PackageSpec{Manager: ManagerAptGet, Name: "nginx", Version: "1.18", VersionMatcher: "=", VersionFamily: true},
+		},
+		{
+			name:     "apt-get with any version",
+			args:     args{manager: ManagerAptGet, packageArg: "nginx=*"},
+			wantSpec: PackageSpec{Manager: ManagerAptGet, Name: "nginx", VersionMatcher: "=", VersionFamily: true},
+		},
+		{
+			name:     "apt-get with version pattern",
+			args:     args{manager: ManagerAptGet, packageArg: "nginx=1.*.3"},
+			wantSpec: PackageSpec{Manager: ManagerAptGet, Name: "nginx", Version: "1.*.3", VersionMatcher: "="},
+		},
 		{
 			name:     "yum name only",
 			args:     args{manager: ManagerYum, packageArg: "foo-3"},
@@ -2357,6 +2389,16 @@ func TestPlatformFlagPreservedInConversion(t *testing.T) {
 			input:          `FROM --platform linux/$ARCH ubuntu:latest`,
 			expectedOutput: `FROM --platform=linux/$ARCH cgr.dev/ORG/chainguard-base:latest`,
 		},
+		{
+			name:           "TARGETPLATFORM preserved verbatim",
+			input:          `FROM --platform=$TARGETPLATFORM node:18 AS runtime`,
+			expectedOutput: `FROM --platform=$TARGETPLATFORM cgr.dev/ORG/node:18-dev AS runtime`,
+		},
+		{
+			name:           "BUILDPLATFORM with braces preserved verbatim",
+			input:          `FROM --platform=${BUILDPLATFORM} node:18`,
+			expectedOutput: `FROM --platform=${BUILDPLATFORM} cgr.dev/ORG/node:18-dev`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -2381,3 +2423,3988 @@ func TestPlatformFlagPreservedInConversion(t *testing.T) {
 		})
 	}
 }
+
+func TestParserDirectives(t *testing.T) {
+	tests := []struct {
+		name           string
+		input          string
+		expectedEscape string
+		expectedLines  int
+		expectedOutput string
+	}{
+		{
+			name: "escape backtick continuation",
+			input: "# escape=`\n" +
+				"FROM debian\n" +
+				"RUN echo hello && `\n" +
+				"    apt-get install -y nano",
+			expectedEscape: "`",
+			expectedLines:  2,
+			expectedOutput: "# escape=`\n" +
+				"FROM cgr.dev/ORG/chainguard-base:latest\n" +
+				"USER root\n" +
+				"RUN echo hello && `\n" +
+				"    apk add --no-cache nano\n",
+		},
+		{
+			name: "syntax directive preserved",
+			input: "# syntax=docker/dockerfile:1\n" +
+				"FROM debian\n" +
+				"RUN apt-get install -y nano",
+			expectedLines: 2,
+			expectedOutput: "# syntax=docker/dockerfile:1\n" +
+				"FROM cgr.dev/ORG/chainguard-base:latest\n" +
+				"USER root\n" +
+				"RUN apk add --no-cache nano\n",
+		},
+		{
+			name: "escape directive after instruction is ignored",
+			input: "FROM debian\n" +
+				"# escape=`\n" +
+				"RUN echo hello \\\n" +
+				"    world",
+			expectedLines: 2,
+			expectedOutput: "FROM cgr.dev/ORG/chainguard-base:latest\n" +
+				"# escape=`\n" +
+				"RUN echo hello \\\n" +
+				"    world",
+		},
+		{
+			name: "escape directive after regular comment is ignored",
+			input: "# a regular comment\n" +
+				"# escape=`\n" +
+				"FROM debian\n" +
+				"RUN echo hello \\\n" +
+				"    world",
+			expectedLines: 2,
+			expectedOutput: "# a regular comment\n" +
+				"# escape=`\n" +
+				"FROM cgr.dev/ORG/chainguard-base:latest\n" +
+				"RUN echo hello \\\n" +
+				"    world",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.input))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+
+			if dockerfile.Escape != tt.expectedEscape {
+				t.Errorf("Expected escape %q, got %q", tt.expectedEscape, dockerfile.Escape)
+			}
+			if len(dockerfile.Lines) != tt.expectedLines {
+				t.Errorf("Expected %d lines, got %d", tt.expectedLines, len(dockerfile.Lines))
+			}
+
+			converted, err := dockerfile.Convert(ctx, Options{})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expectedOutput, converted.String()); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLineContinuationTrailingWhitespace(t *testing.T) {
+	input := "FROM debian\n" +
+		"RUN apt-get update && \\  \n" +
+		"    apt-get install -y \\\t\n" +
+		"    nano \\ \n" +
+		"    curl\n" +
+		"RUN echo done \\   \n" +
+		"    again"
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(input))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+
+	if len(dockerfile.Lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %d", len(dockerfile.Lines))
+	}
+
+	// The raw text, including the stray whitespace, must be kept intact
+	if dockerfile.String() != input {
+		t.Errorf("Round trip not byte-stable:\nwant: %q\ngot:  %q", input, dockerfile.String())
+	}
+
+	run := dockerfile.Lines[1].Run
+	if run == nil || run.Shell == nil || run.Shell.Before == nil {
+		t.Fatalf("Expected RUN details for multiline instruction")
+	}
+	if len(run.Shell.Before.Parts) != 2 {
+		t.Fatalf("Expected 2 shell parts, got %d", len(run.Shell.Before.Parts))
+	}
+	if diff := cmp.Diff([]string{"install", "-y", "nano", "curl"}, run.Shell.Before.Parts[1].Args); diff != "" {
+		t.Errorf("install args mismatch (-want, +got):\n%s", diff)
+	}
+
+	converted, err := dockerfile.Convert(ctx, Options{})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	expected := "FROM cgr.dev/ORG/chainguard-base:latest\n" +
+		"USER root\n" +
+		"RUN apk add --no-cache curl nano\n" +
+		"RUN echo done \\   \n" +
+		"    again"
+	if diff := cmp.Diff(expected, converted.String()); diff != "" {
+		t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+	}
+}
+
+func TestApkNoProgressOption(t *testing.T) {
+	tests := []struct {
+		name       string
+		noProgress bool
+		expected   string
+	}{
+		{
+			name:     "default",
+			expected: "RUN apk add --no-cache nano",
+		},
+		{
+			name:       "no progress",
+			noProgress: true,
+			expected:   "RUN apk add --no-cache --no-progress nano",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dockerfile, err := ParseDockerfile(ctx, []byte("FROM debian\nRUN apt-get update && apt-get install -y nano"))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+
+			converted, err := dockerfile.Convert(ctx, Options{ApkNoProgress: tt.noProgress})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+
+			result := converted.String()
+			if !strings.Contains(result, tt.expected+"\n") {
+				t.Errorf("Expected output to contain %q, got:\n%s", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestApkRepositoriesOption(t *testing.T) {
+	tests := []struct {
+		name         string
+		repositories []string
+		noProgress   bool
+		expected     string
+	}{
+		{
+			name:     "default",
+			expected: "RUN apk add --no-cache nano",
+		},
+		{
+			name:         "one repository",
+			repositories: []string{"https://packages.example.com/os"},
+			expected:     "RUN apk add --no-cache --repository https://packages.example.com/os nano",
+		},
+		{
+			name:         "repositories in order after other flags",
+			repositories: []string{"https://a.example.com/os", "https://b.example.com/os"},
+			noProgress:   true,
+			expected:     "RUN apk add --no-cache --no-progress --repository https://a.example.com/os --repository https://b.example.com/os nano",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dockerfile, err := ParseDockerfile(ctx, []byte("FROM debian\nRUN apt-get update && apt-get install -y nano"))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+
+			converted, err := dockerfile.Convert(ctx, Options{ApkRepositories: tt.repositories, ApkNoProgress: tt.noProgress})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+
+			result := converted.String()
+			if !strings.Contains(result, tt.expected+"\n") {
+				t.Errorf("Expected output to contain %q, got:\n%s", tt.expected, result)
+			}
+
+			// The repository URLs are flag values, not packages
+			installed := apkInstalledPackageNames(converted.Lines[1].Run.Shell)
+			if diff := cmp.Diff(map[string]bool{"nano": true}, installed); diff != "" {
+				t.Errorf("installed packages not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunHeredoc(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		expectedLines int
+		expected      string
+	}{
+		{
+			name: "heredoc with nested and",
+			input: "FROM debian\n" +
+				"RUN <<EOF\n" +
+				"apt-get update\n" +
+				"apt-get install -y nginx && apt-get install -y curl\n" +
+				"rm -rf /var/lib/apt/lists/*\n" +
+				"echo done\n" +
+				"EOF\n" +
+				"RUN echo hello",
+			expectedLines: 3,
+			expected: "FROM cgr.dev/ORG/chainguard-base:latest\n" +
+				"USER root\n" +
+				"RUN <<EOF\n" +
+				"apk add --no-cache curl nginx\n" +
+				"echo done\n" +
+				"EOF\n" +
+				"RUN echo hello",
+		},
+		{
+			name: "quoted delimiter with tab stripping and shebang",
+			input: "FROM debian\n" +
+				"RUN <<-\"EOT\"\n" +
+				"#!/bin/bash\n" +
+				"\tset -e\n" +
+				"\t# install things\n" +
+				"\tapt-get update && apt-get install -y nginx\n" +
+				"\tEOT\n" +
+				"RUN echo hello",
+			expectedLines: 3,
+			expected: "FROM cgr.dev/ORG/chainguard-base:latest\n" +
+				"USER root\n" +
+				"RUN <<-\"EOT\"\n" +
+				"#!/bin/bash\n" +
+				"\tset -e\n" +
+				"\t# install things\n" +
+				"\tapk add --no-cache nginx\n" +
+				"\tEOT\n" +
+				"RUN echo hello",
+		},
+		{
+			name: "comment and blank lines are kept",
+			input: "FROM debian\n" +
+				"RUN <<EOF\n" +
+				"# install deps\n" +
+				"apt-get update\n" +
+				"apt-get install -y curl\n" +
+				"\n" +
+				"  # cleanup\n" +
+				"echo done\n" +
+				"EOF\n" +
+				"RUN echo hello",
+			expectedLines: 3,
+			expected: "FROM cgr.dev/ORG/chainguard-base:latest\n" +
+				"USER root\n" +
+				"RUN <<EOF\n" +
+				"# install deps\n" +
+				"apk add --no-cache curl\n" +
+				"\n" +
+				"  # cleanup\n" +
+				"echo done\n" +
+				"EOF\n" +
+				"RUN echo hello",
+		},
+		{
+			name: "heredoc body lines are not instructions",
+			input: "FROM debian\n" +
+				"RUN cat <<EOF > /etc/motd\n" +
+				"RUN apt-get install -y nginx\n" +
+				"\n" +
+				"# not a comment line\n" +
+				"EOF\n" +
+				"RUN echo \"<<EOF\"",
+			expectedLines: 3,
+			expected: "FROM cgr.dev/ORG/chainguard-base:latest\n" +
+				"RUN cat <<EOF > /etc/motd\n" +
+				"RUN apt-get install -y nginx\n" +
+				"\n" +
+				"# not a comment line\n" +
+				"EOF\n" +
+				"RUN echo \"<<EOF\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.input))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			if len(dockerfile.Lines) != tt.expectedLines {
+				t.Fatalf("Expected %d lines, got %d", tt.expectedLines, len(dockerfile.Lines))
+			}
+			if dockerfile.String() != tt.input {
+				t.Errorf("Round trip not byte-stable:\nwant: %q\ngot:  %q", tt.input, dockerfile.String())
+			}
+
+			converted, err := dockerfile.Convert(ctx, Options{})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.String()); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCommandSubstitutionPackages(t *testing.T) {
+	input := `FROM debian
+
+# install from a list
+RUN apt-get update && apt-get install -y $(cat pkgs.txt) nano`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(input))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+
+	converted, err := dockerfile.Convert(ctx, Options{})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	result := converted.String()
+	if !strings.Contains(result, "RUN apk add --no-cache $(cat pkgs.txt) nano\n") {
+		t.Errorf("Expected command substitution to be preserved, got:\n%s", result)
+	}
+
+	runLine := converted.Lines[1]
+	if diff := cmp.Diff([]string{"nano"}, runLine.Run.Packages); diff != "" {
+		t.Errorf("Packages mismatch (-want, +got):\n%s", diff)
+	}
+
+	diagnostics := converted.Diagnostics()
+	if len(diagnostics) != 1 {
+		t.Fatalf("Expected 1 diagnostic, got %d: %v", len(diagnostics), diagnostics)
+	}
+	if diagnostics[0].Line != 4 {
+		t.Errorf("Expected diagnostic on line 4, got %d", diagnostics[0].Line)
+	}
+	if !strings.Contains(diagnostics[0].Message, "$(cat pkgs.txt)") {
+		t.Errorf("Expected diagnostic to mention the substitution, got %q", diagnostics[0].Message)
+	}
+}
+
+func TestRegistryMap(t *testing.T) {
+	content := `FROM node:18 AS build
+FROM python:3.12 AS runtime
+FROM golang:1.23
+ARG BASE=nginx:1.25
+FROM ${BASE}`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+
+	converted, err := dockerfile.Convert(ctx, Options{
+		Registry: "r.example.com/default",
+		RegistryMap: map[string]string{
+			"node":   "mirror-a.example.com/cg",
+			"python": "mirror-b.example.com/cg/",
+			"nginx":  "mirror-c.example.com/cg",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	expected := `FROM mirror-a.example.com/cg/node:18 AS build
+FROM mirror-b.example.com/cg/python:3.12 AS runtime
+FROM r.example.com/default/go:1.23
+ARG BASE=mirror-c.example.com/cg/nginx:1.25
+FROM ${BASE}`
+	if diff := cmp.Diff(expected, strings.TrimSuffix(converted.String(), "\n")); diff != "" {
+		t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+	}
+}
+
+func TestJSONSchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte("# base\nFROM debian:12 AS build\nRUN apt-get install -y nano"))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	converted, err := dockerfile.Convert(ctx, Options{})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	b, err := json.Marshal(converted)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %v", err)
+	}
+
+	expected := `{"schemaVersion":"` + JSONSchemaVersion + `","lines":[` +
+		`{"raw":"FROM debian:12 AS build","converted":"FROM cgr.dev/ORG/chainguard-base:latest AS build\nUSER root","extra":"# base\n","stage":1,` +
+		`"from":{"base":"debian","tag":"12","alias":"build","orig":"debian:12"}},` +
+		`{"raw":"RUN apt-get install -y nano","converted":"RUN apk add --no-cache nano","stage":1,` +
+		`"run":{"distro":"debian","manager":"apt-get","packages":["nano"]}}]}`
+	if diff := cmp.Diff(expected, string(b)); diff != "" {
+		t.Errorf("JSON not as expected (-want, +got):\n%s", diff)
+	}
+
+	// The schema version must also be present when marshalling a value
+	b, err = json.Marshal(*converted)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %v", err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	if decoded["schemaVersion"] != JSONSchemaVersion {
+		t.Errorf("Expected schemaVersion %q, got %v", JSONSchemaVersion, decoded["schemaVersion"])
+	}
+
+	// A serialized Dockerfile can be read back
+	var roundTrip Dockerfile
+	if err := json.Unmarshal(b, &roundTrip); err != nil {
+		t.Fatalf("json.Unmarshal into Dockerfile failed: %v", err)
+	}
+	if roundTrip.String() != converted.String() {
+		t.Errorf("Round trip mismatch:\nwant: %q\ngot:  %q", converted.String(), roundTrip.String())
+	}
+}
+
+func TestCopyFrom(t *testing.T) {
+	content := `FROM golang:1.23 AS builder
+RUN go build -o /app .
+FROM node:18
+COPY --from=builder /app /app
+COPY --from=0 /app /app2
+COPY --from=nginx:latest /etc/nginx/nginx.conf /etc/nginx/
+COPY --chown=nonroot --from=python /usr/bin/python3 /usr/bin/
+COPY --from=${IMAGE} /src /dst
+COPY . /src`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+
+	var got []*CopyDetails
+	for _, line := range dockerfile.Lines {
+		if strings.HasPrefix(line.Raw, DirectiveCopy) {
+			got = append(got, line.Copy)
+		}
+	}
+	expectedDetails := []*CopyDetails{
+		{From: "builder", FromStage: 1},
+		{From: "0", FromStage: 1},
+		{From: "nginx:latest", FromImage: "nginx:latest"},
+		{From: "python", FromImage: "python"},
+		{From: "${IMAGE}"},
+		nil,
+	}
+	if diff := cmp.Diff(expectedDetails, got); diff != "" {
+		t.Errorf("COPY details not as expected (-want, +got):\n%s", diff)
+	}
+
+	tests := []struct {
+		name     string
+		opts     Options
+		expected string
+	}{
+		{
+			name: "external images left as-is by default",
+			opts: Options{},
+			expected: `FROM cgr.dev/ORG/go:1.23-dev AS builder
+RUN go build -o /app .
+FROM cgr.dev/ORG/node:18
+COPY --from=builder /app /app
+COPY --from=0 /app /app2
+COPY --from=nginx:latest /etc/nginx/nginx.conf /etc/nginx/
+COPY --chown=nonroot --from=python /usr/bin/python3 /usr/bin/
+COPY --from=${IMAGE} /src /dst
+COPY . /src`,
+		},
+		{
+			name: "external images converted",
+			opts: Options{ConvertCopyFrom: true},
+			expected: `FROM cgr.dev/ORG/go:1.23-dev AS builder
+RUN go build -o /app .
+FROM cgr.dev/ORG/node:18
+COPY --from=builder /app /app
+COPY --from=0 /app /app2
+COPY --from=cgr.dev/ORG/nginx:latest /etc/nginx/nginx.conf /etc/nginx/
+COPY --chown=nonroot --from=cgr.dev/ORG/python:latest /usr/bin/python3 /usr/bin/
+COPY --from=${IMAGE} /src /dst
+COPY . /src`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			converted, err := dockerfile.Convert(ctx, tt.opts)
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, strings.TrimSuffix(converted.String(), "\n")); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPackageManagerFlagsWithValue(t *testing.T) {
+	tests := []struct {
+		name             string
+		raw              string
+		expected         string
+		expectedPackages []string
+	}{
+		{
+			name:             "apt-get target release",
+			raw:              `RUN apt-get install -t bookworm-backports -y nginx`,
+			expected:         `RUN apk add --no-cache nginx`,
+			expectedPackages: []string{"nginx"},
+		},
+		{
+			name:             "apt-get long target release and option",
+			raw:              `RUN apt-get install --no-install-recommends --target-release bookworm-backports -o Dpkg::Options::=--force-confold -y curl git`,
+			expected:         `RUN apk add --no-cache curl git`,
+			expectedPackages: []string{"curl", "git"},
+		},
+		{
+			name:             "apt-get flag value with equals",
+			raw:              `RUN apt-get install --target-release=bookworm-backports -y nginx`,
+			expected:         `RUN apk add --no-cache nginx`,
+			expectedPackages: []string{"nginx"},
+		},
+		{
+			name:             "dnf enablerepo",
+			raw:              `RUN dnf install -y --enablerepo crb --setopt install_weak_deps=False git`,
+			expected:         `RUN apk add --no-cache git`,
+			expectedPackages: []string{"git"},
+		},
+		{
+			name:             "apk virtual package",
+			raw:              `RUN apk add --virtual .build-deps gcc`,
+			expected:         `RUN apk add --no-cache --virtual .build-deps gcc`,
+			expectedPackages: []string{"gcc"},
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[0].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.expectedPackages, converted.Lines[0].Run.Packages); diff != "" {
+				t.Errorf("packages not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRuntimeDirectives(t *testing.T) {
+	content := `FROM node:18
+USER node
+WORKDIR /usr/src/app
+USER 1000:1000
+ENTRYPOINT ["docker-entrypoint.sh", "--flag"]
+CMD node server.js \
+    --port "8080"
+CMD ["node"
+ENTRYPOINT []`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+
+	expected := []*DockerfileLine{
+		{Raw: "FROM node:18", Stage: 1, From: &FromDetails{Base: "node", Tag: "18", Orig: "node:18"}},
+		{Raw: "USER node", Stage: 1, User: &UserDetails{User: "node"}},
+		{Raw: "WORKDIR /usr/src/app", Stage: 1, Workdir: &WorkdirDetails{Path: "/usr/src/app"}},
+		{Raw: "USER 1000:1000", Stage: 1, User: &UserDetails{User: "1000", Group: "1000"}},
+		{Raw: `ENTRYPOINT ["docker-entrypoint.sh", "--flag"]`, Stage: 1, Entrypoint: &CommandDetails{Exec: true, Args: []string{"docker-entrypoint.sh", "--flag"}}},
+		{Raw: "CMD node server.js \\\n    --port \"8080\"", Stage: 1, Cmd: &CommandDetails{Args: []string{"node", "server.js", "--port", `"8080"`}}},
+		{Raw: `CMD ["node"`, Stage: 1, Cmd: &CommandDetails{Args: []string{`["node"`}}},
+		{Raw: "ENTRYPOINT []", Stage: 1, Entrypoint: &CommandDetails{Exec: true, Args: []string{}}},
+	}
+	if diff := cmp.Diff(expected, dockerfile.Lines); diff != "" {
+		t.Errorf("parsed lines not as expected (-want, +got):\n%s", diff)
+	}
+
+	if got := dockerfile.Lines[4].Entrypoint.String(); got != `["docker-entrypoint.sh","--flag"]` {
+		t.Errorf("Expected exec form ENTRYPOINT string, got %q", got)
+	}
+	if got := dockerfile.Lines[5].Cmd.String(); got != `node server.js --port "8080"` {
+		t.Errorf("Expected shell form CMD string, got %q", got)
+	}
+
+	// The details are carried over to the converted Dockerfile
+	converted, err := dockerfile.Convert(ctx, Options{})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	if diff := cmp.Diff(dockerfile.Lines[3].User, converted.Lines[3].User); diff != "" {
+		t.Errorf("converted USER details not as expected (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(dockerfile.Lines[5].Cmd, converted.Lines[5].Cmd); diff != "" {
+		t.Errorf("converted CMD details not as expected (-want, +got):\n%s", diff)
+	}
+}
+
+func TestIndirectPackageManager(t *testing.T) {
+	tests := []struct {
+		name            string
+		raw             string
+		wantDiagnostics int
+	}{
+		{
+			name:            "variable set in the same RUN",
+			raw:             `RUN PM=apt-get; $PM install -y nginx`,
+			wantDiagnostics: 1,
+		},
+		{
+			name:            "braced variable",
+			raw:             `RUN ${PKG_MANAGER} update && "${PKG_MANAGER}" install -y curl`,
+			wantDiagnostics: 1,
+		},
+		{
+			name:            "variable not installing packages",
+			raw:             `RUN $SCRIPT --verbose`,
+			wantDiagnostics: 0,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte("FROM debian\n"+tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+
+			runLine := converted.Lines[1]
+			if runLine.Converted != "" {
+				t.Errorf("Expected RUN line to be left unchanged, got %q", runLine.Converted)
+			}
+			if runLine.Run.Manager != "" {
+				t.Errorf("Expected no package manager to be detected, got %q", runLine.Run.Manager)
+			}
+
+			diagnostics := converted.Diagnostics()
+			if len(diagnostics) != tt.wantDiagnostics {
+				t.Fatalf("Expected %d diagnostics, got %d: %v", tt.wantDiagnostics, len(diagnostics), diagnostics)
+			}
+			for _, diagnostic := range diagnostics {
+				if diagnostic.Line != 2 {
+					t.Errorf("Expected diagnostic on line 2, got %d", diagnostic.Line)
+				}
+			}
+		})
+	}
+}
+
+func TestNumericUserDiagnostics(t *testing.T) {
+	content := `FROM debian:12 AS build
+USER 1001
+RUN apt-get update && apt-get install -y nginx
+USER 1001:1001
+USER nginx
+USER 0
+FROM debian:12
+USER 1001`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	converted, err := dockerfile.Convert(ctx, Options{})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	// Only the numeric UID after the converted install is flagged
+	diagnostics := converted.Diagnostics()
+	if len(diagnostics) != 1 {
+		t.Fatalf("Expected 1 diagnostic, got %d: %v", len(diagnostics), diagnostics)
+	}
+	if diagnostics[0].Line != 4 {
+		t.Errorf("Expected diagnostic on line 4, got %d", diagnostics[0].Line)
+	}
+	if !strings.Contains(diagnostics[0].Message, "UID 1001") {
+		t.Errorf("Expected diagnostic to mention the UID, got %q", diagnostics[0].Message)
+	}
+
+	// The diagnostic is advisory only
+	for _, line := range converted.Lines {
+		if line.User != nil && line.Converted != "" {
+			t.Errorf("Expected USER line to be left unchanged, got %q", line.Converted)
+		}
+	}
+}
+
+func TestIsConvertedForm(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{
+			name: "package install",
+			content: `FROM python:3.9
+RUN apt-get update && apt-get install -y nano`,
+		},
+		{
+			name: "multi-stage with trailing newline",
+			content: `FROM golang:1.23 AS builder
+# build it
+RUN apt-get install -y git && go build -o /app .
+
+FROM debian:12
+COPY --from=builder /app /app
+USER nonroot
+ENTRYPOINT ["/app"]
+`,
+		},
+	}
+
+	ctx := context.Background()
+	opts := Options{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.content))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+
+			isConverted, err := dockerfile.IsConvertedForm(ctx, opts)
+			if err != nil {
+				t.Fatalf("IsConvertedForm failed: %v", err)
+			}
+			if isConverted {
+				t.Errorf("Expected original Dockerfile not to be in converted form")
+			}
+
+			converted, err := dockerfile.Convert(ctx, opts)
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			isConverted, err = converted.IsConvertedForm(ctx, opts)
+			if err != nil {
+				t.Fatalf("IsConvertedForm failed: %v", err)
+			}
+			if !isConverted {
+				t.Errorf("Expected converted Dockerfile to be in converted form:\n%s", converted.String())
+			}
+		})
+	}
+}
+
+func TestConvertedInstallWithUserSwitch(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{
+			name: "explicit USER after converted install is respected",
+			content: `FROM debian:12
+RUN apt-get update && apt-get install -y nginx
+USER nginx`,
+			expected: `FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+RUN apk add --no-cache nginx
+USER nginx`,
+		},
+		{
+			name: "USER root already set before install",
+			content: `FROM debian:12
+USER root
+RUN apt-get install -y nginx
+USER nginx`,
+			expected: `FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+RUN apk add --no-cache nginx
+USER nginx`,
+		},
+		{
+			name: "non-root USER before install is restored",
+			content: `FROM debian:12
+USER nginx
+RUN apt-get install -y curl
+CMD ["nginx"]`,
+			expected: `FROM cgr.dev/ORG/chainguard-base:latest
+USER nginx
+USER root
+RUN apk add --no-cache curl
+USER nginx
+CMD ["nginx"]`,
+		},
+		{
+			name: "non-root USER before install followed by explicit USER",
+			content: `FROM debian:12
+RUN apt-get install -y nginx
+USER nginx
+RUN apt-get install -y curl
+USER 1000:1000`,
+			expected: `FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+RUN apk add --no-cache nginx
+USER nginx
+USER root
+RUN apk add --no-cache curl
+USER 1000:1000`,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.content))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, strings.TrimSuffix(converted.String(), "\n")); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+
+			// Converting again must not add more USER directives
+			isConverted, err := converted.IsConvertedForm(ctx, Options{})
+			if err != nil {
+				t.Fatalf("IsConvertedForm failed: %v", err)
+			}
+			if !isConverted {
+				t.Errorf("Expected conversion to be idempotent")
+			}
+		})
+	}
+}
+
+func TestAnnotatePackages(t *testing.T) {
+	content := `FROM debian:12
+RUN apt-get update && apt-get install -y build-essential nano libfoo-dev=1.2`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+
+	opts := Options{
+		NoBuiltIn: true,
+		ExtraMappings: MappingsConfig{
+			Packages: PackageMap{
+				DistroDebian: {
+					"build-essential": []string{"build-base"},
+					"nano":            []string{"nano"},
+					"libfoo-dev":      []string{"foo-dev", "foo"},
+				},
+			},
+		},
+	}
+
+	converted, err := dockerfile.Convert(ctx, opts)
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	if strings.Contains(converted.String(), "# mapped package") {
+		t.Errorf("Expected no annotations without AnnotatePackages, got:\n%s", converted.String())
+	}
+
+	opts.AnnotatePackages = true
+	converted, err = dockerfile.Convert(ctx, opts)
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	expected := `FROM cgr.dev/ORG/debian:12-dev
+USER root
+# mapped package: build-essential -> build-base
+# mapped package: libfoo-dev -> foo-dev, foo
+RUN apk add --no-cache build-base foo-dev=~1.2 foo=~1.2 nano`
+	if diff := cmp.Diff(expected, strings.TrimSuffix(converted.String(), "\n")); diff != "" {
+		t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+	}
+}
+
+func TestApkStyleOption(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		expected string
+	}{
+		{
+			name:     "default",
+			opts:     Options{},
+			expected: "RUN apk add --no-cache nano",
+		},
+		{
+			name:     "no cache",
+			opts:     Options{ApkStyle: ApkStyleNoCache},
+			expected: "RUN apk add --no-cache nano",
+		},
+		{
+			name:     "update index",
+			opts:     Options{ApkStyle: ApkStyleUpdateIndex},
+			expected: "RUN apk add -U nano",
+		},
+		{
+			name:     "update index without progress",
+			opts:     Options{ApkStyle: ApkStyleUpdateIndex, ApkNoProgress: true},
+			expected: "RUN apk add -U --no-progress nano",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dockerfile, err := ParseDockerfile(ctx, []byte("FROM debian\nRUN apt-get update && apt-get install -y nano"))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+
+			converted, err := dockerfile.Convert(ctx, tt.opts)
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+
+			result := converted.String()
+			if !strings.Contains(result, tt.expected+"\n") {
+				t.Errorf("Expected output to contain %q, got:\n%s", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestBackgroundOperatorAndRedirections(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{
+			name:     "background command before install",
+			raw:      `RUN sleep 10 & apt-get install -y nginx`,
+			expected: "RUN sleep 10 & \\\n    apk add --no-cache nginx",
+		},
+		{
+			name:     "redirections are not packages",
+			raw:      `RUN apt-get update 2>&1 && apt-get install -y nginx >/dev/null 2>&1`,
+			expected: `RUN apk add --no-cache nginx >/dev/null 2>&1`,
+		},
+		{
+			name:     "redirection with separate target",
+			raw:      `RUN apt-get install -y curl &> /dev/null`,
+			expected: `RUN apk add --no-cache curl &> /dev/null`,
+		},
+		{
+			name:     "redirections are kept before other commands",
+			raw:      `RUN apt-get install -y nginx > /tmp/install.log 2>&1 && cat /tmp/install.log`,
+			expected: "RUN apk add --no-cache nginx > /tmp/install.log 2>&1 && \\\n    cat /tmp/install.log",
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[0].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAptRecoveryFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{
+			name:     "fix-missing with packages",
+			raw:      `RUN apt-get install -y --fix-missing nginx`,
+			expected: `RUN apk add --no-cache nginx`,
+		},
+		{
+			name:     "fix-broken without packages",
+			raw:      `RUN apt-get update && apt-get -f install`,
+			expected: `RUN true`,
+		},
+		{
+			name:     "fix-broken without packages followed by another command",
+			raw:      `RUN apt-get update && apt-get --fix-broken install -y && echo done`,
+			expected: `RUN echo done`,
+		},
+		{
+			name:     "fix-broken before an install with packages",
+			raw:      `RUN apt-get -f install -y && apt-get install -y curl`,
+			expected: `RUN apk add --no-cache curl`,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[0].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+
+			diagnostics := converted.Diagnostics()
+			if len(diagnostics) != 1 {
+				t.Fatalf("Expected 1 diagnostic, got %d: %v", len(diagnostics), diagnostics)
+			}
+			if !strings.Contains(diagnostics[0].Message, "apk resolves dependencies itself") {
+				t.Errorf("Unexpected diagnostic %q", diagnostics[0].Message)
+			}
+		})
+	}
+}
+
+func TestDisableWildcardImageMatch(t *testing.T) {
+	content := `ARG BASE=mycorp-nodejs:20
+FROM nodejs20-debian12:latest
+FROM node:20
+FROM ${BASE}`
+
+	mappings := MappingsConfig{
+		Images: map[string]string{
+			"nodejs*":  "node",
+			"mycorp-*": "private-base",
+			"node":     "node",
+		},
+	}
+
+	tests := []struct {
+		name     string
+		disable  bool
+		expected string
+	}{
+		{
+			name: "wildcards enabled",
+			expected: `ARG BASE=cgr.dev/ORG/private-base:20
+FROM cgr.dev/ORG/node:latest
+FROM cgr.dev/ORG/node:20
+FROM ${BASE}`,
+		},
+		{
+			name:    "wildcards disabled",
+			disable: true,
+			expected: `ARG BASE=cgr.dev/ORG/mycorp-nodejs:20
+FROM cgr.dev/ORG/nodejs20-debian12:latest
+FROM cgr.dev/ORG/node:20
+FROM ${BASE}`,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(content))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{
+				NoBuiltIn:                 true,
+				ExtraMappings:             mappings,
+				DisableWildcardImageMatch: tt.disable,
+			})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, strings.TrimSuffix(converted.String(), "\n")); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMultilineRunComments(t *testing.T) {
+	content := `FROM debian
+RUN apt-get update && \
+    # install deps
+    apt-get install -y \
+        # editor
+        nano \
+        curl && \
+    # cleanup
+    rm -rf /var/lib/apt/lists/*
+RUN echo a && \
+    # say b
+    echo b
+RUN apt-get install -y git`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+
+	// Comments are kept in the raw instruction, but not parsed as part of the command
+	if !strings.Contains(dockerfile.Lines[1].Raw, "    # install deps\n") {
+		t.Errorf("Expected comment to be kept in raw instruction, got %q", dockerfile.Lines[1].Raw)
+	}
+	expectedArgs := []string{"install", "-y", "nano", "curl"}
+	if diff := cmp.Diff(expectedArgs, dockerfile.Lines[1].Run.Shell.Before.Parts[1].Args); diff != "" {
+		t.Errorf("Args not as expected (-want, +got):\n%s", diff)
+	}
+
+	converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	expected := `FROM cgr.dev/ORG/debian:latest-dev
+USER root
+# install deps
+# editor
+# cleanup
+RUN apk add --no-cache curl nano
+RUN echo a && \
+    # say b
+    echo b
+RUN apk add --no-cache git`
+	if diff := cmp.Diff(expected, strings.TrimSuffix(converted.String(), "\n")); diff != "" {
+		t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+	}
+}
+
+func TestMultilineRunCommentWithHeredocMarker(t *testing.T) {
+	content := `FROM python:3.12 AS build
+RUN echo a && \
+    # run: cat <<EOF
+    echo b
+FROM build
+RUN apt-get install -y curl
+`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+
+	// The heredoc marker in the comment doesn't swallow the following lines
+	if len(dockerfile.Lines) != 5 {
+		t.Fatalf("Expected 5 lines, got %d: %q", len(dockerfile.Lines), dockerfile.Lines[1].Raw)
+	}
+	expectedRaw := "RUN echo a && \\\n    # run: cat <<EOF\n    echo b"
+	if diff := cmp.Diff(expectedRaw, dockerfile.Lines[1].Raw); diff != "" {
+		t.Errorf("Raw not as expected (-want, +got):\n%s", diff)
+	}
+	if dockerfile.Lines[1].Run == nil || dockerfile.Lines[1].Run.Shell == nil {
+		t.Errorf("Expected the RUN with the comment to be parsed as a shell command")
+	}
+
+	converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	if diff := cmp.Diff("RUN apk add --no-cache curl", converted.Lines[3].Converted); diff != "" {
+		t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+	}
+}
+
+func TestApkVirtualPackage(t *testing.T) {
+	tests := []struct {
+		name             string
+		raw              string
+		expected         string
+		expectedPackages []string
+	}{
+		{
+			name:             "no-cache before virtual",
+			raw:              `RUN apk add --no-cache --virtual .deps gcc make`,
+			expected:         `RUN apk add --no-cache --virtual .deps gcc make`,
+			expectedPackages: []string{"gcc", "make"},
+		},
+		{
+			name:             "short flags in any order",
+			raw:              `RUN apk add -t .build-deps --no-cache -U make gcc`,
+			expected:         `RUN apk add --no-cache --virtual .build-deps gcc make`,
+			expectedPackages: []string{"gcc", "make"},
+		},
+		{
+			name:             "virtual with equals",
+			raw:              `RUN apk add --virtual=.deps --no-cache gcc`,
+			expected:         `RUN apk add --no-cache --virtual .deps gcc`,
+			expectedPackages: []string{"gcc"},
+		},
+		{
+			name:             "virtual package removed after build",
+			raw:              `RUN apk add --no-cache --virtual .deps gcc make && make && apk del .deps`,
+			expected:         "RUN apk add --no-cache --virtual .deps gcc make && \\\n    make && \\\n    apk del .deps",
+			expectedPackages: []string{"gcc", "make"},
+		},
+		{
+			name:             "mixed virtual names are dropped",
+			raw:              `RUN apk add --virtual .a gcc && apk add --virtual .b make && make && apk del .a .b`,
+			expected:         "RUN apk add --no-cache gcc make && \\\n    make",
+			expectedPackages: []string{"gcc", "make"},
+		},
+		{
+			name:             "virtual only for apk sources",
+			raw:              `RUN apt-get install -y -t bookworm-backports gcc`,
+			expected:         `RUN apk add --no-cache gcc`,
+			expectedPackages: []string{"gcc"},
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[0].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.expectedPackages, converted.Lines[0].Run.Packages); diff != "" {
+				t.Errorf("packages not as expected (-want, +got):\n%s", diff)
+			}
+
+			// Converting the converted Dockerfile again leaves it unchanged
+			isConverted, err := converted.IsConvertedForm(ctx, Options{NoBuiltIn: true})
+			if err != nil {
+				t.Fatalf("IsConvertedForm failed: %v", err)
+			}
+			if !isConverted {
+				t.Errorf("expected %q to round-trip cleanly", converted.String())
+			}
+		})
+	}
+}
+
+func TestAptMultiarchPackages(t *testing.T) {
+	content := `FROM debian:12
+RUN apt-get update && apt-get install -y nginx:amd64 libssl-dev:i386=3.0.11-1 curl`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	converted, err := dockerfile.Convert(ctx, Options{
+		NoBuiltIn: true,
+		ExtraMappings: MappingsConfig{
+			Packages: PackageMap{
+				DistroDebian: {
+					"nginx":      {"nginx"},
+					"libssl-dev": {"openssl-dev"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	line := converted.Lines[1]
+	if diff := cmp.Diff("RUN apk add --no-cache curl nginx openssl-dev=~3.0.11", line.Converted); diff != "" {
+		t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+	}
+	expectedDiagnostics := []string{
+		"apt-get install nginx:amd64 requests the amd64 architecture, the qualifier was dropped since apk installs packages for the architecture of the image",
+		"apt-get install libssl-dev:i386=3.0.11-1 requests the i386 architecture, the qualifier was dropped since apk installs packages for the architecture of the image",
+	}
+	if diff := cmp.Diff(expectedDiagnostics, line.Diagnostics); diff != "" {
+		t.Errorf("diagnostics not as expected (-want, +got):\n%s", diff)
+	}
+}
+
+func TestRunFlags(t *testing.T) {
+	tests := []struct {
+		name          string
+		raw           string
+		expectedFlags []string
+		expected      string
+	}{
+		{
+			name:          "cache mounted apt install",
+			raw:           `RUN --mount=type=cache,target=/var/cache/apt apt-get update && apt-get install -y nginx`,
+			expectedFlags: []string{"--mount=type=cache,target=/var/cache/apt"},
+			expected:      `RUN --mount=type=cache,target=/var/cache/apt apk add --no-cache nginx`,
+		},
+		{
+			name: "multiple flags across continuation lines",
+			raw: `RUN --mount=type=cache,target=/var/cache/apt,sharing=locked \
+    --mount=type=secret,id=netrc,target="/root/.netrc" \
+    --network=host \
+    apt-get update && apt-get install -y curl && make`,
+			expectedFlags: []string{"--mount=type=cache,target=/var/cache/apt,sharing=locked", `--mount=type=secret,id=netrc,target="/root/.netrc"`, "--network=host"},
+			expected:      "RUN --mount=type=cache,target=/var/cache/apt,sharing=locked --mount=type=secret,id=netrc,target=\"/root/.netrc\" --network=host apk add --no-cache curl && \\\n    make",
+		},
+		{
+			name:          "security flag",
+			raw:           `RUN --security=insecure yum install -y git`,
+			expectedFlags: []string{"--security=insecure"},
+			expected:      `RUN --security=insecure apk add --no-cache git`,
+		},
+		{
+			name:     "no flags",
+			raw:      `RUN apt-get install -y nginx`,
+			expected: `RUN apk add --no-cache nginx`,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expectedFlags, dockerfile.Lines[0].Run.Flags); diff != "" {
+				t.Errorf("flags not as expected (-want, +got):\n%s", diff)
+			}
+
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[0].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.expectedFlags, converted.Lines[0].Run.Flags); diff != "" {
+				t.Errorf("converted flags not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFailOnUnknownDirective(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name: "typo",
+			content: `FROM node:20
+# install deps
+RUN apt-get install -y \
+    curl
+
+FORM python:3.12`,
+			wantErr: "unknown directive FORM on line 6",
+		},
+		{
+			name:    "unsupported directive",
+			content: "FROM node:20\nCOPYFILES . /app",
+			wantErr: "unknown directive COPYFILES on line 2",
+		},
+		{
+			name: "known directives",
+			content: `# syntax=docker/dockerfile:1
+FROM node:20 AS build
+LABEL org.opencontainers.image.source=https://example.com
+ENV NODE_ENV=production
+ADD https://example.com/file.tar.gz /tmp/
+HEALTHCHECK CMD curl -f http://localhost/
+SHELL ["/bin/bash", "-c"]
+ONBUILD RUN echo hi
+EXPOSE 8080
+VOLUME /data
+STOPSIGNAL SIGTERM
+MAINTAINER someone
+run echo lowercase directives are fine`,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.content))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+
+			// Lenient by default
+			if _, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true}); err != nil {
+				t.Fatalf("Convert failed without FailOnUnknownDirective: %v", err)
+			}
+
+			_, err = dockerfile.Convert(ctx, Options{NoBuiltIn: true, FailOnUnknownDirective: true})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Convert failed: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Convert error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScriptDependencyDiagnostics(t *testing.T) {
+	content := `FROM debian:12 AS build
+RUN useradd -m -G sudo,adm app
+RUN usermod -aG docker app && userdel olduser
+RUN bash -c "echo hello"
+SHELL ["/bin/bash", "-o", "pipefail", "-c"]
+RUN <<EOF
+#!/bin/bash
+echo hello
+EOF
+FROM debian:12
+RUN apt-get update && apt-get install -y bash passwd
+RUN usermod -aG docker app && /bin/bash ./setup.sh
+FROM ${BASE}
+RUN usermod -aG docker app`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	converted, err := dockerfile.Convert(ctx, Options{
+		NoBuiltIn: true,
+		ExtraMappings: MappingsConfig{
+			Packages: PackageMap{DistroDebian: {"passwd": {"shadow"}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	// Nothing is reported once bash and shadow are installed, or for stages that weren't converted
+	expected := []Diagnostic{
+		{Line: 2, Message: "useradd -G adds supplementary groups, which busybox adduser (that useradd is converted to) does not support, consider adding shadow to the installed packages to keep useradd"},
+		{Line: 3, Message: "usermod is provided by the shadow package, which may not be installed in the converted image, consider adding shadow to the installed packages"},
+		{Line: 3, Message: "userdel is provided by the shadow package, which may not be installed in the converted image, consider adding shadow to the installed packages"},
+		{Line: 4, Message: "RUN uses bash, which may not be installed in the converted image, consider adding bash to the installed packages"},
+		{Line: 5, Message: "SHELL uses bash, which may not be installed in the converted image, consider adding bash to the installed packages"},
+		{Line: 6, Message: "RUN uses bash, which may not be installed in the converted image, consider adding bash to the installed packages"},
+	}
+	if diff := cmp.Diff(expected, converted.Diagnostics()); diff != "" {
+		t.Errorf("diagnostics not as expected (-want, +got):\n%s", diff)
+	}
+}
+
+func TestInstallKeywordWithFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{
+			name:     "apt-get flag before install across parts",
+			raw:      `RUN apt-get update && apt-get -y install nginx && apt-get -y install curl`,
+			expected: `RUN apk add --no-cache curl nginx`,
+		},
+		{
+			name:     "apt quiet flag before install",
+			raw:      `RUN apt -qq install vim`,
+			expected: `RUN apk add --no-cache vim`,
+		},
+		{
+			name:     "flags with values before install",
+			raw:      `RUN apt-get -o Acquire::Retries=3 -t bookworm-backports -y install jq`,
+			expected: `RUN apk add --no-cache jq`,
+		},
+		{
+			name:     "flags after packages",
+			raw:      `RUN apt-get install nginx -y --no-install-recommends`,
+			expected: `RUN apk add --no-cache nginx`,
+		},
+		{
+			name:     "unknown flag with value before install",
+			raw:      `RUN apt-get --log-file /tmp/apt.log install -y git`,
+			expected: `RUN apk add --no-cache git`,
+		},
+		{
+			name:     "dnf flags before install",
+			raw:      `RUN dnf --setopt tsflags=nodocs -y install git`,
+			expected: `RUN apk add --no-cache git`,
+		},
+		{
+			name:     "install as a flag value is not the subcommand",
+			raw:      `RUN apt-get -y -t install update && apt-get install -y git`,
+			expected: `RUN apk add --no-cache git`,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[0].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPlusSignPackageNames(t *testing.T) {
+	tests := []struct {
+		name             string
+		raw              string
+		expected         string
+		expectedPackages []string
+	}{
+		{
+			name:             "apt-get c++ packages",
+			raw:              `RUN apt-get update && apt-get install -y g++ libstdc++-12-dev libstdc++6 && make`,
+			expected:         "RUN apk add --no-cache gcc libstdc++ libstdc++-dev && \\\n    make",
+			expectedPackages: []string{"g++", "libstdc++-12-dev", "libstdc++6"},
+		},
+		{
+			name:             "apt-get pinned c++ package",
+			raw:              `RUN apt-get install -y libstdc++6=12.2.0-14+deb12u1`,
+			expected:         `RUN apk add --no-cache libstdc++=~12.2.0`,
+			expectedPackages: []string{"libstdc++6=12.2.0-14+deb12u1"},
+		},
+		{
+			name:             "yum c++ packages",
+			raw:              `RUN yum install -y gcc-c++ libstdc++-devel`,
+			expected:         `RUN apk add --no-cache gcc libstdc++-dev`,
+			expectedPackages: []string{"gcc-c++", "libstdc++-devel"},
+		},
+		{
+			name:             "unmapped plus sign package is kept as is",
+			raw:              `RUN apt-get install -y libc++-dev`,
+			expected:         `RUN apk add --no-cache libc++-dev`,
+			expectedPackages: []string{"libc++-dev"},
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[0].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.expectedPackages, converted.Lines[0].Run.Packages); diff != "" {
+				t.Errorf("packages not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestScratchStageExtension(t *testing.T) {
+	tests := []struct {
+		name            string
+		raw             string
+		expected        string
+		expectedParents []int  // Parent of each FROM line, in order
+		expectedScratch []bool // IsScratch of each FROM line, in order
+	}{
+		{
+			name: "scratch parent extended by a later stage",
+			raw: `FROM scratch AS base
+COPY app /app
+FROM base
+ENTRYPOINT ["/app"]
+`,
+			expected: `FROM scratch AS base
+COPY app /app
+FROM base
+ENTRYPOINT ["/app"]
+`,
+			expectedParents: []int{0, 1},
+			expectedScratch: []bool{true, true},
+		},
+		{
+			name: "chain of stages on top of scratch",
+			raw: `FROM scratch AS base
+FROM base AS middle
+FROM middle
+`,
+			expected: `FROM scratch AS base
+FROM base AS middle
+FROM middle
+`,
+			expectedParents: []int{0, 1, 2},
+			expectedScratch: []bool{true, true, true},
+		},
+		{
+			name: "stage reference is case insensitive",
+			raw: `FROM scratch AS Base
+FROM base
+`,
+			expected: `FROM scratch AS Base
+FROM base
+`,
+			expectedParents: []int{0, 1},
+			expectedScratch: []bool{true, true},
+		},
+		{
+			name: "scratch extension alongside a converted stage",
+			raw: `FROM golang:1.22 AS build
+RUN apt-get install -y git
+FROM scratch AS base
+COPY --from=build /out/app /app
+FROM base
+`,
+			expected: `FROM cgr.dev/ORG/go:1.22-dev AS build
+USER root
+RUN apk add --no-cache git
+FROM scratch AS base
+COPY --from=build /out/app /app
+FROM base
+`,
+			expectedParents: []int{0, 0, 2},
+			expectedScratch: []bool{false, true, true},
+		},
+		{
+			name: "scratch runtime stage after converted stages",
+			raw: `FROM debian:12 AS deps
+RUN apt-get update && apt-get install -y ca-certificates
+FROM golang:1.22 AS build
+RUN apt-get install -y git
+FROM scratch
+COPY --from=deps /etc/ssl/certs /etc/ssl/certs
+COPY --from=build /out/app /app
+ENTRYPOINT ["/app"]
+`,
+			expected: `FROM cgr.dev/ORG/chainguard-base:latest AS deps
+USER root
+RUN apk add --no-cache ca-certificates
+FROM cgr.dev/ORG/go:1.22-dev AS build
+USER root
+RUN apk add --no-cache git
+FROM scratch
+COPY --from=deps /etc/ssl/certs /etc/ssl/certs
+COPY --from=build /out/app /app
+ENTRYPOINT ["/app"]
+`,
+			expectedParents: []int{0, 0, 0},
+			expectedScratch: []bool{false, false, true},
+		},
+		{
+			name: "install in a scratch stage gets no USER root",
+			raw: `FROM golang:1.22 AS build
+RUN apt-get install -y git
+FROM scratch
+RUN apt-get install -y curl
+`,
+			expected: `FROM cgr.dev/ORG/go:1.22-dev AS build
+USER root
+RUN apk add --no-cache git
+FROM scratch
+RUN apk add --no-cache curl
+`,
+			expectedParents: []int{0, 0},
+			expectedScratch: []bool{false, true},
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.String()); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+
+			var parents []int
+			var scratch []bool
+			for _, line := range converted.Lines {
+				if line.From != nil {
+					parents = append(parents, line.From.Parent)
+					scratch = append(scratch, line.From.IsScratch)
+					if (line.From.Base == "scratch" || line.From.Parent > 0) && shouldConvertFromLine(line.From) {
+						t.Errorf("FROM %s should not be converted", line.From.Orig)
+					}
+				}
+			}
+			if diff := cmp.Diff(tt.expectedParents, parents); diff != "" {
+				t.Errorf("parent stages not as expected (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.expectedScratch, scratch); diff != "" {
+				t.Errorf("scratch stages not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestContinuedInstallPackages(t *testing.T) {
+	tests := []struct {
+		name             string
+		raw              string
+		expected         string
+		expectedPackages []string
+	}{
+		{
+			name: "one package per continued line",
+			raw: `FROM debian:12
+RUN apt-get install -y \
+    nginx \
+    curl \
+    git
+`,
+			expected: `FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+RUN apk add --no-cache curl git nginx
+`,
+			expectedPackages: []string{"curl", "git", "nginx"},
+		},
+		{
+			name: "comment lines between packages",
+			raw: `FROM debian:12
+RUN apt-get update && apt-get install -y \
+    nginx \
+    # the HTTP client
+    curl \
+	  git \
+    # clean up
+    && rm -rf /var/lib/apt/lists/*
+`,
+			expected: `FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+# the HTTP client
+# clean up
+RUN apk add --no-cache curl git nginx
+`,
+			expectedPackages: []string{"curl", "git", "nginx"},
+		},
+		{
+			name: "empty and blank continued lines",
+			raw:  "FROM debian:12\nRUN apt-get install -y \\\n    \\\n    nginx \\  \n\n    curl\n",
+			expected: `FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+RUN apk add --no-cache curl nginx
+`,
+			expectedPackages: []string{"curl", "nginx"},
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.String()); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+
+			// Continuation whitespace must not end up as a package
+			var packages []string
+			for _, line := range converted.Lines {
+				if line.Run != nil {
+					packages = append(packages, line.Run.Packages...)
+				}
+			}
+			if diff := cmp.Diff(tt.expectedPackages, packages); diff != "" {
+				t.Errorf("packages not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestConditionalInstalls(t *testing.T) {
+	tests := []struct {
+		name                string
+		raw                 string
+		expected            string
+		expectedDiagnostics []string
+	}{
+		{
+			name:     "install guarded by an architecture check",
+			raw:      `RUN if [ "$(uname -m)" = "x86_64" ]; then apt-get install -y nginx; fi`,
+			expected: "RUN if [ \"$(uname -m)\" = \"x86_64\" ] ; \\\n    then apk add --no-cache nginx ; \\\n    fi",
+		},
+		{
+			name: "dropped update keeps the then keyword",
+			raw: `RUN if [ "$(uname -m)" = "aarch64" ]; then \
+      apt-get update && apt-get install -y libatomic1 && rm -rf /var/lib/apt/lists/*; \
+    fi && echo done`,
+			expected: "RUN if [ \"$(uname -m)\" = \"aarch64\" ] ; \\\n    then apk add --no-cache libatomic1 ; \\\n    fi && \\\n    echo done",
+		},
+		{
+			name:     "branch left without commands runs true",
+			raw:      `RUN if [ -d /etc/apt ]; then apt-get update; fi; apt-get install -y curl`,
+			expected: "RUN if [ -d /etc/apt ] ; \\\n    then true ; \\\n    fi ; \\\n    apk add --no-cache curl",
+		},
+		{
+			name:     "cleanup before the end of the branch is dropped",
+			raw:      `RUN if [ -n "$WITH_GIT" ]; then apt-get install -y git && apt-get clean; else echo skipped; fi`,
+			expected: "RUN if [ -n \"$WITH_GIT\" ] ; \\\n    then apk add --no-cache git ; \\\n    else echo skipped ; \\\n    fi",
+		},
+		{
+			name:     "installs in both branches are left unchanged",
+			raw:      `RUN if [ "$(uname -m)" = "x86_64" ]; then apt-get install -y nginx; else apt-get install -y curl; fi`,
+			expected: ``,
+			expectedDiagnostics: []string{
+				"manual review needed: RUN was left unchanged since apt-get installs packages in more than one branch of a shell conditional or loop",
+			},
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[0].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.expectedDiagnostics, converted.Lines[0].Diagnostics); diff != "" {
+				t.Errorf("diagnostics not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGroupedAndBackgroundInstalls(t *testing.T) {
+	tests := []struct {
+		name                string
+		raw                 string
+		expected            string
+		expectedDiagnostics []string
+	}{
+		{
+			name:     "backgrounded install keeps the ampersand",
+			raw:      `RUN apt-get update; apt-get install -y nginx &`,
+			expected: `RUN apk add --no-cache nginx &`,
+			expectedDiagnostics: []string{
+				"apt-get install runs in the background with &, the build step may finish before the packages are installed, consider removing the &",
+			},
+		},
+		{
+			name:     "backgrounded install after another command",
+			raw:      `RUN echo start && apt-get install -y curl &`,
+			expected: "RUN echo start && \\\n    apk add --no-cache curl &",
+			expectedDiagnostics: []string{
+				"apt-get install runs in the background with &, the build step may finish before the packages are installed, consider removing the &",
+			},
+		},
+		{
+			name:     "install in a subshell is left unchanged",
+			raw:      `RUN (apt-get update && apt-get install -y nginx)`,
+			expected: ``,
+			expectedDiagnostics: []string{
+				"manual review needed: RUN was left unchanged since apt-get runs inside a subshell or command group",
+			},
+		},
+		{
+			name:     "install in a subshell followed by other commands",
+			raw:      `RUN (cd /tmp && apt-get install -y curl) && echo ok`,
+			expected: ``,
+			expectedDiagnostics: []string{
+				"manual review needed: RUN was left unchanged since apt-get runs inside a subshell or command group",
+			},
+		},
+		{
+			name:     "install in a command group is left unchanged",
+			raw:      `RUN { apt-get update && apt-get install -y git; } > /tmp/install.log`,
+			expected: ``,
+			expectedDiagnostics: []string{
+				"manual review needed: RUN was left unchanged since apt-get runs inside a subshell or command group",
+			},
+		},
+		{
+			name:     "subshell without a package manager does not block conversion",
+			raw:      `RUN (cd /src && make) && apt-get install -y vim`,
+			expected: "RUN (cd /src && make) && \\\n    apk add --no-cache vim",
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[0].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.expectedDiagnostics, converted.Lines[0].Diagnostics); diff != "" {
+				t.Errorf("diagnostics not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTagRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		rules    map[string]TagRule
+		expected string
+	}{
+		{
+			name:     "default jdk prefix",
+			raw:      "FROM eclipse-temurin:17\nRUN echo hi",
+			expected: "FROM cgr.dev/ORG/jdk:openjdk-17-dev",
+		},
+		{
+			name:     "default chainguard-base latest",
+			raw:      "FROM debian:12.5\nRUN echo hi",
+			expected: "FROM cgr.dev/ORG/chainguard-base:latest",
+		},
+		{
+			name:     "prefix for another image",
+			raw:      "FROM node:20.11.1",
+			rules:    map[string]TagRule{"node": {Prefix: "lts-"}},
+			expected: "FROM cgr.dev/ORG/node:lts-20.11",
+		},
+		{
+			name:     "force latest",
+			raw:      "FROM python:3.12\nRUN echo hi",
+			rules:    map[string]TagRule{"python": {ForceLatest: true}},
+			expected: "FROM cgr.dev/ORG/python:latest",
+		},
+		{
+			name:     "preserve original tag",
+			raw:      "FROM node:20.11.1\nRUN echo hi",
+			rules:    map[string]TagRule{"node": {PreserveOriginal: true}},
+			expected: "FROM cgr.dev/ORG/node:20.11.1-dev",
+		},
+		{
+			name:     "override a default rule",
+			raw:      "FROM eclipse-temurin:17",
+			rules:    map[string]TagRule{"jdk": {}},
+			expected: "FROM cgr.dev/ORG/jdk:17",
+		},
+		{
+			name:     "rules for other images leave the defaults in place",
+			raw:      "FROM eclipse-temurin:17",
+			rules:    map[string]TagRule{"node": {ForceLatest: true}},
+			expected: "FROM cgr.dev/ORG/jdk:openjdk-17",
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true, TagRules: tt.rules})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[0].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestApkRepositoryTaggedPackages(t *testing.T) {
+	tests := []struct {
+		name                string
+		raw                 string
+		expected            string
+		expectedPackages    []string
+		expectedDiagnostics []string
+	}{
+		{
+			name:             "edge and community tags are dropped",
+			raw:              `RUN apk add --no-cache nginx@edge curl@community bash`,
+			expected:         `RUN apk add --no-cache bash curl nginx`,
+			expectedPackages: []string{"bash", "curl@community", "nginx@edge"},
+			expectedDiagnostics: []string{
+				"apk add nginx@edge pins nginx to the @edge repository, the pin was dropped since the Chainguard package repository has no tagged repositories",
+				"apk add curl@community pins curl to the @community repository, the pin was dropped since the Chainguard package repository has no tagged repositories",
+			},
+		},
+		{
+			name:             "tagged package with a version",
+			raw:              `RUN apk add nginx@edge~1.25`,
+			expected:         `RUN apk add --no-cache nginx~1.25`,
+			expectedPackages: []string{"nginx@edge~1.25"},
+			expectedDiagnostics: []string{
+				"apk add nginx@edge~1.25 pins nginx to the @edge repository, the pin was dropped since the Chainguard package repository has no tagged repositories",
+			},
+		},
+		{
+			name:             "tagged package is mapped by name",
+			raw:              `RUN apk add py3-pip@community`,
+			expected:         `RUN apk add --no-cache py3.12-pip`,
+			expectedPackages: []string{"py3-pip@community"},
+			expectedDiagnostics: []string{
+				"apk add py3-pip@community pins py3-pip to the @community repository, the pin was dropped since the Chainguard package repository has no tagged repositories",
+			},
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{
+				NoBuiltIn: true,
+				ExtraMappings: MappingsConfig{
+					Packages: PackageMap{
+						DistroAlpine: {"py3-pip": []string{"py3.12-pip"}},
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[0].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.expectedPackages, converted.Lines[0].Run.Packages); diff != "" {
+				t.Errorf("packages not as expected (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.expectedDiagnostics, converted.Lines[0].Diagnostics); diff != "" {
+				t.Errorf("diagnostics not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReinstall(t *testing.T) {
+	tests := []struct {
+		name                string
+		raw                 string
+		expected            string
+		expectedDiagnostics []string
+	}{
+		{
+			name:     "dnf reinstall",
+			raw:      `RUN dnf reinstall -y nginx`,
+			expected: "RUN apk add --no-cache nginx",
+		},
+		{
+			name:     "yum reinstall with clean",
+			raw:      `RUN yum reinstall -y nginx curl && yum clean all`,
+			expected: "RUN apk add --no-cache curl nginx",
+		},
+		{
+			name:     "microdnf reinstall",
+			raw:      `RUN microdnf reinstall -y git`,
+			expected: "RUN apk add --no-cache git",
+		},
+		{
+			name:     "apt-get reinstall after an update",
+			raw:      `RUN apt-get update && apt-get reinstall -y ca-certificates`,
+			expected: "RUN apk add --no-cache ca-certificates",
+		},
+		{
+			name:     "apt reinstall and install are combined",
+			raw:      `RUN apt install -y curl && apt reinstall -y --fix-broken nginx`,
+			expected: "RUN apk add --no-cache curl nginx",
+			expectedDiagnostics: []string{
+				"apt reinstall uses --fix-broken, which was dropped since apk resolves dependencies itself, the original build may have had dependency issues",
+			},
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[0].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.expectedDiagnostics, converted.Lines[0].Diagnostics); diff != "" {
+				t.Errorf("diagnostics not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestUnsupportedPackageManagerSubcommands(t *testing.T) {
+	tests := []struct {
+		name               string
+		raw                string
+		expectedDiagnostic string
+	}{
+		{
+			name:               "apt-get build-dep",
+			raw:                `RUN apt-get update && apt-get build-dep -y nginx`,
+			expectedDiagnostic: "manual review needed: RUN was left unchanged since apt-get build-dep has no Chainguard equivalent",
+		},
+		{
+			name:               "apt-get source next to an install",
+			raw:                `RUN apt-get source nginx && apt-get install -y curl`,
+			expectedDiagnostic: "manual review needed: RUN was left unchanged since apt-get source has no Chainguard equivalent",
+		},
+		{
+			name:               "apt build-dep after flags",
+			raw:                `RUN apt -o Debug::pkgProblemResolver=yes build-dep -y .`,
+			expectedDiagnostic: "manual review needed: RUN was left unchanged since apt build-dep has no Chainguard equivalent",
+		},
+		{
+			name:               "dnf builddep",
+			raw:                `RUN dnf builddep -y nginx.spec`,
+			expectedDiagnostic: "manual review needed: RUN was left unchanged since dnf builddep has no Chainguard equivalent",
+		},
+		{
+			name:               "apt-get download",
+			raw:                `RUN apt-get update && apt-get download nginx && dpkg -x nginx_*.deb /out`,
+			expectedDiagnostic: "manual review needed: RUN was left unchanged since apt-get download only downloads package files, which apk fetch does",
+		},
+		{
+			name:               "apt download next to an install",
+			raw:                `RUN apt-get install -y curl && apt -o Dir::Cache=/tmp download vim`,
+			expectedDiagnostic: "manual review needed: RUN was left unchanged since apt download only downloads package files, which apk fetch does",
+		},
+		{
+			name:               "dnf download",
+			raw:                `RUN dnf download --resolve nginx`,
+			expectedDiagnostic: "manual review needed: RUN was left unchanged since dnf download only downloads package files, which apk fetch does",
+		},
+		{
+			name:               "dnf localinstall",
+			raw:                `RUN dnf localinstall -y /tmp/nginx.rpm`,
+			expectedDiagnostic: "manual review needed: RUN was left unchanged since dnf localinstall installs local rpm files, which apk can't install",
+		},
+		{
+			name:               "yum localinstall next to an install",
+			raw:                `RUN yum install -y curl && yum localinstall -y ./agent.rpm`,
+			expectedDiagnostic: "manual review needed: RUN was left unchanged since yum localinstall installs local rpm files, which apk can't install",
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if converted.Lines[0].Converted != "" {
+				t.Errorf("expected the line to be left unchanged, got %q", converted.Lines[0].Converted)
+			}
+			if diff := cmp.Diff([]string{tt.expectedDiagnostic}, converted.Lines[0].Diagnostics); diff != "" {
+				t.Errorf("diagnostics not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+
+	// A package that happens to be named like an unsupported subcommand is still installed
+	dockerfile, err := ParseDockerfile(ctx, []byte(`RUN apt-get install -y source download`))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	if diff := cmp.Diff(`RUN apk add --no-cache download source`, converted.Lines[0].Converted); diff != "" {
+		t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+	}
+
+	// Every unsupported subcommand is reported, and the line is not also reported for still using apt-get
+	dockerfile, err = ParseDockerfile(ctx, []byte("FROM debian\nRUN apt-get build-dep -y nginx && apt-get source nginx"))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	converted, err = dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	expectedDiagnostics := []string{
+		"manual review needed: RUN was left unchanged since apt-get build-dep has no Chainguard equivalent",
+		"manual review needed: RUN was left unchanged since apt-get source has no Chainguard equivalent",
+	}
+	if diff := cmp.Diff(expectedDiagnostics, converted.Lines[1].Diagnostics); diff != "" {
+		t.Errorf("diagnostics not as expected (-want, +got):\n%s", diff)
+	}
+}
+
+func TestExportBeforeInstall(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{
+			name:     "export of DEBIAN_FRONTEND is dropped",
+			raw:      `RUN export DEBIAN_FRONTEND=noninteractive && apt-get install -y nginx`,
+			expected: "RUN apk add --no-cache nginx",
+		},
+		{
+			name:     "other exported variables are kept",
+			raw:      `RUN export DEBIAN_FRONTEND=noninteractive PATH=/opt/bin:$PATH && apt-get update && apt-get install -y nginx && nginx -v`,
+			expected: "RUN export PATH=/opt/bin:$PATH && \\\n    apk add --no-cache nginx && \\\n    nginx -v",
+		},
+		{
+			name:     "export unrelated to the package manager",
+			raw:      `RUN export GOFLAGS=-mod=mod; apt-get install -y git`,
+			expected: "RUN export GOFLAGS=-mod=mod ; \\\n    apk add --no-cache git",
+		},
+		{
+			name:     "several exports",
+			raw:      `RUN export DEBCONF_NONINTERACTIVE_SEEN=true && export DEBIAN_FRONTEND=noninteractive && apt-get install -y curl`,
+			expected: "RUN apk add --no-cache curl",
+		},
+		{
+			name:     "RUN without a package manager is left unchanged",
+			raw:      `RUN export DEBIAN_FRONTEND=noninteractive && echo hello`,
+			expected: "",
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[0].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSetOptionsBeforeInstall(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{
+			name:     "set -o pipefail is kept",
+			raw:      `RUN set -o pipefail && apt-get update && apt-get install -y curl`,
+			expected: "RUN set -o pipefail && \\\n    apk add --no-cache curl",
+		},
+		{
+			name:     "several set options separated by a semicolon",
+			raw:      `RUN set -eux -o pipefail; apt-get update; apt-get install -y --no-install-recommends git`,
+			expected: "RUN set -eux -o pipefail ; \\\n    apk add --no-cache git",
+		},
+		{
+			name:     "install piped to another command",
+			raw:      `RUN set -o pipefail && apt-get install -y curl | tee /tmp/install.log`,
+			expected: "RUN set -o pipefail && \\\n    apk add --no-cache curl | tee /tmp/install.log",
+		},
+		{
+			name:     "only an install piped to another command",
+			raw:      `RUN apt-get install -y curl git 2>&1 | tee /tmp/install.log`,
+			expected: "RUN apk add --no-cache curl git 2>&1 | tee /tmp/install.log",
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[0].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLeftoverPackageManagerDiagnostics(t *testing.T) {
+	content := `FROM debian:12
+RUN apt-get update && apt-get install -y curl && apt-get clean
+RUN /usr/bin/apt-get clean && rm -rf /tmp/*
+RUN dpkg -l | grep ssl
+RUN echo "arch: $(dpkg --print-architecture)" && ls | rpm -qa
+RUN (cd / && apt-cache policy curl)
+FROM ${BASE}
+RUN dpkg -l`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	// apt-get commands that were converted away are not reported, nor are stages that weren't converted
+	expected := []Diagnostic{
+		{Line: 3, Message: "RUN still uses apt-get, which is not available in Chainguard Images, consider removing it"},
+		{Line: 4, Message: "RUN still uses dpkg, which is not available in Chainguard Images, consider removing it"},
+		{Line: 5, Message: "RUN still uses dpkg, which is not available in Chainguard Images, consider removing it"},
+		{Line: 5, Message: "RUN still uses rpm, which is not available in Chainguard Images, consider removing it"},
+		{Line: 6, Message: "RUN still uses apt-cache, which is not available in Chainguard Images, consider removing it"},
+	}
+	if diff := cmp.Diff(expected, converted.Diagnostics()); diff != "" {
+		t.Errorf("diagnostics not as expected (-want, +got):\n%s", diff)
+	}
+}
+
+func TestArgInFromTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{
+			name: "ARG tag in a stage with RUN commands",
+			raw: `ARG VERSION=18
+FROM node:${VERSION}
+RUN apt-get install -y curl
+`,
+			expected: `ARG VERSION=18
+FROM cgr.dev/ORG/node:${VERSION}-dev
+USER root
+RUN apk add --no-cache curl
+`,
+		},
+		{
+			name: "ARG tag in a stage without RUN commands",
+			raw: `ARG VERSION=18
+FROM node:${VERSION}
+COPY . .
+`,
+			expected: `ARG VERSION=18
+FROM cgr.dev/ORG/node:${VERSION}
+COPY . .
+`,
+		},
+		{
+			name: "only stages with RUN commands get -dev",
+			raw: `ARG VERSION=18
+FROM node:$VERSION AS build
+RUN npm ci
+FROM node:$VERSION
+COPY --from=build /app /app
+`,
+			expected: `ARG VERSION=18
+FROM cgr.dev/ORG/node:$VERSION-dev AS build
+RUN npm ci
+FROM cgr.dev/ORG/node:$VERSION
+COPY --from=build /app /app
+`,
+		},
+		{
+			name: "variant suffix after the variable is dropped",
+			raw: `ARG VERSION=18
+FROM node:${VERSION}-slim
+RUN npm ci
+`,
+			expected: `ARG VERSION=18
+FROM cgr.dev/ORG/node:${VERSION}-dev
+RUN npm ci
+`,
+		},
+		{
+			name: "variable with a default value",
+			raw: `FROM python:${PYTHON_VERSION:-3.12}-slim
+RUN pip install flask
+`,
+			expected: `FROM cgr.dev/ORG/python:${PYTHON_VERSION:-3.12}-dev
+RUN pip install flask
+`,
+		},
+		{
+			name: "registry with a port",
+			raw: `FROM localhost:5000/node:${VERSION}
+COPY . .
+`,
+			expected: `FROM cgr.dev/ORG/node:${VERSION}
+COPY . .
+`,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.String()); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRuntimePackageManagerDiagnostics(t *testing.T) {
+	content := `FROM debian:12
+RUN apt-get update && apt-get install -y nginx
+CMD apt-get update && nginx -g 'daemon off;'
+ENTRYPOINT yum install -y curl; exec "$@"
+CMD ["apt-get", "update"]
+FROM ${BASE}
+CMD apt-get update`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	// Only shell forms in converted stages are reported, and the lines are left unchanged
+	expected := []Diagnostic{
+		{Line: 3, Message: "CMD runs apt-get when the container starts, which is not available in Chainguard Images and installs packages at runtime, consider installing the packages with a RUN directive instead"},
+		{Line: 4, Message: "ENTRYPOINT runs yum when the container starts, which is not available in Chainguard Images and installs packages at runtime, consider installing the packages with a RUN directive instead"},
+	}
+	if diff := cmp.Diff(expected, converted.Diagnostics()); diff != "" {
+		t.Errorf("diagnostics not as expected (-want, +got):\n%s", diff)
+	}
+	for i, line := range converted.Lines {
+		if line.Cmd == nil && line.Entrypoint == nil {
+			continue
+		}
+		if line.Converted != "" {
+			t.Errorf("line %d: expected no conversion, got %q", i+1, line.Converted)
+		}
+	}
+}
+
+func TestNoDevSuffix(t *testing.T) {
+	content := `ARG BASE=python:3.12
+FROM golang:1.22.3 AS build
+RUN go build ./...
+FROM ${BASE}
+RUN pip install flask
+FROM node:${VERSION}
+RUN npm ci
+FROM debian
+RUN apt-get install -y curl
+`
+
+	tests := []struct {
+		name        string
+		noDevSuffix bool
+		expected    string
+	}{
+		{
+			name: "default adds -dev to stages with RUN commands",
+			expected: `ARG BASE=cgr.dev/ORG/python:3.12-dev
+FROM cgr.dev/ORG/go:1.22-dev AS build
+RUN go build ./...
+FROM ${BASE}
+RUN pip install flask
+FROM cgr.dev/ORG/node:${VERSION}-dev
+RUN npm ci
+FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+RUN apk add --no-cache curl
+`,
+		},
+		{
+			name:        "no dev suffix",
+			noDevSuffix: true,
+			expected: `ARG BASE=cgr.dev/ORG/python:3.12
+FROM cgr.dev/ORG/go:1.22 AS build
+RUN go build ./...
+FROM ${BASE}
+RUN pip install flask
+FROM cgr.dev/ORG/node:${VERSION}
+RUN npm ci
+FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+RUN apk add --no-cache curl
+`,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(content))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true, NoDevSuffix: tt.noDevSuffix})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.String()); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRemoteExecDiagnostics(t *testing.T) {
+	content := `FROM debian:12
+RUN curl -fsSL https://example.com/install.sh | sh
+RUN curl -fsSL -o /tmp/install.sh https://example.com/install.sh && sh /tmp/install.sh
+RUN wget -qO- https://example.com/install.sh | sudo bash -s -- --yes
+RUN (cd /tmp && curl -sL https://example.com/app.tar.gz | tar xz)
+RUN curl -s https://example.com/install.sh | tee install.sh | bash
+RUN curl -fsSL https://example.com/install.sh|sh
+RUN wget -qO- https://example.com/install.sh|bash
+RUN curl -s https://example.com/list.txt | grep "a|sh"
+FROM ${BASE}
+RUN wget -O - https://example.com/install.sh | sh`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	// Downloads that are saved to a file or piped into something other than a shell are not reported,
+	// stages that weren't converted are
+	expected := []Diagnostic{
+		{Line: 2, Message: "RUN pipes the output of curl into sh, which runs a remote script without verifying it, consider downloading the script and checking its checksum before running it"},
+		{Line: 4, Message: "RUN pipes the output of wget into bash, which runs a remote script without verifying it, consider downloading the script and checking its checksum before running it"},
+		{Line: 6, Message: "RUN pipes the output of curl into bash, which runs a remote script without verifying it, consider downloading the script and checking its checksum before running it"},
+		{Line: 7, Message: "RUN pipes the output of curl into sh, which runs a remote script without verifying it, consider downloading the script and checking its checksum before running it"},
+		{Line: 8, Message: "RUN pipes the output of wget into bash, which runs a remote script without verifying it, consider downloading the script and checking its checksum before running it"},
+		{Line: 11, Message: "RUN pipes the output of wget into sh, which runs a remote script without verifying it, consider downloading the script and checking its checksum before running it"},
+	}
+	if diff := cmp.Diff(expected, converted.Diagnostics()); diff != "" {
+		t.Errorf("diagnostics not as expected (-want, +got):\n%s", diff)
+	}
+	for i, line := range converted.Lines {
+		if line.Run != nil && line.Converted != "" {
+			t.Errorf("line %d: expected RUN to be left unchanged, got %q", i+1, line.Converted)
+		}
+	}
+}
+
+func TestFileReadPackageLists(t *testing.T) {
+	content := `FROM debian:12
+RUN apt-get install -y $(<pkgs.txt) curl
+RUN apt-get install -y $(< "build-deps.txt")
+RUN apt-get install -y $(cat pkgs.txt)
+RUN apt-get install -y $(grep -v '^#' pkgs.txt)`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+
+	// $(<file) is a single opaque argument, not a "<" redirection or a package
+	if diff := cmp.Diff([]string{"install", "-y", "$(<pkgs.txt)", "curl"}, dockerfile.Lines[1].Run.Shell.Before.Parts[0].Args); diff != "" {
+		t.Errorf("args mismatch (-want, +got):\n%s", diff)
+	}
+
+	converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	expected := `FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+RUN apk add --no-cache $(<pkgs.txt) curl
+RUN apk add --no-cache $(< "build-deps.txt")
+RUN apk add --no-cache $(cat pkgs.txt)
+RUN apk add --no-cache $(grep -v '^#' pkgs.txt)
+`
+	if diff := cmp.Diff(expected, converted.String()); diff != "" {
+		t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"curl"}, converted.Lines[1].Run.Packages); diff != "" {
+		t.Errorf("packages mismatch (-want, +got):\n%s", diff)
+	}
+
+	expectedDiagnostics := []Diagnostic{
+		{Line: 2, Message: "manual review needed: apt-get install packages were not mapped since they are read from the file pkgs.txt with $(<pkgs.txt)"},
+		{Line: 3, Message: `manual review needed: apt-get install packages were not mapped since they are read from the file build-deps.txt with $(< "build-deps.txt")`},
+		{Line: 4, Message: "manual review needed: apt-get install packages were not mapped since they are read from the file pkgs.txt with $(cat pkgs.txt)"},
+		{Line: 5, Message: "manual review needed: apt-get install packages were not mapped since they come from the command substitution $(grep -v '^#' pkgs.txt)"},
+	}
+	if diff := cmp.Diff(expectedDiagnostics, converted.Diagnostics()); diff != "" {
+		t.Errorf("diagnostics not as expected (-want, +got):\n%s", diff)
+	}
+}
+
+func TestConvertBytes(t *testing.T) {
+	ctx := context.Background()
+	raw := []byte("FROM node:20\nRUN apt-get update && apt-get install -y nano\n")
+
+	got, err := ConvertBytes(ctx, raw, Options{Organization: "example.com", Offline: true})
+	if err != nil {
+		t.Fatalf("ConvertBytes failed: %v", err)
+	}
+
+	// Same result as parsing and converting separately
+	dockerfile, err := ParseDockerfile(ctx, raw)
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	converted, err := dockerfile.Convert(ctx, Options{Organization: "example.com", Offline: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	if diff := cmp.Diff(converted.String(), string(got)); diff != "" {
+		t.Errorf("ConvertBytes() mismatch (-want, +got):\n%s", diff)
+	}
+
+	if _, err := ConvertBytes(ctx, raw, Options{Catalog: "missing", Offline: true}); err == nil {
+		t.Error("expected an error for a conversion that fails")
+	}
+}
+
+func TestSimulatedInstalls(t *testing.T) {
+	tests := []struct {
+		name               string
+		raw                string
+		expectedDiagnostic string
+	}{
+		{
+			name:               "apt-get -s install",
+			raw:                `RUN apt-get update && apt-get -s install -y curl`,
+			expectedDiagnostic: "manual review needed: RUN was left unchanged since apt-get install -s only simulates the install",
+		},
+		{
+			name:               "apt-get --dry-run after install",
+			raw:                `RUN apt-get install --dry-run curl`,
+			expectedDiagnostic: "manual review needed: RUN was left unchanged since apt-get install --dry-run only simulates the install",
+		},
+		{
+			name:               "apt --print-uris",
+			raw:                `RUN apt install --print-uris -qq curl | cut -d"'" -f2`,
+			expectedDiagnostic: "manual review needed: RUN was left unchanged since apt install --print-uris only simulates the install",
+		},
+		{
+			name:               "dnf --assumeno",
+			raw:                `RUN dnf install --assumeno git`,
+			expectedDiagnostic: "manual review needed: RUN was left unchanged since dnf install --assumeno only simulates the install",
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if converted.Lines[0].Converted != "" {
+				t.Errorf("expected the line to be left unchanged, got %q", converted.Lines[0].Converted)
+			}
+			if diff := cmp.Diff([]string{tt.expectedDiagnostic}, converted.Lines[0].Diagnostics); diff != "" {
+				t.Errorf("diagnostics not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+
+	// Display flags don't change what is installed, they are dropped like other apt flags
+	dockerfile, err := ParseDockerfile(ctx, []byte(`RUN apt-get install -V --verbose-versions -y curl`))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	if diff := cmp.Diff(`RUN apk add --no-cache curl`, converted.Lines[0].Converted); diff != "" {
+		t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+	}
+}
+
+func TestArgStageReference(t *testing.T) {
+	tests := []struct {
+		name            string
+		raw             string
+		expected        string
+		expectedParents []int // Parent of each FROM line, in order
+	}{
+		{
+			name: "ARG default names a stage",
+			raw: `ARG BUILD_STAGE=build
+FROM golang:1.22 AS build
+RUN go build -o /app .
+FROM ${BUILD_STAGE} AS final
+CMD ["/app"]
+`,
+			expected: `ARG BUILD_STAGE=build
+FROM cgr.dev/ORG/go:1.22-dev AS build
+RUN go build -o /app .
+FROM ${BUILD_STAGE} AS final
+CMD ["/app"]
+`,
+			expectedParents: []int{0, 1},
+		},
+		{
+			name: "quoted ARG default and $NAME form",
+			raw: `ARG BUILD_STAGE="Build"
+FROM golang:1.22 AS build
+FROM $BUILD_STAGE
+`,
+			expected: `ARG BUILD_STAGE="Build"
+FROM cgr.dev/ORG/go:1.22 AS build
+FROM $BUILD_STAGE
+`,
+			expectedParents: []int{0, 1},
+		},
+		{
+			name: "default value in the reference",
+			raw: `FROM golang:1.22 AS build
+FROM ${STAGE:-build}
+`,
+			expected: `FROM cgr.dev/ORG/go:1.22 AS build
+FROM ${STAGE:-build}
+`,
+			expectedParents: []int{0, 1},
+		},
+		{
+			name: "ARG that is not a stage name is still converted as an image",
+			raw: `ARG BASE=python:3.12
+FROM golang:1.22 AS build
+FROM ${BASE}
+`,
+			expected: `ARG BASE=cgr.dev/ORG/python:3.12
+FROM cgr.dev/ORG/go:1.22 AS build
+FROM ${BASE}
+`,
+			expectedParents: []int{0, 0},
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.String()); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+
+			var parents []int
+			for _, line := range converted.Lines {
+				if line.From != nil {
+					parents = append(parents, line.From.Parent)
+				}
+			}
+			if diff := cmp.Diff(tt.expectedParents, parents); diff != "" {
+				t.Errorf("parents not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestIndentStyle(t *testing.T) {
+	raw := `FROM debian:12
+RUN echo hello ; apt-get update && apt-get install -y curl && echo done`
+
+	tests := []struct {
+		name        string
+		indentStyle string
+		expected    string
+	}{
+		{
+			name: "default is four spaces",
+			expected: "RUN echo hello ; \\\n" +
+				"    apk add --no-cache curl && \\\n" +
+				"    echo done",
+		},
+		{
+			name:        "tabs",
+			indentStyle: "\t",
+			expected: "RUN echo hello ; \\\n" +
+				"\tapk add --no-cache curl && \\\n" +
+				"\techo done",
+		},
+		{
+			name:        "two spaces",
+			indentStyle: "  ",
+			expected: "RUN echo hello ; \\\n" +
+				"  apk add --no-cache curl && \\\n" +
+				"  echo done",
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true, IndentStyle: tt.indentStyle})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[1].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNumericCopyFromConversion(t *testing.T) {
+	tests := []struct {
+		name               string
+		raw                string
+		expected           string
+		expectedFromStage  int // FromStage of the COPY line
+		expectedDiagnostic bool
+	}{
+		{
+			name: "first unnamed stage",
+			raw: `FROM golang:1.22
+RUN go build -o /app .
+FROM debian:12
+COPY --from=0 /app /app
+`,
+			expected: `FROM cgr.dev/ORG/go:1.22-dev
+RUN go build -o /app .
+FROM cgr.dev/ORG/chainguard-base:latest
+COPY --from=0 /app /app
+`,
+			expectedFromStage: 1,
+		},
+		{
+			name: "second stage by index alongside a named stage",
+			raw: `FROM golang:1.22 AS build
+FROM node:20
+FROM debian:12
+COPY --from=1 /usr/local/bin/node /node
+`,
+			expected: `FROM cgr.dev/ORG/go:1.22 AS build
+FROM cgr.dev/ORG/node:20
+FROM cgr.dev/ORG/chainguard-base:latest
+COPY --from=1 /usr/local/bin/node /node
+`,
+			expectedFromStage: 2,
+		},
+		{
+			name: "index that is not an earlier stage is not converted as an image",
+			raw: `FROM golang:1.22
+FROM debian:12
+COPY --from=3 /app /app
+`,
+			expected: `FROM cgr.dev/ORG/go:1.22
+FROM cgr.dev/ORG/chainguard-base:latest
+COPY --from=3 /app /app
+`,
+			expectedDiagnostic: true,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true, ConvertCopyFrom: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.String()); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+
+			var copyLine *DockerfileLine
+			for _, line := range converted.Lines {
+				if line.Copy != nil {
+					copyLine = line
+				}
+			}
+			if copyLine == nil {
+				t.Fatalf("expected COPY details")
+			}
+			if copyLine.Copy.FromStage != tt.expectedFromStage {
+				t.Errorf("FromStage = %d, want %d", copyLine.Copy.FromStage, tt.expectedFromStage)
+			}
+			if copyLine.Copy.FromImage != "" {
+				t.Errorf("FromImage = %q, want empty", copyLine.Copy.FromImage)
+			}
+			if got := len(copyLine.Diagnostics) > 0; got != tt.expectedDiagnostic {
+				t.Errorf("diagnostics = %v, want diagnostic: %v", copyLine.Diagnostics, tt.expectedDiagnostic)
+			}
+		})
+	}
+}
+
+func TestAnnotateOriginal(t *testing.T) {
+	raw := `ARG BASE=python:3.12
+FROM golang:1.22 AS build
+RUN apt-get update && \
+    apt-get install -y nginx
+FROM ${BASE}
+RUN echo done
+`
+	expected := `# dfc: was: ARG BASE=python:3.12
+ARG BASE=cgr.dev/ORG/python:3.12-dev
+# dfc: was: FROM golang:1.22 AS build
+FROM cgr.dev/ORG/go:1.22-dev AS build
+USER root
+# dfc: was: RUN apt-get update && \
+# dfc: was:     apt-get install -y nginx
+RUN apk add --no-cache nginx
+FROM ${BASE}
+RUN echo done
+`
+
+	ctx := context.Background()
+	opts := Options{Offline: true, AnnotateOriginal: true}
+	convert := func(t *testing.T, raw string) string {
+		t.Helper()
+		dockerfile, err := ParseDockerfile(ctx, []byte(raw))
+		if err != nil {
+			t.Fatalf("ParseDockerfile failed: %v", err)
+		}
+		converted, err := dockerfile.Convert(ctx, opts)
+		if err != nil {
+			t.Fatalf("Convert failed: %v", err)
+		}
+		return converted.String()
+	}
+
+	result := convert(t, raw)
+	if diff := cmp.Diff(expected, result); diff != "" {
+		t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+	}
+
+	t.Run("converting again doesn't stack comments", func(t *testing.T) {
+		if diff := cmp.Diff(expected, convert(t, result)); diff != "" {
+			t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+		}
+	})
+
+	t.Run("a stale comment is replaced for a line converted again", func(t *testing.T) {
+		partial := `FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+# dfc: was: RUN apt-get install -y nginx
+RUN apt-get install -y curl
+# dfc: was: RUN apt-get install -y git
+# dfc: was: RUN apt-get install -y \
+# dfc: was:     git
+RUN apt-get install -y \
+    make
+`
+		want := `FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+# dfc: was: RUN apt-get install -y curl
+RUN apk add --no-cache curl
+# dfc: was: RUN apt-get install -y \
+# dfc: was:     make
+RUN apk add --no-cache make
+`
+		if diff := cmp.Diff(want, convert(t, partial)); diff != "" {
+			t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+		}
+	})
+
+	t.Run("FROM with only USER root added is not annotated", func(t *testing.T) {
+		want := `FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+# dfc: was: RUN apt-get install -y curl
+RUN apk add --no-cache curl
+`
+		if diff := cmp.Diff(want, convert(t, "FROM cgr.dev/ORG/chainguard-base:latest\nRUN apt-get install -y curl\n")); diff != "" {
+			t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+		}
+	})
+}
+
+func TestDirectiveWhitespace(t *testing.T) {
+	raw := "FROM\tnode:18 AS  build\n" +
+		"RUN   apt-get update && apt-get install -y curl\n" +
+		"run\tapt-get install -y git\n" +
+		"FROM --platform\tlinux/amd64\tpython:3.12\tAS\tfinal\n" +
+		"ARG\tVERSION=1\n" +
+		"COPY  --from=build /app /app\n" +
+		"USER\tnode\n"
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(raw))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+
+	lines := dockerfile.Lines
+	if diff := cmp.Diff(&FromDetails{Base: "node", Tag: "18", Alias: "build", Orig: "node:18"}, lines[0].From); diff != "" {
+		t.Errorf("FROM with a tab not as expected (-want, +got):\n%s", diff)
+	}
+	if lines[1].Run == nil || lines[2].Run == nil {
+		t.Errorf("expected RUN details for RUN with doubled spaces and with a tab")
+	}
+	if diff := cmp.Diff(&FromDetails{Base: "python", Tag: "3.12", Alias: "final", Orig: "python:3.12", Platform: "linux/amd64"}, lines[3].From); diff != "" {
+		t.Errorf("FROM with tabs around --platform and AS not as expected (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(&ArgDetails{Name: "VERSION", DefaultValue: "1"}, lines[4].Arg); diff != "" {
+		t.Errorf("ARG with a tab not as expected (-want, +got):\n%s", diff)
+	}
+	if lines[5].Copy == nil || lines[5].Copy.FromStage != 1 {
+		t.Errorf("expected COPY --from=build to refer to stage 1, got %+v", lines[5].Copy)
+	}
+	if lines[6].User == nil || lines[6].User.User != "node" {
+		t.Errorf("expected USER node, got %+v", lines[6].User)
+	}
+
+	converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	expected := `FROM cgr.dev/ORG/node:18-dev AS build
+USER root
+RUN apk add --no-cache curl
+run apk add --no-cache git
+FROM --platform=linux/amd64 cgr.dev/ORG/python:3.12 AS final
+ARG	VERSION=1
+COPY  --from=build /app /app
+USER	node
+`
+	if diff := cmp.Diff(expected, converted.String()); diff != "" {
+		t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+	}
+}
+
+func TestCommentOnContinuedLine(t *testing.T) {
+	tests := []struct {
+		name               string
+		raw                string
+		expected           string
+		expectedDiagnostic bool
+	}{
+		{
+			name: "comment before the line continuation",
+			raw: `FROM debian
+RUN apt-get update && \
+    apt-get install -y nginx # web server \
+    curl && \
+    echo done
+`,
+			expected: `FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+# web server
+RUN apk add --no-cache curl nginx && \
+    echo done
+`,
+			expectedDiagnostic: true,
+		},
+		{
+			name: "comment after the line continuation",
+			raw: `FROM debian
+RUN apt-get install -y git \ # vcs
+    make
+`,
+			expected: `FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+# vcs
+RUN apk add --no-cache git make
+`,
+			expectedDiagnostic: true,
+		},
+		{
+			name: "comment after the line continuation at the end of the file",
+			raw: `FROM debian
+RUN apt-get install -y git \ # vcs`,
+			expected: `FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+# vcs
+RUN apk add --no-cache git
+`,
+			expectedDiagnostic: true,
+		},
+		{
+			name: "comment after the line continuation followed by a directive",
+			raw: `FROM debian
+RUN apt-get install -y nginx \ # note
+RUN apt-get install -y curl
+`,
+			expected: `FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+RUN apk add --no-cache nginx
+RUN apk add --no-cache curl
+`,
+		},
+		{
+			name: "hash that doesn't start a comment",
+			raw: `FROM debian
+RUN apt-get install -y git && \
+    echo ${VERSION#v} \
+    http://example.com/#top
+`,
+			expected: `FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+RUN apk add --no-cache git && \
+    echo ${VERSION#v} http://example.com/#top
+`,
+		},
+		{
+			name: "comment on the last line only",
+			raw: `FROM debian
+RUN apt-get install -y \
+    git # vcs
+`,
+			expected: `FROM cgr.dev/ORG/chainguard-base:latest
+USER root
+RUN apk add --no-cache git
+`,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.String()); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+			if got := len(converted.Diagnostics()) > 0; got != tt.expectedDiagnostic {
+				t.Errorf("diagnostics = %v, want diagnostic: %v", converted.Diagnostics(), tt.expectedDiagnostic)
+			}
+		})
+	}
+}
+
+func TestCRLFLineEndings(t *testing.T) {
+	raw := "# build image\r\n" +
+		"FROM debian:12 AS build\r\n" +
+		"RUN apt-get update && \\\r\n" +
+		"    apt-get install -y curl\r\n" +
+		"\r\n" +
+		"FROM build\r\n" +
+		"COPY . /app\r\n"
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(raw))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	if !dockerfile.CRLF {
+		t.Errorf("expected CRLF line endings to be detected")
+	}
+	if diff := cmp.Diff(&FromDetails{Base: "debian", Tag: "12", Alias: "build", Orig: "debian:12"}, dockerfile.Lines[0].From); diff != "" {
+		t.Errorf("FROM not as expected (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("RUN apt-get update && \\\n    apt-get install -y curl", dockerfile.Lines[1].Raw); diff != "" {
+		t.Errorf("RUN not as expected (-want, +got):\n%s", diff)
+	}
+	if dockerfile.Lines[2].From == nil || dockerfile.Lines[2].From.Parent != 1 {
+		t.Errorf("expected FROM build to refer to stage 1, got %+v", dockerfile.Lines[2].From)
+	}
+	for _, line := range dockerfile.Lines {
+		if strings.Contains(line.Raw+line.Extra, "\r") {
+			t.Errorf("unexpected \\r in line %q", line.Raw)
+		}
+	}
+
+	// The unconverted Dockerfile round-trips byte for byte
+	if diff := cmp.Diff(raw, dockerfile.String()); diff != "" {
+		t.Errorf("round trip not as expected (-want, +got):\n%s", diff)
+	}
+
+	converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	expected := "# build image\r\n" +
+		"FROM cgr.dev/ORG/chainguard-base:latest AS build\r\n" +
+		"USER root\r\n" +
+		"RUN apk add --no-cache curl\r\n" +
+		"\r\n" +
+		"FROM build\r\n" +
+		"COPY . /app\r\n"
+	if diff := cmp.Diff(expected, converted.String()); diff != "" {
+		t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+	}
+
+	// Files with mixed line endings are written with \n
+	mixed, err := ParseDockerfile(ctx, []byte("FROM debian\r\nRUN echo hello\n"))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	if diff := cmp.Diff("FROM debian\nRUN echo hello\n", mixed.String()); diff != "" {
+		t.Errorf("mixed line endings not as expected (-want, +got):\n%s", diff)
+	}
+}
+
+func TestRehomeChainguardImages(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		opts     Options
+		expected string
+	}{
+		{
+			name:     "org is replaced and the tag is kept",
+			raw:      "FROM cgr.dev/someorg/python:3.12.1",
+			opts:     Options{Organization: "myorg"},
+			expected: "FROM cgr.dev/myorg/python:3.12.1\n",
+		},
+		{
+			name:     "image without a builtin mapping",
+			raw:      "FROM cgr.dev/someorg/my-app:1.0",
+			opts:     Options{Organization: "myorg"},
+			expected: "FROM cgr.dev/myorg/my-app:1.0\n",
+		},
+		{
+			name:     "prefixed tag is kept",
+			raw:      "FROM cgr.dev/someorg/jdk:openjdk-17",
+			opts:     Options{Organization: "myorg"},
+			expected: "FROM cgr.dev/myorg/jdk:openjdk-17\n",
+		},
+		{
+			name:     "dev tag is kept in a stage without RUN lines",
+			raw:      "FROM cgr.dev/someorg/node:latest-dev AS build",
+			opts:     Options{Organization: "myorg"},
+			expected: "FROM cgr.dev/myorg/node:latest-dev AS build\n",
+		},
+		{
+			name:     "missing tag becomes latest",
+			raw:      "FROM cgr.dev/someorg/node",
+			opts:     Options{Organization: "myorg"},
+			expected: "FROM cgr.dev/myorg/node:latest\n",
+		},
+		{
+			name:     "digest is kept",
+			raw:      "FROM cgr.dev/someorg/node:22@sha256:3b1f",
+			opts:     Options{Organization: "myorg"},
+			expected: "FROM cgr.dev/myorg/node:22@sha256:3b1f\n",
+		},
+		{
+			name:     "dev suffix is added for a stage with RUN lines and the digest is dropped",
+			raw:      "FROM cgr.dev/someorg/node:22@sha256:3b1f\nRUN apt-get install -y git",
+			opts:     Options{Organization: "myorg"},
+			expected: "FROM cgr.dev/myorg/node:22-dev\nUSER root\nRUN apk add --no-cache git\n",
+		},
+		{
+			name:     "image without a dev variant",
+			raw:      "FROM cgr.dev/someorg/chainguard-base:latest\nRUN apt-get install -y git",
+			opts:     Options{Organization: "myorg"},
+			expected: "FROM cgr.dev/myorg/chainguard-base:latest\nUSER root\nRUN apk add --no-cache git\n",
+		},
+		{
+			name:     "registry",
+			raw:      "FROM cgr.dev/someorg/node:22.1",
+			opts:     Options{Registry: "registry.example.com/mirror"},
+			expected: "FROM registry.example.com/mirror/node:22.1\n",
+		},
+		{
+			name:     "COPY --from image",
+			raw:      "FROM cgr.dev/someorg/static:latest\nCOPY --from=cgr.dev/someorg/node:22.1 /usr/bin/node /usr/bin/node\n",
+			opts:     Options{Organization: "myorg", ConvertCopyFrom: true},
+			expected: "FROM cgr.dev/myorg/static:latest\nCOPY --from=cgr.dev/myorg/node:22.1 /usr/bin/node /usr/bin/node\n",
+		},
+		{
+			name:     "ARG used as base image",
+			raw:      "ARG BASE=cgr.dev/someorg/node:22.1\nFROM ${BASE}\n",
+			opts:     Options{Organization: "myorg"},
+			expected: "ARG BASE=cgr.dev/myorg/node:22.1\nFROM ${BASE}\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+
+			converted, err := dockerfile.Convert(ctx, tt.opts)
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.String()); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFromOnly(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		opts     Options
+		expected string
+		manager  Manager
+	}{
+		{
+			name:     "RUN with package install is kept and runs as root",
+			raw:      "FROM debian:12\nRUN apt-get update && apt-get install -y curl\n",
+			expected: "FROM cgr.dev/ORG/chainguard-base:latest\nUSER root\nRUN apt-get update && apt-get install -y curl\n",
+			manager:  ManagerAptGet,
+		},
+		{
+			name:     "RUN without package install is kept",
+			raw:      "FROM python:3.12\nRUN pip install flask\n",
+			expected: "FROM cgr.dev/ORG/python:3.12-dev\nRUN pip install flask\n",
+		},
+		{
+			name:     "non-root USER is switched around the install",
+			raw:      "FROM debian:12\nUSER app\nRUN apt-get install -y git\nCMD [\"git\"]\n",
+			expected: "FROM cgr.dev/ORG/chainguard-base:latest\nUSER app\nUSER root\nRUN apt-get install -y git\nUSER app\nCMD [\"git\"]\n",
+			manager:  ManagerAptGet,
+		},
+		{
+			name:     "ARG base image is converted",
+			raw:      "ARG BASE=node:20\nFROM ${BASE}\nRUN yum install -y git\n",
+			expected: "ARG BASE=cgr.dev/ORG/node:20-dev\nFROM ${BASE}\nUSER root\nRUN yum install -y git\n",
+			manager:  ManagerYum,
+		},
+		{
+			name:     "original lines are only annotated for base images",
+			raw:      "FROM debian:12\nUSER app\nRUN apt-get install -y git\n",
+			opts:     Options{AnnotateOriginal: true},
+			expected: "# dfc: was: FROM debian:12\nFROM cgr.dev/ORG/chainguard-base:latest\nUSER app\nUSER root\nRUN apt-get install -y git\nUSER app\n",
+			manager:  ManagerAptGet,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+
+			tt.opts.FromOnly = true
+			converted, err := dockerfile.Convert(ctx, tt.opts)
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.String()); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+
+			for _, line := range converted.Lines {
+				if line.Run == nil {
+					continue
+				}
+				if line.Run.Shell.After != nil {
+					t.Errorf("expected RUN line %q to be kept as it is", line.Raw)
+				}
+				if line.Run.Manager != tt.manager {
+					t.Errorf("expected manager %q, got %q", tt.manager, line.Run.Manager)
+				}
+				// The package managers are kept on purpose, so there is nothing to review
+				if len(line.Diagnostics) > 0 {
+					t.Errorf("expected no diagnostics for RUN line %q, got %q", line.Raw, line.Diagnostics)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveTagDefaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{
+			name:     "default value",
+			raw:      "FROM node:${TAG:-18}\n",
+			expected: "FROM cgr.dev/ORG/node:18\n",
+		},
+		{
+			name:     "assigned default value in a stage with RUN commands",
+			raw:      "FROM node:${TAG:=18.2.1}\nRUN npm ci\n",
+			expected: "FROM cgr.dev/ORG/node:18.2-dev\nRUN npm ci\n",
+		},
+		{
+			name:     "nested default value",
+			raw:      "FROM python:${TAG:-${PYTHON_VERSION:-3.12.4}}-slim\n",
+			expected: "FROM cgr.dev/ORG/python:3.12\n",
+		},
+		{
+			name:     "ARG without a value is kept dynamic",
+			raw:      "ARG TAG\nFROM node:${TAG:-18}\n",
+			expected: "ARG TAG\nFROM cgr.dev/ORG/node:${TAG:-18}\n",
+		},
+		{
+			name:     "ARG with a value is kept dynamic",
+			raw:      "ARG TAG=20\nFROM node:${TAG:-18}\n",
+			expected: "ARG TAG=20\nFROM cgr.dev/ORG/node:${TAG:-18}\n",
+		},
+		{
+			name:     "alternate value is kept dynamic",
+			raw:      "FROM node:${TAG:+18}\n",
+			expected: "FROM cgr.dev/ORG/node:${TAG:+18}\n",
+		},
+		{
+			name:     "variable without a default is kept dynamic",
+			raw:      "FROM node:${TAG:-18}-${VARIANT}\n",
+			expected: "FROM cgr.dev/ORG/node:${TAG:-18}-${VARIANT}\n",
+		},
+		{
+			name:     "nested variable without a default is kept dynamic",
+			raw:      "FROM node:${TAG:-$VERSION}\n",
+			expected: "FROM cgr.dev/ORG/node:${TAG:-$VERSION}\n",
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true, ResolveTagDefaults: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.String()); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPackagesOnly(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		opts     Options
+		expected string
+	}{
+		{
+			name:     "FROM is kept and USER root is added for the install",
+			raw:      "FROM registry.example.com/approved/node:20 AS build\nRUN apt-get update && apt-get install -y curl\n",
+			expected: "FROM registry.example.com/approved/node:20 AS build\nUSER root\nRUN apk add --no-cache curl\n",
+		},
+		{
+			name:     "stage without installs is kept",
+			raw:      "FROM debian:12\nCOPY . /app\nRUN make\n",
+			expected: "FROM debian:12\nCOPY . /app\nRUN make\n",
+		},
+		{
+			name:     "ARG base image and COPY --from image are kept",
+			raw:      "ARG BASE=node:20\nFROM ${BASE}\nCOPY --from=nginx:1.25 /etc/nginx /etc/nginx\nRUN yum install -y git\n",
+			opts:     Options{ConvertCopyFrom: true},
+			expected: "ARG BASE=node:20\nFROM ${BASE}\nUSER root\nCOPY --from=nginx:1.25 /etc/nginx /etc/nginx\nRUN apk add --no-cache git\n",
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+
+			tt.opts.PackagesOnly = true
+			converted, err := dockerfile.Convert(ctx, tt.opts)
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.String()); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("cannot be used with FromOnly", func(t *testing.T) {
+		dockerfile, err := ParseDockerfile(ctx, []byte("FROM debian:12\n"))
+		if err != nil {
+			t.Fatalf("ParseDockerfile failed: %v", err)
+		}
+		if _, err := dockerfile.Convert(ctx, Options{FromOnly: true, PackagesOnly: true}); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
+
+func TestPrivateRegistryMappingWithoutTag(t *testing.T) {
+	mappings := MappingsConfig{
+		Images: map[string]string{
+			"myregistry.com/base":        "node",
+			"myregistry.com/team/base":   "python:3.12",
+			"myregistry.com:5000/tools":  "go",
+			"myregistry.com/jdk-runtime": "jre",
+		},
+	}
+
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{
+			name:     "latest without RUN commands",
+			raw:      "FROM myregistry.com/base\nCOPY . /app\n",
+			expected: "FROM cgr.dev/ORG/node:latest\nCOPY . /app\n",
+		},
+		{
+			name:     "latest-dev with RUN commands",
+			raw:      "FROM myregistry.com/base AS build\nRUN npm ci\n",
+			expected: "FROM cgr.dev/ORG/node:latest-dev AS build\nRUN npm ci\n",
+		},
+		{
+			name:     "registry with a port",
+			raw:      "FROM myregistry.com:5000/tools\nRUN go build ./...\n",
+			expected: "FROM cgr.dev/ORG/go:latest-dev\nRUN go build ./...\n",
+		},
+		{
+			name:     "tag of the mapping is used",
+			raw:      "FROM myregistry.com/team/base\nRUN pip install flask\n",
+			expected: "FROM cgr.dev/ORG/python:3.12\nRUN pip install flask\n",
+		},
+		{
+			name:     "tag rule of the mapped image does not apply to latest",
+			raw:      "FROM myregistry.com/jdk-runtime\n",
+			expected: "FROM cgr.dev/ORG/jre:latest\n",
+		},
+		{
+			name:     "same repository name under another path is not mapped",
+			raw:      "FROM myregistry.com/other/base\n",
+			expected: "FROM cgr.dev/ORG/base:latest\n",
+		},
+		{
+			name:     "ARG used as base image",
+			raw:      "ARG BASE=myregistry.com/base\nFROM ${BASE}\nRUN npm ci\n",
+			expected: "ARG BASE=cgr.dev/ORG/node:latest-dev\nFROM ${BASE}\nRUN npm ci\n",
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true, ExtraMappings: mappings})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.String()); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestVersionFamilies(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		expected    string
+		packages    []string
+		diagnostics []string
+	}{
+		{
+			name:        "version family becomes a fuzzy version",
+			raw:         `RUN apt-get install -y "nginx=1.18.*" curl=7.88.1-10`,
+			expected:    `RUN apk add --no-cache curl=~7.88.1 "nginx=~1.18"`,
+			packages:    []string{"curl=7.88.1-10", "nginx=1.18.*"},
+			diagnostics: []string{"apt-get install nginx=1.18.* pins nginx to the version family 1.18.*, which was converted to nginx=~1.18 and matches any 1.18 release"},
+		},
+		{
+			name:        "quoted package is mapped",
+			raw:         `RUN apt-get install -y 'build-essential=12.*'`,
+			expected:    `RUN apk add --no-cache 'build-base=~12'`,
+			packages:    []string{"build-essential=12.*"},
+			diagnostics: []string{"apt-get install build-essential=12.* pins build-essential to the version family 12.*, which was converted to build-base=~12 and matches any 12 release"},
+		},
+		{
+			name:     "any version",
+			raw:      "RUN apt-get install -y nginx=*",
+			expected: "RUN apk add --no-cache nginx",
+			packages: []string{"nginx=*"},
+		},
+		{
+			name:        "version pattern is dropped",
+			raw:         "RUN apt-get install -y nginx=1.*.3",
+			expected:    "RUN apk add --no-cache nginx",
+			packages:    []string{"nginx=1.*.3"},
+			diagnostics: []string{"apt-get install nginx=1.*.3 pins nginx to the version pattern 1.*.3, which apk cannot express, the version was dropped and must be pinned manually if needed"},
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte("FROM debian:12\n"+tt.raw+"\n"))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+
+			run := converted.Lines[1]
+			if diff := cmp.Diff(tt.expected, run.Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.packages, run.Run.Packages); diff != "" {
+				t.Errorf("packages not as expected (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.diagnostics, run.Diagnostics); diff != "" {
+				t.Errorf("diagnostics not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLabelParsing(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected LabelDetails
+	}{
+		{
+			name:     "single pair",
+			raw:      "LABEL version=1.0",
+			expected: LabelDetails{"version": "1.0"},
+		},
+		{
+			name:     "multiple pairs with quoted values",
+			raw:      `LABEL org.opencontainers.image.title="My App" version=1.0 "com.example.vendor"='Example Inc'`,
+			expected: LabelDetails{"org.opencontainers.image.title": "My App", "version": "1.0", "com.example.vendor": "Example Inc"},
+		},
+		{
+			name:     "escaped quotes and equals sign in a value",
+			raw:      `LABEL description="say \"hi\"" query="a=b"`,
+			expected: LabelDetails{"description": `say "hi"`, "query": "a=b"},
+		},
+		{
+			name: "continuation lines",
+			raw: `LABEL org.opencontainers.image.source="https://github.com/example/app" \
+      # the license of the app
+      org.opencontainers.image.licenses="Apache-2.0" \
+      org.opencontainers.image.description="An example app"`,
+			expected: LabelDetails{
+				"org.opencontainers.image.source":      "https://github.com/example/app",
+				"org.opencontainers.image.licenses":    "Apache-2.0",
+				"org.opencontainers.image.description": "An example app",
+			},
+		},
+		{
+			name:     "legacy form",
+			raw:      "label maintainer Jane Doe <jane@example.com>",
+			expected: LabelDetails{"maintainer": "Jane Doe <jane@example.com>"},
+		},
+		{
+			name:     "empty value",
+			raw:      `LABEL empty=""`,
+			expected: LabelDetails{"empty": ""},
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "FROM debian:12\n" + tt.raw + "\n"
+			dockerfile, err := ParseDockerfile(ctx, []byte(raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, dockerfile.Lines[1].Labels); diff != "" {
+				t.Errorf("labels not as expected (-want, +got):\n%s", diff)
+			}
+
+			// LABEL lines are never converted, so they are kept byte for byte
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[1].Labels); diff != "" {
+				t.Errorf("converted labels not as expected (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(raw, strings.Replace(converted.String(), "cgr.dev/ORG/chainguard-base:latest", "debian:12", 1)); diff != "" {
+				t.Errorf("round trip not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAddProvenanceLabel(t *testing.T) {
+	label := `LABEL dev.chainguard.dfc.converted="true" dev.chainguard.dfc.version="` + Version() + `"`
+
+	tests := []struct {
+		name     string
+		raw      string
+		opts     Options
+		expected string
+	}{
+		{
+			name:     "added to the final stage",
+			raw:      "FROM golang:1.22 AS build\nRUN go build -o /app\nFROM debian:12\nCOPY --from=build /app /app\n",
+			expected: "FROM cgr.dev/ORG/go:1.22-dev AS build\nRUN go build -o /app\nFROM cgr.dev/ORG/chainguard-base:latest\n" + label + "\nCOPY --from=build /app /app\n",
+		},
+		{
+			name:     "added after USER root",
+			raw:      "FROM debian:12\nRUN apt-get install -y curl\n",
+			expected: "FROM cgr.dev/ORG/chainguard-base:latest\nUSER root\n" + label + "\nRUN apk add --no-cache curl\n",
+		},
+		{
+			name:     "added after an unconverted FROM line",
+			raw:      "FROM debian:12\nRUN apt-get install -y curl\n",
+			opts:     Options{PackagesOnly: true},
+			expected: "FROM debian:12\nUSER root\n" + label + "\nRUN apk add --no-cache curl\n",
+		},
+		{
+			name:     "not added again",
+			raw:      "FROM cgr.dev/ORG/chainguard-base:latest\nLABEL dev.chainguard.dfc.converted=\"true\" dev.chainguard.dfc.version=\"v0.1.0\"\nCOPY . /app\n",
+			expected: "FROM cgr.dev/ORG/chainguard-base:latest\nLABEL dev.chainguard.dfc.converted=\"true\" dev.chainguard.dfc.version=\"v0.1.0\"\nCOPY . /app\n",
+		},
+		{
+			name:     "Dockerfile without FROM",
+			raw:      "ARG VERSION=1\n",
+			expected: "ARG VERSION=1\n",
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			tt.opts.Offline = true
+			tt.opts.AddProvenanceLabel = true
+			converted, err := dockerfile.Convert(ctx, tt.opts)
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.String()); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+
+			// Converting the output again doesn't add another label
+			again, err := ConvertBytes(ctx, []byte(converted.String()), tt.opts)
+			if err != nil {
+				t.Fatalf("ConvertBytes failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, string(again)); diff != "" {
+				t.Errorf("conversion is not idempotent (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLocaleSetupDiagnostics(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		expected    string
+		diagnostics []string
+	}{
+		{
+			name:     "locale-gen and update-locale",
+			raw:      "RUN apt-get update && apt-get install -y locales && locale-gen en_US.UTF-8 && update-locale LANG=en_US.UTF-8",
+			expected: "RUN apk add --no-cache glibc-locales && \\\n    locale-gen en_US.UTF-8 && \\\n    update-locale LANG=en_US.UTF-8",
+			diagnostics: []string{
+				"locale-gen is Debian-specific and not available in Chainguard Images, which have the locales precompiled in the glibc-locales package, consider setting the locale with ENV LANG (e.g. ENV LANG=en_US.UTF-8) instead",
+				"update-locale is Debian-specific and not available in Chainguard Images, which have the locales precompiled in the glibc-locales package, consider setting the locale with ENV LANG (e.g. ENV LANG=en_US.UTF-8) instead",
+			},
+		},
+		{
+			name:     "locale-gen without glibc-locales",
+			raw:      "RUN apt-get install -y curl && /usr/sbin/locale-gen",
+			expected: "RUN apk add --no-cache curl && \\\n    /usr/sbin/locale-gen",
+			diagnostics: []string{
+				"locale-gen is Debian-specific and not available in Chainguard Images, which have the locales precompiled in the glibc-locales package, consider installing it and setting the locale with ENV LANG (e.g. ENV LANG=en_US.UTF-8) instead",
+			},
+		},
+		{
+			name:     "dpkg-reconfigure tzdata",
+			raw:      "RUN apt-get install -y tzdata && ln -fs /usr/share/zoneinfo/UTC /etc/localtime && dpkg-reconfigure -f noninteractive tzdata",
+			expected: "RUN apk add --no-cache tzdata && \\\n    ln -fs /usr/share/zoneinfo/UTC /etc/localtime && \\\n    dpkg-reconfigure -f noninteractive tzdata",
+			diagnostics: []string{
+				"dpkg-reconfigure tzdata is Debian-specific and not available in Chainguard Images, consider setting the timezone with ENV TZ (e.g. ENV TZ=Europe/Berlin) instead",
+			},
+		},
+		{
+			name:     "dpkg-reconfigure tzdata without tzdata",
+			raw:      "RUN apt-get install -y curl && dpkg-reconfigure -f noninteractive tzdata",
+			expected: "RUN apk add --no-cache curl && \\\n    dpkg-reconfigure -f noninteractive tzdata",
+			diagnostics: []string{
+				"dpkg-reconfigure tzdata is Debian-specific and not available in Chainguard Images, consider installing tzdata and setting the timezone with ENV TZ (e.g. ENV TZ=Europe/Berlin) instead",
+			},
+		},
+		{
+			name:     "dpkg-reconfigure locales and another package",
+			raw:      "RUN apt-get install -y locales-all && dpkg-reconfigure locales && dpkg-reconfigure dash",
+			expected: "RUN apk add --no-cache glibc-locales && \\\n    dpkg-reconfigure locales && \\\n    dpkg-reconfigure dash",
+			diagnostics: []string{
+				"dpkg-reconfigure locales is Debian-specific and not available in Chainguard Images, which have the locales precompiled in the glibc-locales package, consider setting the locale with ENV LANG (e.g. ENV LANG=en_US.UTF-8) instead",
+				"RUN still uses dpkg-reconfigure, which is not available in Chainguard Images, consider removing it",
+			},
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte("FROM debian:12\n"+tt.raw+"\n"))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[1].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.diagnostics, converted.Lines[1].Diagnostics); diff != "" {
+				t.Errorf("diagnostics not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSupportedManagersAndDistros(t *testing.T) {
+	managers := SupportedManagers()
+	if len(managers) != len(PackageManagerInfoMap) {
+		t.Errorf("SupportedManagers() returned %d managers, want %d: %v", len(managers), len(PackageManagerInfoMap), managers)
+	}
+	if !slices.IsSorted(managers) {
+		t.Errorf("SupportedManagers() is not sorted: %v", managers)
+	}
+
+	distros := SupportedDistros()
+	if diff := cmp.Diff([]Distro{DistroAlpine, DistroDebian, DistroFedora}, distros); diff != "" {
+		t.Errorf("SupportedDistros() not as expected (-want, +got):\n%s", diff)
+	}
+
+	for manager, info := range PackageManagerInfoMap {
+		if !slices.Contains(managers, manager) {
+			t.Errorf("SupportedManagers() is missing %s", manager)
+		}
+		if !slices.Contains(distros, info.Distro) {
+			t.Errorf("SupportedDistros() is missing %s, the distro of %s", info.Distro, manager)
+		}
+		distro, ok := ManagerDistro(manager)
+		if !ok || distro != info.Distro {
+			t.Errorf("ManagerDistro(%s) = %s, %t, want %s, true", manager, distro, ok, info.Distro)
+		}
+	}
+
+	if distro, ok := ManagerDistro("pacman"); ok {
+		t.Errorf("ManagerDistro(pacman) = %s, true, want false", distro)
+	}
+}
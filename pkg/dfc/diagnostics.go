@@ -0,0 +1,488 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Diagnostic is an advisory about something in the Dockerfile that dfc could
+// not convert automatically and that likely needs manual review
+type Diagnostic struct {
+	Line    int    `json:"line"` // 1-based line number in the original Dockerfile
+	Message string `json:"message"`
+}
+
+// Diagnostics returns the advisories recorded on all lines of the Dockerfile, in order
+func (d *Dockerfile) Diagnostics() []Diagnostic {
+	var diagnostics []Diagnostic
+
+	for lineNumber, line := range d.numberedLines() {
+		for _, message := range line.Diagnostics {
+			diagnostics = append(diagnostics, Diagnostic{Line: lineNumber, Message: message})
+		}
+	}
+
+	return diagnostics
+}
+
+// checkDirectives returns an error for the first line that looks like a directive (an uppercase
+// word at the start of the line) but is not a known one, e.g. a typo such as FORM
+func (d *Dockerfile) checkDirectives() error {
+	for lineNumber, line := range d.numberedLines() {
+		if directive := leadingDirective(line.Raw); directive != "" && !slices.Contains(knownDirectives, directive) {
+			return fmt.Errorf("unknown directive %s on line %d", directive, lineNumber)
+		}
+	}
+	return nil
+}
+
+// leadingDirective returns the first word of a line if it looks like a directive, i.e. it is all uppercase letters
+func leadingDirective(raw string) string {
+	fields := strings.Fields(raw)
+	if len(fields) == 0 {
+		return ""
+	}
+	for _, c := range fields[0] {
+		if c < 'A' || c > 'Z' {
+			return ""
+		}
+	}
+	return fields[0]
+}
+
+// isCommandSubstitution checks if a shell argument is produced by command substitution,
+// e.g. $(cat packages.txt) or `cat packages.txt`
+func isCommandSubstitution(arg string) bool {
+	return strings.Contains(arg, "$(") || strings.Contains(arg, "`")
+}
+
+// substitutedFile returns the file that a command substitution reads, for "$(<file)" (the bash
+// shorthand) and "$(cat file)", or an empty string for any other argument
+func substitutedFile(arg string) string {
+	inner, ok := strings.CutPrefix(arg, "$(")
+	if !ok {
+		return ""
+	}
+	inner, ok = strings.CutSuffix(inner, ")")
+	if !ok {
+		return ""
+	}
+	if file, ok := strings.CutPrefix(inner, "<"); ok {
+		inner = "cat " + file
+	}
+	fields := strings.Fields(inner)
+	if len(fields) != 2 || fields[0] != "cat" || strings.ContainsAny(fields[1], "$`()|;&<>") {
+		return ""
+	}
+	return strings.Trim(fields[1], `"'`)
+}
+
+// isIndirectInstall checks if a shell part appears to install packages through a command
+// that is only known at runtime, e.g. "$PM install -y nginx"
+func isIndirectInstall(part *ShellPart) bool {
+	if !strings.HasPrefix(strings.TrimLeft(part.Command, `"`), "$") {
+		return false
+	}
+	for _, arg := range part.Args {
+		if arg == SubcommandInstall || arg == SubcommandAdd {
+			return true
+		}
+	}
+	return false
+}
+
+// groupedPackageManager returns the first package manager run inside a subshell, e.g. "(cd /tmp && apt-get install -y curl)",
+// or a command group, e.g. "{ apt-get update && apt-get install -y curl; }", or an empty string if there is none.
+// Grouped commands are not converted, since only some of the parts of the group would be rewritten.
+func groupedPackageManager(shell *ShellCommand) Manager {
+	return packageManagerInGroup(shell, 0)
+}
+
+// packageManagerInGroup returns the first package manager in the shell that is run inside a group,
+// where groupDepth is the number of groups the shell itself is nested in
+func packageManagerInGroup(shell *ShellCommand, groupDepth int) Manager {
+	if shell == nil {
+		return ""
+	}
+	for _, part := range shell.Parts {
+		command := part.Command
+		switch {
+		case strings.HasPrefix(command, "(") && strings.HasSuffix(command, ")"):
+			if manager := packageManagerInGroup(ParseMultilineShell(command[1:len(command)-1]), groupDepth+1); manager != "" {
+				return manager
+			}
+			continue
+		case command == "{":
+			groupDepth++
+			if len(part.Args) == 0 {
+				continue
+			}
+			// The first command of the group is in the arguments of the "{" part
+			command = part.Args[0]
+		case command == "}":
+			groupDepth--
+			continue
+		}
+		if groupDepth > 0 && PackageManagerInfoMap[Manager(command)].Distro != "" {
+			return Manager(command)
+		}
+	}
+	return ""
+}
+
+// shadowOnlyCommands are provided by the shadow package and have no busybox equivalent that dfc converts to
+var shadowOnlyCommands = []string{"usermod", "userdel", "groupmod", "groupdel", "chage", "gpasswd", "newusers"}
+
+// addScriptDependencyDiagnostics warns about RUN and SHELL lines in converted stages that depend on
+// bash or on the tools from the shadow package, which the Chainguard Image may not include. RUN lines
+// kept as they are on purpose (fromOnly), or because their installs can't be converted, are not warned
+// about their package managers.
+func addScriptDependencyDiagnostics(lines []*DockerfileLine, fromOnly bool) {
+	convertedStages := make(map[int]bool)
+	installed := make(map[int]map[string]bool)
+	for _, line := range lines {
+		if line.From != nil && line.Converted != "" {
+			convertedStages[line.Stage] = true
+		}
+		if !convertedStages[line.Stage] {
+			continue
+		}
+		if installed[line.Stage] == nil {
+			installed[line.Stage] = make(map[string]bool)
+		}
+
+		var messages []string
+		if line.Run != nil && line.Run.Shell != nil {
+			// Packages installed by this line are available to its later commands
+			for name := range apkInstalledPackageNames(line.Run.Shell) {
+				installed[line.Stage][name] = true
+			}
+			messages = scriptDependencyMessages(line.Run, installed[line.Stage])
+			messages = append(messages, localeSetupMessages(line.Run, installed[line.Stage])...)
+			if !fromOnly && !leftUnchanged(line.Run) {
+				messages = append(messages, leftoverPackageManagerMessages(line.Run, installed[line.Stage])...)
+			}
+			messages = append(messages, languageInstallMessages(line.Run)...)
+		} else if fields := strings.Fields(line.Raw); len(fields) > 1 && strings.EqualFold(fields[0], DirectiveShell) && strings.Contains(line.Raw, PackageBash) && !installed[line.Stage][PackageBash] {
+			messages = append(messages, bashDependencyMessage(DirectiveShell))
+		} else if line.Cmd != nil {
+			messages = runtimePackageManagerMessages(DirectiveCmd, line.Cmd, installed[line.Stage])
+		} else if line.Entrypoint != nil {
+			messages = runtimePackageManagerMessages(DirectiveEntrypoint, line.Entrypoint, installed[line.Stage])
+		}
+		line.Diagnostics = append(line.Diagnostics, messages...)
+	}
+}
+
+// leftUnchanged checks if a RUN directive was left unchanged because its installs can't be converted,
+// which its diagnostics already explain
+func leftUnchanged(run *RunDetails) bool {
+	return run.Shell.After == nil && run.Shell.Before != nil && len(unconvertibleInstallMessages(run.Shell.Before)) > 0
+}
+
+// scriptDependencyMessages returns the advisories for a RUN line that needs bash or shadow,
+// unless the package is installed
+func scriptDependencyMessages(run *RunDetails, installed map[string]bool) []string {
+	var messages []string
+	add := func(message string) {
+		if !slices.Contains(messages, message) {
+			messages = append(messages, message)
+		}
+	}
+
+	if run.Heredoc != nil && strings.Contains(run.Heredoc.Shebang, PackageBash) && !installed[PackageBash] {
+		add(bashDependencyMessage(DirectiveRun))
+	}
+	if run.Shell.Before == nil {
+		return messages
+	}
+	for _, part := range run.Shell.Before.Parts {
+		command := filepath.Base(part.Command)
+		switch {
+		case command == PackageBash && !installed[PackageBash]:
+			add(bashDependencyMessage(DirectiveRun))
+		case slices.Contains(shadowOnlyCommands, command) && !installed[PackageShadow]:
+			add(fmt.Sprintf("%s is provided by the shadow package, which may not be installed in the converted image, consider adding shadow to the installed packages", command))
+		case command == CommandUserAdd && !installed[PackageShadow] && (slices.Contains(part.Args, "-G") || slices.Contains(part.Args, "--groups")):
+			add("useradd -G adds supplementary groups, which busybox adduser (that useradd is converted to) does not support, consider adding shadow to the installed packages to keep useradd")
+		}
+	}
+	return messages
+}
+
+// bashDependencyMessage returns the advisory for a line that uses bash
+func bashDependencyMessage(usedBy string) string {
+	return fmt.Sprintf("%s uses bash, which may not be installed in the converted image, consider adding bash to the installed packages", usedBy)
+}
+
+// localeSetupMessages returns the advisories for a RUN line that sets up locales or the timezone
+// the Debian way, e.g. "locale-gen en_US.UTF-8" or "dpkg-reconfigure tzdata", which doesn't work
+// in Chainguard Images
+func localeSetupMessages(run *RunDetails, installed map[string]bool) []string {
+	shell := run.Shell.After
+	if shell == nil {
+		shell = run.Shell.Before
+	}
+	if shell == nil {
+		return nil
+	}
+
+	var messages []string
+	add := func(message string) {
+		if !slices.Contains(messages, message) {
+			messages = append(messages, message)
+		}
+	}
+	localesHint := "which have the locales precompiled in the glibc-locales package, consider installing it and setting the locale with ENV LANG (e.g. ENV LANG=en_US.UTF-8) instead"
+	if installed[PackageGlibcLocales] {
+		localesHint = "which have the locales precompiled in the glibc-locales package, consider setting the locale with ENV LANG (e.g. ENV LANG=en_US.UTF-8) instead"
+	}
+	timezoneHint := "consider installing tzdata and setting the timezone with ENV TZ (e.g. ENV TZ=Europe/Berlin) instead"
+	if installed[PackageTzdata] {
+		timezoneHint = "consider setting the timezone with ENV TZ (e.g. ENV TZ=Europe/Berlin) instead"
+	}
+	for _, part := range shell.Parts {
+		command := filepath.Base(part.Command)
+		switch {
+		case command == CommandLocaleGen || command == CommandUpdateLocale:
+			add(fmt.Sprintf("%s is Debian-specific and not available in Chainguard Images, %s", command, localesHint))
+		case command == CommandDpkgReconfigure && slices.Contains(part.Args, PackageLocales):
+			add(fmt.Sprintf("%s %s is Debian-specific and not available in Chainguard Images, %s", command, PackageLocales, localesHint))
+		case command == CommandDpkgReconfigure && slices.Contains(part.Args, PackageTzdata):
+			add(fmt.Sprintf("%s %s is Debian-specific and not available in Chainguard Images, %s", command, PackageTzdata, timezoneHint))
+		}
+	}
+	return messages
+}
+
+// languageInstallMessages returns the advisories for a converted RUN line that also installs packages
+// with a language package manager, e.g. "apt-get install -y python3-pip && pip3 install flask".
+// The language installs are kept as they are, only the distro install is converted.
+func languageInstallMessages(run *RunDetails) []string {
+	if run.Manager == "" || run.Shell.After == nil {
+		return nil
+	}
+
+	var messages []string
+	for _, install := range run.LanguageManagers {
+		installed := "packages"
+		if len(install.Packages) > 0 {
+			installed = strings.Join(install.Packages, " ")
+		}
+		messages = append(messages, fmt.Sprintf("RUN also installs %s with %s, which was kept as is since language packages are not converted, packages that build native extensions may need their build dependencies (e.g. build-base) added to the apk add", installed, install.Manager))
+	}
+	return messages
+}
+
+// isLocaleReconfigure checks if a shell part reconfigures the locales or the timezone with dpkg-reconfigure,
+// which localeSetupMessages covers
+func isLocaleReconfigure(part *ShellPart) bool {
+	return filepath.Base(part.Command) == CommandDpkgReconfigure && (slices.Contains(part.Args, PackageLocales) || slices.Contains(part.Args, PackageTzdata))
+}
+
+// distroPackageManagerCommands are the package management tools of the distros dfc converts from,
+// which are not available in Chainguard Images
+var distroPackageManagerCommands = []string{
+	"apt", "apt-get", "apt-cache", "apt-key", "apt-mark", "aptitude",
+	"dpkg", "dpkg-query", "dpkg-reconfigure",
+	"yum", "dnf", "microdnf", "rpm",
+}
+
+// leftoverPackageManagerMessages warns about distro package management tools that a RUN directive
+// still uses after conversion, e.g. "dpkg -l" or an "apt-get" that is called by its full path
+func leftoverPackageManagerMessages(run *RunDetails, installed map[string]bool) []string {
+	shell := run.Shell.After
+	if shell == nil {
+		shell = run.Shell.Before
+	}
+
+	// dpkg-reconfigure for the locales or the timezone has its own advisory
+	localeReconfigures := 0
+	for _, part := range shell.Parts {
+		if isLocaleReconfigure(part) {
+			localeReconfigures++
+		}
+	}
+
+	var messages []string
+	for _, command := range shellCommandNames(shell) {
+		if !slices.Contains(distroPackageManagerCommands, command) || installed[command] {
+			continue
+		}
+		if command == CommandDpkgReconfigure && localeReconfigures > 0 {
+			localeReconfigures--
+			continue
+		}
+		message := fmt.Sprintf("RUN still uses %s, which is not available in Chainguard Images, consider removing it", command)
+		if !slices.Contains(messages, message) {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+// runtimePackageManagerMessages warns about a shell form CMD or ENTRYPOINT that runs a distro package
+// management tool, e.g. "CMD apt-get update && nginx", which installs packages when the container starts.
+// The line is not converted since it is runtime behavior
+func runtimePackageManagerMessages(directive string, command *CommandDetails, installed map[string]bool) []string {
+	if command.Exec {
+		return nil
+	}
+
+	var messages []string
+	for _, name := range shellCommandNames(ParseMultilineShell(command.String())) {
+		if !slices.Contains(distroPackageManagerCommands, name) || installed[name] {
+			continue
+		}
+		message := fmt.Sprintf("%s runs %s when the container starts, which is not available in Chainguard Images and installs packages at runtime, consider installing the packages with a RUN directive instead", directive, name)
+		if !slices.Contains(messages, message) {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+// shellCommandNames returns the base names of the commands run by a shell command, including the
+// commands in pipelines, subshells, command groups and command substitutions
+func shellCommandNames(shell *ShellCommand) []string {
+	if shell == nil {
+		return nil
+	}
+
+	var names []string
+	for _, part := range shell.Parts {
+		command := part.Command
+		switch {
+		case strings.HasPrefix(command, "(") && strings.HasSuffix(command, ")"):
+			names = append(names, shellCommandNames(ParseMultilineShell(command[1:len(command)-1]))...)
+			continue
+		case command == "{" && len(part.Args) > 0:
+			command = part.Args[0]
+		}
+		names = append(names, filepath.Base(command))
+
+		for i, arg := range part.Args {
+			if arg == "|" && i+1 < len(part.Args) {
+				names = append(names, filepath.Base(part.Args[i+1]))
+			}
+			for _, substitution := range commandSubstitutions(arg) {
+				names = append(names, shellCommandNames(ParseMultilineShell(substitution))...)
+			}
+		}
+	}
+	return names
+}
+
+// commandSubstitutions returns the commands inside the $(...) command substitutions of a shell argument
+func commandSubstitutions(arg string) []string {
+	var substitutions []string
+	for {
+		start := strings.Index(arg, "$(")
+		if start < 0 {
+			return substitutions
+		}
+		arg = arg[start+2:]
+		depth := 1
+		end := strings.IndexFunc(arg, func(r rune) bool {
+			switch r {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			return depth == 0
+		})
+		if end < 0 {
+			return substitutions
+		}
+		substitutions = append(substitutions, arg[:end])
+		arg = arg[end+1:]
+	}
+}
+
+// downloadCommands fetch remote content and shellCommands run a script, the output of one piped into
+// the other runs a remote script without any verification
+var (
+	downloadCommands = []string{"curl", "wget"}
+	shellCommands    = []string{"sh", "bash", "ash", "dash", "zsh"}
+)
+
+// addRemoteExecDiagnostics warns about RUN lines that pipe a download into a shell, e.g. "curl -fsSL url | sh".
+// All stages are checked, since this is a supply chain risk whether or not the stage was converted
+func addRemoteExecDiagnostics(lines []*DockerfileLine) {
+	for _, line := range lines {
+		if line.Run == nil || line.Run.Shell == nil {
+			continue
+		}
+		for _, message := range remoteExecMessages(line.Run.Shell.Before) {
+			if !slices.Contains(line.Diagnostics, message) {
+				line.Diagnostics = append(line.Diagnostics, message)
+			}
+		}
+	}
+}
+
+// remoteExecMessages returns the advisories for the pipelines of a shell command that pipe the output
+// of curl or wget into a shell, including the pipelines in subshells and command groups
+func remoteExecMessages(shell *ShellCommand) []string {
+	if shell == nil {
+		return nil
+	}
+
+	var messages []string
+	for _, part := range shell.Parts {
+		if strings.HasPrefix(part.Command, "(") && strings.HasSuffix(part.Command, ")") {
+			messages = append(messages, remoteExecMessages(ParseMultilineShell(part.Command[1:len(part.Command)-1]))...)
+			continue
+		}
+
+		// Split the part into the commands of its pipeline, the pipe may also be written without
+		// spaces around it (e.g. "https://example.com/install.sh|sh")
+		pipeline := [][]string{{part.Command}}
+		for _, arg := range part.Args {
+			fields := []string{arg}
+			if !strings.HasPrefix(arg, `"`) && !strings.HasPrefix(arg, "'") {
+				fields = strings.Split(arg, "|")
+			}
+			for j, field := range fields {
+				if j > 0 {
+					pipeline = append(pipeline, nil)
+				}
+				if field != "" {
+					pipeline[len(pipeline)-1] = append(pipeline[len(pipeline)-1], field)
+				}
+			}
+		}
+
+		download := ""
+		for _, command := range pipeline {
+			name := pipelineCommandName(command)
+			switch {
+			case slices.Contains(downloadCommands, name):
+				download = name
+			case download != "" && slices.Contains(shellCommands, name):
+				messages = append(messages, fmt.Sprintf("RUN pipes the output of %s into %s, which runs a remote script without verifying it, consider downloading the script and checking its checksum before running it", download, name))
+			}
+		}
+	}
+	return messages
+}
+
+// pipelineCommandName returns the base name of the command of a pipeline element, skipping the
+// command group brace and sudo
+func pipelineCommandName(command []string) string {
+	for _, field := range command {
+		if field == "{" || field == "sudo" {
+			continue
+		}
+		return filepath.Base(field)
+	}
+	return ""
+}
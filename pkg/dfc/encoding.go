@@ -0,0 +1,61 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Byte order marks
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// normalizeEncoding returns the content as UTF-8 without a byte order mark.
+// UTF-16 content with a byte order mark is transcoded, and any other content
+// that is not valid UTF-8 is rejected rather than silently corrupted.
+func normalizeEncoding(content []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(content, bomUTF8):
+		content = content[len(bomUTF8):]
+	case bytes.HasPrefix(content, bomUTF16LE):
+		return decodeUTF16(content[len(bomUTF16LE):], binary.LittleEndian)
+	case bytes.HasPrefix(content, bomUTF16BE):
+		return decodeUTF16(content[len(bomUTF16BE):], binary.BigEndian)
+	}
+
+	if !utf8.Valid(content) {
+		return nil, fmt.Errorf("dockerfile is not valid UTF-8 (other encodings such as Latin-1 are not supported)")
+	}
+	return content, nil
+}
+
+// decodeUTF16 transcodes UTF-16 content (without byte order mark) to UTF-8
+func decodeUTF16(content []byte, order binary.ByteOrder) ([]byte, error) {
+	if len(content)%2 != 0 {
+		return nil, fmt.Errorf("dockerfile has a UTF-16 byte order mark but an odd number of bytes")
+	}
+
+	units := make([]uint16, 0, len(content)/2)
+	for i := 0; i < len(content); i += 2 {
+		units = append(units, order.Uint16(content[i:]))
+	}
+
+	var buf bytes.Buffer
+	for _, r := range utf16.Decode(units) {
+		if r == utf8.RuneError {
+			return nil, fmt.Errorf("dockerfile contains invalid UTF-16")
+		}
+		buf.WriteRune(r)
+	}
+	return buf.Bytes(), nil
+}
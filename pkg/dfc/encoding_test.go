@@ -0,0 +1,99 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+)
+
+// encodeUTF16 encodes a string as UTF-16 with a byte order mark
+func encodeUTF16(s string, order binary.ByteOrder) []byte {
+	var b []byte
+	if order == binary.LittleEndian {
+		b = append(b, bomUTF16LE...)
+	} else {
+		b = append(b, bomUTF16BE...)
+	}
+	for _, unit := range utf16.Encode([]rune(s)) {
+		buf := make([]byte, 2)
+		order.PutUint16(buf, unit)
+		b = append(b, buf...)
+	}
+	return b
+}
+
+func TestNormalizeEncoding(t *testing.T) {
+	const dockerfile = "FROM debian\nRUN echo héllo"
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "valid utf-8",
+			input: []byte(dockerfile),
+			want:  dockerfile,
+		},
+		{
+			name:  "utf-8 with bom",
+			input: append(append([]byte{}, bomUTF8...), dockerfile...),
+			want:  dockerfile,
+		},
+		{
+			name:  "utf-16 little endian with bom",
+			input: encodeUTF16(dockerfile, binary.LittleEndian),
+			want:  dockerfile,
+		},
+		{
+			name:  "utf-16 big endian with bom",
+			input: encodeUTF16(dockerfile, binary.BigEndian),
+			want:  dockerfile,
+		},
+		{
+			name:    "utf-16 with odd length",
+			input:   append(encodeUTF16(dockerfile, binary.LittleEndian), 'x'),
+			wantErr: true,
+		},
+		{
+			name:    "latin-1",
+			input:   []byte("FROM debian\nRUN echo h\xe9llo"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeEncoding(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeEncoding() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("normalizeEncoding() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDockerfileUTF16(t *testing.T) {
+	ctx := context.Background()
+
+	dockerfile, err := ParseDockerfile(ctx, encodeUTF16("FROM debian:12\nRUN apt-get install -y nano", binary.LittleEndian))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	if len(dockerfile.Lines) != 2 || dockerfile.Lines[0].From == nil || dockerfile.Lines[0].From.Base != "debian" {
+		t.Fatalf("UTF-16 Dockerfile not parsed correctly: %+v", dockerfile.Lines)
+	}
+
+	if _, err := ParseDockerfile(ctx, []byte("FROM debian\xff")); err == nil {
+		t.Errorf("ParseDockerfile() error = nil, want error for invalid UTF-8")
+	}
+}
@@ -0,0 +1,291 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// HeredocLineDelimiter is used as the ShellPart delimiter between lines of a heredoc script
+const HeredocLineDelimiter = "\n"
+
+// HeredocDetails holds details about a RUN directive whose script is provided as a heredoc
+// (e.g. "RUN <<EOF ... EOF")
+type HeredocDetails struct {
+	Header    string `json:"header"`              // The original RUN line containing the heredoc marker
+	Delimiter string `json:"delimiter"`           // The terminator word, e.g. EOF
+	StripTabs bool   `json:"stripTabs,omitempty"` // True for the <<- form
+	Shebang   string `json:"shebang,omitempty"`   // Optional interpreter line at the start of the script
+	Body      string `json:"body"`                // The raw script between the header and the terminator
+	Footer    string `json:"footer"`              // The original terminator line
+}
+
+// heredocMarker describes a heredoc opened on an instruction line
+type heredocMarker struct {
+	delimiter string
+	stripTabs bool
+}
+
+// heredocDirectives are the Dockerfile directives that support heredocs
+var heredocDirectives = []string{DirectiveRun, DirectiveCopy, DirectiveAdd}
+
+// runHeredocHeaderRegex matches a RUN whose entire script is a single heredoc, e.g. "<<EOF" or "<<-'EOF'"
+var runHeredocHeaderRegex = regexp.MustCompile(`^<<(-?)(["']?)([A-Za-z_][A-Za-z0-9_]*)(["']?)$`)
+
+// findHeredocMarkers returns the heredocs opened by an instruction, in order,
+// ignoring anything that appears inside quotes or on comment lines within the instruction
+func findHeredocMarkers(instruction string) []heredocMarker {
+	instruction = withoutCommentLines(instruction)
+	fields := strings.Fields(instruction)
+	if len(fields) == 0 {
+		return nil
+	}
+	directive := strings.ToUpper(fields[0])
+	supported := false
+	for _, d := range heredocDirectives {
+		if directive == d {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return nil
+	}
+
+	var markers []heredocMarker
+	inSingleQuote := false
+	inDoubleQuote := false
+	for i := 0; i < len(instruction); i++ {
+		c := instruction[i]
+		if c == '\'' && !inDoubleQuote {
+			inSingleQuote = !inSingleQuote
+			continue
+		}
+		if c == '"' && !inSingleQuote {
+			inDoubleQuote = !inDoubleQuote
+			continue
+		}
+		if inSingleQuote || inDoubleQuote || c != '<' || i+1 >= len(instruction) || instruction[i+1] != '<' {
+			continue
+		}
+		// Skip here-strings (<<<) and the "<<" inside them
+		if (i > 0 && instruction[i-1] == '<') || (i+2 < len(instruction) && instruction[i+2] == '<') {
+			continue
+		}
+
+		j := i + 2
+		stripTabs := false
+		if j < len(instruction) && instruction[j] == '-' {
+			stripTabs = true
+			j++
+		}
+		var quote byte
+		if j < len(instruction) && (instruction[j] == '"' || instruction[j] == '\'') {
+			quote = instruction[j]
+			j++
+		}
+		start := j
+		for j < len(instruction) && (instruction[j] == '_' || isAlphaNumeric(instruction[j])) {
+			j++
+		}
+		if j == start {
+			continue
+		}
+		delimiter := instruction[start:j]
+		if quote != 0 {
+			if j >= len(instruction) || instruction[j] != quote {
+				continue
+			}
+			j++
+		}
+		markers = append(markers, heredocMarker{delimiter: delimiter, stripTabs: stripTabs})
+		i = j - 1
+	}
+	return markers
+}
+
+// isHeredocTerminator checks if a line closes the given heredoc
+func isHeredocTerminator(line string, marker heredocMarker) bool {
+	if marker.stripTabs {
+		line = strings.TrimLeft(line, "\t")
+	}
+	return strings.TrimRight(line, " \t\r") == marker.delimiter
+}
+
+// isAlphaNumeric checks if a byte is an ASCII letter or digit
+func isAlphaNumeric(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// isVariableNameChar checks if a rune can be part of a shell variable name, i.e. an ASCII letter,
+// digit or underscore
+func isVariableNameChar(r rune) bool {
+	return r <= unicode.MaxASCII && (r == '_' || isAlphaNumeric(byte(r)))
+}
+
+// isNotVariableNameChar checks if a rune ends a shell variable name, for use with strings.IndexFunc
+func isNotVariableNameChar(r rune) bool {
+	return !isVariableNameChar(r)
+}
+
+// parseRunHeredoc extracts the heredoc details from a RUN instruction if the whole
+// script is a single heredoc. Other heredoc forms (e.g. "RUN cat <<EOF > file") return nil.
+func parseRunHeredoc(instruction string) *HeredocDetails {
+	lines := strings.Split(instruction, "\n")
+	if len(lines) < 2 {
+		return nil
+	}
+
+	header := lines[0]
+	trimmedHeader := strings.TrimSpace(header)
+	if len(trimmedHeader) <= len(DirectiveRun) || !strings.EqualFold(trimmedHeader[:len(DirectiveRun)], DirectiveRun) {
+		return nil
+	}
+	matches := runHeredocHeaderRegex.FindStringSubmatch(strings.TrimSpace(trimmedHeader[len(DirectiveRun):]))
+	if matches == nil || matches[2] != matches[4] {
+		return nil
+	}
+
+	heredoc := &HeredocDetails{
+		Header:    header,
+		Delimiter: matches[3],
+		StripTabs: matches[1] == "-",
+		Footer:    lines[len(lines)-1],
+	}
+	if !isHeredocTerminator(heredoc.Footer, heredocMarker{delimiter: heredoc.Delimiter, stripTabs: heredoc.StripTabs}) {
+		return nil
+	}
+
+	body := lines[1 : len(lines)-1]
+	heredoc.Body = strings.Join(body, "\n")
+	if len(body) > 0 && strings.HasPrefix(strings.TrimSpace(body[0]), "#!") {
+		heredoc.Shebang = strings.TrimSpace(body[0])
+	}
+
+	return heredoc
+}
+
+// ParseHeredocShell parses a heredoc script into a structured representation.
+// Each line of the script becomes one or more parts, with HeredocLineDelimiter
+// separating the lines. Comment and blank lines become parts without a command
+// that hold the line verbatim in ExtraPre, so that they are kept in place.
+func ParseHeredocShell(body string) *ShellCommand {
+	var parts []*ShellPart
+	commands := 0
+
+	add := func(newParts ...*ShellPart) {
+		if len(parts) > 0 && parts[len(parts)-1].Delimiter == "" {
+			parts[len(parts)-1].Delimiter = HeredocLineDelimiter
+		}
+		parts = append(parts, newParts...)
+	}
+
+	var logicalLine strings.Builder
+	flush := func() {
+		if logicalLine.Len() == 0 {
+			return
+		}
+		cmd := ParseMultilineShell(logicalLine.String())
+		line := logicalLine.String()
+		logicalLine.Reset()
+		if cmd == nil {
+			add(&ShellPart{ExtraPre: line})
+			return
+		}
+		commands++
+		add(cmd.Parts...)
+	}
+
+	for _, line := range strings.Split(body, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if logicalLine.Len() == 0 && (trimmed == "" || strings.HasPrefix(trimmed, "#")) {
+			add(&ShellPart{ExtraPre: line})
+			continue
+		}
+		logicalLine.WriteString(line)
+		if strings.HasSuffix(trimmed, "\\") {
+			logicalLine.WriteString("\n")
+			continue
+		}
+		flush()
+	}
+	flush()
+
+	if commands == 0 {
+		return nil
+	}
+	return &ShellCommand{Parts: parts}
+}
+
+// heredocScript renders a shell command as the lines of a heredoc script. Parts without
+// a command are comment or blank lines of the original script, they are written verbatim.
+func heredocScript(sc *ShellCommand, indent string) string {
+	var builder strings.Builder
+	lineStart := true
+	for _, part := range sc.Parts {
+		if part.Command == "" {
+			builder.WriteString(part.ExtraPre)
+		} else {
+			if lineStart {
+				builder.WriteString(indent)
+			}
+			if part.ExtraPre != "" {
+				builder.WriteString(part.ExtraPre + " ")
+			}
+			builder.WriteString(part.Command)
+			if len(part.Args) > 0 {
+				builder.WriteString(" " + strings.Join(part.Args, " "))
+			}
+		}
+		lineStart = false
+		switch part.Delimiter {
+		case "":
+		case HeredocLineDelimiter:
+			builder.WriteString("\n")
+			lineStart = true
+		default:
+			builder.WriteString(" " + part.Delimiter + " ")
+		}
+	}
+	return builder.String()
+}
+
+// String returns the heredoc form of a RUN directive with the given script
+func (h *HeredocDetails) String(script *ShellCommand) string {
+	// Reuse the indentation of the first command in the original body
+	var indent string
+	for _, line := range strings.Split(h.Body, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent = line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		break
+	}
+
+	var builder strings.Builder
+	builder.WriteString(h.Header)
+	builder.WriteString("\n")
+	builder.WriteString(heredocScript(script, indent))
+	builder.WriteString("\n")
+	builder.WriteString(h.Footer)
+	return builder.String()
+}
+
+// withoutCommentLines returns a multi-line instruction without the comment lines
+// after its first line, e.g. "    # run: cat <<EOF" in a continued RUN
+func withoutCommentLines(instruction string) string {
+	lines := strings.Split(instruction, "\n")
+	kept := lines[:1]
+	for _, line := range lines[1:] {
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
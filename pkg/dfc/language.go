@@ -0,0 +1,166 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// LanguageManager represents a language-specific package manager
+type LanguageManager string
+
+// Supported language package managers
+const (
+	LanguageManagerPip   LanguageManager = "pip"
+	LanguageManagerNpm   LanguageManager = "npm"
+	LanguageManagerGem   LanguageManager = "gem"
+	LanguageManagerCargo LanguageManager = "cargo"
+)
+
+// LanguageInstall describes packages installed by a language package manager in a RUN directive.
+// These are only detected, never rewritten.
+type LanguageInstall struct {
+	Manager  LanguageManager `json:"manager"`
+	Global   bool            `json:"global,omitempty"` // npm only: true for npm install -g
+	Packages []string        `json:"packages,omitempty"`
+}
+
+// languageManagerInfo holds the details needed to detect installs for a language package manager
+type languageManagerInfo struct {
+	InstallKeywords []string // Subcommands that install packages
+	FlagsWithValue  []string // Flags that take the following argument as their value
+	GlobalFlags     []string // Flags that make the install global (npm only)
+}
+
+var languageManagers = map[LanguageManager]languageManagerInfo{
+	LanguageManagerPip: {
+		InstallKeywords: []string{SubcommandInstall},
+		FlagsWithValue: []string{
+			"-r", "--requirement", "-c", "--constraint", "-e", "--editable",
+			"-i", "--index-url", "--extra-index-url", "-f", "--find-links",
+			"-t", "--target", "--prefix", "--root", "--trusted-host", "--platform",
+			"--python-version", "--implementation", "--abi", "--src", "--cache-dir",
+		},
+	},
+	LanguageManagerNpm: {
+		InstallKeywords: []string{SubcommandInstall, "i", "add", "ci"},
+		FlagsWithValue:  []string{"--prefix", "--registry", "--cache", "--tag", "-w", "--workspace", "--omit", "--include"},
+		GlobalFlags:     []string{"-g", "--global", "--location=global"},
+	},
+	LanguageManagerGem: {
+		InstallKeywords: []string{SubcommandInstall},
+		FlagsWithValue:  []string{"-v", "--version", "-i", "--install-dir", "-n", "--bindir", "-s", "--source", "--platform"},
+	},
+	LanguageManagerCargo: {
+		InstallKeywords: []string{SubcommandInstall},
+		FlagsWithValue: []string{
+			"--version", "--vers", "--git", "--branch", "--tag", "--rev", "--path",
+			"--root", "--index", "--registry", "-F", "--features", "-j", "--jobs",
+			"--target", "--target-dir", "--profile", "--bin", "--example",
+		},
+	},
+}
+
+// pythonCommands are the interpreters that can run pip as a module (e.g. python3 -m pip install)
+var pythonCommands = []string{"python", "python3"}
+
+// detectLanguageInstalls returns the language package manager installs in a shell command, in order
+func detectLanguageInstalls(sc *ShellCommand) []LanguageInstall {
+	if sc == nil {
+		return nil
+	}
+
+	var installs []LanguageInstall
+	for _, part := range sc.Parts {
+		manager, args := languageManagerCommand(part)
+		if manager == "" {
+			continue
+		}
+		if install := parseLanguageInstall(manager, args); install != nil {
+			installs = append(installs, *install)
+		}
+	}
+	return installs
+}
+
+// languageManagerCommand returns the language package manager run by a shell part,
+// along with the arguments passed to it
+func languageManagerCommand(part *ShellPart) (LanguageManager, []string) {
+	command := filepath.Base(part.Command)
+
+	if slices.Contains(pythonCommands, command) || strings.HasPrefix(command, "python3.") {
+		if len(part.Args) >= 2 && part.Args[0] == "-m" && (part.Args[1] == "pip" || part.Args[1] == "pip3") {
+			return LanguageManagerPip, part.Args[2:]
+		}
+		return "", nil
+	}
+
+	switch command {
+	case "pip", "pip3":
+		return LanguageManagerPip, part.Args
+	case "npm":
+		return LanguageManagerNpm, part.Args
+	case "gem":
+		return LanguageManagerGem, part.Args
+	case "cargo":
+		return LanguageManagerCargo, part.Args
+	}
+	return "", nil
+}
+
+// parseLanguageInstall extracts the packages from the arguments of a language package manager,
+// returning nil if the arguments are not an install
+func parseLanguageInstall(manager LanguageManager, args []string) *LanguageInstall {
+	info := languageManagers[manager]
+
+	var install *LanguageInstall
+	var global bool
+	var packages []string
+	// Stop at a pipe, what follows is a different command
+	if i := slices.Index(args, "|"); i >= 0 {
+		args = args[:i]
+	}
+	// Output redirections are not packages
+	args, _ = splitRedirections(args)
+
+	skipNext := false
+	for _, arg := range args {
+		if skipNext {
+			skipNext = false
+			continue
+		}
+
+		if slices.Contains(info.GlobalFlags, arg) {
+			global = true
+			continue
+		}
+
+		if strings.HasPrefix(arg, "-") {
+			skipNext = slices.Contains(info.FlagsWithValue, arg)
+			continue
+		}
+
+		// The first non-flag argument is the subcommand
+		if install == nil {
+			if !slices.Contains(info.InstallKeywords, arg) {
+				return nil
+			}
+			install = &LanguageInstall{Manager: manager}
+			continue
+		}
+
+		packages = append(packages, arg)
+	}
+
+	if install == nil {
+		return nil
+	}
+	install.Global = global
+	install.Packages = packages
+	return install
+}
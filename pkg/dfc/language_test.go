@@ -0,0 +1,167 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDetectLanguageInstalls(t *testing.T) {
+	tests := []struct {
+		name     string
+		run      string
+		expected []LanguageInstall
+	}{
+		{
+			name:     "npm global install",
+			run:      "npm install -g yarn typescript@5",
+			expected: []LanguageInstall{{Manager: LanguageManagerNpm, Global: true, Packages: []string{"yarn", "typescript@5"}}},
+		},
+		{
+			name:     "npm local install",
+			run:      "npm i --registry https://registry.example.com express",
+			expected: []LanguageInstall{{Manager: LanguageManagerNpm, Packages: []string{"express"}}},
+		},
+		{
+			name:     "npm ci installs from the lockfile",
+			run:      "npm ci --omit dev",
+			expected: []LanguageInstall{{Manager: LanguageManagerNpm}},
+		},
+		{
+			name:     "npm global flag after packages",
+			run:      "npm install pnpm --location=global",
+			expected: []LanguageInstall{{Manager: LanguageManagerNpm, Global: true, Packages: []string{"pnpm"}}},
+		},
+		{
+			name:     "gem install with version",
+			run:      "gem install bundler -v 2.5.0 --no-document",
+			expected: []LanguageInstall{{Manager: LanguageManagerGem, Packages: []string{"bundler"}}},
+		},
+		{
+			name:     "cargo install",
+			run:      "cargo install --locked --version 0.1.0 cargo-audit ripgrep",
+			expected: []LanguageInstall{{Manager: LanguageManagerCargo, Packages: []string{"cargo-audit", "ripgrep"}}},
+		},
+		{
+			name:     "pip install with requirements file",
+			run:      "pip install --no-cache-dir -r requirements.txt flask",
+			expected: []LanguageInstall{{Manager: LanguageManagerPip, Packages: []string{"flask"}}},
+		},
+		{
+			name:     "python -m pip",
+			run:      "python3 -m pip install --upgrade pip",
+			expected: []LanguageInstall{{Manager: LanguageManagerPip, Packages: []string{"pip"}}},
+		},
+		{
+			name: "multiple managers in one RUN",
+			run:  "apt-get update && npm install -g npm@10 > /dev/null && gem install rake && cargo build",
+			expected: []LanguageInstall{
+				{Manager: LanguageManagerNpm, Global: true, Packages: []string{"npm@10"}},
+				{Manager: LanguageManagerGem, Packages: []string{"rake"}},
+			},
+		},
+		{
+			name:     "not an install",
+			run:      "npm run build && cargo build --release && gem list",
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := detectLanguageInstalls(ParseMultilineShell(tt.run))
+			if diff := cmp.Diff(tt.expected, got); diff != "" {
+				t.Errorf("detectLanguageInstalls() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLanguageInstallsParsedAndConverted(t *testing.T) {
+	content := `FROM node:20
+RUN apt-get update && apt-get install -y git && npm install -g pnpm`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+
+	expected := []LanguageInstall{{Manager: LanguageManagerNpm, Global: true, Packages: []string{"pnpm"}}}
+	if diff := cmp.Diff(expected, dockerfile.Lines[1].Run.LanguageManagers); diff != "" {
+		t.Errorf("parsed language installs not as expected (-want, +got):\n%s", diff)
+	}
+
+	converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	if diff := cmp.Diff(expected, converted.Lines[1].Run.LanguageManagers); diff != "" {
+		t.Errorf("converted language installs not as expected (-want, +got):\n%s", diff)
+	}
+	if got := converted.Lines[1].Converted; got != "RUN apk add --no-cache git && \\\n    npm install -g pnpm" {
+		t.Errorf("npm install should be kept as is, got %q", got)
+	}
+}
+
+func TestMixedDistroAndLanguageInstalls(t *testing.T) {
+	const advisory = "which was kept as is since language packages are not converted, packages that build native extensions may need their build dependencies (e.g. build-base) added to the apk add"
+	tests := []struct {
+		name                string
+		raw                 string
+		expected            string
+		expectedDiagnostics []string
+	}{
+		{
+			name:                "apt install followed by pip",
+			raw:                 `RUN apt-get install -y python3-pip && pip3 install flask`,
+			expected:            "RUN apk add --no-cache py3-pip && \\\n    pip3 install flask",
+			expectedDiagnostics: []string{"RUN also installs flask with pip, " + advisory},
+		},
+		{
+			name:                "pip between the apt install and its cleanup",
+			raw:                 `RUN apt-get update && apt-get install -y python3-pip python3-dev && python3 -m pip install -r requirements.txt && rm -rf /var/lib/apt/lists/*`,
+			expected:            "RUN apk add --no-cache py3-pip python3-dev && \\\n    python3 -m pip install -r requirements.txt",
+			expectedDiagnostics: []string{"RUN also installs packages with pip, " + advisory},
+		},
+		{
+			name:     "pip and npm in one chain",
+			raw:      `RUN apt-get install -y python3-pip nodejs && pip install --no-cache-dir flask gunicorn; npm install -g pnpm`,
+			expected: "RUN apk add --no-cache nodejs py3-pip && \\\n    pip install --no-cache-dir flask gunicorn ; \\\n    npm install -g pnpm",
+			expectedDiagnostics: []string{
+				"RUN also installs flask gunicorn with pip, " + advisory,
+				"RUN also installs pnpm with npm, " + advisory,
+			},
+		},
+		{
+			name: "pip without a distro install",
+			raw:  `RUN pip install flask`,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte("FROM python:3.12\n"+tt.raw+"\n"))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, converted.Lines[1].Converted); diff != "" {
+				t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.expectedDiagnostics, converted.Lines[1].Diagnostics); diff != "" {
+				t.Errorf("diagnostics not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
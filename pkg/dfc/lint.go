@@ -0,0 +1,138 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Lint finding codes, these are stable and can be used to filter findings
+const (
+	LintDeadUpdate      = "DFC001" // Package index update with no subsequent install, or RUN reduced to true
+	LintUnnamedStages   = "DFC002" // Multi-stage Dockerfile with stages that have no AS alias
+	LintLeftoverCleanup = "DFC003" // Converted RUN line that still cleans up after the original package manager
+	LintUnusedUserRoot  = "DFC004" // USER root added to a stage that has no RUN lines
+)
+
+// LintFinding is a likely issue in a converted Dockerfile, found by Lint
+type LintFinding struct {
+	Code    string `json:"code"`
+	Line    int    `json:"line"` // 1-based line number in the original Dockerfile
+	Message string `json:"message"`
+}
+
+// String returns the finding in the form "line 3: DFC001 message"
+func (f LintFinding) String() string {
+	return fmt.Sprintf("line %d: %s %s", f.Line, f.Code, f.Message)
+}
+
+// debianManagers are the package managers whose index must be updated before an install
+var debianManagers = []string{string(ManagerAptGet), string(ManagerApt)}
+
+// packageManagerCacheDirs are the index and cache directories of non-apk package managers,
+// commonly removed after an install
+var packageManagerCacheDirs = []string{"/var/lib/apt/lists", "/var/cache/apt", "/var/cache/dnf", "/var/cache/yum"}
+
+// Lint checks a converted Dockerfile for common issues left after conversion, such as
+// a package index update with no install or cleanup commands for the original package manager.
+// It can also be used on a Dockerfile that was only parsed, the raw lines are checked then.
+func (d *Dockerfile) Lint() []LintFinding {
+	var findings []LintFinding
+
+	// Stages with RUN lines, and the number of stages
+	stagesWithRun := map[int]bool{}
+	stages := 0
+	for _, line := range d.Lines {
+		if line.From != nil {
+			stages++
+		}
+		if line.Run != nil {
+			stagesWithRun[line.Stage] = true
+		}
+	}
+
+	for lineNumber, line := range d.numberedLines() {
+		add := func(code, message string) {
+			findings = append(findings, LintFinding{Code: code, Line: lineNumber, Message: message})
+		}
+
+		if line.From != nil {
+			// The final stage is usually not referenced, so it doesn't need a name
+			if stages > 1 && line.Stage < stages && line.From.Alias == "" {
+				add(LintUnnamedStages, fmt.Sprintf("stage %d has no AS alias, later stages can only refer to it by its index %d, consider naming it", line.Stage, line.Stage-1))
+			}
+			if slices.Contains(strings.Split(line.Converted, "\n")[1:], DirectiveUser+" "+DefaultUser) && !stagesWithRun[line.Stage] {
+				add(LintUnusedUserRoot, fmt.Sprintf("%s %s was added after FROM but the stage has no RUN lines, consider removing it", DirectiveUser, DefaultUser))
+			}
+		}
+
+		if line.Run != nil && line.Run.Shell != nil {
+			converted := line.Converted != "" && line.Converted != line.Raw
+			shell := line.Run.Shell.Before
+			if converted && line.Run.Shell.After != nil {
+				shell = line.Run.Shell.After
+			}
+			for _, message := range deadUpdateMessages(shell, converted) {
+				add(LintDeadUpdate, message)
+			}
+			if converted {
+				for _, message := range leftoverCleanupMessages(shell) {
+					add(LintLeftoverCleanup, message)
+				}
+			}
+		}
+	}
+
+	return findings
+}
+
+// deadUpdateMessages returns a message for each package index update that is not followed by an install
+// in the same RUN command, and for a converted RUN command that was reduced to "true"
+func deadUpdateMessages(shell *ShellCommand, converted bool) []string {
+	if shell == nil {
+		return nil
+	}
+	if converted && len(shell.Parts) == 1 && shell.Parts[0].Command == "true" && len(shell.Parts[0].Args) == 0 {
+		return []string{"RUN only runs true after conversion, the package manager commands it ran are not needed with apk, consider removing the line"}
+	}
+
+	var messages []string
+	for i, part := range shell.Parts {
+		if !slices.Contains(debianManagers, part.Command) || findSubcommand(part.Args, PackageManagerInfoMap[Manager(part.Command)], []string{SubcommandUpdate}) == -1 {
+			continue
+		}
+		installed := slices.ContainsFunc(shell.Parts[i+1:], func(next *ShellPart) bool {
+			return slices.Contains(debianManagers, next.Command) && findInstallKeyword(next.Args, PackageManagerInfoMap[Manager(next.Command)]) != -1
+		})
+		if !installed {
+			messages = append(messages, fmt.Sprintf("%s update is not followed by an install in the same RUN, a later RUN may install from a stale cached index, consider combining them or removing it", part.Command))
+		}
+	}
+	return messages
+}
+
+// leftoverCleanupMessages returns a message for each cleanup command of a non-apk package manager
+// that remains in a converted RUN command
+func leftoverCleanupMessages(shell *ShellCommand) []string {
+	var messages []string
+	for _, part := range shell.Parts {
+		switch {
+		case part.Command != string(ManagerApk) && PackageManagerInfoMap[Manager(part.Command)].Distro != "" && slices.Contains(part.Args, SubcommandClean):
+			messages = append(messages, fmt.Sprintf("RUN was converted to apk but %s clean remains, consider removing it", part.Command))
+		case part.Command == "rm":
+			for _, arg := range part.Args {
+				if i := slices.IndexFunc(packageManagerCacheDirs, func(dir string) bool {
+					return strings.HasPrefix(arg, dir)
+				}); i != -1 {
+					messages = append(messages, fmt.Sprintf("RUN was converted to apk but still removes %s, consider removing it", packageManagerCacheDirs[i]))
+				}
+			}
+		}
+	}
+	return messages
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		convert  bool
+		expected []LintFinding
+	}{
+		{
+			name: "update without install in the same RUN",
+			raw: `FROM debian AS build
+RUN apt-get update
+RUN apt-get install -y curl
+`,
+			expected: []LintFinding{
+				{Code: LintDeadUpdate, Line: 2, Message: "apt-get update is not followed by an install in the same RUN, a later RUN may install from a stale cached index, consider combining them or removing it"},
+			},
+		},
+		{
+			name: "RUN reduced to true by the conversion",
+			raw: `FROM debian AS build
+RUN apt-get update
+RUN apt-get install -y curl
+`,
+			convert: true,
+			expected: []LintFinding{
+				{Code: LintDeadUpdate, Line: 2, Message: "RUN only runs true after conversion, the package manager commands it ran are not needed with apk, consider removing the line"},
+			},
+		},
+		{
+			name: "unnamed stages other than the final one",
+			raw: `FROM golang:1.22
+RUN go build -o /app
+
+FROM node:20 AS assets
+FROM debian:12
+COPY --from=0 /app /app
+`,
+			convert: true,
+			expected: []LintFinding{
+				{Code: LintUnnamedStages, Line: 1, Message: "stage 1 has no AS alias, later stages can only refer to it by its index 0, consider naming it"},
+			},
+		},
+		{
+			name: "cache directory of the original package manager still removed",
+			raw: `FROM fedora
+RUN dnf install -y curl && dnf clean all && rm -rf /var/cache/dnf
+`,
+			convert: true,
+			expected: []LintFinding{
+				{Code: LintLeftoverCleanup, Line: 2, Message: "RUN was converted to apk but still removes /var/cache/dnf, consider removing it"},
+			},
+		},
+		{
+			name: "RUN with only a clean up reduced to true",
+			raw: `FROM debian
+RUN apt-get clean
+`,
+			convert: true,
+			expected: []LintFinding{
+				{Code: LintDeadUpdate, Line: 2, Message: "RUN only runs true after conversion, the package manager commands it ran are not needed with apk, consider removing the line"},
+			},
+		},
+		{
+			name: "clean install",
+			raw: `FROM debian AS build
+RUN apt-get update && apt-get install -y curl && rm -rf /var/lib/apt/lists/*
+FROM debian
+COPY --from=build /usr/bin/curl /usr/bin/curl
+`,
+			convert: true,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			if tt.convert {
+				dockerfile, err = dockerfile.Convert(ctx, Options{Offline: true})
+				if err != nil {
+					t.Fatalf("Convert failed: %v", err)
+				}
+			}
+			if diff := cmp.Diff(tt.expected, dockerfile.Lint()); diff != "" {
+				t.Errorf("Lint() not as expected (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLintLeftoverCleanAndUserRoot(t *testing.T) {
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte("FROM debian\nRUN apt-get install -y curl\nFROM debian\nCOPY . /app\n"))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	// Simulate a custom converter that kept the clean up, and a USER root added to a stage without RUN lines
+	converted.Lines[1].Run.Shell.After = ParseMultilineShell("apk add --no-cache curl && apt-get clean")
+	converted.Lines[2].Converted += "\nUSER root"
+
+	expected := []LintFinding{
+		{Code: LintUnnamedStages, Line: 1, Message: "stage 1 has no AS alias, later stages can only refer to it by its index 0, consider naming it"},
+		{Code: LintLeftoverCleanup, Line: 2, Message: "RUN was converted to apk but apt-get clean remains, consider removing it"},
+		{Code: LintUnusedUserRoot, Line: 3, Message: "USER root was added after FROM but the stage has no RUN lines, consider removing it"},
+	}
+	if diff := cmp.Diff(expected, converted.Lint()); diff != "" {
+		t.Errorf("Lint() not as expected (-want, +got):\n%s", diff)
+	}
+
+	finding := expected[1].String()
+	if want := "line 2: DFC003 RUN was converted to apk but apt-get clean remains, consider removing it"; finding != want {
+		t.Errorf("String() = %q, want %q", finding, want)
+	}
+}
@@ -8,7 +8,13 @@ package dfc
 import (
 	"context"
 	_ "embed"
+	"errors"
 	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 
 	"github.com/chainguard-dev/clog"
 	"gopkg.in/yaml.v3"
@@ -17,17 +23,49 @@ import (
 //go:embed builtin-mappings.yaml
 var builtinMappingsYAMLBytes []byte
 
+// The embedded mappings never change, so they are only unmarshalled once per process
+// and shared (read-only) across conversions
+var (
+	builtinMappingsOnce sync.Once
+	builtinMappings     MappingsConfig
+	builtinMappingsErr  error
+)
+
+// loadBuiltinMappings returns the embedded builtin mappings, unmarshalling them on first use
+func loadBuiltinMappings() (MappingsConfig, error) {
+	builtinMappingsOnce.Do(func() {
+		if err := yaml.Unmarshal(builtinMappingsYAMLBytes, &builtinMappings); err != nil {
+			builtinMappingsErr = fmt.Errorf("unmarshalling builtin mappings: %w", err)
+		}
+	})
+	return builtinMappings, builtinMappingsErr
+}
+
 // defaultGetDefaultMappings is the real implementation of GetDefaultMappings
-func defaultGetDefaultMappings(ctx context.Context, update bool) (MappingsConfig, error) {
+func defaultGetDefaultMappings(ctx context.Context, update bool, offline bool) (MappingsConfig, error) {
 	log := clog.FromContext(ctx)
 	var mappings MappingsConfig
 
+	if offline {
+		// In offline mode never touch the network or the XDG cache, so that
+		// conversions are deterministic for a given dfc binary
+		if update {
+			log.Debug("Offline mode enabled, skipping mappings update")
+		}
+		if len(builtinMappingsYAMLBytes) == 0 {
+			return mappings, fmt.Errorf("offline mode requires embedded builtin mappings, but none are available")
+		}
+		log.Debug("Offline mode enabled, using embedded builtin mappings")
+		return loadBuiltinMappings()
+	}
+
 	// If update is requested, try to update the mappings first
 	if update {
 		// Set up update options
 		updateOpts := UpdateOptions{}
 		// Use the default URL
 		updateOpts.MappingsURL = defaultMappingsURL
+		updateOpts.Retries = DefaultUpdateRetries
 
 		if err := Update(ctx, updateOpts); err != nil {
 			log.Warn("Failed to update mappings, will try to use existing mappings", "error", err)
@@ -40,18 +78,15 @@ func defaultGetDefaultMappings(ctx context.Context, update bool) (MappingsConfig
 		return mappings, fmt.Errorf("checking XDG config mappings: %w", err)
 	}
 
-	var mappingsBytes []byte
-	if xdgMappings != nil {
-		log.Debug("Using mappings from XDG config directory")
-		mappingsBytes = xdgMappings
-	} else {
+	if xdgMappings == nil {
 		// Fall back to embedded mappings
 		log.Debug("Using embedded builtin mappings")
-		mappingsBytes = builtinMappingsYAMLBytes
+		return loadBuiltinMappings()
 	}
 
-	// Unmarshal the mappings
-	if err := yaml.Unmarshal(mappingsBytes, &mappings); err != nil {
+	// The XDG mappings may be updated at any time, so they are read on every call
+	log.Debug("Using mappings from XDG config directory")
+	if err := yaml.Unmarshal(xdgMappings, &mappings); err != nil {
 		return mappings, fmt.Errorf("unmarshalling mappings: %w", err)
 	}
 
@@ -96,5 +131,275 @@ func MergeMappings(base, overlay MappingsConfig) MappingsConfig {
 		}
 	}
 
+	// Merge the package groups in the same way
+	for _, groups := range []PackageMap{base.Groups, overlay.Groups} {
+		for distro, distroGroups := range groups {
+			if result.Groups == nil {
+				result.Groups = make(PackageMap)
+			}
+			if result.Groups[distro] == nil {
+				result.Groups[distro] = make(map[string][]string)
+			}
+			for group, packages := range distroGroups {
+				result.Groups[distro][group] = packages
+			}
+		}
+	}
+
+	// Merge the mappings of each catalog in the same way
+	for _, catalogs := range []map[string]CatalogMappings{base.Catalogs, overlay.Catalogs} {
+		for name, catalog := range catalogs {
+			if result.Catalogs == nil {
+				result.Catalogs = make(map[string]CatalogMappings)
+			}
+			merged := MergeMappings(result.Catalogs[name].mappings(), catalog.mappings())
+			result.Catalogs[name] = CatalogMappings{Images: merged.Images, Packages: merged.Packages}
+		}
+	}
+
 	return result
 }
+
+// CatalogMappings are image and package mappings that only apply when converting for a specific
+// target catalog (e.g. a private registry with a curated subset of images), selected with Options.Catalog
+type CatalogMappings struct {
+	Images   map[string]string `yaml:"images,omitempty"`
+	Packages PackageMap        `yaml:"packages,omitempty"`
+}
+
+// mappings returns the catalog mappings as a MappingsConfig
+func (c CatalogMappings) mappings() MappingsConfig {
+	return MappingsConfig{Images: c.Images, Packages: c.Packages}
+}
+
+// ForCatalog returns the mappings to use for a target catalog: the mappings of the catalog overlaid
+// on the mappings shared by all catalogs. An empty catalog returns the mappings unchanged.
+func (m MappingsConfig) ForCatalog(catalog string) (MappingsConfig, error) {
+	if catalog == "" {
+		return m, nil
+	}
+	catalogMappings, ok := m.Catalogs[catalog]
+	if !ok {
+		names := make([]string, 0, len(m.Catalogs))
+		for name := range m.Catalogs {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		if len(names) == 0 {
+			return m, fmt.Errorf("unknown catalog %q, no catalogs are defined in the mappings", catalog)
+		}
+		return m, fmt.Errorf("unknown catalog %q, must be one of: %s", catalog, strings.Join(names, ", "))
+	}
+	merged := MergeMappings(MappingsConfig{Images: m.Images, Packages: m.Packages}, catalogMappings.mappings())
+	merged.Groups = m.Groups
+	return merged, nil
+}
+
+// packageMapWithGroups returns the package mappings with the package groups added as "@group" keys,
+// the syntax dnf and yum use to install a group (e.g. dnf install @development-tools)
+func (m MappingsConfig) packageMapWithGroups() PackageMap {
+	if len(m.Groups) == 0 {
+		return m.Packages
+	}
+	result := make(PackageMap, len(m.Packages))
+	for distro, packages := range m.Packages {
+		result[distro] = maps.Clone(packages)
+	}
+	for distro, groups := range m.Groups {
+		if result[distro] == nil {
+			result[distro] = make(map[string][]string)
+		}
+		for group, packages := range groups {
+			result[distro]["@"+group] = packages
+		}
+	}
+	return result
+}
+
+// ValidateMappingsConfig checks that mappings are well formed: distro keys are supported,
+// image and package names are non-empty, image targets are valid image references, and
+// wildcard image patterns only use a trailing "*".
+// The mappings of each catalog are checked in the same way. All problems found are returned together.
+func ValidateMappingsConfig(m MappingsConfig) error {
+	errs := validateMappings("", m.Images, m.Packages)
+	errs = append(errs, validatePackageMap("groups", m.Groups)...)
+
+	catalogs := make([]string, 0, len(m.Catalogs))
+	for name := range m.Catalogs {
+		catalogs = append(catalogs, name)
+	}
+	slices.Sort(catalogs)
+	for _, name := range catalogs {
+		if strings.TrimSpace(name) == "" {
+			errs = append(errs, fmt.Errorf("catalogs: empty catalog name"))
+			continue
+		}
+		errs = append(errs, validateMappings("catalogs."+name+".", m.Catalogs[name].Images, m.Catalogs[name].Packages)...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateMappings checks image and package mappings, prefixing the field names in errors with prefix
+func validateMappings(prefix string, imageMappings map[string]string, packageMappings PackageMap) []error {
+	var errs []error
+
+	images := make([]string, 0, len(imageMappings))
+	for image := range imageMappings {
+		images = append(images, image)
+	}
+	slices.Sort(images)
+	for _, image := range images {
+		switch {
+		case strings.TrimSpace(image) == "":
+			errs = append(errs, fmt.Errorf("%simages: empty image name (mapped to %q)", prefix, imageMappings[image]))
+		case strings.TrimSpace(imageMappings[image]) == "":
+			errs = append(errs, fmt.Errorf("%simages: %q is mapped to an empty image", prefix, image))
+		case !isImageReference(imageMappings[image]):
+			errs = append(errs, fmt.Errorf("%simages: %q is mapped to %q, which is not a valid image reference", prefix, image, imageMappings[image]))
+		case strings.Contains(strings.TrimSuffix(image, "*"), "*"):
+			errs = append(errs, fmt.Errorf("%simages: wildcard pattern %q is not supported, \"*\" can only be used at the end (e.g. nodejs*)", prefix, image))
+		}
+	}
+
+	return append(errs, validatePackageMap(prefix+"packages", packageMappings)...)
+}
+
+// validatePackageMap checks a map of distro to package (or package group) mappings, using field in errors
+func validatePackageMap(field string, packageMappings PackageMap) []error {
+	var errs []error
+
+	distros := make([]Distro, 0, len(packageMappings))
+	for distro := range packageMappings {
+		distros = append(distros, distro)
+	}
+	slices.Sort(distros)
+	supported := SupportedDistros()
+	for _, distro := range distros {
+		if !slices.Contains(supported, distro) {
+			var names []string
+			for _, d := range supported {
+				names = append(names, string(d))
+			}
+			errs = append(errs, fmt.Errorf("%s: unknown distro %q, must be one of: %s", field, distro, strings.Join(names, ", ")))
+			continue
+		}
+
+		packages := make([]string, 0, len(packageMappings[distro]))
+		for pkg := range packageMappings[distro] {
+			packages = append(packages, pkg)
+		}
+		slices.Sort(packages)
+		for _, pkg := range packages {
+			if strings.TrimSpace(pkg) == "" {
+				errs = append(errs, fmt.Errorf("%s.%s: empty package name", field, distro))
+				continue
+			}
+			for _, target := range packageMappings[distro][pkg] {
+				if strings.TrimSpace(target) == "" {
+					errs = append(errs, fmt.Errorf("%s.%s: %q is mapped to an empty package name", field, distro, pkg))
+					break
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// MatchKind describes how an image was matched against the image mappings
+type MatchKind string
+
+// Image mapping match kinds, in the order they are tried
+const (
+	MatchKindNone             MatchKind = ""                  // No mapping matched
+	MatchKindExact            MatchKind = "exact"             // The image (with or without tag) or its base name is a key
+	MatchKindDockerHubVariant MatchKind = "dockerhub-variant" // A Docker Hub form of the image (e.g. docker.io/library/node) is a key
+	MatchKindNormalized       MatchKind = "normalized"        // The image with its Docker Hub registry prefix removed is a key
+	MatchKindWildcard         MatchKind = "wildcard"          // A key ending in "*" is a prefix of the image base name
+)
+
+// GetImageMapping returns the mapped image for an image reference (e.g. "node:18"),
+// or an empty string if there is no mapping
+func (m MappingsConfig) GetImageMapping(image string) string {
+	target, _ := m.GetImageMappingWithKind(image)
+	return target
+}
+
+// GetImageMappingWithKind is like GetImageMapping, but also returns how the mapping was matched
+func (m MappingsConfig) GetImageMappingWithKind(image string) (string, MatchKind) {
+	base, tag := splitImageTag(image)
+	target, kind, _ := lookupImageMapping(m.Images, base, tag, true)
+	return target, kind
+}
+
+// lookupImageMapping finds the mapping for an image, returning the mapped image,
+// how it was matched, and the mappings key that matched. Wildcard keys are only
+// considered if wildcards is true.
+func lookupImageMapping(images map[string]string, base, tag string, wildcards bool) (string, MatchKind, string) {
+	baseFilename := filepath.Base(base)
+
+	// Check for exact match first, in specific order
+	// For example, if the mapping is just node, it should match all of the following:
+	// FROM registry-1.docker.io/library/node
+	// FROM docker.io/node
+	// FROM docker.io/library/node
+	// FROM index.docker.io/node
+	// FROM index.docker.io/library/node
+	//
+	// If the mapping is someorg/somerepo, it should match all of the following:
+	// FROM registry-1.docker.io/someorg/somerepo
+	// FROM docker.io/someorg/somerepo
+	// FROM index.docker.io/someorg/somerepo
+
+	// First check for exact match with full image reference including tag
+	fullImageRef := base
+	if tag != "" {
+		fullImageRef += ":" + tag
+	}
+	for _, key := range []string{fullImageRef, base, baseFilename} {
+		if img, ok := images[key]; ok {
+			return img, MatchKindExact, key
+		}
+	}
+
+	// Check if any Docker Hub variant of the base image matches a key in the mappings
+	for _, variant := range generateDockerHubVariants(base) {
+		if img, ok := images[variant]; ok {
+			return img, MatchKindDockerHubVariant, variant
+		}
+	}
+
+	// If still no match, try to normalize the base and check against simple keys
+	normalizedBase := normalizeImageName(base)
+	if img, ok := images[normalizedBase]; ok {
+		return img, MatchKindNormalized, normalizedBase
+	}
+	if strings.HasPrefix(normalizedBase, "library/") {
+		// Try removing library/ prefix if it exists
+		simpleBase := strings.TrimPrefix(normalizedBase, "library/")
+		if img, ok := images[simpleBase]; ok {
+			return img, MatchKindNormalized, simpleBase
+		}
+	}
+
+	if !wildcards {
+		return "", MatchKindNone, ""
+	}
+
+	// If still no match, check for glob patterns with asterisks (in sorted order, so results are stable)
+	patterns := make([]string, 0, len(images))
+	for pattern := range images {
+		if strings.HasSuffix(pattern, "*") {
+			patterns = append(patterns, pattern)
+		}
+	}
+	slices.Sort(patterns)
+	for _, pattern := range patterns {
+		if strings.HasPrefix(baseFilename, strings.TrimSuffix(pattern, "*")) {
+			return images[pattern], MatchKindWildcard, pattern
+		}
+	}
+
+	return "", MatchKindNone, ""
+}
@@ -0,0 +1,502 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestGetImageMappingWithKind(t *testing.T) {
+	mappings := MappingsConfig{
+		Images: map[string]string{
+			"node":                   "node",
+			"python:2":               "python:2.7",
+			"someorg/somerepo":       "somerepo",
+			"nodejs*":                "node",
+			"docker.io/library/ruby": "ruby",
+		},
+	}
+
+	tests := []struct {
+		image      string
+		wantTarget string
+		wantKind   MatchKind
+	}{
+		{image: "node:18", wantTarget: "node", wantKind: MatchKindExact},
+		{image: "python:2", wantTarget: "python:2.7", wantKind: MatchKindExact},
+		{image: "registry.example.com/team/node@sha256:abc", wantTarget: "node", wantKind: MatchKindExact},
+		{image: "ruby:3", wantTarget: "ruby", wantKind: MatchKindDockerHubVariant},
+		{image: "docker.io/someorg/somerepo:1.0", wantTarget: "somerepo", wantKind: MatchKindNormalized},
+		{image: "nodejs-alpine:20", wantTarget: "node", wantKind: MatchKindWildcard},
+		{image: "python:3", wantTarget: "", wantKind: MatchKindNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			target, kind := mappings.GetImageMappingWithKind(tt.image)
+			if target != tt.wantTarget || kind != tt.wantKind {
+				t.Errorf("GetImageMappingWithKind(%q) = (%q, %q), want (%q, %q)", tt.image, target, kind, tt.wantTarget, tt.wantKind)
+			}
+			if got := mappings.GetImageMapping(tt.image); got != tt.wantTarget {
+				t.Errorf("GetImageMapping(%q) = %q, want %q", tt.image, got, tt.wantTarget)
+			}
+		})
+	}
+}
+
+func TestBuiltinMappingsCached(t *testing.T) {
+	first, err := loadBuiltinMappings()
+	if err != nil {
+		t.Fatalf("loadBuiltinMappings() error = %v", err)
+	}
+	if len(first.Images) == 0 || len(first.Packages) == 0 {
+		t.Fatalf("Expected builtin mappings to contain images and packages")
+	}
+	second, err := loadBuiltinMappings()
+	if err != nil {
+		t.Fatalf("loadBuiltinMappings() error = %v", err)
+	}
+	if reflect.ValueOf(first.Images).Pointer() != reflect.ValueOf(second.Images).Pointer() {
+		t.Errorf("Expected builtin mappings to only be unmarshalled once")
+	}
+
+	// Concurrent conversions share the cached mappings
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte("FROM node:18\nRUN apt-get install -y build-essential"))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	want, err := dockerfile.Convert(ctx, Options{Offline: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	results := make([]string, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+			if err != nil {
+				t.Errorf("Convert failed: %v", err)
+				return
+			}
+			results[i] = converted.String()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, got := range results {
+		if got != want.String() {
+			t.Errorf("Conversion %d = %q, want %q", i, got, want.String())
+		}
+	}
+}
+
+func TestValidateMappingsConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		mappings MappingsConfig
+		wantErrs []string
+	}{
+		{
+			name: "valid",
+			mappings: MappingsConfig{
+				Images: map[string]string{"node": "node", "nodejs*": "node"},
+				Packages: PackageMap{
+					DistroDebian: {"build-essential": {"build-base"}, "software-properties-common": {}},
+					DistroFedora: {"gcc-c++": {"gcc"}},
+				},
+			},
+		},
+		{
+			name:     "empty",
+			mappings: MappingsConfig{},
+		},
+		{
+			name: "unknown distro",
+			mappings: MappingsConfig{
+				Packages: PackageMap{"ubuntu": {"curl": {"curl"}}},
+			},
+			wantErrs: []string{`packages: unknown distro "ubuntu", must be one of: alpine, debian, fedora`},
+		},
+		{
+			name: "empty values",
+			mappings: MappingsConfig{
+				Images: map[string]string{"node": "", "": "python"},
+				Packages: PackageMap{
+					DistroDebian: {"curl": {""}, "": {"git"}},
+				},
+			},
+			wantErrs: []string{
+				`images: empty image name (mapped to "python")`,
+				`images: "node" is mapped to an empty image`,
+				`packages.debian: empty package name`,
+				`packages.debian: "curl" is mapped to an empty package name`,
+			},
+		},
+		{
+			name: "valid image references",
+			mappings: MappingsConfig{
+				Images: map[string]string{
+					"node":    "node:latest",
+					"python":  "cgr.dev/chainguard/python:3.12-dev",
+					"nginx":   "registry.example.com:5000/mirror/nginx@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+					"golang*": "go",
+				},
+			},
+		},
+		{
+			name: "malformed image targets",
+			mappings: MappingsConfig{
+				Images: map[string]string{
+					"node":   "Node:latest",
+					"python": "python 3",
+					"ruby":   "ruby:",
+					"nginx":  "https://cgr.dev/chainguard/nginx",
+				},
+			},
+			wantErrs: []string{
+				`images: "nginx" is mapped to "https://cgr.dev/chainguard/nginx", which is not a valid image reference`,
+				`images: "node" is mapped to "Node:latest", which is not a valid image reference`,
+				`images: "python" is mapped to "python 3", which is not a valid image reference`,
+				`images: "ruby" is mapped to "ruby:", which is not a valid image reference`,
+			},
+		},
+		{
+			name: "wildcard not at the end",
+			mappings: MappingsConfig{
+				Images: map[string]string{"node*-slim": "node"},
+			},
+			wantErrs: []string{`images: wildcard pattern "node*-slim" is not supported, "*" can only be used at the end (e.g. nodejs*)`},
+		},
+		{
+			name: "invalid catalog mappings",
+			mappings: MappingsConfig{
+				Catalogs: map[string]CatalogMappings{
+					"enterprise": {
+						Images:   map[string]string{"node": ""},
+						Packages: PackageMap{"ubuntu": {"curl": {"curl"}}},
+					},
+					"": {},
+				},
+			},
+			wantErrs: []string{
+				`catalogs: empty catalog name`,
+				`catalogs.enterprise.images: "node" is mapped to an empty image`,
+				`catalogs.enterprise.packages: unknown distro "ubuntu", must be one of: alpine, debian, fedora`,
+			},
+		},
+		{
+			name: "invalid package groups",
+			mappings: MappingsConfig{
+				Groups: PackageMap{
+					DistroFedora: {"development-tools": {"build-base", ""}},
+					"centos":     {"development-tools": {"build-base"}},
+				},
+			},
+			wantErrs: []string{
+				`groups: unknown distro "centos", must be one of: alpine, debian, fedora`,
+				`groups.fedora: "development-tools" is mapped to an empty package name`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateMappingsConfig(tt.mappings)
+			if len(tt.wantErrs) == 0 {
+				if err != nil {
+					t.Errorf("ValidateMappingsConfig() unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("ValidateMappingsConfig() expected errors %q, got nil", tt.wantErrs)
+			}
+			if got := strings.Split(err.Error(), "\n"); !reflect.DeepEqual(got, tt.wantErrs) {
+				t.Errorf("ValidateMappingsConfig() errors = %q, want %q", got, tt.wantErrs)
+			}
+		})
+	}
+}
+
+func TestBuiltinMappingsValid(t *testing.T) {
+	mappings, err := loadBuiltinMappings()
+	if err != nil {
+		t.Fatalf("loadBuiltinMappings() error: %v", err)
+	}
+	if err := ValidateMappingsConfig(mappings); err != nil {
+		t.Errorf("builtin mappings are invalid: %v", err)
+	}
+}
+
+func TestMappingsYAMLRoundTrip(t *testing.T) {
+	mappings, err := loadBuiltinMappings()
+	if err != nil {
+		t.Fatalf("loadBuiltinMappings() error: %v", err)
+	}
+
+	// Map keys are sorted when marshalling, so the output is deterministic
+	first, err := yaml.Marshal(mappings)
+	if err != nil {
+		t.Fatalf("yaml.Marshal() error: %v", err)
+	}
+	var reloaded MappingsConfig
+	if err := yaml.Unmarshal(first, &reloaded); err != nil {
+		t.Fatalf("yaml.Unmarshal() error: %v", err)
+	}
+	second, err := yaml.Marshal(reloaded)
+	if err != nil {
+		t.Fatalf("yaml.Marshal() error: %v", err)
+	}
+	if string(first) != string(second) {
+		t.Errorf("mappings YAML is not stable across a round trip")
+	}
+	if !reflect.DeepEqual(mappings, reloaded) {
+		t.Errorf("mappings changed across a YAML round trip")
+	}
+}
+
+func TestCatalogMappings(t *testing.T) {
+	mappings := MappingsConfig{
+		Images: map[string]string{"node": "node", "python": "python"},
+		Packages: PackageMap{
+			DistroDebian: {"libssl-dev": {"openssl-dev"}},
+		},
+		Catalogs: map[string]CatalogMappings{
+			"public": {
+				Images: map[string]string{"node": "node:latest"},
+			},
+			"enterprise": {
+				Images: map[string]string{"node": "node-fips"},
+				Packages: PackageMap{
+					DistroDebian: {"libssl-dev": {"openssl-fips-dev"}},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		catalog  string
+		expected string
+	}{
+		{
+			catalog:  "",
+			expected: "FROM cgr.dev/ORG/node:20-dev\nUSER root\nRUN apk add --no-cache openssl-dev\nFROM cgr.dev/ORG/python:3.12\n",
+		},
+		{
+			catalog:  "public",
+			expected: "FROM cgr.dev/ORG/node:latest\nUSER root\nRUN apk add --no-cache openssl-dev\nFROM cgr.dev/ORG/python:3.12\n",
+		},
+		{
+			catalog:  "enterprise",
+			expected: "FROM cgr.dev/ORG/node-fips:20-dev\nUSER root\nRUN apk add --no-cache openssl-fips-dev\nFROM cgr.dev/ORG/python:3.12\n",
+		},
+	}
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte("FROM node:20\nRUN apt-get install -y libssl-dev\nFROM python:3.12"))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.catalog, func(t *testing.T) {
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true, ExtraMappings: mappings, Catalog: tt.catalog})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if got := converted.String(); got != tt.expected {
+				t.Errorf("Convert() with catalog %q = %q, want %q", tt.catalog, got, tt.expected)
+			}
+		})
+	}
+
+	if _, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true, ExtraMappings: mappings, Catalog: "missing"}); err == nil || err.Error() != `unknown catalog "missing", must be one of: enterprise, public` {
+		t.Errorf("Convert() with an unknown catalog: unexpected error %v", err)
+	}
+
+	// Catalogs from several mappings files are merged like the top-level mappings
+	merged := MergeMappings(mappings, MappingsConfig{
+		Catalogs: map[string]CatalogMappings{
+			"enterprise": {Images: map[string]string{"python": "python-fips"}},
+		},
+	})
+	enterprise, err := merged.ForCatalog("enterprise")
+	if err != nil {
+		t.Fatalf("ForCatalog failed: %v", err)
+	}
+	wantImages := map[string]string{"node": "node-fips", "python": "python-fips"}
+	if !reflect.DeepEqual(enterprise.Images, wantImages) {
+		t.Errorf("merged enterprise images = %v, want %v", enterprise.Images, wantImages)
+	}
+}
+
+func TestExtraMappingsPriority(t *testing.T) {
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte("FROM golang:1.22\nRUN apt-get install -y build-essential libfoo"))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+
+	// The built-in mappings convert golang* to go and build-essential to build-base,
+	// libfoo is only mapped by the extra mappings
+	extra := MappingsConfig{
+		Images: map[string]string{"golang*": "go-fips"},
+		Packages: PackageMap{
+			DistroDebian: {"build-essential": {"gcc", "make"}, "libfoo": {"foo-dev"}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		priority ExtraMappingsPriority
+		expected string
+	}{
+		{
+			name:     "extra mappings override the built-in mappings by default",
+			expected: "FROM cgr.dev/ORG/go-fips:1.22-dev\nUSER root\nRUN apk add --no-cache foo-dev gcc make\n",
+		},
+		{
+			name:     "override",
+			priority: ExtraMappingsOverride,
+			expected: "FROM cgr.dev/ORG/go-fips:1.22-dev\nUSER root\nRUN apk add --no-cache foo-dev gcc make\n",
+		},
+		{
+			name:     "fallback only fills gaps in the built-in mappings",
+			priority: ExtraMappingsFallback,
+			expected: "FROM cgr.dev/ORG/go:1.22-dev\nUSER root\nRUN apk add --no-cache build-base foo-dev\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true, ExtraMappings: extra, ExtraMappingsPriority: tt.priority})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if got := converted.String(); got != tt.expected {
+				t.Errorf("Convert() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPackageGroups(t *testing.T) {
+	mappings := MappingsConfig{
+		Packages: PackageMap{
+			DistroFedora: {"gcc-c++": {"gcc"}},
+		},
+		Groups: PackageMap{
+			DistroFedora: {"development-tools": {"build-base", "git"}},
+		},
+	}
+
+	tests := []struct {
+		name               string
+		raw                string
+		expected           string
+		expectedDiagnostic string
+	}{
+		{
+			name:     "group expands to its packages",
+			raw:      `RUN dnf install -y @development-tools gcc-c++`,
+			expected: `RUN apk add --no-cache build-base gcc git`,
+		},
+		{
+			name:     "microdnf group",
+			raw:      `RUN microdnf install -y @development-tools`,
+			expected: `RUN apk add --no-cache build-base git`,
+		},
+		{
+			name:               "unknown group is dropped",
+			raw:                `RUN dnf install -y @c-development gcc-c++`,
+			expected:           `RUN apk add --no-cache gcc`,
+			expectedDiagnostic: "dnf install @c-development installs a package group that has no mapping, it was dropped and the packages it provides must be added manually, or mapped under groups in a mappings file",
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			// Strict mode reports unknown groups with a diagnostic instead of failing
+			converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true, ExtraMappings: mappings, Strict: tt.expectedDiagnostic != ""})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if got := converted.Lines[0].Converted; got != tt.expected {
+				t.Errorf("Convert() = %q, want %q", got, tt.expected)
+			}
+			var expectedDiagnostics []string
+			if tt.expectedDiagnostic != "" {
+				expectedDiagnostics = []string{tt.expectedDiagnostic}
+			}
+			if got := converted.Lines[0].Diagnostics; !reflect.DeepEqual(got, expectedDiagnostics) {
+				t.Errorf("diagnostics = %q, want %q", got, expectedDiagnostics)
+			}
+		})
+	}
+
+	// Groups from several mappings files are merged like packages
+	merged := MergeMappings(mappings, MappingsConfig{
+		Groups: PackageMap{DistroFedora: {"c-development": {"build-base"}}},
+	})
+	want := PackageMap{DistroFedora: {"development-tools": {"build-base", "git"}, "c-development": {"build-base"}}}
+	if !reflect.DeepEqual(merged.Groups, want) {
+		t.Errorf("merged groups = %v, want %v", merged.Groups, want)
+	}
+}
+
+func TestBuiltInPackageGroups(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected string
+	}{
+		{
+			raw:      `RUN dnf install -y @development-tools`,
+			expected: `RUN apk add --no-cache build-base gettext git patch`,
+		},
+		{
+			raw:      `RUN dnf install -y @c-development gcc-c++`,
+			expected: `RUN apk add --no-cache autoconf automake bison build-base flex gcc libtool pkgconf`,
+		},
+		{
+			raw:      `RUN yum install -y @development`,
+			expected: `RUN apk add --no-cache autoconf automake bison build-base flex git libtool patch pkgconf`,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			dockerfile, err := ParseDockerfile(ctx, []byte(tt.raw))
+			if err != nil {
+				t.Fatalf("ParseDockerfile failed: %v", err)
+			}
+			converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if got := converted.Lines[0].Converted; got != tt.expected {
+				t.Errorf("Convert() = %q, want %q", got, tt.expected)
+			}
+			if got := converted.Lines[0].Diagnostics; len(got) > 0 {
+				t.Errorf("expected no diagnostics, got %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Parts of the image reference grammar of the OCI distribution spec
+const (
+	referenceDomainComponent = `(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])`
+	referenceDomain          = referenceDomainComponent + `(?:\.` + referenceDomainComponent + `)*(?::[0-9]+)?`
+	referencePathComponent   = `[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*`
+	referenceTag             = `[\w][\w.-]{0,127}`
+	referenceDigest          = `[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9A-Fa-f]{32,}`
+)
+
+// imageReferenceRegex matches a valid image reference, e.g. "chainguard-base:latest" or
+// "registry.example.com:5000/team/node:18@sha256:...", capturing the first path component
+// (which may be a registry), the rest of the path, the tag and the digest
+var imageReferenceRegex = regexp.MustCompile(`^(?:(` + referenceDomain + `)/)?` +
+	`(` + referencePathComponent + `(?:/` + referencePathComponent + `)*)` +
+	`(?::(` + referenceTag + `))?` +
+	`(?:@(` + referenceDigest + `))?$`)
+
+// imageReference is an image reference split into its parts
+type imageReference struct {
+	Registry   string // e.g. "localhost:5000", empty for Docker Hub images given without a registry
+	Repository string // e.g. "library/node"
+	Tag        string
+	Digest     string // e.g. "sha256:..."
+}
+
+// name returns the image name with its registry, e.g. "localhost:5000/node"
+func (r imageReference) name() string {
+	if r.Registry == "" {
+		return r.Repository
+	}
+	return r.Registry + "/" + r.Repository
+}
+
+// parseImageReference parses an image reference following the OCI distribution grammar, returning
+// false if it is not a valid reference (e.g. it uses variables such as ${TAG})
+func parseImageReference(ref string) (imageReference, bool) {
+	matches := imageReferenceRegex.FindStringSubmatch(ref)
+	if matches == nil {
+		return imageReference{}, false
+	}
+	reference := imageReference{Registry: matches[1], Repository: matches[2], Tag: matches[3], Digest: matches[4]}
+
+	// Like Docker, the first component is only a registry if it looks like a host name,
+	// otherwise it is part of the repository (e.g. "someorg/somerepo")
+	if reference.Registry != "" && !strings.ContainsAny(reference.Registry, ".:") && reference.Registry != "localhost" && strings.ToLower(reference.Registry) == reference.Registry {
+		reference.Repository = reference.Registry + "/" + reference.Repository
+		reference.Registry = ""
+	}
+	return reference, true
+}
+
+// isImageReference checks if ref is a valid image reference
+func isImageReference(ref string) bool {
+	_, ok := parseImageReference(ref)
+	return ok
+}
+
+// splitImageReference splits an image reference into its name (including the registry), tag and digest.
+// References that are not valid, e.g. because they use variables such as python:${PYTHON_VERSION:-3.12},
+// are split leniently, allowing for a registry with a port (e.g. localhost:5000/node:${TAG}).
+func splitImageReference(ref string) (name, tag, digest string) {
+	if reference, ok := parseImageReference(ref); ok {
+		return reference.name(), reference.Tag, reference.Digest
+	}
+
+	name, digest, _ = strings.Cut(ref, "@")
+	colon, slash := -1, -1
+	braceDepth := 0
+	for i := 0; i < len(name); i++ {
+		switch {
+		case name[i] == '$' && i+1 < len(name) && name[i+1] == '{':
+			braceDepth++
+			i++
+		case name[i] == '}' && braceDepth > 0:
+			braceDepth--
+		case braceDepth > 0:
+		case name[i] == '/':
+			slash = i
+		case name[i] == ':' && colon <= slash:
+			colon = i
+		}
+	}
+	if colon > slash {
+		return name[:colon], name[colon+1:], digest
+	}
+	return name, "", digest
+}
+
+// splitImageTag splits an image reference into its name and tag, like splitImageReference without the digest
+func splitImageTag(ref string) (name, tag string) {
+	name, tag, _ = splitImageReference(ref)
+	return name, tag
+}
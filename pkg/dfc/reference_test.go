@@ -0,0 +1,116 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseImageReference(t *testing.T) {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		ref     string
+		want    imageReference
+		invalid bool
+	}{
+		{ref: "node", want: imageReference{Repository: "node"}},
+		{ref: "node:18", want: imageReference{Repository: "node", Tag: "18"}},
+		{ref: "node:18.20.4-bookworm-slim", want: imageReference{Repository: "node", Tag: "18.20.4-bookworm-slim"}},
+		{ref: "library/node:18", want: imageReference{Repository: "library/node", Tag: "18"}},
+		{ref: "someorg/team/app:v1", want: imageReference{Repository: "someorg/team/app", Tag: "v1"}},
+		{ref: "docker.io/library/node:18", want: imageReference{Registry: "docker.io", Repository: "library/node", Tag: "18"}},
+		{ref: "localhost/node", want: imageReference{Registry: "localhost", Repository: "node"}},
+		{ref: "localhost:5000/node", want: imageReference{Registry: "localhost:5000", Repository: "node"}},
+		{ref: "localhost:5000/node:18", want: imageReference{Registry: "localhost:5000", Repository: "node", Tag: "18"}},
+		{ref: "registry.example.com:5000/team/sub/python:3.12-dev", want: imageReference{Registry: "registry.example.com:5000", Repository: "team/sub/python", Tag: "3.12-dev"}},
+		{ref: "Registry.Example.com/app", want: imageReference{Registry: "Registry.Example.com", Repository: "app"}},
+		{ref: "MyRegistry/app", want: imageReference{Registry: "MyRegistry", Repository: "app"}},
+		{ref: "node@" + digest, want: imageReference{Repository: "node", Digest: digest}},
+		{ref: "node:18@" + digest, want: imageReference{Repository: "node", Tag: "18", Digest: digest}},
+		{ref: "localhost:5000/node:18@" + digest, want: imageReference{Registry: "localhost:5000", Repository: "node", Tag: "18", Digest: digest}},
+		{ref: "my_org/my__app/a-b--c:TAG_1.x", want: imageReference{Repository: "my_org/my__app/a-b--c", Tag: "TAG_1.x"}},
+		{ref: "", invalid: true},
+		{ref: "Node:18", invalid: true},
+		{ref: "node:", invalid: true},
+		{ref: "node:-18", invalid: true},
+		{ref: "node@sha256:abc", invalid: true},
+		{ref: "python:${PYTHON_VERSION:-3.12}", invalid: true},
+		{ref: "https://cgr.dev/chainguard/node", invalid: true},
+		{ref: "node 18", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, ok := parseImageReference(tt.ref)
+			if ok == tt.invalid {
+				t.Fatalf("parseImageReference(%q) valid = %v, want %v", tt.ref, ok, !tt.invalid)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("parseImageReference(%q) not as expected (-want, +got):\n%s", tt.ref, diff)
+			}
+		})
+	}
+}
+
+func TestSplitImageReference(t *testing.T) {
+	tests := []struct {
+		ref        string
+		wantName   string
+		wantTag    string
+		wantDigest string
+	}{
+		{ref: "localhost:5000/node:18", wantName: "localhost:5000/node", wantTag: "18"},
+		{ref: "localhost:5000/node", wantName: "localhost:5000/node"},
+		{ref: "registry.example.com:5000/team/node:18@sha256:0123456789abcdef0123456789abcdef", wantName: "registry.example.com:5000/team/node", wantTag: "18", wantDigest: "sha256:0123456789abcdef0123456789abcdef"},
+
+		// References with variables are split leniently
+		{ref: "python:${PYTHON_VERSION:-3.12}", wantName: "python", wantTag: "${PYTHON_VERSION:-3.12}"},
+		{ref: "${REGISTRY}/node:${TAG}", wantName: "${REGISTRY}/node", wantTag: "${TAG}"},
+		{ref: "localhost:5000/node:${TAG}@${DIGEST}", wantName: "localhost:5000/node", wantTag: "${TAG}", wantDigest: "${DIGEST}"},
+		{ref: "${BASE_IMAGE}", wantName: "${BASE_IMAGE}"},
+		{ref: "node@sha256:abc", wantName: "node", wantDigest: "sha256:abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			name, tag, digest := splitImageReference(tt.ref)
+			if diff := cmp.Diff([]string{tt.wantName, tt.wantTag, tt.wantDigest}, []string{name, tag, digest}); diff != "" {
+				t.Errorf("splitImageReference(%q) not as expected (-want, +got):\n%s", tt.ref, diff)
+			}
+		})
+	}
+}
+
+func TestConvertRegistryPortReferences(t *testing.T) {
+	raw := `ARG BASE=localhost:5000/node:18
+FROM ${BASE}
+RUN echo hello
+FROM registry.example.com:5000/team/python:3.12
+COPY --from=registry.example.com:5000/tools/node:20 /app /app
+`
+	expected := `ARG BASE=cgr.dev/ORG/node:18-dev
+FROM ${BASE}
+RUN echo hello
+FROM cgr.dev/ORG/python:3.12
+COPY --from=cgr.dev/ORG/node:20 /app /app
+`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(raw))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	converted, err := dockerfile.Convert(ctx, Options{NoBuiltIn: true, ConvertCopyFrom: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	if diff := cmp.Diff(expected, converted.String()); diff != "" {
+		t.Errorf("conversion not as expected (-want, +got):\n%s", diff)
+	}
+}
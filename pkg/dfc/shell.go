@@ -6,6 +6,8 @@ SPDX-License-Identifier: Apache-2.0
 package dfc
 
 import (
+	"regexp"
+	"slices"
 	"strings"
 )
 
@@ -22,10 +24,58 @@ type ShellPart struct {
 	Delimiter string   // The delimiter for this part, such as "&&" or "||" or ";"
 }
 
-const partSeparator = " \\\n    "
+// shellKeywords are the reserved words that can come before a command, such as "then" in
+// "if [ -f /x ]; then apt-get install -y nginx; fi", they are kept in the ExtraPre of the command
+var shellKeywords = []string{"if", "then", "else", "elif", "while", "until", "do"}
+
+// conditionKeywords are the shell keywords followed by a condition rather than a command to run
+var conditionKeywords = []string{"if", "elif", "while", "until"}
+
+// closingKeywords are the reserved words that end a conditional or a loop
+var closingKeywords = []string{"fi", "done"}
+
+// keywords returns the shell keywords at the start of the ExtraPre of a part (e.g. "then"), if any
+func (p *ShellPart) keywords() []string {
+	var keywords []string
+	for _, token := range strings.Fields(p.ExtraPre) {
+		if !slices.Contains(shellKeywords, token) {
+			break
+		}
+		keywords = append(keywords, token)
+	}
+	return keywords
+}
+
+// isCondition checks if a part is the condition of an if, elif, while or until
+func (p *ShellPart) isCondition() bool {
+	return slices.ContainsFunc(p.keywords(), func(keyword string) bool {
+		return slices.Contains(conditionKeywords, keyword)
+	})
+}
+
+// continuesCompound checks if a part continues a conditional or a loop started by an earlier part
+// (e.g. "then ...", "else ..." or "fi"), the part before it must then end with ";" rather than "&&"
+func (p *ShellPart) continuesCompound() bool {
+	if slices.Contains(closingKeywords, p.Command) {
+		return true
+	}
+	keywords := p.keywords()
+	return len(keywords) > 0 && !slices.Contains(conditionKeywords, keywords[0])
+}
+
+// defaultIndent is the indentation of the continuation lines of a ShellCommand
+const defaultIndent = "    "
+
+const partSeparator = " \\\n" + defaultIndent
 
 // String converts a ShellCommand back to its string representation
 func (sc *ShellCommand) String() string {
+	return sc.StringWithIndent(defaultIndent)
+}
+
+// StringWithIndent is like String, but indents the continuation lines with indent (e.g. "\t")
+// instead of four spaces
+func (sc *ShellCommand) StringWithIndent(indent string) string {
 	// If no parts, return "true" as fallback
 	if len(sc.Parts) == 0 {
 		return "true"
@@ -34,7 +84,7 @@ func (sc *ShellCommand) String() string {
 	s := ""
 	for i, part := range sc.Parts {
 		if i != 0 {
-			s += partSeparator
+			s += " \\\n" + indent
 		}
 		if part.ExtraPre != "" {
 			s += part.ExtraPre + " "
@@ -95,28 +145,8 @@ func removeComments(input string) string {
 	var result strings.Builder
 	lines := strings.Split(input, "\n")
 
-	for i, line := range lines {
-		// Find comment position (if any)
-		commentPos := -1
-		inSingleQuote := false
-		inDoubleQuote := false
-
-		for j := 0; j < len(line); j++ {
-			if line[j] == '\'' && !inDoubleQuote {
-				inSingleQuote = !inSingleQuote
-				continue
-			}
-			if line[j] == '"' && !inSingleQuote {
-				inDoubleQuote = !inDoubleQuote
-				continue
-			}
-
-			// Only treat # as comment marker if outside quotes
-			if line[j] == '#' && !inSingleQuote && !inDoubleQuote {
-				commentPos = j
-				break
-			}
-		}
+	for _, line := range lines {
+		commentPos := commentIndex(line)
 
 		// Process line with possible comment removal
 		var processedLine string
@@ -127,8 +157,9 @@ func removeComments(input string) string {
 		}
 
 		if processedLine != "" {
-			// Check if the line ends with a backslash (line continuation)
-			if strings.HasSuffix(processedLine, "\\") && i < len(lines)-1 {
+			// Check if the line ends with a backslash (line continuation), which is dropped
+			// on the last line too since nothing follows it
+			if strings.HasSuffix(processedLine, "\\") {
 				// Add the line without the trailing backslash
 				result.WriteString(strings.TrimSpace(processedLine[:len(processedLine)-1]))
 				result.WriteString(" ") // Just add a space instead of a newline
@@ -142,6 +173,24 @@ func removeComments(input string) string {
 	return strings.TrimSpace(result.String())
 }
 
+// commentIndex returns the index of the # starting a shell comment in a line, or -1. The # must
+// be outside quotes and start a word, so that e.g. ${VERSION#v} or a URL fragment is not a comment.
+func commentIndex(line string) int {
+	inSingleQuote := false
+	inDoubleQuote := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\'' && !inDoubleQuote:
+			inSingleQuote = !inSingleQuote
+		case line[i] == '"' && !inSingleQuote:
+			inDoubleQuote = !inDoubleQuote
+		case line[i] == '#' && !inSingleQuote && !inDoubleQuote && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return i
+		}
+	}
+	return -1
+}
+
 // findNextDelimiter finds the position of the next delimiter not inside quotes/parentheses
 func findNextDelimiter(cmd string, delimiters []string) (string, int) {
 	inSingleQuote := false
@@ -194,6 +243,11 @@ func findNextDelimiter(cmd string, delimiters []string) (string, int) {
 				break // Ignore everything until the end of this segment
 			}
 
+			// An ampersand that is part of a redirection (e.g. 2>&1, >&2, &>file, |&) is not the background operator
+			if cmd[i] == '&' && isRedirectionAmpersand(cmd, i) {
+				continue
+			}
+
 			// Only check for delimiters when not in any quotes or special sections
 			if !inSingleQuote && !inDoubleQuote && parenDepth == 0 && backtickDepth == 0 && subshellDepth == 0 {
 				for _, delim := range delimiters {
@@ -208,6 +262,49 @@ func findNextDelimiter(cmd string, delimiters []string) (string, int) {
 	return "", -1
 }
 
+// isRedirectionAmpersand checks if the ampersand at position i belongs to a redirection
+// operator rather than being the "&&" or "&" delimiter
+func isRedirectionAmpersand(cmd string, i int) bool {
+	if i+1 < len(cmd) && cmd[i+1] == '&' {
+		return false // "&&"
+	}
+	if i > 0 && (cmd[i-1] == '>' || cmd[i-1] == '<' || cmd[i-1] == '|') {
+		return true // ">&", "<&" and "|&"
+	}
+	return i+1 < len(cmd) && cmd[i+1] == '>' // "&>" and "&>>"
+}
+
+// redirectionRegex matches a shell redirection, with the optional target in the last group
+var redirectionRegex = regexp.MustCompile(`^[0-9]*(?:&>>?|>>?&?|<<?&?|>\|)(.*)$`)
+
+// isRedirection checks if a shell argument is a redirection (e.g. ">/dev/null" or "2>&1").
+// needsTarget is true when the redirection target is the following argument (e.g. "> /dev/null").
+func isRedirection(arg string) (redirection bool, needsTarget bool) {
+	matches := redirectionRegex.FindStringSubmatch(arg)
+	if matches == nil {
+		return false, false
+	}
+	return true, matches[1] == ""
+}
+
+// splitRedirections separates the redirections of a command (e.g. "> /tmp/install.log" or "2>&1")
+// from its other arguments
+func splitRedirections(args []string) (rest []string, redirections []string) {
+	for i := 0; i < len(args); i++ {
+		redirection, needsTarget := isRedirection(args[i])
+		if !redirection {
+			rest = append(rest, args[i])
+			continue
+		}
+		redirections = append(redirections, args[i])
+		if needsTarget && i+1 < len(args) {
+			i++
+			redirections = append(redirections, args[i])
+		}
+	}
+	return rest, redirections
+}
+
 // parseShellPart parses a command part into command and args
 func parseShellPart(cmdPart string, delimiter string) *ShellPart {
 	cmdPart = strings.TrimSpace(cmdPart)
@@ -257,8 +354,16 @@ func parseShellPart(cmdPart string, delimiter string) *ShellPart {
 }
 
 // findCommandIndex finds the index of the first token that's not an environment variable declaration
+// or a shell keyword
 func findCommandIndex(tokens []string) int {
+	keywords := true
 	for i, token := range tokens {
+		// Shell keywords only come before the env var assignments
+		if keywords && slices.Contains(shellKeywords, token) {
+			continue
+		}
+		keywords = false
+
 		// If it doesn't look like an env var assignment, consider it the command
 		if !isEnvVarAssignment(token) {
 			return i
@@ -309,6 +414,14 @@ func tokenize(cmd string) []string {
 
 		// Handle parentheses, backticks, and subshells
 		if !inSingleQuote && !inDoubleQuote {
+			if i < len(cmd)-1 && char == '$' && cmd[i+1] == '(' {
+				// Command substitution is kept as a single opaque token
+				subshellDepth++
+				inToken = true
+				currentToken.WriteString("$(")
+				i++ // Skip the opening parenthesis
+				continue
+			}
 			if char == '(' {
 				parenDepth++
 				inToken = true
@@ -316,7 +429,11 @@ func tokenize(cmd string) []string {
 				continue
 			}
 			if char == ')' {
-				parenDepth--
+				if parenDepth > 0 {
+					parenDepth--
+				} else if subshellDepth > 0 {
+					subshellDepth--
+				}
 				inToken = true
 				currentToken.WriteByte(char)
 				continue
@@ -327,18 +444,6 @@ func tokenize(cmd string) []string {
 				currentToken.WriteByte(char)
 				continue
 			}
-			if i < len(cmd)-1 && char == '$' && cmd[i+1] == '(' {
-				subshellDepth++
-				inToken = true
-				currentToken.WriteByte(char)
-				continue
-			}
-			if char == ')' && subshellDepth > 0 {
-				subshellDepth--
-				inToken = true
-				currentToken.WriteByte(char)
-				continue
-			}
 		}
 
 		// Handle spaces to separate tokens
@@ -335,6 +335,157 @@ func TestShellParsing(t *testing.T) {
 		},
 	})
 
+	cases = append(cases, testCase{
+		name: "trailing whitespace after continuation",
+		raw: "apt-get update && \\  \n" +
+			"    apt-get install -y \\\t\n" +
+			"    nano \\ \n" +
+			"    curl",
+		expected: `apt-get update && \
+    apt-get install -y nano curl`,
+		wantCommand: &ShellCommand{
+			Parts: []*ShellPart{
+				{
+					Command:   "apt-get",
+					Args:      []string{"update"},
+					Delimiter: "&&",
+				},
+				{
+					Command: "apt-get",
+					Args:    []string{"install", "-y", "nano", "curl"},
+				},
+			},
+		},
+	})
+
+	cases = append(cases, testCase{
+		name:     "command substitution is a single argument",
+		raw:      "apt-get install -y $(cat pkgs.txt) curl `echo a b` $(echo $(echo nested)) && echo done",
+		expected: "apt-get install -y $(cat pkgs.txt) curl `echo a b` $(echo $(echo nested)) &&" + partSeparator + "echo done",
+		wantCommand: &ShellCommand{
+			Parts: []*ShellPart{
+				{
+					Command:   "apt-get",
+					Args:      []string{"install", "-y", "$(cat pkgs.txt)", "curl", "`echo a b`", "$(echo $(echo nested))"},
+					Delimiter: "&&",
+				},
+				{
+					Command: "echo",
+					Args:    []string{"done"},
+				},
+			},
+		},
+	})
+
+	cases = append(cases, testCase{
+		name:     "background operator",
+		raw:      "sleep 10 & apt-get install -y nginx && echo done &",
+		expected: "sleep 10 &" + partSeparator + "apt-get install -y nginx &&" + partSeparator + "echo done &",
+		wantCommand: &ShellCommand{
+			Parts: []*ShellPart{
+				{
+					Command:   "sleep",
+					Args:      []string{"10"},
+					Delimiter: "&",
+				},
+				{
+					Command:   "apt-get",
+					Args:      []string{"install", "-y", "nginx"},
+					Delimiter: "&&",
+				},
+				{
+					Command:   "echo",
+					Args:      []string{"done"},
+					Delimiter: "&",
+				},
+			},
+		},
+	})
+
+	cases = append(cases, testCase{
+		name:     "ampersand in redirections",
+		raw:      "echo hi >&2 && apt-get install -y curl >/dev/null 2>&1 && make &> build.log",
+		expected: "echo hi >&2 &&" + partSeparator + "apt-get install -y curl >/dev/null 2>&1 &&" + partSeparator + "make &> build.log",
+		wantCommand: &ShellCommand{
+			Parts: []*ShellPart{
+				{
+					Command:   "echo",
+					Args:      []string{"hi", ">&2"},
+					Delimiter: "&&",
+				},
+				{
+					Command:   "apt-get",
+					Args:      []string{"install", "-y", "curl", ">/dev/null", "2>&1"},
+					Delimiter: "&&",
+				},
+				{
+					Command: "make",
+					Args:    []string{"&>", "build.log"},
+				},
+			},
+		},
+	})
+
+	cases = append(cases, testCase{
+		name:     "hash inside a word is not a comment",
+		raw:      "echo ${VERSION#v} http://example.com/#top # comment",
+		expected: "echo ${VERSION#v} http://example.com/#top",
+		wantCommand: &ShellCommand{
+			Parts: []*ShellPart{
+				{
+					Command: "echo",
+					Args:    []string{"${VERSION#v}", "http://example.com/#top"},
+				},
+			},
+		},
+	})
+
+	cases = append(cases, testCase{
+		name:     "dangling continuation at the end",
+		raw:      "apt-get install -y git \\",
+		expected: "apt-get install -y git",
+		wantCommand: &ShellCommand{
+			Parts: []*ShellPart{
+				{
+					Command: "apt-get",
+					Args:    []string{"install", "-y", "git"},
+				},
+			},
+		},
+	})
+
+	cases = append(cases, testCase{
+		name:     "shell keywords before commands",
+		raw:      `if [ "$(uname -m)" = "x86_64" ]; then DEBIAN_FRONTEND=noninteractive apt-get install -y nginx; else echo skipped; fi`,
+		expected: `if [ "$(uname -m)" = "x86_64" ] ;` + partSeparator + `then DEBIAN_FRONTEND=noninteractive apt-get install -y nginx ;` + partSeparator + `else echo skipped ;` + partSeparator + `fi`,
+		wantCommand: &ShellCommand{
+			Parts: []*ShellPart{
+				{
+					ExtraPre:  "if",
+					Command:   "[",
+					Args:      []string{`"$(uname -m)"`, "=", `"x86_64"`, "]"},
+					Delimiter: ";",
+				},
+				{
+					ExtraPre:  "then DEBIAN_FRONTEND=noninteractive",
+					Command:   "apt-get",
+					Args:      []string{"install", "-y", "nginx"},
+					Delimiter: ";",
+				},
+				{
+					ExtraPre:  "else",
+					Command:   "echo",
+					Args:      []string{"skipped"},
+					Delimiter: ";",
+				},
+				{
+					Command: "fi",
+					Args:    []string{},
+				},
+			},
+		},
+	})
+
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
 			got := ParseMultilineShell(tt.raw)
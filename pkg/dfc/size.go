@@ -0,0 +1,136 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// SizeEstimate is the approximate change in base image size for a converted FROM line.
+// Sizes are compressed linux/amd64 sizes in MB taken from a built-in table, not queried from a registry.
+type SizeEstimate struct {
+	Stage  int    `json:"stage"`
+	From   string `json:"from"`   // Original image reference
+	To     string `json:"to"`     // Converted image reference
+	FromMB int    `json:"fromMB"` // Approximate size of the original image
+	ToMB   int    `json:"toMB"`   // Approximate size of the converted image
+}
+
+// SavedMB returns the approximate size reduction, negative if the converted image is larger
+func (e SizeEstimate) SavedMB() int {
+	return e.FromMB - e.ToMB
+}
+
+// upstreamImageSizes are approximate sizes of common upstream base images, keyed by Docker Hub repository,
+// or by repository and variant (e.g. "node:alpine") for the much smaller alpine and slim variants
+var upstreamImageSizes = map[string]int{
+	"alpine":                 4,
+	"debian":                 49,
+	"debian:slim":            28,
+	"ubuntu":                 29,
+	"fedora":                 60,
+	"node":                   390,
+	"node:alpine":            45,
+	"node:slim":              75,
+	"python":                 370,
+	"python:alpine":          20,
+	"python:slim":            45,
+	"golang":                 290,
+	"golang:alpine":          80,
+	"eclipse-temurin":        190,
+	"eclipse-temurin:alpine": 165,
+	"ruby":                   360,
+	"ruby:alpine":            30,
+	"ruby:slim":              75,
+	"php":                    170,
+	"php:alpine":             35,
+	"nginx":                  70,
+	"nginx:alpine":           20,
+}
+
+// imageVariant returns the variant of an upstream image tag, "alpine" or "slim", e.g. "alpine" for
+// "20-alpine3.19" and "slim" for "bookworm-slim", or "" for the default variant
+func imageVariant(tag string) string {
+	for _, field := range strings.Split(tag, "-") {
+		switch {
+		case strings.HasPrefix(field, "alpine"):
+			return "alpine"
+		case field == "slim":
+			return "slim"
+		}
+	}
+	return ""
+}
+
+// chainguardImageSize holds the approximate sizes of a Chainguard image and its -dev variant
+type chainguardImageSize struct {
+	Size    int
+	DevSize int // Zero if the image has no -dev variant
+}
+
+// chainguardImageSizes are approximate sizes of Chainguard images, keyed by repository name
+var chainguardImageSizes = map[string]chainguardImageSize{
+	"chainguard-base": {Size: 6},
+	"node":            {Size: 50, DevSize: 120},
+	"python":          {Size: 25, DevSize: 90},
+	"go":              {Size: 240, DevSize: 260},
+	"jdk":             {Size: 170, DevSize: 200},
+	"ruby":            {Size: 20, DevSize: 90},
+	"php":             {Size: 30, DevSize: 90},
+	"nginx":           {Size: 20, DevSize: 60},
+}
+
+// estimateSize returns the size estimate for a converted FROM line,
+// or nil if either image, including the variant of the original image, is not in the size tables
+func estimateSize(line *DockerfileLine) *SizeEstimate {
+	if line.From == nil || line.From.BaseDynamic {
+		return nil
+	}
+	fromLine, _, _ := strings.Cut(line.Converted, "\n")
+	if fromLine == "" || fromLine == line.Raw {
+		return nil
+	}
+
+	key := strings.TrimPrefix(normalizeImageName(line.From.Base), "library/")
+	if variant := imageVariant(line.From.Tag); variant != "" {
+		key += ":" + variant
+	}
+	fromMB, ok := upstreamImageSizes[key]
+	if !ok {
+		return nil
+	}
+
+	to := convertedFromImage(fromLine)
+	repository, tag := splitImageTag(to)
+	target, ok := chainguardImageSizes[filepath.Base(repository)]
+	if !ok {
+		return nil
+	}
+	toMB := target.Size
+	if strings.HasSuffix(tag, "-dev") && target.DevSize > 0 {
+		toMB = target.DevSize
+	}
+
+	return &SizeEstimate{
+		Stage:  line.Stage,
+		From:   line.From.Orig,
+		To:     to,
+		FromMB: fromMB,
+		ToMB:   toMB,
+	}
+}
+
+// convertedFromImage returns the image reference of a FROM line, skipping any flags such as --platform
+func convertedFromImage(fromLine string) string {
+	fields := strings.Fields(fromLine)
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "--") {
+			return field
+		}
+	}
+	return ""
+}
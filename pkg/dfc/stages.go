@@ -0,0 +1,110 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Stage is a build stage of a Dockerfile, as returned by Dockerfile.Stages
+type Stage struct {
+	Index      int         // 0-based index of the stage, which COPY --from uses for stages without an alias
+	Name       string      // Alias given with AS, empty if the stage has none
+	Dockerfile *Dockerfile // The global lines (e.g. ARG) before the first FROM, followed by the lines of the stage
+	DependsOn  []int       // Indexes of the earlier stages that the stage builds on (FROM) or copies from (COPY --from)
+}
+
+// FileName returns the name of the file for the stage when the stages are written
+// to separate files, e.g. "stage-0-build.Dockerfile" or "stage-2.Dockerfile"
+func (s Stage) FileName() string {
+	if s.Name == "" {
+		return fmt.Sprintf("stage-%d.Dockerfile", s.Index)
+	}
+	return fmt.Sprintf("stage-%d-%s.Dockerfile", s.Index, strings.ToLower(s.Name))
+}
+
+// Stages splits the Dockerfile into its build stages, e.g. to write each stage to its own file.
+// Each stage starts with the global lines before the first FROM, so that its FROM line can use the
+// global ARGs. References to other stages (FROM <stage> or COPY --from=<stage>) are kept as they are,
+// such a stage can only be built as part of the combined Dockerfile. A comment saying so is added
+// above its FROM line.
+func (d *Dockerfile) Stages() []Stage {
+	var global []*DockerfileLine
+	var stages []Stage
+	for _, line := range d.Lines {
+		if line.Stage == 0 {
+			global = append(global, line)
+			continue
+		}
+		if line.From != nil {
+			stages = append(stages, Stage{
+				Index: line.Stage - 1,
+				Name:  line.From.Alias,
+				Dockerfile: &Dockerfile{
+					Lines:  slices.Clone(global),
+					Escape: d.Escape,
+					CRLF:   d.CRLF,
+				},
+			})
+		}
+		if len(stages) == 0 {
+			continue
+		}
+		stage := &stages[len(stages)-1]
+		stage.Dockerfile.Lines = append(stage.Dockerfile.Lines, line)
+
+		// Stages are numbered from 1 in the parsed lines
+		var dependency int
+		switch {
+		case line.From != nil:
+			dependency = line.From.Parent
+		case line.Copy != nil:
+			dependency = line.Copy.FromStage
+		}
+		if dependency > 0 && !slices.Contains(stage.DependsOn, dependency-1) {
+			stage.DependsOn = append(stage.DependsOn, dependency-1)
+		}
+	}
+
+	for i, stage := range stages {
+		// Like the last line of the Dockerfile, an empty line ends the last directive of the stage with a newline
+		if lines := stage.Dockerfile.Lines; lines[len(lines)-1].Raw != "" {
+			stages[i].Dockerfile.Lines = append(lines, &DockerfileLine{Stage: stage.Index + 1})
+		}
+
+		// Note the stages a stage uses above its FROM line
+		if len(stage.DependsOn) == 0 {
+			continue
+		}
+		var used []string
+		for _, index := range stage.DependsOn {
+			used = append(used, stages[index].description())
+		}
+		note := fmt.Sprintf("# dfc: %s was split from a multi-stage Dockerfile and uses %s,\n# build it as part of the combined Dockerfile\n", stage.description(), strings.Join(used, " and "))
+
+		lines := stages[i].Dockerfile.Lines
+		for j, line := range lines {
+			if line.From != nil {
+				from := *line
+				from.Extra += note
+				lines[j] = &from
+				break
+			}
+		}
+	}
+
+	return stages
+}
+
+// description returns the stage as it is referred to in comments, e.g. "stage 0 (build)"
+func (s Stage) description() string {
+	if s.Name == "" {
+		return fmt.Sprintf("stage %d", s.Index)
+	}
+	return fmt.Sprintf("stage %d (%s)", s.Index, s.Name)
+}
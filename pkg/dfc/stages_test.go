@@ -0,0 +1,87 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStages(t *testing.T) {
+	ctx := context.Background()
+	raw := `ARG BASE=debian:12
+FROM ${BASE} AS build
+RUN apt-get update && apt-get install -y gcc
+
+FROM build AS test
+RUN make test
+
+# The final image
+FROM debian:12
+COPY --from=build /out /out
+COPY --from=1 /report /report
+ENTRYPOINT ["/out"]`
+
+	dockerfile, err := ParseDockerfile(ctx, []byte(raw))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+
+	type stage struct {
+		FileName  string
+		DependsOn []int
+		Content   string
+	}
+	want := []stage{
+		{
+			FileName: "stage-0-build.Dockerfile",
+			Content: `ARG BASE=debian:12
+FROM ${BASE} AS build
+RUN apt-get update && apt-get install -y gcc
+`,
+		},
+		{
+			FileName:  "stage-1-test.Dockerfile",
+			DependsOn: []int{0},
+			Content: `ARG BASE=debian:12
+
+# dfc: stage 1 (test) was split from a multi-stage Dockerfile and uses stage 0 (build),
+# build it as part of the combined Dockerfile
+FROM build AS test
+RUN make test
+`,
+		},
+		{
+			FileName:  "stage-2.Dockerfile",
+			DependsOn: []int{0, 1},
+			Content: `ARG BASE=debian:12
+
+# The final image
+# dfc: stage 2 was split from a multi-stage Dockerfile and uses stage 0 (build) and stage 1 (test),
+# build it as part of the combined Dockerfile
+FROM debian:12
+COPY --from=build /out /out
+COPY --from=1 /report /report
+ENTRYPOINT ["/out"]
+`,
+		},
+	}
+
+	var got []stage
+	for _, s := range dockerfile.Stages() {
+		got = append(got, stage{FileName: s.FileName(), DependsOn: s.DependsOn, Content: s.Dockerfile.String()})
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("stages not as expected (-want, +got):\n%s", diff)
+	}
+
+	// Splitting leaves the Dockerfile unchanged
+	if diff := cmp.Diff(raw, dockerfile.String()); diff != "" {
+		t.Errorf("Dockerfile changed by Stages (-want, +got):\n%s", diff)
+	}
+}
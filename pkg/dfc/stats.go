@@ -0,0 +1,207 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Stats summarizes the changes made by a conversion
+type Stats struct {
+	Stages          int       `json:"stages"`
+	FromConverted   int       `json:"fromConverted"`   // FROM lines rewritten
+	ArgConverted    int       `json:"argConverted"`    // ARG lines used as base images rewritten
+	RunConverted    int       `json:"runConverted"`    // RUN lines rewritten
+	PackagesMapped  int       `json:"packagesMapped"`  // Packages installed under a different name
+	PackagesKept    int       `json:"packagesKept"`    // Packages installed under their original name
+	PackageManagers []Manager `json:"packageManagers"` // Package managers encountered, sorted
+
+	UnmappedPackages []string `json:"unmappedPackages,omitempty"` // Names of the packages kept because they have no mapping, sorted
+
+	SizeEstimates []SizeEstimate `json:"sizeEstimates,omitempty"` // Approximate base image size changes, for known images
+}
+
+// Stats returns a summary of the changes in a converted Dockerfile
+func (d *Dockerfile) Stats() Stats {
+	var stats Stats
+	managers := map[Manager]bool{}
+	unmapped := map[string]bool{}
+
+	for _, line := range d.Lines {
+		converted := line.Converted != "" && line.Converted != line.Raw
+		if line.From != nil {
+			stats.Stages++
+			// Ignore a USER directive added after an unchanged FROM line
+			if fromLine, _, _ := strings.Cut(line.Converted, "\n"); converted && fromLine != line.Raw {
+				stats.FromConverted++
+			}
+			if estimate := estimateSize(line); estimate != nil {
+				stats.SizeEstimates = append(stats.SizeEstimates, *estimate)
+			}
+		}
+		if line.Arg != nil && line.Arg.UsedAsBase && converted {
+			stats.ArgConverted++
+		}
+		if line.Run == nil || line.Run.Manager == "" {
+			continue
+		}
+
+		managers[line.Run.Manager] = true
+		if !converted {
+			continue
+		}
+		stats.RunConverted++
+
+		installed := apkInstalledPackageNames(line.Run.Shell)
+		for _, pkg := range line.Run.Packages {
+			if name := parsePackageSpec(line.Run.Manager, pkg).Name; installed[name] {
+				stats.PackagesKept++
+				// apk packages don't need a mapping
+				if line.Run.Manager != ManagerApk {
+					unmapped[name] = true
+				}
+			} else {
+				stats.PackagesMapped++
+			}
+		}
+	}
+
+	for manager := range managers {
+		stats.PackageManagers = append(stats.PackageManagers, manager)
+	}
+	slices.Sort(stats.PackageManagers)
+	stats.UnmappedPackages = slices.Sorted(maps.Keys(unmapped))
+
+	return stats
+}
+
+// FileStats is the summary of the conversion of a single file, as passed to MergeStats
+type FileStats struct {
+	File  string `json:"file"`
+	Stats Stats  `json:"stats"`
+}
+
+// MergedStats summarizes the conversions of several files
+type MergedStats struct {
+	Stats
+	UnmappedPackageFiles map[string][]string `json:"unmappedPackageFiles,omitempty"` // Files installing each unmapped package, in the order given
+}
+
+// MergeStats combines the summaries of several conversions, e.g. of the Dockerfiles in a repository,
+// into one. Counts are added up, package managers and unmapped packages are deduplicated and size
+// estimates are kept in order. The files installing each unmapped package are listed too.
+func MergeStats(files ...FileStats) MergedStats {
+	var merged MergedStats
+	for _, file := range files {
+		s := file.Stats
+		merged.Stages += s.Stages
+		merged.FromConverted += s.FromConverted
+		merged.ArgConverted += s.ArgConverted
+		merged.RunConverted += s.RunConverted
+		merged.PackagesMapped += s.PackagesMapped
+		merged.PackagesKept += s.PackagesKept
+		for _, manager := range s.PackageManagers {
+			if !slices.Contains(merged.PackageManagers, manager) {
+				merged.PackageManagers = append(merged.PackageManagers, manager)
+			}
+		}
+		merged.SizeEstimates = append(merged.SizeEstimates, s.SizeEstimates...)
+		for _, pkg := range s.UnmappedPackages {
+			if merged.UnmappedPackageFiles == nil {
+				merged.UnmappedPackageFiles = map[string][]string{}
+			}
+			if !slices.Contains(merged.UnmappedPackageFiles[pkg], file.File) {
+				merged.UnmappedPackageFiles[pkg] = append(merged.UnmappedPackageFiles[pkg], file.File)
+			}
+		}
+	}
+	slices.Sort(merged.PackageManagers)
+	if len(merged.UnmappedPackageFiles) > 0 {
+		merged.UnmappedPackages = slices.Sorted(maps.Keys(merged.UnmappedPackageFiles))
+	}
+	return merged
+}
+
+// apkInstalledPackageNames returns the names of the packages installed by apk add in the converted shell
+func apkInstalledPackageNames(shell *RunDetailsShell) map[string]bool {
+	names := map[string]bool{}
+	if shell == nil || shell.After == nil {
+		return names
+	}
+	for _, part := range shell.After.Parts {
+		if part.Command != string(ManagerApk) || len(part.Args) == 0 || part.Args[0] != SubcommandAdd {
+			continue
+		}
+		skipNext := false
+		for _, arg := range part.Args[1:] {
+			if skipNext {
+				// The value of a flag such as --virtual, not a package
+				skipNext = false
+				continue
+			}
+			if strings.HasPrefix(arg, "-") {
+				skipNext = slices.Contains(apkFlagsWithValue, arg)
+				continue
+			}
+			names[parsePackageSpec(ManagerApk, arg).Name] = true
+		}
+	}
+	return names
+}
+
+// String returns a human-readable summary
+func (s Stats) String() string {
+	managers := make([]string, 0, len(s.PackageManagers))
+	for _, manager := range s.PackageManagers {
+		managers = append(managers, string(manager))
+	}
+	if len(managers) == 0 {
+		managers = append(managers, "none")
+	}
+
+	var builder strings.Builder
+	builder.WriteString("Conversion summary:\n")
+	builder.WriteString(fmt.Sprintf("  Stages: %d\n", s.Stages))
+	builder.WriteString(fmt.Sprintf("  FROM lines converted: %d\n", s.FromConverted))
+	builder.WriteString(fmt.Sprintf("  ARG lines converted: %d\n", s.ArgConverted))
+	builder.WriteString(fmt.Sprintf("  RUN lines converted: %d\n", s.RunConverted))
+	builder.WriteString(fmt.Sprintf("  Packages remapped: %d\n", s.PackagesMapped))
+	builder.WriteString(fmt.Sprintf("  Packages kept: %d\n", s.PackagesKept))
+	builder.WriteString(fmt.Sprintf("  Package managers: %s\n", strings.Join(managers, ", ")))
+	if len(s.UnmappedPackages) > 0 {
+		builder.WriteString(fmt.Sprintf("  Unmapped packages: %s\n", strings.Join(s.UnmappedPackages, ", ")))
+	}
+	if len(s.SizeEstimates) > 0 {
+		builder.WriteString("  Estimated base image sizes (approximate, compressed):\n")
+		for _, estimate := range s.SizeEstimates {
+			change := fmt.Sprintf("saves ~%d MB", estimate.SavedMB())
+			if estimate.SavedMB() < 0 {
+				change = fmt.Sprintf("adds ~%d MB", -estimate.SavedMB())
+			}
+			builder.WriteString(fmt.Sprintf("    %s (~%d MB) -> %s (~%d MB), %s\n", estimate.From, estimate.FromMB, estimate.To, estimate.ToMB, change))
+		}
+	}
+	return builder.String()
+}
+
+// String returns a human-readable summary, listing the files that install each unmapped package
+func (s MergedStats) String() string {
+	summary := s.Stats.String()
+	if len(s.UnmappedPackages) == 0 {
+		return summary
+	}
+
+	var builder strings.Builder
+	builder.WriteString(summary)
+	builder.WriteString("  Unmapped packages by file:\n")
+	for _, pkg := range s.UnmappedPackages {
+		builder.WriteString(fmt.Sprintf("    %s: %s\n", pkg, strings.Join(s.UnmappedPackageFiles[pkg], ", ")))
+	}
+	return builder.String()
+}
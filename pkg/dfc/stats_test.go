@@ -0,0 +1,194 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStats(t *testing.T) {
+	content := `ARG BASE=python:3.12
+FROM golang:1.23 AS builder
+RUN apt-get update && apt-get install -y build-essential git
+FROM ${BASE}
+RUN yum install -y curl
+RUN echo done`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	converted, err := dockerfile.Convert(ctx, Options{
+		NoBuiltIn: true,
+		ExtraMappings: MappingsConfig{
+			Packages: PackageMap{
+				DistroDebian: {
+					"build-essential": []string{"build-base"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	expected := Stats{
+		Stages:          2,
+		FromConverted:   1,
+		ArgConverted:    1,
+		RunConverted:    2,
+		PackagesMapped:  1,
+		PackagesKept:    2,
+		PackageManagers: []Manager{ManagerAptGet, ManagerYum},
+
+		UnmappedPackages: []string{"curl", "git"},
+	}
+	if diff := cmp.Diff(expected, converted.Stats()); diff != "" {
+		t.Errorf("Stats not as expected (-want, +got):\n%s", diff)
+	}
+
+	expectedString := `Conversion summary:
+  Stages: 2
+  FROM lines converted: 1
+  ARG lines converted: 1
+  RUN lines converted: 2
+  Packages remapped: 1
+  Packages kept: 2
+  Package managers: apt-get, yum
+  Unmapped packages: curl, git
+`
+	if diff := cmp.Diff(expectedString, converted.Stats().String()); diff != "" {
+		t.Errorf("Stats string not as expected (-want, +got):\n%s", diff)
+	}
+
+	// Nothing is reported for a Dockerfile that was not converted
+	if diff := cmp.Diff(Stats{Stages: 2}, dockerfile.Stats()); diff != "" {
+		t.Errorf("Stats of original not as expected (-want, +got):\n%s", diff)
+	}
+}
+
+func TestStatsSizeEstimates(t *testing.T) {
+	content := `FROM golang:1.23 AS builder
+RUN apt-get update && apt-get install -y git
+FROM ubuntu:22.04
+COPY --from=builder /out/app /app
+FROM node:20-alpine
+FROM python:3.12-slim-bookworm
+FROM php:8.3-fpm-bullseye-slim
+FROM example.com/custom/image:1.0`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+	converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	// Variants are estimated at their own size, the slim php variant and the custom image are not
+	// in the size table, so they have no estimate
+	expected := []SizeEstimate{
+		{Stage: 1, From: "golang:1.23", To: "cgr.dev/ORG/go:1.23-dev", FromMB: 290, ToMB: 260},
+		{Stage: 2, From: "ubuntu:22.04", To: "cgr.dev/ORG/chainguard-base:latest", FromMB: 29, ToMB: 6},
+		{Stage: 3, From: "node:20-alpine", To: "cgr.dev/ORG/node:20", FromMB: 45, ToMB: 50},
+		{Stage: 4, From: "python:3.12-slim-bookworm", To: "cgr.dev/ORG/python:3.12", FromMB: 45, ToMB: 25},
+	}
+	stats := converted.Stats()
+	if diff := cmp.Diff(expected, stats.SizeEstimates); diff != "" {
+		t.Errorf("size estimates not as expected (-want, +got):\n%s", diff)
+	}
+
+	expectedString := `  Estimated base image sizes (approximate, compressed):
+    golang:1.23 (~290 MB) -> cgr.dev/ORG/go:1.23-dev (~260 MB), saves ~30 MB
+    ubuntu:22.04 (~29 MB) -> cgr.dev/ORG/chainguard-base:latest (~6 MB), saves ~23 MB
+    node:20-alpine (~45 MB) -> cgr.dev/ORG/node:20 (~50 MB), adds ~5 MB
+    python:3.12-slim-bookworm (~45 MB) -> cgr.dev/ORG/python:3.12 (~25 MB), saves ~20 MB
+`
+	if !strings.HasSuffix(stats.String(), expectedString) {
+		t.Errorf("Stats string does not end with the size estimates:\n%s", stats.String())
+	}
+
+	// Nothing is estimated for a Dockerfile that was not converted
+	if estimates := dockerfile.Stats().SizeEstimates; estimates != nil {
+		t.Errorf("expected no size estimates for the original Dockerfile, got %v", estimates)
+	}
+}
+
+func TestMergeStats(t *testing.T) {
+	ctx := context.Background()
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"base/Dockerfile", "FROM debian:12\nRUN apt-get update && apt-get install -y build-essential nano libfoo\n"},
+		{"web/Dockerfile", "FROM fedora:40\nRUN dnf install -y git libfoo\nFROM node:20\n"},
+		{"api/Dockerfile", "FROM node:20\nRUN apt-get install -y curl libfoo libbar\n"},
+	}
+
+	var stats []FileStats
+	for _, file := range files {
+		dockerfile, err := ParseDockerfile(ctx, []byte(file.content))
+		if err != nil {
+			t.Fatalf("ParseDockerfile failed: %v", err)
+		}
+		converted, err := dockerfile.Convert(ctx, Options{Offline: true})
+		if err != nil {
+			t.Fatalf("Convert failed: %v", err)
+		}
+		stats = append(stats, FileStats{File: file.name, Stats: converted.Stats()})
+	}
+
+	want := MergedStats{
+		Stats: Stats{
+			Stages:          4,
+			FromConverted:   4,
+			RunConverted:    3,
+			PackagesMapped:  1,
+			PackagesKept:    7,
+			PackageManagers: []Manager{ManagerAptGet, ManagerDnf},
+			SizeEstimates: []SizeEstimate{
+				{Stage: 1, From: "debian:12", To: "cgr.dev/ORG/chainguard-base:latest", FromMB: 49, ToMB: 6},
+				{Stage: 1, From: "fedora:40", To: "cgr.dev/ORG/chainguard-base:latest", FromMB: 60, ToMB: 6},
+				{Stage: 2, From: "node:20", To: "cgr.dev/ORG/node:20", FromMB: 390, ToMB: 50},
+				{Stage: 1, From: "node:20", To: "cgr.dev/ORG/node:20-dev", FromMB: 390, ToMB: 120},
+			},
+			UnmappedPackages: []string{"curl", "git", "libbar", "libfoo", "nano"},
+		},
+		UnmappedPackageFiles: map[string][]string{
+			"curl":   {"api/Dockerfile"},
+			"git":    {"web/Dockerfile"},
+			"libbar": {"api/Dockerfile"},
+			"libfoo": {"base/Dockerfile", "web/Dockerfile", "api/Dockerfile"},
+			"nano":   {"base/Dockerfile"},
+		},
+	}
+	merged := MergeStats(stats...)
+	if diff := cmp.Diff(want, merged); diff != "" {
+		t.Errorf("MergeStats() mismatch (-want, +got):\n%s", diff)
+	}
+
+	expectedString := `  Unmapped packages by file:
+    curl: api/Dockerfile
+    git: web/Dockerfile
+    libbar: api/Dockerfile
+    libfoo: base/Dockerfile, web/Dockerfile, api/Dockerfile
+    nano: base/Dockerfile
+`
+	if !strings.HasSuffix(merged.String(), expectedString) {
+		t.Errorf("MergedStats string does not end with the unmapped packages by file:\n%s", merged.String())
+	}
+
+	if diff := cmp.Diff(MergedStats{}, MergeStats()); diff != "" {
+		t.Errorf("MergeStats() with no stats mismatch (-want, +got):\n%s", diff)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/adrg/xdg"
@@ -27,6 +28,21 @@ const (
 
 	// orgName is the organization name used in XDG paths
 	orgName = "dev.chainguard.dfc"
+
+	// defaultUpdateTimeout is the timeout of each attempt to fetch the mappings when UpdateOptions.Timeout is not set
+	defaultUpdateTimeout = 30 * time.Second
+)
+
+// DefaultUpdateRetries is the number of retries (UpdateOptions.Retries) used by the dfc CLI and by
+// conversions with Options.Update, to ride out transient network failures, e.g. in CI
+const DefaultUpdateRetries = 2
+
+var (
+	// updateRetryBackoff is the wait before the first retry of a failed fetch, doubled for each further retry
+	updateRetryBackoff = time.Second
+
+	// updateTransport is the transport used to fetch the mappings, nil for http.DefaultTransport
+	updateTransport http.RoundTripper
 )
 
 // UpdateOptions configures the update behavior
@@ -36,6 +52,18 @@ type UpdateOptions struct {
 
 	// MappingsURL is the URL to fetch the latest mappings from
 	MappingsURL string
+
+	// ExpectedDigest optionally pins the mappings content (e.g. "sha256:abc...").
+	// When set, Update fails without saving anything if the downloaded content does not match.
+	ExpectedDigest string
+
+	// Timeout limits each attempt to fetch the mappings, including reading the response body.
+	// Defaults to 30 seconds.
+	Timeout time.Duration
+
+	// Retries is the number of times a failed fetch is retried, waiting twice as long before each
+	// retry, starting at one second. Only network errors and 5xx or 429 responses are retried.
+	Retries int
 }
 
 // ociLayout represents the oci-layout file
@@ -211,49 +239,87 @@ func updateIndexJSON(cacheDir, digest string, size int64) error {
 	return nil
 }
 
-// Update checks for available updates to the dfc tool
-func Update(ctx context.Context, opts UpdateOptions) error {
+// fetchMappings downloads the mappings, reporting whether a failure is worth retrying
+func fetchMappings(ctx context.Context, client *http.Client, mappingsURL, userAgent string) ([]byte, bool, error) {
 	log := clog.FromContext(ctx)
-	log.Info("Checking for mappings update...")
-
-	// Set default MappingsURL if not provided
-	mappingsURL := opts.MappingsURL
-	if mappingsURL == "" {
-		mappingsURL = defaultMappingsURL
-	}
 
 	// Create a new HTTP request
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mappingsURL, nil)
 	if err != nil {
-		return fmt.Errorf("creating request: %w", err)
+		return nil, false, fmt.Errorf("creating request: %w", err)
 	}
-
-	// Set the User-Agent header
-	userAgent := opts.UserAgent
-	if userAgent == "" {
-		userAgent = "dfc/dev"
-	}
-	log.Debug("Using user agent", "user_agent", userAgent)
 	req.Header.Set("User-Agent", userAgent)
 
 	// Send the request
 	log.Debug("Fetching mappings", "url", mappingsURL)
-	client := http.DefaultClient
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("fetching mappings: %w", err)
+		// Retrying is pointless once the context is done
+		return nil, ctx.Err() == nil, fmt.Errorf("fetching mappings: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// Check the response status
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		retryable := resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retryable, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
 	// Read the response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("reading response body: %w", err)
+		return nil, ctx.Err() == nil, fmt.Errorf("reading response body: %w", err)
+	}
+
+	return body, false, nil
+}
+
+// Update checks for available updates to the dfc tool
+func Update(ctx context.Context, opts UpdateOptions) error {
+	log := clog.FromContext(ctx)
+	log.Info("Checking for mappings update...")
+
+	// Set default MappingsURL if not provided
+	mappingsURL := opts.MappingsURL
+	if mappingsURL == "" {
+		mappingsURL = defaultMappingsURL
+	}
+
+	// Set default UserAgent if not provided
+	userAgent := opts.UserAgent
+	if userAgent == "" {
+		userAgent = "dfc/dev"
+	}
+	log.Debug("Using user agent", "user_agent", userAgent)
+
+	// Use a dedicated client so a hung server can't block the update indefinitely
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultUpdateTimeout
+	}
+	client := &http.Client{Transport: updateTransport, Timeout: timeout}
+
+	// Fetch the mappings, retrying transient failures
+	var body []byte
+	backoff := updateRetryBackoff
+	for attempt := 0; ; attempt++ {
+		var retryable bool
+		var err error
+		body, retryable, err = fetchMappings(ctx, client, mappingsURL, userAgent)
+		if err == nil {
+			break
+		}
+		if !retryable || attempt >= opts.Retries {
+			return err
+		}
+
+		log.Warn("Failed to fetch mappings, retrying", "error", err, "retry", attempt+1, "wait", backoff)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("fetching mappings: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
 	}
 
 	// Calculate SHA256 hash
@@ -261,6 +327,17 @@ func Update(ctx context.Context, opts UpdateOptions) error {
 	hashString := hex.EncodeToString(hash[:])
 	digestString := "sha256:" + hashString
 
+	// Verify the content before anything is written to the cache
+	if opts.ExpectedDigest != "" {
+		expected := opts.ExpectedDigest
+		if !strings.Contains(expected, ":") {
+			expected = "sha256:" + expected
+		}
+		if !strings.EqualFold(expected, digestString) {
+			return fmt.Errorf("mappings digest mismatch: expected %s, got %s", expected, digestString)
+		}
+	}
+
 	// Get the XDG cache directory
 	cacheDir := getCacheDir()
 
@@ -10,6 +10,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -18,6 +19,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/adrg/xdg"
 )
@@ -648,18 +650,16 @@ func TestUpdate_NewRequestError(t *testing.T) {
 func TestUpdate_ResponseBodyReadError(t *testing.T) {
 	setupTestEnvironment(t)
 
-	// Set up a client with a mock transport
-	origClient := http.DefaultClient
-	defer func() { http.DefaultClient = origClient }()
-
-	http.DefaultClient = &http.Client{
-		Transport: &mockTransport{
-			roundTripFn: func(_ *http.Request) (*http.Response, error) {
-				return &http.Response{
-					StatusCode: http.StatusOK,
-					Body:       errorReadCloser{},
-				}, nil
-			},
+	// Set up a mock transport
+	origTransport := updateTransport
+	defer func() { updateTransport = origTransport }()
+
+	updateTransport = &mockTransport{
+		roundTripFn: func(_ *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       errorReadCloser{},
+			}, nil
 		},
 	}
 
@@ -683,3 +683,220 @@ func (e errorReadCloser) Read(_ []byte) (n int, err error) {
 func (e errorReadCloser) Close() error {
 	return nil
 }
+
+// TestOfflineMode tests that offline mode ignores cached mappings and skips updates
+func TestOfflineMode(t *testing.T) {
+	_, xdgConfigDir, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+
+	// Write cached mappings that differ from the embedded ones
+	nestedConfigDir := filepath.Join(xdgConfigDir, orgName)
+	if err := os.MkdirAll(nestedConfigDir, 0755); err != nil {
+		t.Fatalf("Failed to create config directory: %v", err)
+	}
+	cachedMappings := "images:\n  debian: cached-debian\n"
+	if err := os.WriteFile(filepath.Join(nestedConfigDir, "builtin-mappings.yaml"), []byte(cachedMappings), 0600); err != nil {
+		t.Fatalf("Failed to write cached mappings: %v", err)
+	}
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte("FROM debian:12"))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+
+	// Without offline mode the cached mappings are used
+	converted, err := dockerfile.Convert(ctx, Options{})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	if got, want := converted.String(), "FROM cgr.dev/ORG/cached-debian:12\n"; got != want {
+		t.Errorf("Convert() = %q, want %q", got, want)
+	}
+
+	// With offline mode only the embedded mappings are used, even if update is requested
+	converted, err = dockerfile.Convert(ctx, Options{Offline: true, Update: true})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	if got, want := converted.String(), "FROM cgr.dev/ORG/chainguard-base:latest\n"; got != want {
+		t.Errorf("Convert() = %q, want %q", got, want)
+	}
+
+	// Offline mode fails clearly when no embedded mappings are available
+	origBuiltin := builtinMappingsYAMLBytes
+	builtinMappingsYAMLBytes = nil
+	defer func() { builtinMappingsYAMLBytes = origBuiltin }()
+
+	if _, err := dockerfile.Convert(ctx, Options{Offline: true}); err == nil {
+		t.Errorf("Convert() error = nil, want error when embedded mappings are missing")
+	}
+}
+
+// TestUpdateWithExpectedDigest tests that the downloaded mappings are verified against a pinned digest
+func TestUpdateWithExpectedDigest(t *testing.T) {
+	hash := sha256.Sum256([]byte(testMappingsYAML))
+	hashString := hex.EncodeToString(hash[:])
+
+	tests := []struct {
+		name           string
+		expectedDigest string
+		wantErr        bool
+	}{
+		{
+			name:           "matching digest",
+			expectedDigest: "sha256:" + hashString,
+		},
+		{
+			name:           "matching digest without algorithm",
+			expectedDigest: hashString,
+		},
+		{
+			name:           "mismatched digest",
+			expectedDigest: "sha256:" + strings.Repeat("0", 64),
+			wantErr:        true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestEnvironment(t)
+			server := setupTestServer(t)
+
+			err := Update(context.Background(), UpdateOptions{
+				MappingsURL:    server.URL + "/builtin-mappings.yaml",
+				ExpectedDigest: tt.expectedDigest,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Update() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			// Nothing may be saved when the digest does not match
+			blobPath := filepath.Join(getCacheDir(), "blobs", "sha256", hashString)
+			_, statErr := os.Stat(blobPath)
+			if tt.wantErr && statErr == nil {
+				t.Errorf("Blob %s was written despite digest mismatch", blobPath)
+			}
+			if !tt.wantErr && statErr != nil {
+				t.Errorf("Blob %s not written: %v", blobPath, statErr)
+			}
+		})
+	}
+}
+
+// TestUpdateWithRetries tests that transient failures are retried and others are not
+func TestUpdateWithRetries(t *testing.T) {
+	origBackoff := updateRetryBackoff
+	defer func() { updateRetryBackoff = origBackoff }()
+	updateRetryBackoff = time.Millisecond
+
+	tests := []struct {
+		name         string
+		statuses     []int // Status of each response, the mappings are served after these
+		retries      int
+		wantErr      bool
+		wantRequests int
+	}{
+		{
+			name:         "no retries by default",
+			statuses:     []int{http.StatusServiceUnavailable},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			name:         "succeeds after retries",
+			statuses:     []int{http.StatusBadGateway, http.StatusTooManyRequests},
+			retries:      2,
+			wantRequests: 3,
+		},
+		{
+			name:         "gives up after the retries",
+			statuses:     []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError},
+			retries:      2,
+			wantErr:      true,
+			wantRequests: 3,
+		},
+		{
+			name:         "client errors are not retried",
+			statuses:     []int{http.StatusNotFound},
+			retries:      2,
+			wantErr:      true,
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestEnvironment(t)
+
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				requests++
+				if requests <= len(tt.statuses) {
+					w.WriteHeader(tt.statuses[requests-1])
+					return
+				}
+				_, _ = w.Write([]byte(testMappingsYAML))
+			}))
+			defer server.Close()
+
+			err := Update(context.Background(), UpdateOptions{MappingsURL: server.URL, Retries: tt.retries})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Update() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("server got %d requests, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+// TestUpdateWithTimeout tests that a hung server fails the update after the timeout
+func TestUpdateWithTimeout(t *testing.T) {
+	setupTestEnvironment(t)
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	start := time.Now()
+	err := Update(context.Background(), UpdateOptions{MappingsURL: server.URL, Timeout: 50 * time.Millisecond})
+	if err == nil {
+		t.Fatal("Update() error = nil, want error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Update() took %s, want it to time out after about 50ms", elapsed)
+	}
+}
+
+// TestUpdateCancelledBetweenRetries tests that cancelling the context stops the retries
+func TestUpdateCancelledBetweenRetries(t *testing.T) {
+	setupTestEnvironment(t)
+
+	origBackoff := updateRetryBackoff
+	defer func() { updateRetryBackoff = origBackoff }()
+	updateRetryBackoff = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests++
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	err := Update(ctx, UpdateOptions{MappingsURL: server.URL, Retries: 3})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Update() error = %v, want context.Canceled", err)
+	}
+	if requests != 1 {
+		t.Errorf("server got %d requests, want 1", requests)
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"iter"
+	"strings"
+)
+
+// Walk calls fn for each line of the Dockerfile, in order. If fn returns an error,
+// the walk stops and Walk returns that error.
+func (d *Dockerfile) Walk(fn func(*DockerfileLine) error) error {
+	for _, line := range d.Lines {
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEachFrom calls fn for each FROM line of the Dockerfile, in order, stopping at the first error
+func (d *Dockerfile) ForEachFrom(fn func(*DockerfileLine, *FromDetails) error) error {
+	return d.Walk(func(line *DockerfileLine) error {
+		if line.From == nil {
+			return nil
+		}
+		return fn(line, line.From)
+	})
+}
+
+// ForEachRun calls fn for each RUN line of the Dockerfile, in order, stopping at the first error
+func (d *Dockerfile) ForEachRun(fn func(*DockerfileLine, *RunDetails) error) error {
+	return d.Walk(func(line *DockerfileLine) error {
+		if line.Run == nil {
+			return nil
+		}
+		return fn(line, line.Run)
+	})
+}
+
+// ForEachArg calls fn for each ARG line of the Dockerfile, in order, stopping at the first error
+func (d *Dockerfile) ForEachArg(fn func(*DockerfileLine, *ArgDetails) error) error {
+	return d.Walk(func(line *DockerfileLine) error {
+		if line.Arg == nil {
+			return nil
+		}
+		return fn(line, line.Arg)
+	})
+}
+
+// numberedLines yields each line of the Dockerfile with the 1-based number of its directive in the
+// original Dockerfile, i.e. after the comments and whitespace that precede it
+func (d *Dockerfile) numberedLines() iter.Seq2[int, *DockerfileLine] {
+	return func(yield func(int, *DockerfileLine) bool) {
+		lineNumber := 1
+		for _, line := range d.Lines {
+			lineNumber += strings.Count(line.Extra, "\n")
+			if !yield(lineNumber, line) {
+				return
+			}
+			if line.Raw != "" {
+				lineNumber += strings.Count(line.Raw, "\n") + 1
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2025 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dfc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWalk(t *testing.T) {
+	content := `ARG BASE=python:3.12
+FROM golang:1.22 AS build
+RUN go build -o /app .
+ARG VERSION
+FROM ${BASE}
+COPY --from=build /app /app
+RUN pip install flask`
+
+	ctx := context.Background()
+	dockerfile, err := ParseDockerfile(ctx, []byte(content))
+	if err != nil {
+		t.Fatalf("ParseDockerfile failed: %v", err)
+	}
+
+	var raws []string
+	if err := dockerfile.Walk(func(line *DockerfileLine) error {
+		raws = append(raws, line.Raw)
+		return nil
+	}); err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	wantRaws := []string{
+		"ARG BASE=python:3.12",
+		"FROM golang:1.22 AS build",
+		"RUN go build -o /app .",
+		"ARG VERSION",
+		"FROM ${BASE}",
+		"COPY --from=build /app /app",
+		"RUN pip install flask",
+	}
+	if diff := cmp.Diff(wantRaws, raws); diff != "" {
+		t.Errorf("Walk lines mismatch (-want, +got):\n%s", diff)
+	}
+
+	var froms []string
+	if err := dockerfile.ForEachFrom(func(_ *DockerfileLine, from *FromDetails) error {
+		froms = append(froms, from.Orig)
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEachFrom failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"golang:1.22", "${BASE}"}, froms); diff != "" {
+		t.Errorf("ForEachFrom mismatch (-want, +got):\n%s", diff)
+	}
+
+	var runStages []int
+	if err := dockerfile.ForEachRun(func(line *DockerfileLine, _ *RunDetails) error {
+		runStages = append(runStages, line.Stage)
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEachRun failed: %v", err)
+	}
+	if diff := cmp.Diff([]int{1, 2}, runStages); diff != "" {
+		t.Errorf("ForEachRun stages mismatch (-want, +got):\n%s", diff)
+	}
+
+	var args []string
+	if err := dockerfile.ForEachArg(func(_ *DockerfileLine, arg *ArgDetails) error {
+		args = append(args, arg.Name)
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEachArg failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"BASE", "VERSION"}, args); diff != "" {
+		t.Errorf("ForEachArg mismatch (-want, +got):\n%s", diff)
+	}
+
+	// An error from the callback stops the walk and is returned as is
+	errStop := errors.New("stop")
+	visited := 0
+	err = dockerfile.ForEachRun(func(_ *DockerfileLine, _ *RunDetails) error {
+		visited++
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("ForEachRun error = %v, want %v", err, errStop)
+	}
+	if visited != 1 {
+		t.Errorf("ForEachRun visited %d lines after an error, want 1", visited)
+	}
+}